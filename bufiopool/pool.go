@@ -39,6 +39,16 @@ func New(readBufferSize, writeBufferSize int) *Pool {
 	}
 }
 
+// ReadBufferSize size of the buffered readers acquired
+func (p *Pool) ReadBufferSize() int {
+	return p.readBufferSize
+}
+
+// WriteBufferSize size of the buffered writers acquired
+func (p *Pool) WriteBufferSize() int {
+	return p.writeBufferSize
+}
+
 // AcquireReader acquire a buffered reader based on net connection
 func (p *Pool) AcquireReader(c io.Reader) *bufio.Reader {
 	v := p.readerPool.Get()
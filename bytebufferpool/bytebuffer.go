@@ -25,64 +25,60 @@ func (b *ByteBuffer) Len() int {
 	return len(b.B)
 }
 
+// DefaultCopyBufSize size of the buffer used by Copy and CopyWithIdleDuration
+const DefaultCopyBufSize = 32 * 1024
+
 // Copy copies from src to dst until either EOF is reached
 // on src or an error occurs. It returns the number of bytes
 // copied and the first error encountered while copying, if any.
 func (b *ByteBuffer) Copy(dst io.Writer, src io.Reader) (written int64, err error) {
-	b.Reset()
-	b.B = make([]byte, 32*1024)
-	for {
-		nr, er := src.Read(b.B)
-		if nr > 0 {
-			nw, ew := dst.Write(b.B[0:nr])
-			if nw > 0 {
-				written += int64(nw)
-			}
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
-		}
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-			break
-		}
-	}
-	return written, err
+	return b.CopyWithIdleDurationAndBufSize(dst, src, 0, DefaultCopyBufSize)
 }
 
 // CopyWithIdleDuration copies from src to dst until either EOF is reached
 // on src, or an error occurs, or idle time out. It returns the number of bytes
 // copied and the first error encountered while copying, if any.
 func (b *ByteBuffer) CopyWithIdleDuration(dst io.Writer, src io.Reader, idle time.Duration) (written int64, err error) {
-	if idle == 0 {
-		return b.Copy(dst, src)
-	}
+	return b.CopyWithIdleDurationAndBufSize(dst, src, idle, DefaultCopyBufSize)
+}
 
-	b.Reset()
-	b.B = make([]byte, 32*1024)
+// CopyWithIdleDurationAndBufSize same as CopyWithIdleDuration using a
+// buffer of bufSize, DefaultCopyBufSize is used if bufSize not set.
+//
+// Every chunk read is written into dst before the next read, so a slow
+// dst stops the reading from src with at most bufSize bytes held.
+func (b *ByteBuffer) CopyWithIdleDurationAndBufSize(dst io.Writer, src io.Reader,
+	idle time.Duration, bufSize int) (written int64, err error) {
+	if bufSize <= 0 {
+		bufSize = DefaultCopyBufSize
+	}
+	if cap(b.B) < bufSize {
+		b.B = make([]byte, bufSize)
+	}
+	b.B = b.B[:bufSize]
+	buf := b.B
 	for {
 		var nr int
 		var er error
-		idleChan := make(chan struct{}, 1)
-		go func() {
-			nr, er = src.Read(b.B)
-			idleChan <- struct{}{}
-		}()
-		select {
-		case <-idleChan:
-		case <-time.After(idle):
-			return written, errors.New("idle time out")
+		if idle == 0 {
+			nr, er = src.Read(buf)
+		} else {
+			idleChan := make(chan struct{}, 1)
+			go func() {
+				nr, er = src.Read(buf)
+				idleChan <- struct{}{}
+			}()
+			select {
+			case <-idleChan:
+			case <-time.After(idle):
+				// the pending read still owns the buffer, detach it
+				b.B = nil
+				return written, errors.New("idle time out")
+			}
 		}
 
 		if nr > 0 {
-			nw, ew := dst.Write(b.B[0:nr])
+			nw, ew := dst.Write(buf[0:nr])
 			if nw > 0 {
 				written += int64(nw)
 			}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Phase a phase of the request sharing the deadline budget of the request
+type Phase int
+
+// Phases of a request in order
+const (
+	// PhaseDial resolving, connecting and the handshake with the super proxy
+	PhaseDial Phase = iota
+	// PhaseTLS the TLS handshake with the target host
+	PhaseTLS
+	// PhaseWrite writing the request
+	PhaseWrite
+	// PhaseTTFB waiting for the first byte of the response
+	PhaseTTFB
+	// PhaseRead reading the rest of the response
+	PhaseRead
+	// NumPhases number of the phases
+	NumPhases
+)
+
+var phaseNames = [NumPhases]string{"dial", "tls", "write", "ttfb", "read"}
+
+func (p Phase) String() string {
+	if p < 0 || p >= NumPhases {
+		return "unknown"
+	}
+	return phaseNames[p]
+}
+
+// DeadlineError the deadline of the request is exceeded in Phase,
+// it's ErrDeadlineExceeded as matched by errors.Is
+type DeadlineError struct {
+	Phase Phase
+}
+
+func (e *DeadlineError) Error() string {
+	return "request deadline exceeded during " + e.Phase.String()
+}
+
+// Timeout always true
+func (e *DeadlineError) Timeout() bool { return true }
+
+// Temporary always true
+func (e *DeadlineError) Temporary() bool { return true }
+
+// Is if target is ErrDeadlineExceeded
+func (e *DeadlineError) Is(target error) bool { return target == ErrDeadlineExceeded }
+
+// BudgetRecorder optional interface of Request with a deadline recording
+// the time spent by each phase of the request, called once the request
+// is done with the time remaining before the deadline
+type BudgetRecorder interface {
+	RecordBudget(spent [NumPhases]time.Duration, remaining time.Duration)
+}
+
+// budget the deadline of a request shared by all its phases, every phase
+// is limited by the time remaining as well as its own timeout. The phase
+// is entered by the dialing goroutine as well, so it's guarded by lock.
+type budget struct {
+	deadline time.Time
+
+	lock  sync.Mutex
+	phase Phase
+	// since when the current phase is entered
+	since time.Time
+	spent [NumPhases]time.Duration
+}
+
+// newBudget starts the budget of the deadline in PhaseDial,
+// nil if there's no deadline
+func newBudget(deadline time.Time) *budget {
+	if deadline.IsZero() {
+		return nil
+	}
+	return &budget{deadline: deadline, phase: PhaseDial, since: time.Now()}
+}
+
+// Deadline the deadline, zero if b is nil
+func (b *budget) Deadline() time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	return b.deadline
+}
+
+// enter ends the current phase and enters phase
+func (b *budget) enter(phase Phase) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	now := time.Now()
+	b.spent[b.phase] += now.Sub(b.since)
+	b.phase, b.since = phase, now
+	b.lock.Unlock()
+}
+
+// limit the earlier one of timeout and the time remaining
+func (b *budget) limit(timeout time.Duration) time.Duration {
+	if b == nil {
+		return timeout
+	}
+	if remaining := time.Until(b.deadline); timeout <= 0 || remaining < timeout {
+		return remaining
+	}
+	return timeout
+}
+
+// exceeded the deadline error of the current phase
+func (b *budget) exceeded() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return &DeadlineError{Phase: b.phase}
+}
+
+// wrap converts err into the deadline error of the current phase
+// if it's a timeout after the deadline, others are returned as is
+func (b *budget) wrap(err error) error {
+	if b == nil || err == nil || time.Now().Before(b.deadline) {
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return b.exceeded()
+	}
+	return err
+}
+
+// report reports the time spent to the request if it's a BudgetRecorder
+func (b *budget) report(req Request) {
+	r, ok := req.(BudgetRecorder)
+	if b == nil || !ok {
+		return
+	}
+	b.lock.Lock()
+	now := time.Now()
+	b.spent[b.phase] += now.Sub(b.since)
+	b.since = now
+	spent := b.spent
+	b.lock.Unlock()
+	r.RecordBudget(spent, b.deadline.Sub(now))
+}
@@ -28,12 +28,42 @@ import (
 var ErrConnectionClosed = errors.New("the server closed connection before returning the first response byte. " +
 	"Make sure the server returns 'Connection: close' response header before closing the connection")
 
+// ErrDial the connection to the host or super proxy can't be made,
+// the TLS handshake with the host included, as well as the host is
+// unreachable from the SOCKS5 super proxy, see superproxy.SOCKS5Error
+var ErrDial = errors.New("fail to dial")
+
+// dialError marks err as ErrDial unless it's a super proxy handshake failure
+func dialError(err error) error {
+	if errors.Is(err, superproxy.ErrHandshake) {
+		return err
+	}
+	return util.ErrKind(ErrDial, err)
+}
+
+// ErrOriginPrelude the OnNewOriginConn of the client failed the new
+// connection to the host, it's ErrDial too
+var ErrOriginPrelude = errors.New("origin connection prelude failed")
+
+// ErrDeadlineExceeded the deadline of the request is exceeded before the
+// response is read, it's a timeout net.Error. The errors returned by Do are
+// *DeadlineError telling the phase exhausting the deadline, see Phase.
+var ErrDeadlineExceeded error = deadlineError{}
+
+type deadlineError struct{}
+
+func (deadlineError) Error() string   { return "request deadline exceeded" }
+func (deadlineError) Timeout() bool   { return true }
+func (deadlineError) Temporary() bool { return true }
+
 // Request http request used for client
 type Request interface {
 	// Method request method in UPPER case
 	Method() []byte
 	// TargetWithPort, expected ip with port, if not, domain with port
 	TargetWithPort() string
+	// HostWithPort, domain with port, used by the absolute-form request line
+	HostWithPort() string
 	// Path request relative path
 	PathWithQueryFragment() []byte
 	// Protocol HTTP/1.0, HTTP/1.1 etc.
@@ -62,6 +92,51 @@ type Request interface {
 	GetProxy() *superproxy.SuperProxy
 }
 
+// TLSStateRecorder optional interface of Request recording the TLS
+// connection state of the host, given to SetTLSState before the request
+// is written if WantTLSState returns true
+type TLSStateRecorder interface {
+	WantTLSState() bool
+	SetTLSState(state tls.ConnectionState)
+}
+
+// HeaderCacheUser optional interface of Request writing its header through
+// the cache of the connection it's written to, given to SetHeaderCache
+// before the request is written, see transport.HeaderCache
+type HeaderCacheUser interface {
+	SetHeaderCache(cache *transport.HeaderCache)
+}
+
+// Dialers the dial functions making the connections of a request or a
+// tunnel instead of the Dial and DialTLS of the client, Dial is
+// transport.Dial if not set, see HostClient for the nil DialTLS
+type Dialers struct {
+	Dial    func(addr string) (net.Conn, error)
+	DialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error)
+}
+
+// DialersRequest optional interface of Request making its connections by
+// its own Dialers, e.g. the ones chosen by the hijacker of the request,
+// the ones of the client are used if nil
+type DialersRequest interface {
+	Dialers() *Dialers
+}
+
+// Deadliner optional interface of Request capping the whole round trip,
+// i.e. the dial, handshakes, writing the request and reading the response,
+// the read and write timeouts still apply. The zero time means no deadline.
+type Deadliner interface {
+	Deadline() time.Time
+}
+
+// requestDeadline the deadline of req, zero if not a Deadliner
+func requestDeadline(req Request) time.Time {
+	if d, ok := req.(Deadliner); ok {
+		return d.Deadline()
+	}
+	return time.Time{}
+}
+
 // Response http response used for client
 type Response interface {
 	// ReadFrom read the http response from the buffer IO reader
@@ -106,6 +181,66 @@ type Client struct {
 	// By default request write timeout is unlimited.
 	WriteTimeout time.Duration
 
+	// Maximum duration for TLS handshakes with hosts.
+	//
+	// transport.DefaultTLSHandshakeTimeout is used if not set.
+	TLSHandshakeTimeout time.Duration
+
+	// Maximum duration for the CONNECT handshakes with super proxies,
+	// counted from the connection to the super proxy made, independent of
+	// the dial timeout. The handshake timing out fails with a timeout
+	// superproxy.ErrHandshake.
+	//
+	// By default only the request deadline limits the handshakes.
+	SuperProxyHandshakeTimeout time.Duration
+
+	// Buffer sizes used by the tunnels made by DoRaw for each direction,
+	// i.e. from the client to the host and from the host to the client.
+	//
+	// bytebufferpool.DefaultCopyBufSize is used if not set.
+	TunnelClientToServerBufSize int
+	TunnelServerToClientBufSize int
+
+	// TunnelWriteCoalesceWindow coalesces the small writes of the tunnels
+	// made within the window, see transport.ForwardWithCoalescing.
+	//
+	// Disabled if not set.
+	TunnelWriteCoalesceWindow time.Duration
+
+	// Maximum duration for the response header reading, counted from the
+	// request written, overridden by the requests implementing
+	// ResponseTimeouter. ErrResponseHeaderTimeout is returned if exceeded.
+	//
+	// By default only ReadTimeout limits the response header reading.
+	ResponseHeaderTimeout time.Duration
+
+	// Maximum duration between the reads of the response body, the read
+	// deadline is pushed back after every read, so a slow but steady body
+	// is read to its end. ErrBodyInactivityTimeout is returned if exceeded.
+	//
+	// By default only ReadTimeout limits the response body reading.
+	BodyInactivityTimeout time.Duration
+
+	// TLSProfileForHost optional TLS profile of the handshakes with the
+	// host, i.e. the TLS server name of the request, nil for the default
+	// ClientHello. It's called once for each host by each host client,
+	// which caches the TLS config made.
+	TLSProfileForHost func(host string) *TLSProfile
+
+	// OnNewOriginConn optional prelude of the new connections to the hosts,
+	// e.g. a banner exchange or a STARTTLS upgrade some origins require.
+	// It's called with the host with port of the request once the
+	// connection is made, directly or through a super proxy tunnel, and
+	// before the TLS handshake with the host and any request written. The
+	// connection returned is used instead, e.g. conn wrapped by tls.Client,
+	// and it's pooled as is, so the prelude runs once per connection.
+	//
+	// The connections made by DialTLS are passed after their handshake,
+	// while the ones to HTTP super proxies forwarding the plain HTTP
+	// requests and the tunnels made by DoRaw are not passed. The error
+	// returned fails the request with ErrOriginPrelude.
+	OnNewOriginConn func(hostWithPort string, conn net.Conn) (net.Conn, error)
+
 	hostClientsLock sync.Mutex
 	// host clients pool, separate common and TLS clients
 	hostClients    map[string]*HostClient
@@ -153,9 +288,21 @@ func (c *Client) DoFake(req Request, resp Response, fakeRespReader io.Reader) er
 	return err
 }
 
-// DoRaw make simple raw traffic forwarding
-func (c *Client) DoRaw(rw io.ReadWriter, sProxy *superproxy.SuperProxy,
-	targetWithPort string, onTunnelMade func(error) error) (rwReadNum, rwWriteNum int64, err error) {
+// TunnelRelay relays the tunnel made between rw and the connection to the
+// host, returns the bytes read from and written into rw
+type TunnelRelay func(rw io.ReadWriter, conn net.Conn) (rwReadNum, rwWriteNum int64, err error)
+
+// RawOptions optional settings of DoRaw, nil for the defaults
+type RawOptions struct {
+	// Relay relays the tunnel made, which is forwarded by DoRaw itself if nil
+	Relay TunnelRelay
+	// Dialers make the tunnel, the ones of the client are used if nil
+	Dialers *Dialers
+}
+
+// DoRaw make simple raw traffic forwarding, opts may be nil
+func (c *Client) DoRaw(rw io.ReadWriter, sProxy *superproxy.SuperProxy, targetWithPort string,
+	onTunnelMade func(error) error, opts *RawOptions) (rwReadNum, rwWriteNum int64, err error) {
 	//TODO: TEST DoRaw, Do and DoFake with the same super proxy
 	if rw == nil {
 		return 0, 0, onTunnelMade(errNilReadWriter)
@@ -170,7 +317,7 @@ func (c *Client) DoRaw(rw io.ReadWriter, sProxy *superproxy.SuperProxy,
 		isConnectHostTLS = sProxy.GetProxyType() == superproxy.ProxyTypeHTTPS
 	}
 	return c.getHostClient(connectHostWithPort,
-		isConnectHostTLS).DoRaw(rw, sProxy, targetWithPort, onTunnelMade)
+		isConnectHostTLS).DoRaw(rw, sProxy, targetWithPort, onTunnelMade, opts)
 }
 
 // Do performs the given http request and fills the given http response.
@@ -190,23 +337,41 @@ func (c *Client) Do(req Request, resp Response) error {
 		return errNilBufioPool
 	}
 
+	if r, ok := req.(DirectRacer); ok && req.GetProxy() != nil {
+		if race, headStart := r.RaceDirect(); race {
+			return c.doRace(req, resp, r, headStart)
+		}
+	}
+	hc, err := c.hostClientOf(req, req.GetProxy())
+	if err != nil {
+		return err
+	}
+	return hc.Do(req, resp)
+}
+
+// hostClientOf the host client making req through sProxy, directly if nil
+func (c *Client) hostClientOf(req Request, sProxy *superproxy.SuperProxy) (*HostClient, error) {
 	connectHostWithPort := ""
 	isConnectHostTLS := false
-	if sProxy := req.GetProxy(); sProxy != nil {
-		connectHostWithPort = req.GetProxy().HostWithPort()
+	if sProxy != nil {
+		connectHostWithPort = sProxy.HostWithPort()
 		if len(connectHostWithPort) == 0 {
-			return errNilSuperProxyHost
+			return nil, errNilSuperProxyHost
 		}
 		isConnectHostTLS = (sProxy.GetProxyType() == superproxy.ProxyTypeHTTPS)
 	} else {
 		connectHostWithPort = req.TargetWithPort()
 		if len(connectHostWithPort) == 0 {
-			return errNilTargetHost
+			return nil, errNilTargetHost
 		}
 		isConnectHostTLS = req.IsTLS()
+		if isConnectHostTLS {
+			// the TLS config of a host client is made for a single server name
+			connectHostWithPort += "/" + req.TLSServerName()
+		}
 	}
 
-	return c.getHostClient(connectHostWithPort, isConnectHostTLS).Do(req, resp)
+	return c.getHostClient(connectHostWithPort, isConnectHostTLS), nil
 }
 
 // getHostClient get a host client with providing the host to connect
@@ -233,11 +398,20 @@ func (c *Client) getHostClient(connectHostWithPort string,
 	hc := hostClients[connectHostWithPort]
 	if hc == nil {
 		hc = &HostClient{
-			Dial:         c.Dial,
-			DialTLS:      c.DialTLS,
-			BufioPool:    c.BufioPool,
-			ReadTimeout:  c.ReadTimeout,
-			WriteTimeout: c.WriteTimeout,
+			Dial:                        c.Dial,
+			DialTLS:                     c.DialTLS,
+			BufioPool:                   c.BufioPool,
+			ReadTimeout:                 c.ReadTimeout,
+			WriteTimeout:                c.WriteTimeout,
+			TLSHandshakeTimeout:         c.TLSHandshakeTimeout,
+			SuperProxyHandshakeTimeout:  c.SuperProxyHandshakeTimeout,
+			TunnelClientToServerBufSize: c.TunnelClientToServerBufSize,
+			TunnelServerToClientBufSize: c.TunnelServerToClientBufSize,
+			TunnelWriteCoalesceWindow:   c.TunnelWriteCoalesceWindow,
+			ResponseHeaderTimeout:       c.ResponseHeaderTimeout,
+			BodyInactivityTimeout:       c.BodyInactivityTimeout,
+			TLSProfileForHost:           c.TLSProfileForHost,
+			OnNewOriginConn:             c.OnNewOriginConn,
 			ConnManager: transport.ConnManager{
 				MaxConns:            c.MaxConnsPerHost,
 				MaxIdleConnDuration: c.MaxIdleConnDuration,
@@ -256,6 +430,25 @@ func (c *Client) getHostClient(connectHostWithPort string,
 	return hc
 }
 
+// CloseIdleConns closes the idle connections pooled to all the hosts,
+// e.g. to free the file descriptors, returns the number closed
+func (c *Client) CloseIdleConns() int {
+	c.hostClientsLock.Lock()
+	hostClients := make([]*HostClient, 0, len(c.hostClients)+len(c.hostTLSClients))
+	for _, hc := range c.hostClients {
+		hostClients = append(hostClients, hc)
+	}
+	for _, hc := range c.hostTLSClients {
+		hostClients = append(hostClients, hc)
+	}
+	c.hostClientsLock.Unlock()
+	n := 0
+	for _, hc := range hostClients {
+		n += hc.ConnManager.CloseIdleConns()
+	}
+	return n
+}
+
 func (c *Client) mCleaner(m map[string]*HostClient) {
 	mustStop := false
 	for {
@@ -289,12 +482,16 @@ func (c *Client) mCleaner(m map[string]*HostClient) {
 //
 // It is safe calling HostClient methods from concurrently running go routines.
 type HostClient struct {
-	// Dialer
+	// Dialer, the direct TLS connections are dialed by Dial with the
+	// handshake made by the client if DialTLS is not set, so that the
+	// prelude of OnNewOriginConn runs before it and TLSHandshakeTimeout
+	// bounds it
 	Dial    func(addr string) (net.Conn, error)
 	DialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error)
 
 	// cached TLS server config
-	tlsServerConfig *tls.Config
+	tlsServerConfig     *tls.Config
+	tlsServerConfigLock sync.Mutex
 
 	// TODO: should I give each HostClient a bufio pool rather than share one?
 	// BufioPool buffer connection reader & writer pool
@@ -310,6 +507,40 @@ type HostClient struct {
 	// By default request write timeout is unlimited.
 	WriteTimeout time.Duration
 
+	// Maximum duration for TLS handshakes with hosts.
+	//
+	// transport.DefaultTLSHandshakeTimeout is used if not set.
+	TLSHandshakeTimeout time.Duration
+
+	// SuperProxyHandshakeTimeout see the one of Client
+	SuperProxyHandshakeTimeout time.Duration
+
+	// Buffer sizes used by the tunnels made by DoRaw for each direction,
+	// i.e. from the client to the host and from the host to the client.
+	//
+	// bytebufferpool.DefaultCopyBufSize is used if not set.
+	TunnelClientToServerBufSize int
+	TunnelServerToClientBufSize int
+
+	// TunnelWriteCoalesceWindow coalesces the small writes of the tunnels
+	// made within the window, see transport.ForwardWithCoalescing.
+	//
+	// Disabled if not set.
+	TunnelWriteCoalesceWindow time.Duration
+
+	// ResponseHeaderTimeout and BodyInactivityTimeout, see the ones of Client
+	ResponseHeaderTimeout time.Duration
+	BodyInactivityTimeout time.Duration
+
+	// TLSProfileForHost optional TLS profile of the handshakes with the
+	// host, see Client.TLSProfileForHost
+	TLSProfileForHost func(host string) *TLSProfile
+	tlsProfiles       tlsProfiles
+
+	// OnNewOriginConn optional prelude of the new connections to the
+	// host, see Client.OnNewOriginConn
+	OnNewOriginConn func(hostWithPort string, conn net.Conn) (net.Conn, error)
+
 	// ConnManager manager of the connections
 	ConnManager transport.ConnManager
 
@@ -326,30 +557,41 @@ func (c *HostClient) LastUseTime() time.Time {
 	return time.Unix(startTimeUnix+int64(n), 0)
 }
 
-// DoRaw make simple raw traffic forwarding
-func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
-	targetWithPort string, onTunnelMade func(error) error) (rwReadNum, rwWriteNum int64, err error) {
+// DoRaw make simple raw traffic forwarding, opts may be nil
+func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy, targetWithPort string,
+	onTunnelMade func(error) error, opts *RawOptions) (rwReadNum, rwWriteNum int64, err error) {
 	// set hostClient's last used time
 	atomic.StoreUint32(&c.lastUseTime, uint32(servertime.CoarseTimeNow().Unix()-startTimeUnix))
+	if opts == nil {
+		opts = &RawOptions{}
+	}
+	relay, dialers := opts.Relay, opts.Dialers
+	if dialers == nil {
+		dialers = &Dialers{Dial: c.Dial, DialTLS: c.DialTLS}
+	}
 
 	// retrieve a connection from pool
 	var cc *transport.Conn
 	var netConn net.Conn
 	if superProxy == nil {
-		if c.Dial != nil {
-			netConn, err = c.Dial(targetWithPort)
+		if dialers.Dial != nil {
+			netConn, err = dialers.Dial(targetWithPort)
 		} else {
 			netConn, err = transport.Dial(targetWithPort)
 		}
 	} else {
-		netConn, err = superProxy.MakeTunnel(c.Dial, c.DialTLS, c.BufioPool, targetWithPort)
+		netConn, err = superProxy.MakeTunnelWithin(dialers.Dial, dialers.DialTLS, c.BufioPool,
+			targetWithPort, time.Time{}, c.SuperProxyHandshakeTimeout)
 	}
-	if err != nil {
-		return 0, 0, onTunnelMade(err)
+	if err == nil {
+		cc, err = c.ConnManager.AcquireConn(dialerWrapper(netConn, err))
 	}
-	cc, err = c.ConnManager.AcquireConn(dialerWrapper(netConn, err))
 	if err != nil {
-		return 0, 0, onTunnelMade(err)
+		err = dialError(err)
+		if e := onTunnelMade(err); e != nil {
+			return 0, 0, e
+		}
+		return 0, 0, err
 	}
 	if onTunnelMade != nil {
 		if err := onTunnelMade(nil); err != nil {
@@ -386,14 +628,32 @@ func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
 			cc.LastWriteDeadlineTime = currentTime
 		}
 	}
+	if relay != nil {
+		rwReadNum, rwWriteNum, err = relay(rw, conn)
+		if err != nil {
+			err = util.ErrWrapper(err, "error occurred when tunneling")
+		}
+		c.ConnManager.CloseConn(cc)
+		return rwReadNum, rwWriteNum, err
+	}
+
 	// forward incoming connection to destination tunnel
+	idle := c.ConnManager.MaxIdleConnDuration
+	if idle <= 0 {
+		idle = transport.DefaultMaxIdleConnDuration
+	}
+	// counted apart from the results, which the forwarding still running
+	// on return must not touch
+	var readNum, writeNum int64
 	errChan := make(chan error, 2)
 	go func() {
-		_, readErr := transport.Forward(conn, rw, c.ConnManager.MaxIdleConnDuration)
+		_, readErr := transport.ForwardWithCoalescing(conn, &countingReader{r: rw, n: &readNum},
+			idle, c.TunnelClientToServerBufSize, c.TunnelWriteCoalesceWindow)
 		errChan <- readErr
 	}()
 	go func() {
-		_, writeErr := transport.Forward(rw, conn, c.ConnManager.MaxIdleConnDuration)
+		_, writeErr := transport.ForwardWithCoalescing(&countingWriter{w: rw, n: &writeNum}, conn,
+			idle, c.TunnelServerToClientBufSize, c.TunnelWriteCoalesceWindow)
 		errChan <- writeErr
 	}()
 	select {
@@ -405,7 +665,31 @@ func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
 
 	//TODO: should reuse these connections????? only close socks5 connections? more tests?
 	c.ConnManager.CloseConn(cc)
-	return
+	return atomic.LoadInt64(&readNum), atomic.LoadInt64(&writeNum), err
+}
+
+// countingReader counts the bytes read from r atomically
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written into w atomically
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
 }
 
 // Do performs the given http request and sets the corresponding response.
@@ -415,6 +699,12 @@ func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
 // ErrNoFreeConns is returned if all HostClient.MaxConns connections
 // to the host are busy.
 func (c *HostClient) Do(req Request, resp Response) (err error) {
+	return c.doWith(req, resp, newBudget(requestDeadline(req)), nil)
+}
+
+// doWith is Do within the budget b, the connection raced is used by the
+// first attempt if not nil
+func (c *HostClient) doWith(req Request, resp Response, b *budget, raced *transport.Conn) (err error) {
 	if req == nil {
 		return errors.New("nil request")
 	}
@@ -431,10 +721,15 @@ func (c *HostClient) Do(req Request, resp Response) (err error) {
 	buffer := bytebufferpool.Get()
 	var retry bool
 	for {
-		retry, err = c.do(req, resp, buffer)
+		retry, err = c.do(req, resp, buffer, b, raced)
+		raced = nil
 		if err == nil || !retry {
 			break
 		}
+		if b != nil && !time.Now().Before(b.deadline) {
+			err = b.wrap(err)
+			break
+		}
 
 		if !isHeadOrGet(req.Method()) {
 			// Retry non-idempotent requests if the server closes
@@ -455,6 +750,7 @@ func (c *HostClient) Do(req Request, resp Response) (err error) {
 	}
 	bytebufferpool.Put(buffer)
 	atomic.AddUint64(&c.pendingRequests, ^uint64(0))
+	b.report(req)
 
 	if err == io.EOF {
 		err = ErrConnectionClosed
@@ -474,34 +770,70 @@ func (c *HostClient) PendingRequests() int {
 var errDialEOF = errors.New("dial EOF")
 
 func (c *HostClient) do(req Request, resp Response,
-	reqCacheForRetry *bytebufferpool.ByteBuffer) (retry bool, e error) {
+	reqCacheForRetry *bytebufferpool.ByteBuffer, b *budget, raced *transport.Conn) (retry bool, e error) {
+	deadline := b.Deadline()
+	if raced == nil {
+		b.enter(PhaseDial)
+	}
 	// set hostClient's last used time
 	atomic.StoreUint32(&c.lastUseTime, uint32(servertime.CoarseTimeNow().Unix()-startTimeUnix))
 
-	// analysis request type
-	viaProxy := req.GetProxy() != nil
+	// analysis request type, non-tunneled requests made to a HTTP proxy
+	// reuse the keep-alive connections pooled by the super proxy
+	superProxy := req.GetProxy()
+	reuseProxyConn := reusesProxyConn(superProxy, req)
+	guard := newDialGuard(req)
+	defer guard.abandon()
+	acquireConn, closeConn := c.connFuncs(req, superProxy, b, guard)
 
 	// get the connection
 	var cc *transport.Conn
 	var err error
 
-	cc, err = c.ConnManager.AcquireConn(c.makeDialer(req.GetProxy(),
-		req.TargetWithPort(), req.IsTLS(), req.TLSServerName()))
+	if raced != nil {
+		cc = raced
+	} else {
+		cc, err = acquireConnBefore(acquireConn, closeConn, deadline)
+	}
 
 	redialCount := 0
 	for err == io.EOF && redialCount < 3 {
 		redialCount++
 		time.Sleep(time.Duration(redialCount*300) * time.Millisecond)
-		cc, err = c.ConnManager.AcquireConn(c.makeDialer(req.GetProxy(),
-			req.TargetWithPort(), req.IsTLS(), req.TLSServerName()))
+		cc, err = acquireConnBefore(acquireConn, closeConn, deadline)
 	}
 	if err != nil {
+		if err == ErrDeadlineExceeded || (b != nil && !time.Now().Before(deadline)) {
+			return false, b.exceeded()
+		}
 		if err == io.EOF {
 			err = errDialEOF
 		}
-		return false, err
+		return false, dialError(err)
 	}
 	conn := cc.Get()
+	b.enter(PhaseWrite)
+	// the connection is closed if the request or response panics, e.g. in
+	// the callbacks of the caller, which may recover from it
+	defer func() {
+		if v := recover(); v != nil {
+			closeConn(cc)
+			panic(v)
+		}
+	}()
+
+	// record the TLS state of the host if asked
+	if r, ok := req.(TLSStateRecorder); ok && req.IsTLS() && r.WantTLSState() {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			r.SetTLSState(tlsConn.ConnectionState())
+		}
+	}
+	if r, ok := req.(TLSProfileRecorder); ok && req.IsTLS() && !reuseProxyConn {
+		r.SetTLSProfile(c.tlsProfileName(req.TargetWithPort(), req.TLSServerName()))
+	}
+	if r, ok := req.(HeaderCacheUser); ok {
+		r.SetHeaderCache(cc.HeaderCache())
+	}
 
 	// pre-setup
 	if c.WriteTimeout > 0 {
@@ -511,12 +843,20 @@ func (c *HostClient) do(req Request, resp Response,
 		currentTime := servertime.CoarseTimeNow()
 		if currentTime.Sub(cc.LastWriteDeadlineTime) > (c.WriteTimeout >> 2) {
 			if err = conn.SetWriteDeadline(currentTime.Add(c.WriteTimeout)); err != nil {
-				c.ConnManager.CloseConn(cc)
+				closeConn(cc)
 				return true, err
 			}
 			cc.LastWriteDeadlineTime = currentTime
 		}
 	}
+	if !deadline.IsZero() {
+		// the deadlines are set again by the next request of the connection
+		if err = conn.SetWriteDeadline(earlierDeadline(deadline, c.WriteTimeout)); err != nil {
+			closeConn(cc)
+			return false, err
+		}
+		cc.LastWriteDeadlineTime = time.Time{}
+	}
 	resetConnection := false
 	if c.ConnManager.MaxConnDuration > 0 &&
 		time.Since(cc.CreatedTime()) > c.ConnManager.MaxConnDuration &&
@@ -539,20 +879,21 @@ func (c *HostClient) do(req Request, resp Response,
 			if shouldCacheReqForRetry {
 				reqCacheForRetry.Reset()
 			}
-			c.ConnManager.CloseConn(cc)
+			closeConn(cc)
 			// cannot even read a complete request, do NOT retry
-			return false, err
+			return false, b.wrap(err)
 		}
 	}
 	if isCachedReqAvailable() {
 		// write the cached http requests to conn
 		if _, err = c.writeData(reqCacheForRetry.Bytes(), conn); err != nil {
-			c.ConnManager.CloseConn(cc)
+			closeConn(cc)
 			return true, err
 		}
 	}
 
 	// get response
+	b.enter(PhaseTTFB)
 	if c.ReadTimeout > 0 {
 		// Optimization: update read deadline only if more than 25%
 		// of the last read deadline exceeded.
@@ -560,41 +901,179 @@ func (c *HostClient) do(req Request, resp Response,
 		currentTime := servertime.CoarseTimeNow()
 		if currentTime.Sub(cc.LastReadDeadlineTime) > (c.ReadTimeout >> 2) {
 			if err = conn.SetReadDeadline(currentTime.Add(c.ReadTimeout)); err != nil {
-				c.ConnManager.CloseConn(cc)
+				closeConn(cc)
 				return true, err
 			}
 			cc.LastReadDeadlineTime = currentTime
 		}
 	}
-	br := c.BufioPool.AcquireReader(conn)
+	if !deadline.IsZero() {
+		if err = conn.SetReadDeadline(earlierDeadline(deadline, c.ReadTimeout)); err != nil {
+			closeConn(cc)
+			return false, err
+		}
+		cc.LastReadDeadlineTime = time.Time{}
+	}
+	// the response timeouts switch the read deadline as the response is read
+	var rc *responseConn
+	var respConn net.Conn = conn
+	if header, bodyInactivity := c.responseTimeouts(req); header > 0 || bodyInactivity > 0 {
+		rc = newResponseConn(conn, resp, header, bodyInactivity)
+		rc.max = readDeadline(deadline, c.ReadTimeout)
+		respConn = rc
+	}
+	br := c.BufioPool.AcquireReader(respConn)
 	// read a byte from response to test if the connection has been closed by remote
-	if b, err := br.Peek(1); err != nil {
-		if err == io.EOF {
+	if peeked, err := br.Peek(1); err != nil || len(peeked) == 0 {
+		c.BufioPool.ReleaseReader(br)
+		closeConn(cc)
+		if err == nil || err == io.EOF {
 			return true, io.EOF
 		}
-		return false, err
-	} else if len(b) == 0 {
-		return true, io.EOF
+		return false, b.wrap(err)
+	}
+	b.enter(PhaseRead)
+	if rc != nil {
+		if !deadline.IsZero() {
+			rc.max = earlierDeadline(deadline, c.ReadTimeout)
+		}
+	} else if !deadline.IsZero() {
+		// the rest of the response is read within its own read timeout
+		if err = conn.SetReadDeadline(earlierDeadline(deadline, c.ReadTimeout)); err != nil {
+			c.BufioPool.ReleaseReader(br)
+			closeConn(cc)
+			return false, err
+		}
 	}
 
 	if _, err = resp.ReadFrom(isHead(req.Method()), br); err != nil {
 		c.BufioPool.ReleaseReader(br)
-		c.ConnManager.CloseConn(cc)
-		return false, err
+		closeConn(cc)
+		return false, b.wrap(err)
 	}
 	c.BufioPool.ReleaseReader(br)
+	if rc != nil {
+		// the read deadline is set by the next request of the connection
+		cc.LastReadDeadlineTime = time.Time{}
+	}
 
 	// release or close connection
-	if viaProxy || resetConnection || req.ConnectionClose() || resp.ConnectionClose() {
-		//TODO: reuse super proxy connections
-		c.ConnManager.CloseConn(cc)
+	if resetConnection || req.ConnectionClose() || resp.ConnectionClose() {
+		closeConn(cc)
+	} else if reuseProxyConn && (deadline.IsZero() && rc == nil || conn.SetDeadline(time.Time{}) == nil) {
+		// the deadline is cleared for the next request without one
+		superProxy.ReleaseConn(cc)
 	} else {
-		c.ConnManager.CloseConn(cc)
+		//TODO: reuse direct and tunneled connections
+		closeConn(cc)
 	}
 
 	return false, err
 }
 
+// reusesProxyConn if req is made through superProxy on the keep-alive
+// connections it pools, i.e. the non-tunneled requests made to HTTP proxies
+func reusesProxyConn(superProxy *superproxy.SuperProxy, req Request) bool {
+	return superProxy != nil && parseRequestType(superProxy, req.IsTLS()) == requestProxyHTTP
+}
+
+// dialersOf the dialers making the connections of req, the ones of the
+// client unless it has its own
+func (c *HostClient) dialersOf(req Request) Dialers {
+	if r, ok := req.(DialersRequest); ok {
+		if dialers := r.Dialers(); dialers != nil {
+			return *dialers
+		}
+	}
+	return Dialers{Dial: c.Dial, DialTLS: c.DialTLS}
+}
+
+// connFuncs the functions acquiring and closing the connections making req
+// through superProxy, directly if nil. The request is read here only, as the
+// connection may still be acquired once the request is released, e.g. after
+// the deadline is exceeded, the dials are recorded into it until the guard
+// is abandoned.
+func (c *HostClient) connFuncs(req Request, superProxy *superproxy.SuperProxy,
+	b *budget, guard *dialGuard) (acquire func() (*transport.Conn, error), closeConn func(*transport.Conn)) {
+	dialers := c.dialersOf(req)
+	if reusesProxyConn(superProxy, req) {
+		dial, dialTLS := dialers.Dial, dialers.DialTLS
+		if guard != nil {
+			dial, dialTLS = recordProxyDial(dial, dialTLS, guard)
+		}
+		return func() (*transport.Conn, error) {
+			return superProxy.AcquireConn(dial, dialTLS)
+		}, superProxy.CloseConn
+	}
+	dial := c.makeDialer(dialers, superProxy, req.HostWithPort(),
+		req.TargetWithPort(), req.IsTLS(), req.TLSServerName(), b)
+	if guard != nil {
+		addr := req.TargetWithPort()
+		if superProxy != nil {
+			addr = superProxy.HostWithPort()
+		}
+		dial = recordDial(dial, guard, addr)
+	}
+	return func() (*transport.Conn, error) {
+		return c.ConnManager.AcquireConn(dial)
+	}, c.ConnManager.CloseConn
+}
+
+// acquireConnBefore acquires a connection with acquire, gives up with
+// ErrDeadlineExceeded once the deadline is exceeded, the connection
+// acquired too late is closed by closeConn
+func acquireConnBefore(acquire func() (*transport.Conn, error),
+	closeConn func(*transport.Conn), deadline time.Time) (*transport.Conn, error) {
+	if deadline.IsZero() {
+		return acquire()
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, ErrDeadlineExceeded
+	}
+	type result struct {
+		cc  *transport.Conn
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		cc, err := acquire()
+		ch <- result{cc, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.cc, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-ch; r.err == nil {
+				closeConn(r.cc)
+			}
+		}()
+		return nil, ErrDeadlineExceeded
+	}
+}
+
+// readDeadline the read deadline of the response by the deadline and
+// the read timeout, zero for none
+func readDeadline(deadline time.Time, readTimeout time.Duration) time.Time {
+	if deadline.IsZero() && readTimeout > 0 {
+		return time.Now().Add(readTimeout)
+	}
+	return earlierDeadline(deadline, readTimeout)
+}
+
+// earlierDeadline the earlier one of the deadline and the timeout from now
+func earlierDeadline(deadline time.Time, timeout time.Duration) time.Time {
+	if timeout > 0 {
+		if t := time.Now().Add(timeout); t.Before(deadline) {
+			return t
+		}
+	}
+	return deadline
+}
+
 func (c *HostClient) writeData(data []byte, w io.Writer) (int, error) {
 	bw := c.BufioPool.AcquireWriter(w)
 	defer c.BufioPool.ReleaseWriter(bw)
@@ -614,7 +1093,7 @@ func (c *HostClient) readFromReqAndWriteToIOWriter(req Request, w io.Writer) (er
 	// start line
 	if isReqProxyHTTP {
 		_, err = writeRequestLine(bw, true, req.Method(),
-			req.TargetWithPort(), req.PathWithQueryFragment(), req.Protocol())
+			req.HostWithPort(), req.PathWithQueryFragment(), req.Protocol())
 	} else {
 		_, err = writeRequestLine(bw, false, req.Method(),
 			"", req.PathWithQueryFragment(), req.Protocol())
@@ -753,6 +753,10 @@ func (r *SimpleRequest) Method() []byte {
 func (r *SimpleRequest) TargetWithPort() string {
 	return r.targetwithport
 }
+
+func (r *SimpleRequest) HostWithPort() string {
+	return r.targetwithport
+}
 func (r *SimpleRequest) SetTargetWithPort(s string) {
 	r.targetwithport = s
 }
@@ -851,6 +855,10 @@ func (r *BigHeaderRequest) Method() []byte {
 func (r *BigHeaderRequest) TargetWithPort() string {
 	return r.targetwithport
 }
+
+func (r *BigHeaderRequest) HostWithPort() string {
+	return r.targetwithport
+}
 func (r *BigHeaderRequest) SetTargetWithPort(s string) {
 	r.targetwithport = s
 }
@@ -965,6 +973,10 @@ func (r *IdempotentRequest) SetMethod(method []byte) {
 func (r *IdempotentRequest) TargetWithPort() string {
 	return r.targetwithport
 }
+
+func (r *IdempotentRequest) HostWithPort() string {
+	return r.targetwithport
+}
 func (r *IdempotentRequest) SetTargetWithPort(s string) {
 	r.targetwithport = s
 }
@@ -1075,6 +1087,10 @@ func (r *HTTPSRequest) Method() []byte {
 func (r *HTTPSRequest) TargetWithPort() string {
 	return "127.0.0.1:4433"
 }
+
+func (r *HTTPSRequest) HostWithPort() string {
+	return "127.0.0.1:4433"
+}
 func (r *HTTPSRequest) SetTargetWithPort(s string) {}
 
 func (r *HTTPSRequest) PathWithQueryFragment() []byte {
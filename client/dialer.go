@@ -4,10 +4,13 @@ import (
 	"crypto/tls"
 	"errors"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/haxii/fastproxy/cert"
 	"github.com/haxii/fastproxy/superproxy"
 	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/util"
 )
 
 type requestType int
@@ -49,49 +52,198 @@ func parseRequestType(superProxy *superproxy.SuperProxy, isHTTPS bool) requestTy
 	return rt
 }
 
-func (c *HostClient) makeDialer(superProxy *superproxy.SuperProxy,
-	targetWithPort string, isTargetHTTPS bool, targetTLSServerName string) transport.NewConn {
+// DialRecorder optional interface of Request recording the new connections
+// dialed for it if WantDialRecord, e.g. for tracing the request. The addr is
+// the one of the super proxy if the request is made through one, took
+// includes the handshakes with the super proxy and the target.
+type DialRecorder interface {
+	WantDialRecord() bool
+	RecordDial(addr string, took time.Duration, err error)
+}
+
+// dialGuard records the dials into the DialRecorder of a request until
+// abandoned, i.e. the request is done, the dials outliving the request,
+// e.g. the ones given up for the deadline, are never recorded then
+type dialGuard struct {
+	r         DialRecorder
+	lock      sync.Mutex
+	abandoned bool
+}
+
+// newDialGuard the guard of the dials recorded into req, nil if it
+// records none
+func newDialGuard(req Request) *dialGuard {
+	if r, ok := req.(DialRecorder); ok && r.WantDialRecord() {
+		return &dialGuard{r: r}
+	}
+	return nil
+}
+
+func (g *dialGuard) WantDialRecord() bool {
+	return true
+}
+
+func (g *dialGuard) RecordDial(addr string, took time.Duration, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.abandoned {
+		g.r.RecordDial(addr, took, err)
+	}
+}
+
+// abandon stops recording, waiting for the one being recorded
+func (g *dialGuard) abandon() {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	g.abandoned = true
+	g.lock.Unlock()
+}
+
+// recordDial records the connections made by dial into r
+func recordDial(dial transport.NewConn, r DialRecorder, addr string) transport.NewConn {
+	return func() (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial()
+		r.RecordDial(addr, time.Since(start), err)
+		return conn, err
+	}
+}
+
+// recordProxyDial records the new connections to the super proxy pooled,
+// made by dial or dialTLS, into r
+func recordProxyDial(dial func(addr string) (net.Conn, error),
+	dialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error), r DialRecorder) (
+	func(addr string) (net.Conn, error), func(addr string, tlsConfig *tls.Config) (net.Conn, error)) {
+	if dial == nil {
+		dial = transport.Dial
+	}
+	if dialTLS == nil {
+		dialTLS = transport.DialTLS
+	}
+	return func(addr string) (net.Conn, error) {
+			return recordDial(func() (net.Conn, error) { return dial(addr) }, r, addr)()
+		}, func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+			return recordDial(func() (net.Conn, error) { return dialTLS(addr, tlsConfig) }, r, addr)()
+		}
+}
+
+// makeDialer makes the dialer of the new connections to the target, which
+// is called only if no idle connection is pooled
+func (c *HostClient) makeDialer(dialers Dialers, superProxy *superproxy.SuperProxy, hostWithPort, targetWithPort string,
+	isTargetHTTPS bool, targetTLSServerName string, b *budget) transport.NewConn {
+	return func() (net.Conn, error) {
+		return c.dialTarget(dialers, superProxy, hostWithPort, targetWithPort, isTargetHTTPS, targetTLSServerName, b)
+	}
+}
+
+// dialTarget makes a new connection to the target by dialers, the prelude
+// of OnNewOriginConn is run before the TLS handshake with the target
+func (c *HostClient) dialTarget(dialers Dialers, superProxy *superproxy.SuperProxy, hostWithPort, targetWithPort string,
+	isTargetHTTPS bool, targetTLSServerName string, b *budget) (net.Conn, error) {
 	reqType := parseRequestType(superProxy, isTargetHTTPS)
 	// setup dial functions
-	dialFunc := c.Dial
+	dialFunc := dialers.Dial
 	if dialFunc == nil {
 		dialFunc = transport.Dial
 	}
-	dialTLSFunc := c.DialTLS
-	if dialTLSFunc == nil {
-		dialTLSFunc = transport.DialTLS
-	}
+	prelude := c.originPrelude(hostWithPort)
 	//set https tls config
 	switch reqType {
 	case requestDirectHTTP:
-		return dialerWrapper(dialFunc(targetWithPort))
+		return prelude(dialFunc(targetWithPort))
 	case requestDirectHTTPS:
-		if c.tlsServerConfig == nil {
-			c.tlsServerConfig = cert.MakeClientTLSConfig("", targetTLSServerName)
+		tlsConfig := c.withTLSProfile(c.serverTLSConfig(func() *tls.Config {
+			return cert.MakeClientTLSConfig("", targetTLSServerName)
+		}), targetWithPort, targetTLSServerName)
+		if dialers.DialTLS != nil {
+			return prelude(c.tlsHandshake(b)(dialers.DialTLS(targetWithPort, tlsConfig)))
+		}
+		conn, err := prelude(dialFunc(targetWithPort))
+		if err == nil {
+			conn = tls.Client(conn, tlsConfig)
 		}
-		return dialerWrapper(dialTLSFunc(targetWithPort, c.tlsServerConfig))
+		return c.tlsHandshake(b)(conn, err)
 	case requestProxyHTTP:
-		return dialerWrapper(dialFunc(superProxy.HostWithPort()))
+		return dialFunc(superProxy.HostWithPort())
 	case requestProxyHTTPS:
 		fallthrough
 	case requestProxySOCKS5:
-		tunnelConn, err := superProxy.MakeTunnel(c.Dial, c.DialTLS, c.BufioPool, targetWithPort)
+		tunnelConn, err := prelude(superProxy.MakeTunnelWithin(dialers.Dial, dialers.DialTLS, c.BufioPool,
+			targetWithPort, b.Deadline(), c.SuperProxyHandshakeTimeout))
 		if err != nil {
-			return dialerWrapper(nil, err)
+			return nil, err
 		}
 		if isTargetHTTPS {
-			if c.tlsServerConfig == nil {
-				c.tlsServerConfig = &tls.Config{
+			tlsConfig := c.withTLSProfile(c.serverTLSConfig(func() *tls.Config {
+				return &tls.Config{
 					ClientSessionCache: tls.NewLRUClientSessionCache(0),
 					InsecureSkipVerify: true, //TODO: cache every host config in more safe way in a concurrent map
 				}
+			}), targetWithPort, targetTLSServerName)
+			return c.tlsHandshake(b)(tls.Client(tunnelConn, tlsConfig), nil)
+		}
+		return tunnelConn, nil
+	}
+	return nil, errors.New("request type not implemented")
+}
+
+// serverTLSConfig the TLS config of the target cached, made by newConfig
+// for the first connection, which may be dialed concurrently
+func (c *HostClient) serverTLSConfig(newConfig func() *tls.Config) *tls.Config {
+	c.tlsServerConfigLock.Lock()
+	defer c.tlsServerConfigLock.Unlock()
+	if c.tlsServerConfig == nil {
+		c.tlsServerConfig = newConfig()
+	}
+	return c.tlsServerConfig
+}
+
+// originPrelude runs OnNewOriginConn on the new connection to the host,
+// the connection returned by it is used instead
+func (c *HostClient) originPrelude(hostWithPort string) func(conn net.Conn, err error) (net.Conn, error) {
+	return func(conn net.Conn, err error) (net.Conn, error) {
+		if err != nil || c.OnNewOriginConn == nil {
+			return conn, err
+		}
+		newConn, err := c.OnNewOriginConn(hostWithPort, conn)
+		if err != nil {
+			conn.Close()
+			return nil, util.ErrKind(ErrOriginPrelude, err)
+		}
+		if newConn == nil {
+			newConn = conn
+		}
+		return newConn, nil
+	}
+}
+
+// tlsHandshake completes the handshake of a TLS connection within the
+// TLSHandshakeTimeout and the time remaining of b, other connections
+// are returned as is
+func (c *HostClient) tlsHandshake(b *budget) func(conn net.Conn, err error) (net.Conn, error) {
+	return func(conn net.Conn, err error) (net.Conn, error) {
+		if err != nil {
+			return nil, err
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			b.enter(PhaseTLS)
+			timeout := c.TLSHandshakeTimeout
+			if timeout <= 0 {
+				timeout = transport.DefaultTLSHandshakeTimeout
+			}
+			if timeout = b.limit(timeout); timeout <= 0 {
+				conn.Close()
+				return nil, ErrDeadlineExceeded
+			}
+			if err = transport.TLSHandshake(tlsConn, timeout); err != nil {
+				conn.Close()
+				return nil, err
 			}
-			conn := tls.Client(tunnelConn, c.tlsServerConfig)
-			return dialerWrapper(conn, nil)
 		}
-		return dialerWrapper(tunnelConn, nil)
+		return conn, nil
 	}
-	return dialerWrapper(nil, errors.New("request type not implemented"))
 }
 
 // wrap a connection and error into a transport Dialer
@@ -48,6 +48,10 @@ func (r *VariedRequest) Method() []byte {
 func (r *VariedRequest) TargetWithPort() string {
 	return "127.0.0.1"
 }
+
+func (r *VariedRequest) HostWithPort() string {
+	return "127.0.0.1"
+}
 func (r *VariedRequest) SetTargetWithPort(s string) {}
 
 func (r *VariedRequest) PathWithQueryFragment() []byte {
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// test the direct TLS connections are dialed by Dial if DialTLS is not set,
+// with the prelude run before the handshake made by the client
+func TestDialTargetTLSWithoutDialTLS(t *testing.T) {
+	origin := httptest.NewTLSServer(nethttp.HandlerFunc(func(nethttp.ResponseWriter, *nethttp.Request) {}))
+	defer origin.Close()
+	addr := origin.Listener.Addr().String()
+
+	var dialed, preluded []string
+	c := &HostClient{
+		tlsServerConfig: &tls.Config{InsecureSkipVerify: true},
+		OnNewOriginConn: func(hostWithPort string, conn net.Conn) (net.Conn, error) {
+			if _, ok := conn.(*tls.Conn); ok {
+				t.Errorf("prelude run on the TLS connection")
+			}
+			preluded = append(preluded, hostWithPort)
+			return conn, nil
+		},
+	}
+	dialers := Dialers{Dial: func(addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return net.Dial("tcp", addr)
+	}}
+	conn, err := c.dialTarget(dialers, nil, "example.com:443", addr, true, "example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if tlsConn, ok := conn.(*tls.Conn); !ok || !tlsConn.ConnectionState().HandshakeComplete {
+		t.Fatalf("expected a TLS connection handshaken, got %T", conn)
+	}
+	if len(dialed) != 1 || dialed[0] != addr || len(preluded) != 1 || preluded[0] != "example.com:443" {
+		t.Fatalf("unexpected dials %v, preludes %v", dialed, preluded)
+	}
+}
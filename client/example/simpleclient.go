@@ -21,6 +21,10 @@ func (r *simpleReq) TargetWithPort() string {
 	return "0.0.0.0:8090"
 }
 
+func (r *simpleReq) HostWithPort() string {
+	return "localhost:8090"
+}
+
 func (r *simpleReq) PathWithQueryFragment() []byte {
 	return []byte("/")
 }
@@ -129,6 +133,6 @@ func main() {
 	// Do Raw
 	time.Sleep(time.Second)
 	fmt.Println()
-	fmt.Println(client.DoRaw(&simpleReadWriter{}, nil, "0.0.0.0:8090", nil))
+	fmt.Println(client.DoRaw(&simpleReadWriter{}, nil, "0.0.0.0:8090", nil, nil))
 
 }
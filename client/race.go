@@ -0,0 +1,122 @@
+package client
+
+import (
+	"io"
+	"time"
+
+	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/transport"
+)
+
+// DefaultRaceHeadStart the head start of the super proxy before the direct
+// connection racing it is dialed, like the delay of Happy Eyeballs
+const DefaultRaceHeadStart = 250 * time.Millisecond
+
+// DirectRacer optional interface of Request made through a super proxy,
+// racing a direct connection to the target against the one through the
+// super proxy like Happy Eyeballs across the routes, the request is made
+// on the connection made first and written to it only
+type DirectRacer interface {
+	// RaceDirect if the request is raced, with the head start of the super
+	// proxy, the direct connection is dialed once it's over or the super
+	// proxy fails, DefaultRaceHeadStart is used if not set
+	RaceDirect() (race bool, headStart time.Duration)
+	// SetRaceWinner called with the winner before the request is written,
+	// the request won by the direct connection is made directly from then
+	// on, i.e. its GetProxy returns nil afterwards
+	SetRaceWinner(direct bool)
+}
+
+// raceResult the connection acquired by a path of the race
+type raceResult struct {
+	hc        *HostClient
+	cc        *transport.Conn
+	closeConn func(*transport.Conn)
+	direct    bool
+	err       error
+}
+
+// doRace makes req on the connection made first by either its super proxy
+// or the direct path given the head start of the super proxy. The direct
+// connection is never dialed if the super proxy wins within the head start,
+// otherwise the loser is closed once made.
+func (c *Client) doRace(req Request, resp Response, r DirectRacer, headStart time.Duration) error {
+	superProxy := req.GetProxy()
+	proxied, err := c.hostClientOf(req, superProxy)
+	if err != nil {
+		return err
+	}
+	direct, err := c.hostClientOf(req, nil)
+	if err != nil {
+		return err
+	}
+	if headStart <= 0 {
+		headStart = DefaultRaceHeadStart
+	}
+
+	b := newBudget(requestDeadline(req))
+	// the loser may still be dialing once the request is done
+	guard := newDialGuard(req)
+	defer guard.abandon()
+	results := make(chan raceResult, 2)
+	pending := 1
+	go proxied.raceConn(req, superProxy, b, guard, results)
+	directStarted := false
+	startDirect := func() {
+		if !directStarted {
+			directStarted = true
+			pending++
+			go direct.raceConn(req, nil, b, guard, results)
+		}
+	}
+	timer := time.NewTimer(headStart)
+	defer timer.Stop()
+
+	var winner *raceResult
+	var proxiedErr error
+	for winner == nil && pending > 0 {
+		select {
+		case <-timer.C:
+			startDirect()
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				winner = &result
+			} else if !result.direct {
+				proxiedErr = result.err
+				startDirect()
+			}
+		}
+	}
+	// close the loser once made
+	go func(pending int) {
+		for ; pending > 0; pending-- {
+			if result := <-results; result.err == nil {
+				result.closeConn(result.cc)
+			}
+		}
+	}(pending)
+
+	if winner == nil {
+		b.report(req)
+		err = proxiedErr
+		if err == ErrDeadlineExceeded || (b != nil && !time.Now().Before(b.deadline)) {
+			return b.exceeded()
+		}
+		if err == io.EOF {
+			err = errDialEOF
+		}
+		return dialError(err)
+	}
+	r.SetRaceWinner(winner.direct)
+	return winner.hc.doWith(req, resp, b, winner.cc)
+}
+
+// raceConn acquires a connection making req through superProxy, directly
+// if nil, and sends the result into results
+func (c *HostClient) raceConn(req Request, superProxy *superproxy.SuperProxy,
+	b *budget, guard *dialGuard, results chan<- raceResult) {
+	acquire, closeConn := c.connFuncs(req, superProxy, b, guard)
+	cc, err := acquireConnBefore(acquire, closeConn, b.Deadline())
+	results <- raceResult{hc: c, cc: cc, closeConn: closeConn, direct: superProxy == nil, err: err}
+}
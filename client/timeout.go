@@ -0,0 +1,110 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/haxii/fastproxy/util"
+)
+
+// ErrResponseHeaderTimeout the response header is not read within the
+// ResponseHeaderTimeout, ErrBodyInactivityTimeout the response body
+// stalls longer than the BodyInactivityTimeout. They're timeout net.Errors.
+var (
+	ErrResponseHeaderTimeout error = responseTimeoutError("response header timeout")
+	ErrBodyInactivityTimeout error = responseTimeoutError("response body inactivity timeout")
+)
+
+type responseTimeoutError string
+
+func (e responseTimeoutError) Error() string   { return string(e) }
+func (e responseTimeoutError) Timeout() bool   { return true }
+func (e responseTimeoutError) Temporary() bool { return true }
+
+// ResponseTimeouter optional interface of Request overriding the
+// ResponseHeaderTimeout and BodyInactivityTimeout of the client, the zero
+// durations keep the ones of the client
+type ResponseTimeouter interface {
+	ResponseTimeouts() (header, bodyInactivity time.Duration)
+}
+
+// HeaderReadNotifier optional interface of Response calling the func given
+// to OnHeaderRead once the final response header is read, which ends the
+// ResponseHeaderTimeout and starts the BodyInactivityTimeout. They're
+// switched at the first byte of the responses not implementing it.
+type HeaderReadNotifier interface {
+	OnHeaderRead(f func())
+}
+
+// responseTimeouts the response timeouts of req
+func (c *HostClient) responseTimeouts(req Request) (header, bodyInactivity time.Duration) {
+	header, bodyInactivity = c.ResponseHeaderTimeout, c.BodyInactivityTimeout
+	if r, ok := req.(ResponseTimeouter); ok {
+		h, b := r.ResponseTimeouts()
+		if h > 0 {
+			header = h
+		}
+		if b > 0 {
+			bodyInactivity = b
+		}
+	}
+	return
+}
+
+// responseConn sets the read deadline of the connection before every read
+// of the response, the earlier one of its cap and the header deadline
+// until the header is read, or the body inactivity one after every read
+type responseConn struct {
+	net.Conn
+	// max deadline of the reads by ReadTimeout and the request deadline,
+	// zero for none
+	max time.Time
+	// header deadline of the response header, zero for none
+	header time.Time
+	// inactivity max duration between the reads of the body, 0 for none
+	inactivity time.Duration
+	// headerRead once the response header is read, headerByFirstByte if
+	// it's assumed at the first byte read
+	headerRead        bool
+	headerByFirstByte bool
+}
+
+func newResponseConn(conn net.Conn, resp Response, header, bodyInactivity time.Duration) *responseConn {
+	rc := &responseConn{Conn: conn, inactivity: bodyInactivity, headerByFirstByte: true}
+	if header > 0 {
+		rc.header = time.Now().Add(header)
+	}
+	if n, ok := resp.(HeaderReadNotifier); ok {
+		rc.headerByFirstByte = false
+		n.OnHeaderRead(func() { rc.headerRead = true })
+	}
+	return rc
+}
+
+func (c *responseConn) Read(b []byte) (int, error) {
+	deadline, kind := c.max, error(nil)
+	earlier := func(d time.Time, k error) {
+		if deadline.IsZero() || d.Before(deadline) {
+			deadline, kind = d, k
+		}
+	}
+	if !c.headerRead && !c.header.IsZero() {
+		earlier(c.header, ErrResponseHeaderTimeout)
+	}
+	if c.headerRead && c.inactivity > 0 {
+		earlier(time.Now().Add(c.inactivity), ErrBodyInactivityTimeout)
+	}
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.headerByFirstByte {
+		c.headerRead = true
+	}
+	var netErr net.Error
+	if err != nil && kind != nil && errors.As(err, &netErr) && netErr.Timeout() {
+		err = util.ErrKind(kind, err)
+	}
+	return n, err
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+)
+
+// TLSProfile customizes the ClientHello of the handshakes with an origin,
+// e.g. for the origins fingerprinting the clients and blocking the Go
+// defaults. The zero fields keep the config the profile is layered on.
+type TLSProfile struct {
+	// Name optional name of the profile recorded with the requests made
+	// with it, see TLSProfileRecorder
+	Name string
+	// CipherSuites the TLS 1.0-1.2 cipher suites offered, in the order
+	// preferred. The TLS 1.3 ones are not configurable, and crypto/tls
+	// decides the order itself since Go 1.17, only honoring the list.
+	CipherSuites []uint16
+	// CurvePreferences the elliptic curves offered, in the order preferred
+	CurvePreferences []tls.CurveID
+	// NextProtos the protocols offered by ALPN, in the order preferred
+	NextProtos []string
+	// MinVersion and MaxVersion bounds of the TLS versions offered
+	MinVersion uint16
+	MaxVersion uint16
+}
+
+// apply layers the profile on top of config, a copy of which is returned
+func (p *TLSProfile) apply(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if len(p.CipherSuites) > 0 {
+		config.CipherSuites = append([]uint16(nil), p.CipherSuites...)
+	}
+	if len(p.CurvePreferences) > 0 {
+		config.CurvePreferences = append([]tls.CurveID(nil), p.CurvePreferences...)
+	}
+	if len(p.NextProtos) > 0 {
+		config.NextProtos = append([]string(nil), p.NextProtos...)
+	}
+	if p.MinVersion != 0 {
+		config.MinVersion = p.MinVersion
+	}
+	if p.MaxVersion != 0 {
+		config.MaxVersion = p.MaxVersion
+	}
+	return config
+}
+
+// TLSProfileRecorder optional interface of Request recording the name of
+// the TLSProfile the connection to the host is made with, given to
+// SetTLSProfile before the request is written
+type TLSProfileRecorder interface {
+	SetTLSProfile(name string)
+}
+
+// tlsProfiles the TLS profiles of the hosts made by TLSProfileForHost, and
+// the configs they're applied to, which are made once for each host
+type tlsProfiles struct {
+	hosts sync.Map
+}
+
+// profiledTLSConfig the profile of a host with its config applied, both
+// nil if the host has no profile
+type profiledTLSConfig struct {
+	profile *TLSProfile
+	config  *tls.Config
+}
+
+// get the profile of host made by forHost and base applied with it
+func (p *tlsProfiles) get(forHost func(host string) *TLSProfile,
+	host string, base *tls.Config) *profiledTLSConfig {
+	if v, ok := p.hosts.Load(host); ok {
+		return v.(*profiledTLSConfig)
+	}
+	pc := &profiledTLSConfig{}
+	if pc.profile = forHost(host); pc.profile != nil {
+		pc.config = pc.profile.apply(base)
+	}
+	v, _ := p.hosts.LoadOrStore(host, pc)
+	return v.(*profiledTLSConfig)
+}
+
+// tlsProfileHost the host the TLS profile is chosen by, i.e. the server
+// name if set, otherwise the host of targetWithPort
+func tlsProfileHost(targetWithPort, serverName string) string {
+	if len(serverName) > 0 {
+		return serverName
+	}
+	if host, _, err := net.SplitHostPort(targetWithPort); err == nil {
+		return host
+	}
+	return targetWithPort
+}
+
+// withTLSProfile base layered with the TLS profile of the host, base if
+// the host has no profile
+func (c *HostClient) withTLSProfile(base *tls.Config, targetWithPort, serverName string) *tls.Config {
+	if c.TLSProfileForHost == nil {
+		return base
+	}
+	pc := c.tlsProfiles.get(c.TLSProfileForHost, tlsProfileHost(targetWithPort, serverName), base)
+	if pc.config == nil {
+		return base
+	}
+	return pc.config
+}
+
+// tlsProfileName the name of the TLS profile of the host, empty if none
+func (c *HostClient) tlsProfileName(targetWithPort, serverName string) string {
+	if c.TLSProfileForHost == nil {
+		return ""
+	}
+	v, ok := c.tlsProfiles.hosts.Load(tlsProfileHost(targetWithPort, serverName))
+	if !ok || v.(*profiledTLSConfig).profile == nil {
+		return ""
+	}
+	return v.(*profiledTLSConfig).profile.Name
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// test a stalled client halts the reading of the tunnel's upstream
+func TestTunnelBackPressure(t *testing.T) {
+	const bufSize = 4096
+	upstream, origin := net.Pipe()
+	defer origin.Close()
+	client, tunnelClient := net.Pipe()
+	defer client.Close()
+
+	c := &HostClient{
+		Dial: func(addr string) (net.Conn, error) {
+			return upstream, nil
+		},
+		TunnelClientToServerBufSize: 512,
+		TunnelServerToClientBufSize: bufSize,
+	}
+	go c.DoRaw(tunnelClient, nil, "example.com:443", nil, nil)
+
+	// the origin keeps sending, net.Pipe returns only when the tunnel reads
+	var sent int64
+	go func() {
+		chunk := make([]byte, 1024)
+		for {
+			n, err := origin.Write(chunk)
+			atomic.AddInt64(&sent, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// the client reads a few buffers then stalls
+	const received = 3 * bufSize
+	if _, err := io.ReadFull(client, make([]byte, received)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	halted := atomic.LoadInt64(&sent)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&sent); n != halted {
+		t.Fatalf("upstream reads not halted, %d then %d bytes read", halted, n)
+	}
+	if halted > received+bufSize {
+		t.Fatalf("expected at most %d bytes read from upstream, got %d", received+bufSize, halted)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"errors"
 	"io"
-	"net"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+	"github.com/haxii/fastproxy/uri"
 )
 
 var (
@@ -29,98 +31,43 @@ func isHeadOrGet(method []byte) bool {
 }
 
 var (
-	startLineScheme  = []byte("http://")
-	startLineSP      = byte(' ')
-	startLinePathSep = byte('/')
-	startLineCRLF    = []byte("\r\n")
+	startLineSP   = byte(' ')
+	startLineCRLF = []byte("\r\n")
 )
 
-const defaultHTTPPort = "80"
-
-var errNilBufioWriter = errors.New("nil bufio writer")
+var (
+	errNilBufioWriter = errors.New("nil bufio writer")
+	errNoHostWithPort = errors.New("no host provided for absolute-form request line")
+)
 
+// writeRequestLine writes the request line, in absolute-form if fullURL is set,
+// which is required by HTTP proxies, otherwise in origin-form used by origins
 func writeRequestLine(bw *bufio.Writer, fullURL bool,
 	method []byte, hostWithPort string, path, protocol []byte) (int, error) {
-
-	writeSize := 0
-	write := func(b []byte) error {
-		var nw int
-		var err error
-		if bw == nil {
-			return errNilBufioWriter
-		}
-		if nw, err = bw.Write(b); err != nil {
-			return err
-		} else if nw != len(b) {
-			return io.ErrShortWrite
-		}
-		writeSize += nw
-		return nil
-	}
-	writeStr := func(s string) error {
-		var nw int
-		var err error
-		if nw, err = bw.WriteString(s); err != nil {
-			return err
-		} else if nw != len(s) {
-			return io.ErrShortWrite
-		}
-		writeSize += nw
-		return nil
-	}
-	if err := write(method); err != nil {
-		return writeSize, err
-	}
-	if err := bw.WriteByte(startLineSP); err != nil {
-		return writeSize, err
+	if bw == nil {
+		return 0, errNilBufioWriter
 	}
-	writeSize++
+	line := bytebufferpool.Get()
+	defer bytebufferpool.Put(line)
+	line.B = append(line.B, method...)
+	line.B = append(line.B, startLineSP)
 	if fullURL {
-		host, port, err := net.SplitHostPort(hostWithPort)
-		if err != nil {
-			return 0, err
-		}
-
-		if err := write(startLineScheme); err != nil {
-			return writeSize, err
-		}
-		if port != defaultHTTPPort {
-			if err := writeStr(hostWithPort); err != nil {
-				return writeSize, err
-			}
-		} else {
-			if err := writeStr(host); err != nil {
-				return writeSize, err
-			}
-		}
-	}
-	if len(path) == 0 {
-		if err := bw.WriteByte(startLinePathSep); err != nil {
-			return writeSize, err
+		if len(hostWithPort) == 0 {
+			return 0, errNoHostWithPort
 		}
+		line.B = uri.AppendAbsolute(line.B, hostWithPort, path)
 	} else {
-		if path[0] != startLinePathSep {
-			if err := bw.WriteByte(startLinePathSep); err != nil {
-				return writeSize, err
-			}
-		}
-		if err := write(path); err != nil {
-			return writeSize, err
-		}
-	}
-	if err := bw.WriteByte(startLineSP); err != nil {
-		return writeSize, err
-	}
-	writeSize++
-	if err := write(protocol); err != nil {
-		return writeSize, err
+		line.B = uri.AppendOrigin(line.B, path)
 	}
+	line.B = append(line.B, startLineSP)
+	line.B = append(line.B, protocol...)
+	line.B = append(line.B, startLineCRLF...)
 
-	if err := write(startLineCRLF); err != nil {
-		return writeSize, err
+	nw, err := bw.Write(line.B)
+	if err == nil && nw != len(line.B) {
+		err = io.ErrShortWrite
 	}
-
-	return writeSize, nil
+	return nw, err
 }
 
 // defaultDevNullWriter
@@ -2,16 +2,25 @@ package http
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"sync"
 
 	"github.com/haxii/fastproxy/bytebufferpool"
 	"github.com/haxii/fastproxy/util"
 )
 
 // Body http body
-type Body struct{}
+type Body struct {
+	// CopyBufSize size of the pooled buffer the large bodies are read into
+	// once the bytes buffered by the reader are consumed, which saves the
+	// reads of the large uploads. The bodies are read through the buffer of
+	// the reader if it's not larger.
+	CopyBufSize int
+}
 
 // BodyType how http body is formed
 type BodyType int
@@ -28,29 +37,114 @@ const (
 // BodyWrapper body reader helper
 type BodyWrapper func(isChunkHeader bool, data []byte) (int, error)
 
-// Parse parse body from reader and wraps data in BodyWrapper
+// TrailerFilter filters the trailer fields of the chunked body,
+// returns if the raw field line is kept
+type TrailerFilter func(field []byte) bool
+
+// Parse parse body from reader and wraps data in BodyWrapper,
+// the trailer fields of the chunked body are wrapped as is
 func (b *Body) Parse(reader *bufio.Reader, bodyType BodyType,
 	contentLength int64, w BodyWrapper) (int, error) {
+	return b.ParseWithTrailer(reader, bodyType, contentLength, w, nil)
+}
+
+// ParseWithTrailer parse body like Parse, the trailer fields of the chunked
+// body not kept by the optional filter are dropped
+func (b *Body) ParseWithTrailer(reader *bufio.Reader, bodyType BodyType,
+	contentLength int64, w BodyWrapper, filter TrailerFilter) (int, error) {
+	var buf *copyBuffer
+	if b.CopyBufSize > reader.Size() {
+		buf = &copyBuffer{size: b.CopyBufSize}
+		defer buf.release()
+	}
 	switch bodyType {
 	case BodyTypeFixedSize:
 		if contentLength > 0 {
-			return parseBodyFixedSize(reader, w, contentLength)
+			return parseBodyFixedSize(reader, w, contentLength, buf)
 		}
 	case BodyTypeChunked:
-		return parseBodyChunked(reader, w)
+		return parseBodyChunked(reader, w, filter, buf)
 	case BodyTypeIdentity:
-		return parseBodyIdentity(reader, w)
+		return parseBodyIdentity(reader, w, buf)
 	}
 	return 0, nil
 }
 
-func parseBodyFixedSize(src *bufio.Reader, w BodyWrapper, contentLength int64) (int, error) {
+// copyBufferPool pool of the buffers of copyBuffer
+var copyBufferPool sync.Pool
+
+// copyBuffer pooled buffer of size acquired once used
+type copyBuffer struct {
+	size int
+	b    *[]byte
+}
+
+func (c *copyBuffer) bytes() []byte {
+	if c.b == nil {
+		if v := copyBufferPool.Get(); v != nil {
+			c.b = v.(*[]byte)
+		} else {
+			c.b = new([]byte)
+		}
+		if cap(*c.b) < c.size {
+			*c.b = make([]byte, c.size)
+		}
+	}
+	return (*c.b)[:c.size]
+}
+
+func (c *copyBuffer) release() {
+	if c.b != nil {
+		copyBufferPool.Put(c.b)
+		c.b = nil
+	}
+}
+
+// readLarge reads up to n bytes from src into the optional buf skipping the
+// buffer of src, ok is false if buf is not used, i.e. nil, there are bytes
+// buffered in src or the bytes wanted fit into its buffer
+func readLarge(src *bufio.Reader, buf *copyBuffer, n int64) (b []byte, ok bool, err error) {
+	if buf == nil || src.Buffered() > 0 || n <= int64(src.Size()) {
+		return nil, false, nil
+	}
+	b = buf.bytes()
+	if n < int64(len(b)) {
+		b = b[:n]
+	}
+	// the empty reader reads the large buffer from its source directly
+	nr, err := src.Read(b)
+	return b[:nr], true, err
+}
+
+func parseBodyFixedSize(src *bufio.Reader, w BodyWrapper, contentLength int64, buf *copyBuffer) (int, error) {
 	byteStillNeeded := contentLength
 	var wn int
 	for {
-		// read one more bytes
-		if b, _ := src.Peek(1); len(b) == 0 {
-			return wn, io.EOF
+		// read the large bodies past the buffer of src
+		if b, ok, err := readLarge(src, buf, byteStillNeeded); ok {
+			if len(b) == 0 {
+				if err != nil {
+					return wn, err
+				}
+				continue
+			}
+			n, e := w(false, b)
+			wn += n
+			if e != nil {
+				return wn, e
+			}
+			if byteStillNeeded -= int64(len(b)); byteStillNeeded == 0 || err != nil {
+				return wn, err
+			}
+			continue
+		}
+
+		// read one more bytes, the read error is kept, e.g. timeouts
+		if b, err := src.Peek(1); len(b) == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return wn, err
 		}
 
 		// must read buffed bytes
@@ -82,7 +176,7 @@ func parseBodyFixedSize(src *bufio.Reader, w BodyWrapper, contentLength int64) (
 	}
 }
 
-func parseBodyChunked(src *bufio.Reader, w BodyWrapper) (int, error) {
+func parseBodyChunked(src *bufio.Reader, w BodyWrapper, filter TrailerFilter, buf *copyBuffer) (int, error) {
 	buffer := bytebufferpool.Get()
 	defer bytebufferpool.Put(buffer)
 	var wn, n int
@@ -97,23 +191,52 @@ func parseBodyChunked(src *bufio.Reader, w BodyWrapper) (int, error) {
 			return wn, err
 		}
 		wn += n
+		if chunkSize == 0 {
+			n, err = parseTrailer(src, w, filter)
+			return wn + n, err
+		}
 		// copy the chunk
 		if n, err = parseBodyFixedSize(src, w,
 			// 2 means the length of `\r\n` i.e. CRLF
-			int64(chunkSize+2)); err != nil {
+			int64(chunkSize+2), buf); err != nil {
 			return wn, err
 		}
 		wn += n
-		if chunkSize == 0 {
+	}
+}
+
+var errTrailerTooLarge = errors.New("trailer field too large")
+
+// parseTrailer parses the trailer fields ending the chunked body, i.e. the
+// lines till an empty one, which are wrapped if kept by the optional filter
+func parseTrailer(src *bufio.Reader, w BodyWrapper, filter TrailerFilter) (int, error) {
+	var wn int
+	for {
+		line, err := src.ReadSlice('\n')
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				err = errTrailerTooLarge
+			}
+			return wn, util.ErrWrapper(err, "fail to read trailer")
+		}
+		last := len(bytes.TrimRight(line, "\r\n")) == 0
+		if last || filter == nil || filter(line) {
+			n, err := w(false, line)
+			wn += n
+			if err != nil {
+				return wn, err
+			}
+		}
+		if last {
 			return wn, nil
 		}
 	}
 }
 
-func parseBodyIdentity(src *bufio.Reader, w BodyWrapper) (int, error) {
+func parseBodyIdentity(src *bufio.Reader, w BodyWrapper, buf *copyBuffer) (int, error) {
 	var n int
 	var err error
-	if n, err = parseBodyFixedSize(src, w, math.MaxInt64); err != nil {
+	if n, err = parseBodyFixedSize(src, w, math.MaxInt64, buf); err != nil {
 		// TODO: make sure the io.EOF is reachable
 		if err == io.EOF {
 			return n, nil
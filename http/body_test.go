@@ -2,7 +2,9 @@ package http
 
 import (
 	"bufio"
+	"bytes"
 	"io"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -24,6 +26,87 @@ func TestParseBodyField(t *testing.T) {
 	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "5\r\n", io.EOF.Error(), w)
 }
 
+func TestParseBodyTrailer(t *testing.T) {
+	raw := "5\r\nasdfg\r\n0\r\nX-Sum: 1\r\nX-Other: 2\r\n\r\nnext"
+	for _, c := range []struct {
+		filter   TrailerFilter
+		expected string
+	}{
+		{nil, "5\r\nasdfg\r\n0\r\nX-Sum: 1\r\nX-Other: 2\r\n\r\n"},
+		{func(field []byte) bool { return strings.HasPrefix(string(field), "X-Sum:") },
+			"5\r\nasdfg\r\n0\r\nX-Sum: 1\r\n\r\n"},
+	} {
+		var body Body
+		var parsed []byte
+		br := bufio.NewReader(strings.NewReader(raw))
+		_, err := body.ParseWithTrailer(br, BodyTypeChunked, 0, func(isChunkHeader bool, data []byte) (int, error) {
+			parsed = append(parsed, data...)
+			return len(data), nil
+		}, c.filter)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(parsed) != c.expected {
+			t.Fatalf("expected %q, got %q", c.expected, parsed)
+		}
+		if rest, _ := br.ReadString(0); rest != "next" {
+			t.Fatalf("unexpected rest %q", rest)
+		}
+	}
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "0\r\nX-Sum: 1\r\n", io.EOF.Error(),
+		func(bool, []byte) (int, error) { return 0, nil })
+}
+
+// countingReader counts the reads of r
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	c.reads++
+	return c.r.Read(b)
+}
+
+func TestParseBodyCopyBufSize(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	chunked := strconv.FormatInt(int64(len(payload)), 16) + "\r\n" + string(payload) + "\r\n0\r\n\r\n"
+	for _, c := range []struct {
+		bodyType BodyType
+		raw      string
+		expected string
+	}{
+		{BodyTypeFixedSize, string(payload) + "next", string(payload)},
+		{BodyTypeChunked, chunked + "next", chunked},
+		{BodyTypeIdentity, string(payload), string(payload)},
+	} {
+		var reads [2]int
+		for i, size := range []int{0, 64 * 1024} {
+			body := Body{CopyBufSize: size}
+			src := &countingReader{r: strings.NewReader(c.raw)}
+			br := bufio.NewReaderSize(src, 4096)
+			var parsed []byte
+			_, err := body.Parse(br, c.bodyType, int64(len(payload)), func(isChunkHeader bool, data []byte) (int, error) {
+				parsed = append(parsed, data...)
+				return len(data), nil
+			})
+			if err != nil {
+				t.Fatalf("body type %d: unexpected error: %s", c.bodyType, err)
+			}
+			if string(parsed) != c.expected {
+				t.Fatalf("body type %d: unexpected body of %d bytes", c.bodyType, len(parsed))
+			}
+			if rest, _ := br.ReadString(0); c.bodyType != BodyTypeIdentity && rest != "next" {
+				t.Fatalf("body type %d: unexpected rest %q", c.bodyType, rest)
+			}
+			reads[i] = src.reads
+		}
+		if reads[1]*8 > reads[0] {
+			t.Fatalf("body type %d: unexpected reads %v", c.bodyType, reads)
+		}
+	}
+}
+
 func testParseBodyFieldByBodyType(t *testing.T, bt BodyType, s string) {
 	body := &Body{}
 	br := bufio.NewReader(strings.NewReader(s))
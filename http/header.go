@@ -15,16 +15,28 @@ import (
 type Header struct {
 	isConnectionClose      bool
 	isProxyConnectionClose bool
+	hasContentLength       bool
 	contentLength          int64
 	contentType            string
+	host                   []byte
+	hostCount              int
+	hostConflicting        bool
+
+	// raw the raw header fields parsed, ends with an empty line
+	raw []byte
 }
 
 // Reset reset header info into default val
 func (header *Header) Reset() {
 	header.isConnectionClose = false
 	header.isProxyConnectionClose = false
+	header.hasContentLength = false
 	header.contentLength = 0
 	header.contentType = ""
+	header.host = nil
+	header.hostCount = 0
+	header.hostConflicting = false
+	header.raw = nil
 }
 
 // IsConnectionClose is connection header set to `close`
@@ -37,6 +49,29 @@ func (header *Header) IsProxyConnectionClose() bool {
 	return header.isProxyConnectionClose
 }
 
+// Host the Host header value, empty if not set,
+// the first one wins if there are several
+func (header *Header) Host() []byte {
+	return header.host
+}
+
+// HostCount number of the Host header fields
+func (header *Header) HostCount() int {
+	return header.hostCount
+}
+
+// HasConflictingHosts if there are several Host header fields
+// with different values, which makes the request ambiguous
+func (header *Header) HasConflictingHosts() bool {
+	return header.hostConflicting
+}
+
+// HasContentLength if the Content-Length header is set, 0 included,
+// it's ignored if the body is chunked
+func (header *Header) HasContentLength() bool {
+	return header.hasContentLength
+}
+
 // ContentType content type in header
 func (header *Header) ContentType() string {
 	return header.contentType
@@ -62,6 +97,131 @@ func (header *Header) BodyType() BodyType {
 	return BodyTypeFixedSize
 }
 
+// Raw the raw header fields parsed or mutated, ends with an empty line
+func (header *Header) Raw() []byte {
+	return header.raw
+}
+
+// VisitAll calls f for each header field in order, key and value are
+// trimmed and only valid inside f, do NOT mutate the header inside f
+func (header *Header) VisitAll(f func(key, value []byte)) {
+	visitHeaderLines(header.raw, func(line []byte) {
+		if key, value, ok := splitHeaderLine(line); ok {
+			f(key, value)
+		}
+	})
+}
+
+// Peek returns the value of the first header field of key, nil if not found
+func (header *Header) Peek(key string) []byte {
+	var v []byte
+	found := false
+	keyBytes := []byte(key)
+	header.VisitAll(func(k, value []byte) {
+		if !found && equalIgnoreCase(k, keyBytes) {
+			v = value
+			found = true
+		}
+	})
+	return v
+}
+
+// Set sets the header field key to value, replacing all the existing fields of key
+func (header *Header) Set(key, value string) error {
+	return header.rewrite(key, value, true, true)
+}
+
+// Add adds a header field key with value, the existing fields are kept
+func (header *Header) Add(key, value string) error {
+	return header.rewrite(key, value, false, true)
+}
+
+// Del deletes all the header fields of key
+func (header *Header) Del(key string) error {
+	return header.rewrite(key, "", true, false)
+}
+
+var errMalformedHeader = errors.New("malformed header fields")
+
+// rewrite generates the raw header into a newly allocated buffer, the header
+// fields of key are deleted if del, and key with value is added if add,
+// at the position of the first deleted field if any otherwise at the end.
+// The header is left untouched if the rewritten one is malformed.
+func (header *Header) rewrite(key, value string, del, add bool) error {
+	if len(key) == 0 || strings.ContainsAny(key, ":\r\n") || strings.ContainsAny(value, "\r\n") {
+		return errMalformedHeader
+	}
+	field := key + ": " + value + "\r\n"
+	keyBytes := []byte(key)
+	raw := make([]byte, 0, len(header.raw)+len(field)+2)
+	visitHeaderLines(header.raw, func(line []byte) {
+		if isEmptyHeaderLine(line) {
+			if add {
+				raw = append(raw, field...)
+				add = false
+			}
+		} else if del {
+			if k, _, ok := splitHeaderLine(line); ok && equalIgnoreCase(k, keyBytes) {
+				if add {
+					raw = append(raw, field...)
+					add = false
+				}
+				return
+			}
+		}
+		raw = append(raw, line...)
+	})
+	if add {
+		raw = append(raw, field...)
+	}
+	if len(raw) == 0 || !isEmptyHeaderLine(lastHeaderLine(raw)) {
+		raw = append(raw, "\r\n"...)
+	}
+	var rewritten Header
+	n, err := rewritten.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if n != len(raw) {
+		return errMalformedHeader
+	}
+	*header = rewritten
+	return nil
+}
+
+// visitHeaderLines calls f for each line in raw, line breaks included
+func visitHeaderLines(raw []byte, f func(line []byte)) {
+	for len(raw) > 0 {
+		n := bytes.IndexByte(raw, '\n') + 1
+		if n == 0 {
+			n = len(raw)
+		}
+		f(raw[:n])
+		raw = raw[n:]
+	}
+}
+
+// lastHeaderLine the last line of raw
+func lastHeaderLine(raw []byte) []byte {
+	if i := bytes.LastIndexByte(raw[:len(raw)-1], '\n'); i >= 0 {
+		return raw[i+1:]
+	}
+	return raw
+}
+
+func isEmptyHeaderLine(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0 && bytes.IndexByte(line, '\n') >= 0
+}
+
+// splitHeaderLine splits line into trimmed key and value
+func splitHeaderLine(line []byte) (key, value []byte, ok bool) {
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 {
+		return nil, nil, false
+	}
+	return bytes.TrimSpace(line[:i]), bytes.TrimSpace(line[i+1:]), true
+}
+
 /*
 // IsBodyChunked if body is set `chunked`
 func (header *Header) IsBodyChunked() bool {
@@ -157,18 +317,27 @@ func (header *Header) Parse(buf []byte) (headerLength int, err error) {
 			// content-length header can only be set with transfer encoding unset
 			lengthBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
 			if lengthBytesIndex > 0 {
+				header.hasContentLength = true
 				lengthBytes := rawHeaderLine[lengthBytesIndex+1:]
 				length, _ := strconv.ParseInt(strings.TrimSpace(string(lengthBytes)), 10, 64)
 				if length > 0 {
 					header.contentLength = length
 				}
 			}
-		} else if isTransferEncodingHeader(rawHeaderLine) {
+		} else if IsTransferEncodingHeader(rawHeaderLine) {
 			if bytes.Contains(rawHeaderLine, []byte("chunked")) {
 				header.contentLength = -1
 			} else if bytes.Contains(rawHeaderLine, []byte("identity")) {
 				header.contentLength = -2
 			}
+		} else if IsHostHeader(rawHeaderLine) {
+			host := bytes.TrimSpace(rawHeaderLine[len(hostHeader):])
+			if header.hostCount == 0 {
+				header.host = host
+			} else if !bytes.EqualFold(header.host, host) {
+				header.hostConflicting = true
+			}
+			header.hostCount++
 		} else if isContentTypeHeader(rawHeaderLine) {
 			contentTypeBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
 			if contentTypeBytesIndex >= 0 {
@@ -187,6 +356,7 @@ func (header *Header) Parse(buf []byte) (headerLength int, err error) {
 	}
 	if (n == 1 && buf[0] == '\r') || n == 0 {
 		// empty headers, write \n or \r\n
+		header.raw = buf[:n+1]
 		return n + 1, nil
 	}
 	n++
@@ -209,6 +379,7 @@ func (header *Header) Parse(buf []byte) (headerLength int, err error) {
 		}
 		n += m
 		if (m == 2 && b[0] == '\r') || m == 1 {
+			header.raw = buf[:n]
 			return n, nil
 		}
 	}
@@ -225,12 +396,46 @@ func isProxyConnectionHeader(header []byte) bool {
 	return hasPrefixIgnoreCase(header, proxyConnectionHeader)
 }
 
+var keepAliveHeader = []byte("Keep-Alive")
+
+// IsPerHopHeader is the given header the Connection or Keep-Alive one,
+// which applies to a single connection, i.e. hop
+func IsPerHopHeader(header []byte) bool {
+	return isConnectionHeader(header) || hasPrefixIgnoreCase(header, keepAliveHeader)
+}
+
+var hostHeader = []byte("Host:")
+
+// IsHostHeader is the given header a Host header
+func IsHostHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, hostHeader)
+}
+
 var contentLengthHeader = []byte("Content-Length")
 
 func isContentLengthHeader(header []byte) bool {
 	return hasPrefixIgnoreCase(header, contentLengthHeader)
 }
 
+// IsContentLengthHeader is the given header a Content-Length header
+func IsContentLengthHeader(header []byte) bool {
+	return isContentLengthHeader(header)
+}
+
+var acceptEncodingHeader = []byte("Accept-Encoding:")
+
+// IsAcceptEncodingHeader is the given header an Accept-Encoding header
+func IsAcceptEncodingHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, acceptEncodingHeader)
+}
+
+var contentEncodingHeader = []byte("Content-Encoding")
+
+// IsContentEncodingHeader is the given header a Content-Encoding header
+func IsContentEncodingHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, contentEncodingHeader)
+}
+
 var contentTypeHeader = []byte("Content-Type")
 
 func isContentTypeHeader(header []byte) bool {
@@ -239,7 +444,8 @@ func isContentTypeHeader(header []byte) bool {
 
 var transferEncoding = []byte("Transfer-Encoding")
 
-func isTransferEncodingHeader(header []byte) bool {
+// IsTransferEncodingHeader is the given header a Transfer-Encoding header
+func IsTransferEncodingHeader(header []byte) bool {
 	return hasPrefixIgnoreCase(header, transferEncoding)
 }
 
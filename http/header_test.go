@@ -91,3 +91,95 @@ func testParseHeaderFields(t *testing.T, bufioBufferSize int, sampleHeader strin
 			header.contentType, expectingContentType)
 	}
 }
+
+func TestHeaderVisitAndMutate(t *testing.T) {
+	raw := "Host: www.google.com\r\nX-A: 1\r\nUser-Agent: curl/7.54.0\r\nx-a: 2\r\n\r\n"
+	header := &Header{}
+	if _, err := header.Parse([]byte(raw)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var visited []string
+	header.VisitAll(func(key, value []byte) {
+		visited = append(visited, string(key)+"="+string(value))
+	})
+	if strings.Join(visited, ",") != "Host=www.google.com,X-A=1,User-Agent=curl/7.54.0,x-a=2" {
+		t.Fatalf("unexpected visited header %s", visited)
+	}
+	if v := header.Peek("x-A"); string(v) != "1" {
+		t.Fatalf("unexpected header value %s", v)
+	}
+
+	header.Set("x-a", "3")
+	testHeaderRaw(t, header, "Host: www.google.com\r\nx-a: 3\r\nUser-Agent: curl/7.54.0\r\n\r\n")
+	header.Add("Content-Length", "10")
+	testHeaderRaw(t, header, "Host: www.google.com\r\nx-a: 3\r\nUser-Agent: curl/7.54.0\r\nContent-Length: 10\r\n\r\n")
+	if header.ContentLength() != 10 {
+		t.Fatalf("expected content length parsed after mutation, got %d", header.ContentLength())
+	}
+	header.Del("host")
+	testHeaderRaw(t, header, "x-a: 3\r\nUser-Agent: curl/7.54.0\r\nContent-Length: 10\r\n\r\n")
+	if len(header.Host()) != 0 {
+		t.Fatalf("expected host deleted, got %s", header.Host())
+	}
+
+	empty := &Header{}
+	empty.Set("Host", "www.google.com")
+	testHeaderRaw(t, empty, "Host: www.google.com\r\n\r\n")
+
+	// the malformed fields are rejected, the header left untouched
+	for _, field := range [][2]string{{"X-B", "1\r\n\r\nX-C: 2"}, {"X-B", "1\r\nX-C: 2"}, {"X-B: 1", ""}, {"", "1"}} {
+		if err := header.Set(field[0], field[1]); err == nil {
+			t.Fatalf("expected error setting %q", field)
+		}
+		testHeaderRaw(t, header, "x-a: 3\r\nUser-Agent: curl/7.54.0\r\nContent-Length: 10\r\n\r\n")
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { header.Peek("User-Agent") }); allocs > 0 {
+		t.Fatalf("unexpected %v allocations peeking the header", allocs)
+	}
+}
+
+func TestHeaderDuplicateHosts(t *testing.T) {
+	for _, c := range []struct {
+		raw         string
+		host        string
+		count       int
+		conflicting bool
+	}{
+		{"User-Agent: curl/7.54.0\r\n\r\n", "", 0, false},
+		{"Host: a.com\r\n\r\n", "a.com", 1, false},
+		{"Host: a.com\r\nhost:  A.com \r\n\r\n", "a.com", 2, false},
+		{"Host: a.com\r\nX-A: 1\r\nHost: b.com\r\n\r\n", "a.com", 2, true},
+		{"Host: a.com\r\nHost:\r\n\r\n", "a.com", 2, true},
+	} {
+		header := &Header{}
+		if _, err := header.Parse([]byte(c.raw)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(header.Host()) != c.host || header.HostCount() != c.count ||
+			header.HasConflictingHosts() != c.conflicting {
+			t.Fatalf("unexpected hosts of %q: %q %d %v", c.raw,
+				header.Host(), header.HostCount(), header.HasConflictingHosts())
+		}
+	}
+
+	// the duplicates are collapsed by setting the host
+	header := &Header{}
+	header.Parse([]byte("Host: a.com\r\nX-A: 1\r\nHost: b.com\r\n\r\n"))
+	header.Set("Host", "a.com")
+	testHeaderRaw(t, header, "Host: a.com\r\nX-A: 1\r\n\r\n")
+	if header.HostCount() != 1 || header.HasConflictingHosts() {
+		t.Fatalf("unexpected hosts %d %v", header.HostCount(), header.HasConflictingHosts())
+	}
+
+	raw := []byte("Host: a.com\r\nX-A: 1\r\n\r\n")
+	if allocs := testing.AllocsPerRun(100, func() { header.Parse(raw) }); allocs > 0 {
+		t.Fatalf("unexpected %v allocations parsing the host", allocs)
+	}
+}
+
+func testHeaderRaw(t *testing.T, header *Header, expRaw string) {
+	if string(header.Raw()) != expRaw {
+		t.Fatalf("expected raw header %q, got %q", expRaw, header.Raw())
+	}
+}
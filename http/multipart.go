@@ -0,0 +1,310 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"strings"
+)
+
+const (
+	// DefaultMultipartPreviewSize bytes of the body of each part previewed
+	// if MultipartScanner.PreviewSize is not set
+	DefaultMultipartPreviewSize = 512
+	// DefaultMultipartMaxHeaderSize size limit of the header of each part
+	// if MultipartScanner.MaxHeaderSize is not set
+	DefaultMultipartMaxHeaderSize = 8 * 1024
+
+	// multipartMaxPadding longest transport padding after a boundary,
+	// i.e. the whitespaces before its line break
+	multipartMaxPadding = 128
+)
+
+// ErrMultipartHeaderTooLarge the header of a part is larger than
+// MultipartScanner.MaxHeaderSize, the rest of the body is not scanned
+var ErrMultipartHeaderTooLarge = errors.New("multipart part header too large")
+
+// MultipartBoundary the boundary of the multipart/form-data body of
+// contentType, nil if it's of another type or without boundary
+func MultipartBoundary(contentType string) []byte {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" || len(params["boundary"]) == 0 {
+		return nil
+	}
+	return []byte(params["boundary"])
+}
+
+// MultipartPart a part of the multipart body scanned, which is reused by the
+// scanner, so it's only valid in the callbacks
+type MultipartPart struct {
+	// Header the header fields of the part
+	Header Header
+	// Name the form field name of the Content-Disposition
+	Name string
+	// FileName the file name of the Content-Disposition, the RFC 2231 one
+	// preferred, with the `%22`, `%0D` and `%0A` escaped by the browsers
+	// unescaped, empty if not a file
+	FileName string
+	// ContentType the Content-Type of the part
+	ContentType string
+
+	// Preview the first bytes of the body up to PreviewSize, Size of the body
+	// and Unterminated if it's ended by Close instead of a boundary, they're
+	// set once the body ends
+	Preview      []byte
+	Size         int64
+	Unterminated bool
+}
+
+// parseHeader parses the raw header fields of the part
+func (p *MultipartPart) parseHeader(raw []byte) {
+	p.Header.Parse(raw)
+	p.ContentType = p.Header.ContentType()
+	_, params, err := mime.ParseMediaType(string(p.Header.Peek("Content-Disposition")))
+	if err != nil {
+		return
+	}
+	p.Name = params["name"]
+	// the filename* is decoded into filename by ParseMediaType
+	p.FileName = params["filename"]
+	if !strings.Contains(string(p.Header.Peek("Content-Disposition")), "filename*") {
+		p.FileName = browserFileNameReplacer.Replace(p.FileName)
+	}
+}
+
+// browserFileNameReplacer unescapes the file names escaped by the browsers,
+// see the multipart/form-data encoding algorithm of the HTML standard
+var browserFileNameReplacer = strings.NewReplacer("%22", `"`, "%0D", "\r", "%0A", "\n")
+
+// multipartState what the scanner is reading
+type multipartState int
+
+const (
+	multipartPreamble multipartState = iota
+	multipartHeader
+	multipartBody
+	multipartEpilogue
+)
+
+// MultipartScanner scans the multipart body written into it incrementally
+// with bounded memory, i.e. the header and the preview of each part, so the
+// large uploads are inspected without buffering them. The preamble and the
+// epilogue are skipped, the close boundary may miss its line break or be
+// missing at all, ending the last part by Close.
+type MultipartScanner struct {
+	// PreviewSize bytes of the body of each part previewed,
+	// DefaultMultipartPreviewSize is used if not set
+	PreviewSize int
+	// MaxHeaderSize size limit of the header of each part,
+	// DefaultMultipartMaxHeaderSize is used if not set
+	MaxHeaderSize int
+
+	// OnPartHeader called with each part once its header is parsed
+	OnPartHeader func(part *MultipartPart)
+	// OnPartEnd called with each part once its body ends
+	OnPartEnd func(part *MultipartPart)
+
+	// delimiter the line break and the dashes before the boundary
+	delimiter []byte
+	state     multipartState
+	part      MultipartPart
+	header    []byte
+	// held bytes kept for the next write, which may start a delimiter,
+	// and scratch the held bytes joined with the ones written
+	held    []byte
+	scratch []byte
+	err     error
+}
+
+// NewMultipartScanner makes the scanner of the multipart body of boundary,
+// see MultipartBoundary
+func NewMultipartScanner(boundary []byte) *MultipartScanner {
+	s := &MultipartScanner{delimiter: append([]byte("\r\n--"), boundary...)}
+	// the first boundary is found without the line break before
+	s.held = append(s.held, '\r', '\n')
+	return s
+}
+
+// Err the error ending the scan, nil if none
+func (s *MultipartScanner) Err() error {
+	return s.err
+}
+
+// Write scans b, returns ErrMultipartHeaderTooLarge if the header of the
+// part scanned is too large
+func (s *MultipartScanner) Write(b []byte) (int, error) {
+	if s.state == multipartEpilogue {
+		return len(b), s.err
+	}
+	s.scratch = append(append(s.scratch[:0], s.held...), b...)
+	s.held = s.held[:0]
+	s.scan(s.scratch, false)
+	return len(b), s.err
+}
+
+// Close ends the scan, the part not ended by the close boundary yet is
+// ended as Unterminated
+func (s *MultipartScanner) Close() error {
+	if s.state != multipartEpilogue {
+		held := append(s.scratch[:0], s.held...)
+		s.held = s.held[:0]
+		s.scan(held, true)
+	}
+	if s.state == multipartBody {
+		s.endPart(true)
+	}
+	s.state = multipartEpilogue
+	return s.err
+}
+
+// scan scans b, keeping the bytes which may start a delimiter in held
+// unless atEOF
+func (s *MultipartScanner) scan(b []byte, atEOF bool) {
+	for len(b) > 0 {
+		switch s.state {
+		case multipartPreamble, multipartBody:
+			i := bytes.Index(b, s.delimiter)
+			if i < 0 {
+				keep := len(s.delimiter) - 1
+				if atEOF {
+					keep = 0
+				} else if keep > len(b) {
+					keep = len(b)
+				}
+				s.body(b[:len(b)-keep])
+				s.held = append(s.held, b[len(b)-keep:]...)
+				return
+			}
+			n, final := delimiterLineEnd(b[i+len(s.delimiter):], atEOF)
+			if n < 0 {
+				s.body(b[:i])
+				s.held = append(s.held, b[i:]...)
+				return
+			}
+			if n == 0 && !final {
+				// the boundary is followed by other bytes, not a delimiter
+				s.body(b[:i+1])
+				b = b[i+1:]
+				continue
+			}
+			s.body(b[:i])
+			if s.state == multipartBody {
+				s.endPart(false)
+			}
+			b = b[i+len(s.delimiter)+n:]
+			if final {
+				s.state = multipartEpilogue
+				return
+			}
+			s.state = multipartHeader
+			// the line break of the delimiter line starts the header
+			s.header = append(s.header[:0], '\n')
+		case multipartHeader:
+			maxHeaderSize := s.MaxHeaderSize
+			if maxHeaderSize <= 0 {
+				maxHeaderSize = DefaultMultipartMaxHeaderSize
+			}
+			// the header is kept with its line breaks, up to the limit
+			read := len(s.header)
+			take := b
+			if limit := maxHeaderSize + 3 - read; len(take) > limit {
+				take = take[:limit]
+			}
+			s.header = append(s.header, take...)
+			end, sep := headerEnd(s.header)
+			if end > maxHeaderSize || (end < 0 && len(s.header) == maxHeaderSize+3) {
+				s.err = ErrMultipartHeaderTooLarge
+				s.state = multipartEpilogue
+				return
+			}
+			if end < 0 {
+				return
+			}
+			b = b[end+sep-read:]
+			s.startPart(append(s.header[1:end+1], '\r', '\n'))
+		default:
+			return
+		}
+	}
+}
+
+// delimiterLineEnd the length of the delimiter line rest b, i.e. the
+// transport padding and the line break, or the dashes of the close
+// delimiter as final. It's -1 if more bytes are needed, which end the close
+// delimiter atEOF instead, and 0 without final if b doesn't follow a
+// delimiter.
+func delimiterLineEnd(b []byte, atEOF bool) (n int, final bool) {
+	if len(b) >= 2 && b[0] == '-' && b[1] == '-' {
+		return 2, true
+	}
+	i := 0
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t') {
+		i++
+	}
+	switch {
+	case i == len(b) || (i == 0 && b[0] == '-' && len(b) == 1) || (b[i] == '\r' && i+1 == len(b)):
+		if atEOF {
+			return len(b), true
+		}
+		if i > multipartMaxPadding {
+			return 0, false
+		}
+		return -1, false
+	case b[i] == '\r' && b[i+1] == '\n':
+		return i + 2, false
+	case b[i] == '\n':
+		return i + 1, false
+	}
+	return 0, false
+}
+
+// headerEnd the index of the line break ending the last header line in
+// header, which starts with a line break, and the length of the line
+// breaks ending the header, -1 if not ended yet
+func headerEnd(header []byte) (end, sep int) {
+	crlf := bytes.Index(header, []byte("\n\r\n"))
+	lf := bytes.Index(header, []byte("\n\n"))
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return crlf, 3
+	case lf >= 0:
+		return lf, 2
+	}
+	return -1, 0
+}
+
+// startPart starts the part of the raw header fields
+func (s *MultipartScanner) startPart(raw []byte) {
+	s.part = MultipartPart{Preview: s.part.Preview[:0]}
+	s.part.parseHeader(raw)
+	s.state = multipartBody
+	if s.OnPartHeader != nil {
+		s.OnPartHeader(&s.part)
+	}
+}
+
+// body scans b of the body of the part, which is skipped in the preamble
+func (s *MultipartScanner) body(b []byte) {
+	if s.state != multipartBody || len(b) == 0 {
+		return
+	}
+	previewSize := s.PreviewSize
+	if previewSize <= 0 {
+		previewSize = DefaultMultipartPreviewSize
+	}
+	if room := previewSize - len(s.part.Preview); room > 0 {
+		if room > len(b) {
+			room = len(b)
+		}
+		s.part.Preview = append(s.part.Preview, b[:room]...)
+	}
+	s.part.Size += int64(len(b))
+}
+
+// endPart ends the body of the part
+func (s *MultipartScanner) endPart(unterminated bool) {
+	s.part.Unterminated = unterminated
+	if s.OnPartEnd != nil {
+		s.OnPartEnd(&s.part)
+	}
+}
@@ -0,0 +1,184 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// the multipart bodies as sent by the browsers, a text field and a file
+const (
+	chromeBoundary  = "----WebKitFormBoundaryePkpFF7tjBAqx29L"
+	chromeMultipart = "------WebKitFormBoundaryePkpFF7tjBAqx29L\r\n" +
+		"Content-Disposition: form-data; name=\"comment\"\r\n\r\n" +
+		"see attached\r\n" +
+		"------WebKitFormBoundaryePkpFF7tjBAqx29L\r\n" +
+		"Content-Disposition: form-data; name=\"upload\"; filename=\"r\u00e9sum\u00e9 %22final%22.pdf\"\r\n" +
+		"Content-Type: application/pdf\r\n\r\n" +
+		"%PDF-1.4\r\n%\xe2\xe3\xcf\xd3\r\n1 0 obj\r\n" +
+		"------WebKitFormBoundaryePkpFF7tjBAqx29L--\r\n"
+	firefoxBoundary  = "---------------------------9051914041544843365972754266"
+	firefoxMultipart = "-----------------------------9051914041544843365972754266\r\n" +
+		"Content-Disposition: form-data; name=\"file1\"; filename=\"\xe6\x8a\xa5\xe5\x91\x8a.txt\"\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"Content of a.txt.\r\n\r\n" +
+		"-----------------------------9051914041544843365972754266\r\n" +
+		"Content-Disposition: form-data; name=\"file2\"; filename=\"\"\r\n" +
+		"Content-Type: application/octet-stream\r\n\r\n" +
+		"\r\n" +
+		"-----------------------------9051914041544843365972754266--\r\n"
+)
+
+// scanMultipart scans body of boundary written in chunks of size,
+// returns the events of the parts
+func scanMultipart(boundary, body string, size, previewSize int) ([]string, error) {
+	var events []string
+	s := NewMultipartScanner([]byte(boundary))
+	s.PreviewSize = previewSize
+	s.OnPartHeader = func(part *MultipartPart) {
+		events = append(events, fmt.Sprintf("header %q %q %q", part.Name, part.FileName, part.ContentType))
+	}
+	s.OnPartEnd = func(part *MultipartPart) {
+		events = append(events, fmt.Sprintf("end %q %d %v", part.Preview, part.Size, part.Unterminated))
+	}
+	for len(body) > 0 {
+		n := size
+		if n > len(body) {
+			n = len(body)
+		}
+		if _, err := s.Write([]byte(body[:n])); err != nil {
+			return events, err
+		}
+		body = body[n:]
+	}
+	return events, s.Close()
+}
+
+func TestMultipartScanner(t *testing.T) {
+	for _, c := range []struct {
+		name, boundary, body string
+		expected             []string
+	}{
+		{"chrome", chromeBoundary, chromeMultipart, []string{
+			`header "comment" "" ""`,
+			`end "see att" 12 false`,
+			`header "upload" "résumé \"final\".pdf" "application/pdf"`,
+			`end "%PDF-1." 24 false`,
+		}},
+		{"firefox", firefoxBoundary, firefoxMultipart, []string{
+			`header "file1" "报告.txt" "text/plain"`,
+			`end "Content" 19 false`,
+			`header "file2" "" "application/octet-stream"`,
+			`end "" 0 false`,
+		}},
+		// the RFC 2231 file name preferred, the stray backslashes of the full
+		// paths sent by the legacy browsers kept
+		{"encoded file names", "b", "--b\r\n" +
+			"Content-Disposition: form-data; name=\"f\"; filename=\"a.txt\"; filename*=UTF-8''%E2%82%AC%22.txt\r\n\r\n" +
+			"x\r\n--b\r\n" +
+			"Content-Disposition: form-data; name=\"g\"; filename=\"C:\\Users\\me\\a b.txt\"\r\n\r\n" +
+			"y\r\n--b--", []string{
+			`header "f" "€\".txt" ""`,
+			`end "x" 1 false`,
+			`header "g" "C:\\Users\\me\\a b.txt" ""`,
+			`end "y" 1 false`,
+		}},
+		// the preamble and the epilogue are skipped, the close boundary may
+		// miss its line break
+		{"preamble and epilogue", "b", "This is the preamble.\r\n--b \t\r\n" +
+			"Content-Disposition: form-data; name=\"a\"\r\n\r\n" +
+			"1\r\n--b--", []string{
+			`header "a" "" ""`,
+			`end "1" 1 false`,
+		}},
+		{"epilogue", "b", "--b\r\n\r\n1\r\n--b--\r\nepilogue\r\n--b\r\n\r\n2\r\n--b--", []string{
+			`header "" "" ""`,
+			`end "1" 1 false`,
+		}},
+		// the boundary followed by other bytes is body, bare line feeds
+		// are tolerated
+		{"boundary prefix", "b", "--b\nName: x\n\n--bc\r\n--b-\r\n--b--", []string{
+			`header "" "" ""`,
+			`end "--bc\r\n-" 10 false`,
+		}},
+		// the close boundary missing
+		{"unterminated", "b", "--b\r\n\r\ntruncated\r\n--", []string{
+			`header "" "" ""`,
+			`end "truncat" 13 true`,
+		}},
+		{"unterminated delimiter", "b", "--b\r\n\r\n1\r\n--b", []string{
+			`header "" "" ""`,
+			`end "1" 1 false`,
+		}},
+		{"no parts", "b", "preamble only", nil},
+	} {
+		for _, size := range []int{1, 3, 7, 64, len(c.body)} {
+			events, err := scanMultipart(c.boundary, c.body, size, 7)
+			if err != nil || fmt.Sprint(events) != fmt.Sprint(c.expected) {
+				t.Fatalf("%s in chunks of %d: unexpected events %q, error: %v", c.name, size, events, err)
+			}
+		}
+	}
+}
+
+func TestMultipartScannerLimits(t *testing.T) {
+	// the large bodies are sized without being kept
+	body := "--b\r\n\r\n" + strings.Repeat("0123456789", 100000) + "\r\n--b--\r\n"
+	s := NewMultipartScanner([]byte("b"))
+	var size int64
+	var preview string
+	s.OnPartEnd = func(part *MultipartPart) { size, preview = part.Size, string(part.Preview) }
+	for i := 0; i < len(body); i += 4096 {
+		end := i + 4096
+		if end > len(body) {
+			end = len(body)
+		}
+		s.Write([]byte(body[i:end]))
+	}
+	if err := s.Close(); err != nil || size != 1000000 || len(preview) != DefaultMultipartPreviewSize {
+		t.Fatalf("unexpected part of %d bytes previewed %d, error: %v", size, len(preview), err)
+	}
+	if cap(s.scratch) > 8192 || cap(s.header) > 8192 {
+		t.Fatalf("unexpected buffers of %d and %d bytes", cap(s.scratch), cap(s.header))
+	}
+
+	// the header too large ends the scan
+	body = "--b\r\nX-Long: " + strings.Repeat("a", 100) + "\r\n\r\nbody\r\n--b--"
+	for _, size := range []int{1, 64, len(body)} {
+		s := NewMultipartScanner([]byte("b"))
+		s.MaxHeaderSize = 64
+		parts := 0
+		s.OnPartHeader = func(*MultipartPart) { parts++ }
+		var err error
+		for i := 0; i < len(body) && err == nil; i += size {
+			end := i + size
+			if end > len(body) {
+				end = len(body)
+			}
+			_, err = s.Write([]byte(body[i:end]))
+		}
+		if parts != 0 || err != ErrMultipartHeaderTooLarge || s.Close() != ErrMultipartHeaderTooLarge ||
+			cap(s.header) > 128 {
+			t.Fatalf("unexpected %d parts in chunks of %d, error: %v", parts, size, err)
+		}
+	}
+	// which fits in the limit otherwise
+	if events, err := scanMultipart("b", body, 1, 0); err != nil || len(events) != 2 {
+		t.Fatalf("unexpected events %q, error: %v", events, err)
+	}
+}
+
+func TestMultipartBoundary(t *testing.T) {
+	for contentType, expected := range map[string]string{
+		"multipart/form-data; boundary=" + chromeBoundary:      chromeBoundary,
+		`Multipart/Form-Data; charset=utf-8; boundary="a b:c"`: "a b:c",
+		"multipart/form-data":                                  "",
+		"multipart/mixed; boundary=b":                          "",
+		"application/x-www-form-urlencoded":                    "",
+		"":                                                     "",
+	} {
+		if boundary := MultipartBoundary(contentType); string(boundary) != expected {
+			t.Fatalf("unexpected boundary %q of %q", boundary, contentType)
+		}
+	}
+}
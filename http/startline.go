@@ -107,59 +107,111 @@ type RequestLine struct {
 	protocol []byte
 }
 
-// ParseRequestLine parse request line in stand-alone mode
-func ParseRequestLine(reader *bufio.Reader) (*RequestLine, error) {
-	reqLine := &RequestLine{}
-
-	if err := reqLine.Parse(reader); err != nil {
-		return nil, err
-	}
-	return reqLine, nil
-}
+var (
+	errReqLineNoMethod    = errors.New("no method provided")
+	errReqLineNoURI       = errors.New("no request uri provided")
+	errReqLineBadProtocol = errors.New("malformed protocol version")
+)
 
-// Parse parse request line
+// ParseRequestLine parses the request line, with or without the ending CRLF,
+// into its method, request-target and protocol version, the method is
+// upper-cased in place. Use uri.ParseRequestTarget to parse the target.
 //
 // A request-line begins with a method token, followed by a single space
 // (SP), the request-target, another single space (SP), the protocol
 // version, and ends with CRLF.
-func (l *RequestLine) Parse(reader *bufio.Reader) error {
-	reqLineWithCRLF, err := parseStartLine(reader)
-	if err != nil {
-		return err
-	}
-
-	var reqLine []byte
-	if reqLineWithCRLF[len(reqLineWithCRLF)-2] == '\r' {
-		reqLine = reqLineWithCRLF[:len(reqLineWithCRLF)-2] // CRLF included
-	} else {
-		reqLine = reqLineWithCRLF[:len(reqLineWithCRLF)-1] // only LF included
-	}
+func ParseRequestLine(line []byte) (method, target []byte, protoMajor, protoMinor int, err error) {
+	line = trimCRLF(line)
 
 	// method token
-	methodEndIndex := bytes.IndexByte(reqLine, ' ')
+	methodEndIndex := bytes.IndexByte(line, ' ')
 	if methodEndIndex <= 0 {
-		return errors.New("no method provided")
+		return nil, nil, 0, 0, errReqLineNoMethod
 	}
-	method := reqLine[:methodEndIndex]
+	method = line[:methodEndIndex]
 	changeToUpperCase(method)
 
 	// request target
-	reqURIStartIndex := methodEndIndex + 1
-	reqURIEndIndex := reqURIStartIndex + bytes.IndexByte(reqLine[reqURIStartIndex:], ' ')
-	if reqURIEndIndex <= reqURIStartIndex {
-		return errors.New("no request uri provided")
+	targetStartIndex := methodEndIndex + 1
+	targetEndIndex := targetStartIndex + bytes.IndexByte(line[targetStartIndex:], ' ')
+	if targetEndIndex <= targetStartIndex {
+		return nil, nil, 0, 0, errReqLineNoURI
 	}
-	reqURI := reqLine[reqURIStartIndex:reqURIEndIndex]
-	isConnect := IsMethodConnect(method)
-	l.uri.Parse(isConnect, reqURI)
+	target = line[targetStartIndex:targetEndIndex]
 
 	// protocol
-	protocolStartIndex := reqURIEndIndex + 1
-	protocol := reqLine[protocolStartIndex:]
+	if protoMajor, protoMinor, err = parseProtocol(line[targetEndIndex+1:]); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	return method, target, protoMajor, protoMinor, nil
+}
+
+// trimCRLF trims the ending CRLF or LF of line
+func trimCRLF(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+		if n > 1 && line[n-2] == '\r' {
+			line = line[:n-2]
+		}
+	}
+	return line
+}
+
+// parseProtocol parses the protocol version `HTTP/major.minor`
+func parseProtocol(protocol []byte) (major, minor int, err error) {
+	if !bytes.HasPrefix(protocol, protocolPrefix) {
+		return 0, 0, errReqLineBadProtocol
+	}
+	version := protocol[len(protocolPrefix):]
+	dot := bytes.IndexByte(version, '.')
+	if dot < 0 {
+		return 0, 0, errReqLineBadProtocol
+	}
+	if major, err = parseVersionNumber(version[:dot]); err != nil {
+		return 0, 0, err
+	}
+	if minor, err = parseVersionNumber(version[dot+1:]); err != nil {
+		return 0, 0, err
+	}
+	return major, minor, nil
+}
+
+var protocolPrefix = []byte("HTTP/")
+
+func parseVersionNumber(b []byte) (int, error) {
+	if len(b) == 0 || len(b) > 3 {
+		return 0, errReqLineBadProtocol
+	}
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, errReqLineBadProtocol
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, nil
+}
+
+// Parse parse request line with ParseRequestLine, the request target is
+// parsed with uri.ParseRequestTarget
+func (l *RequestLine) Parse(reader *bufio.Reader) error {
+	reqLineWithCRLF, err := parseStartLine(reader)
+	if err != nil {
+		return err
+	}
+
+	reqLine := trimCRLF(reqLineWithCRLF)
+	method, target, _, _, err := ParseRequestLine(reqLine)
+	if err != nil {
+		return err
+	}
+	if err = uri.ParseRequestTarget(method, target, &l.uri); err != nil {
+		return err
+	}
 
 	l.fullLine = reqLineWithCRLF
 	l.method = method
-	l.protocol = protocol
+	l.protocol = reqLine[len(method)+len(target)+2:]
 
 	return nil
 }
@@ -192,6 +244,11 @@ func (l *RequestLine) Protocol() []byte {
 	return l.protocol
 }
 
+// URI the parsed request uri from request line
+func (l *RequestLine) URI() *uri.URI {
+	return &l.uri
+}
+
 // HostInfo the host info from request line
 func (l *RequestLine) HostInfo() *uri.HostInfo {
 	return l.uri.HostInfo()
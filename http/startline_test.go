@@ -7,6 +7,8 @@ import (
 	"io"
 	"strings"
 	"testing"
+
+	"github.com/haxii/fastproxy/uri"
 )
 
 func TestRespLine(t *testing.T) {
@@ -46,3 +48,60 @@ func testRespLineParse(t *testing.T, line string, expErr error, expProtocol stri
 		t.Fatalf("unexpected status msg %s, expecting %s,", resp.GetStatusMessage(), expMsg)
 	}
 }
+
+var requestLineTests = []struct {
+	line         string
+	method       string
+	major, minor int
+	hostWithPort string
+	path         string
+	fail         bool
+}{
+	{line: "GET http://www.example.com/a?b=1 HTTP/1.1\r\n", method: "GET", major: 1, minor: 1,
+		hostWithPort: "www.example.com:80", path: "/a?b=1"},
+	{line: "get http://www.example.com:8080 HTTP/1.0\n", method: "GET", major: 1, minor: 0,
+		hostWithPort: "www.example.com:8080", path: "/"},
+	{line: "POST /a#b HTTP/1.1\r\n", method: "POST", major: 1, minor: 1, path: "/a#b"},
+	{line: "CONNECT www.example.com:8443 HTTP/1.1\r\n", method: "CONNECT", major: 1, minor: 1,
+		hostWithPort: "www.example.com:8443"},
+	{line: "CONNECT www.example.com HTTP/1.1\r\n", method: "CONNECT", major: 1, minor: 1,
+		hostWithPort: "www.example.com:443"},
+	{line: "OPTIONS * HTTP/1.1\r\n", method: "OPTIONS", major: 1, minor: 1, path: "*"},
+	{line: "GET * HTTP/1.1\r\n", fail: true},
+	{line: "CONNECT / HTTP/1.1\r\n", fail: true},
+	{line: "GET  HTTP/1.1\r\n", fail: true},
+	{line: "GET /\r\n", fail: true},
+	{line: " / HTTP/1.1\r\n", fail: true},
+	{line: "GET / HTTP1.1\r\n", fail: true},
+	{line: "GET / HTTP/1.x\r\n", fail: true},
+}
+
+func TestParseRequestLine(t *testing.T) {
+	for _, test := range requestLineTests {
+		// the exported parsers
+		var u uri.URI
+		method, target, major, minor, err := ParseRequestLine([]byte(test.line))
+		if err == nil {
+			err = uri.ParseRequestTarget(method, target, &u)
+		}
+		if test.fail != (err != nil) {
+			t.Fatalf("unexpected error of %q: %v", test.line, err)
+		}
+		if err == nil && (string(method) != test.method || major != test.major || minor != test.minor ||
+			u.HostInfo().HostWithPort() != test.hostWithPort || string(u.PathWithQueryFragment()) != test.path) {
+			t.Fatalf("unexpected result of %q: %s %s %d.%d", test.line, method, target, major, minor)
+		}
+
+		// the request line parsed by the proxy
+		var l RequestLine
+		err = l.Parse(bufio.NewReader(strings.NewReader(test.line)))
+		if test.fail != (err != nil) {
+			t.Fatalf("unexpected error of %q: %v", test.line, err)
+		}
+		if err == nil && (string(l.Method()) != test.method || l.HostInfo().HostWithPort() != test.hostWithPort ||
+			string(l.PathWithQueryFragment()) != test.path || string(l.GetRequestLine()) != test.method+test.line[len(test.method):]) {
+			t.Fatalf("unexpected request line of %q: %s %s %s", test.line, l.Method(),
+				l.HostInfo().HostWithPort(), l.PathWithQueryFragment())
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package mitm
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -15,7 +16,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/haxii/fastproxy/transport"
 	"github.com/haxii/fastproxy/util"
+	"github.com/haxii/fastproxy/util/singleflight"
 )
 
 var (
@@ -25,17 +28,39 @@ var (
 // HijackTLSConnection hijacks the given TLS connection by setting up a fake TLS server using MITM
 // then return the fake server connection and the targetServerName ( a.k.a. server name declared in TLS
 // handshake if the clients support SNI see http://tools.ietf.org/html/rfc4366#section-3.1 )
-// onHandshake is called before the fake server handshaking is made with the connection
+// onHandshake is called before the fake server handshaking is made with the connection,
+// the handshake must be completed within transport.DefaultTLSHandshakeTimeout
 func HijackTLSConnection(certAuthority *tls.Certificate, c net.Conn, domainName string,
 	onHandshake func(error) error) (serverConn *tls.Conn, targetServerName string, err error) {
+	return HijackTLSConnectionWithTimeout(certAuthority, c, domainName, 0, onHandshake)
+}
+
+// HijackTLSConnectionWithTimeout same as HijackTLSConnection with the handshake completed
+// within handshakeTimeout, transport.DefaultTLSHandshakeTimeout is used if not set
+func HijackTLSConnectionWithTimeout(certAuthority *tls.Certificate, c net.Conn, domainName string,
+	handshakeTimeout time.Duration, onHandshake func(error) error) (serverConn *tls.Conn, targetServerName string, err error) {
 	targetServerName = domainName
 	if len(domainName) == 0 || strings.Contains(domainName, ":") {
 		err = onHandshake(errWrongDomain)
 		return
 	}
+	// the cert signed for the concurrent tunnels is waited for as long as
+	// the handshake may take
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = transport.DefaultTLSHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	sign := func(name string) (*tls.Certificate, error) {
+		cert, err := signLeafCert(ctx, certAuthority, name)
+		if err == context.DeadlineExceeded {
+			err = transport.ErrTLSHandshakeTimeout
+		}
+		return cert, err
+	}
 	// make a cert for the provided domain
 	var fakeTargetServerCert *tls.Certificate
-	fakeTargetServerCert, err = SignLeafCertUsingCertAuthority(certAuthority, domainName)
+	fakeTargetServerCert, err = sign(domainName)
 	if err != nil {
 		err = onHandshake(err)
 		return
@@ -46,7 +71,7 @@ func HijackTLSConnection(certAuthority *tls.Certificate, c net.Conn, domainName
 			if len(hello.ServerName) > 0 {
 				targetServerName = hello.ServerName
 			}
-			return SignLeafCertUsingCertAuthority(certAuthority, targetServerName)
+			return sign(targetServerName)
 		},
 	}
 	// perform the fake handshake with the connection given
@@ -56,7 +81,7 @@ func HijackTLSConnection(certAuthority *tls.Certificate, c net.Conn, domainName
 			return
 		}
 	}
-	if err = serverConn.Handshake(); err != nil {
+	if err = transport.TLSHandshake(serverConn, handshakeTimeout); err != nil {
 		serverConn.Close()
 		serverConn = nil
 	}
@@ -193,9 +218,26 @@ const (
 		x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement
 )
 
+// certFlights the leaf certificates being signed by their domain names
+var certFlights singleflight.Group
+
 // SignLeafCertUsingCertAuthority signs a leaf certificate for domainNames using provided
-// certificate authority default MITM certificate is used when no cert authority provided
+// certificate authority default MITM certificate is used when no cert authority provided,
+// the concurrent callers of the same domain name wait for the one signing it
 func SignLeafCertUsingCertAuthority(certAuthority *tls.Certificate,
+	domainName string) (*tls.Certificate, error) {
+	return signLeafCert(context.Background(), certAuthority, domainName)
+}
+
+// CertStats the leaf certificates signed and the callers waiting for them
+// being signed by the others
+func CertStats() singleflight.Stats {
+	return certFlights.Stats()
+}
+
+// signLeafCert signs the leaf certificate of domainName unless cached, once
+// for the concurrent callers, the ones waiting give up once ctx is done
+func signLeafCert(ctx context.Context, certAuthority *tls.Certificate,
 	domainName string) (*tls.Certificate, error) {
 	if len(domainName) == 0 {
 		return nil, errors.New("invalid domain name")
@@ -203,7 +245,21 @@ func SignLeafCertUsingCertAuthority(certAuthority *tls.Certificate,
 	if cachedCert, exists := mitmCertPool.Load(domainName); exists {
 		return cachedCert.(*tls.Certificate), nil
 	}
+	cert, _, err := certFlights.Do(ctx, domainName, func() (interface{}, error) {
+		// signed by the call finished just before
+		if cachedCert, exists := mitmCertPool.Load(domainName); exists {
+			return cachedCert, nil
+		}
+		return newLeafCert(certAuthority, domainName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert.(*tls.Certificate), nil
+}
 
+// newLeafCert signs a new leaf certificate of domainName and caches it
+func newLeafCert(certAuthority *tls.Certificate, domainName string) (*tls.Certificate, error) {
 	if certAuthority == nil {
 		certAuthority = defaultMITMCertAuthority
 	}
@@ -242,3 +298,21 @@ func SignLeafCertUsingCertAuthority(certAuthority *tls.Certificate,
 	cachedCert, _ := mitmCertPool.LoadOrStore(domainName, cert)
 	return cachedCert.(*tls.Certificate), nil
 }
+
+// LeafCerts the leaf certificates signed and cached by
+// SignLeafCertUsingCertAuthority by their domain names
+func LeafCerts() map[string]*tls.Certificate {
+	certs := make(map[string]*tls.Certificate)
+	mitmCertPool.Range(func(k, v interface{}) bool {
+		certs[k.(string)] = v.(*tls.Certificate)
+		return true
+	})
+	return certs
+}
+
+// StoreLeafCert caches the leaf certificate of domainName signed before,
+// e.g. kept across restarts, which is returned by
+// SignLeafCertUsingCertAuthority instead of signing a new one
+func StoreLeafCert(domainName string, cert *tls.Certificate) {
+	mitmCertPool.Store(domainName, cert)
+}
@@ -14,6 +14,9 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
 )
 
 var (
@@ -267,3 +270,17 @@ WZoEro0kBysFz36m27Pa32CMlWZhkD8gdi7gC2bJA8fM1dTU9GUJiQ==
 -----END RSA PRIVATE KEY-----
 `)
 )
+
+func TestHijackTLSConnectionHandshakeTimeout(t *testing.T) {
+	// the client never sends its hello
+	client, server := net.Pipe()
+	defer client.Close()
+	start := time.Now()
+	fakeConn, _, err := HijackTLSConnectionWithTimeout(nil, server, "localhost", 50*time.Millisecond, nil)
+	if err != transport.ErrTLSHandshakeTimeout || fakeConn != nil {
+		t.Fatalf("expected error %s, got %v", transport.ErrTLSHandshakeTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("handshake timeout took too long: %s", elapsed)
+	}
+}
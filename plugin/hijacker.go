@@ -195,6 +195,12 @@ func (h *Hijacker) SSLBump() bool {
 	return h.connInfo.SSLBump()
 }
 
+// SetSSLBump takes the decision shared by the SSLBump of another hijacker,
+// see proxy.SSLBumpSharer
+func (h *Hijacker) SetSSLBump(sslBump bool) {
+	h.connInfo.sslBump = sslBump
+}
+
 func (h *Hijacker) RewriteTLSServerName(serverName string) string {
 	h.connInfo.tlsServerName = serverName
 	if h.handler != nil {
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+var identityEncoding = []byte("identity")
+
+// acceptEncoding the Accept-Encoding header value sent to the origin of req
+// instead of the client's, nil to leave it untouched. It's the one of
+// AcceptEncodingForHost, restricted to the encodings BodyTransform decodes
+// if the hijacker transforms the responses.
+func (p *Proxy) acceptEncoding(req *Request) []byte {
+	value := req.header.Peek("Accept-Encoding")
+	var rewritten []byte
+	if p.AcceptEncodingForHost != nil {
+		if rewritten = p.AcceptEncodingForHost(req.reqLine.HostInfo().Domain()); rewritten != nil {
+			value = rewritten
+		}
+	}
+	if _, ok := req.hijacker.(ResponseTransformHijacker); ok && value != nil {
+		if decodable := decodableEncodings(value); !bytes.Equal(decodable, value) {
+			return decodable
+		}
+	}
+	return rewritten
+}
+
+// decodableEncodings the codings of the Accept-Encoding value decodable by
+// BodyTransform with their weights, identity if none of them is
+func decodableEncodings(value []byte) []byte {
+	var kept [][]byte
+	for _, coding := range bytes.Split(value, []byte(",")) {
+		coding = bytes.TrimSpace(coding)
+		name := coding
+		if i := bytes.IndexByte(name, ';'); i >= 0 {
+			name = bytes.TrimSpace(name[:i])
+		}
+		switch strings.ToLower(string(name)) {
+		case "gzip", "x-gzip", "deflate", "identity":
+			kept = append(kept, coding)
+		}
+	}
+	if len(kept) == 0 {
+		return identityEncoding
+	}
+	return bytes.Join(kept, []byte(", "))
+}
+
+// acceptEncodingRewriter the header rewriter sending value as the
+// Accept-Encoding header, nil if value is
+func acceptEncodingRewriter(value []byte) (drop func([]byte) bool, extra []byte) {
+	if value == nil {
+		return nil, nil
+	}
+	extra = make([]byte, 0, len("Accept-Encoding: \r\n")+len(value))
+	extra = append(append(append(extra, "Accept-Encoding: "...), value...), "\r\n"...)
+	return http.IsAcceptEncodingHeader, extra
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// encodingHijacker resolves all the hosts to the local origin, recording
+// the Accept-Encoding seen by OnRequest
+type encodingHijacker struct {
+	tlsTestHijacker
+	seen string
+}
+
+func (h *encodingHijacker) Resolve() net.IP { return net.IPv4(127, 0, 0, 1) }
+func (h *encodingHijacker) OnRequest(path []byte, header http.Header, rawHeader []byte) io.WriteCloser {
+	h.seen = string(header.Peek("Accept-Encoding"))
+	return nil
+}
+
+// decodingHijacker encodingHijacker transforming the responses
+type decodingHijacker struct{ *encodingHijacker }
+
+func (h decodingHijacker) TransformResponse(http.ResponseLine, http.Header) *BodyTransform {
+	return nil
+}
+
+type encodingHijackerPool struct {
+	h         *encodingHijacker
+	transform bool
+}
+
+func (p encodingHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	if p.transform {
+		return decodingHijacker{p.h}
+	}
+	return p.h
+}
+func (p encodingHijackerPool) Put(Hijacker) {}
+
+func TestAcceptEncodingForHost(t *testing.T) {
+	var sent atomic.Value
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		sent.Store(r.Header.Get("Accept-Encoding"))
+	}))
+	defer origin.Close()
+	port := strconv.Itoa(origin.Listener.Addr().(*net.TCPAddr).Port)
+
+	h := &encodingHijacker{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = encodingHijackerPool{h: h}
+		p.AcceptEncodingForHost = func(host string) []byte {
+			if host == "rewritten.test" {
+				return []byte("gzip;q=1.0, identity")
+			}
+			return nil
+		}
+	})
+	expect := func(host, accepted, expected string) {
+		resp, _ := proxyTestRequest(t, p, "GET", "http://"+host+":"+port+"/", "Accept-Encoding: "+accepted+"\r\n", "")
+		if resp.StatusCode != 200 || sent.Load() != expected {
+			t.Fatalf("%s: unexpected Accept-Encoding %q sent for %q", host, sent.Load(), accepted)
+		}
+		if h.seen != accepted {
+			t.Fatalf("%s: unexpected Accept-Encoding %q seen by the hijacker", host, h.seen)
+		}
+	}
+
+	// rewritten for the matching hosts only
+	expect("rewritten.test", "br, gzip", "gzip;q=1.0, identity")
+	expect("other.test", "br, gzip", "br, gzip")
+
+	// restricted to the decodable ones for the responses transformed
+	p.HijackerPool = encodingHijackerPool{h: h, transform: true}
+	expect("other.test", "br, gzip;q=0.5, deflate", "gzip;q=0.5, deflate")
+	expect("other.test", "br", "identity")
+	expect("rewritten.test", "br", "gzip;q=1.0, identity")
+}
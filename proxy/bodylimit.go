@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"io"
+)
+
+// BodyLimitAction what to do with the rest of a response body crossing
+// ResponseBodyLimit, decided by OnBodySizeExceeded
+type BodyLimitAction int
+
+const (
+	// BodyLimitContinue relays the rest of the body, e.g. only logging it
+	BodyLimitContinue BodyLimitAction = iota
+	// BodyLimitTruncate relays the body up to the limit, then closes both
+	// the client and the upstream connections with ErrBodySizeExceeded
+	BodyLimitTruncate
+	// BodyLimitAbort closes both the client and the upstream connections
+	// with ErrBodySizeExceeded without relaying the data crossing the limit
+	BodyLimitAbort
+)
+
+// bodyLimiter writes the response body to w, calling exceeded once
+// the size of the body written is about to cross limit
+type bodyLimiter struct {
+	w        io.Writer
+	host     string
+	limit    int64
+	written  int64
+	exceeded func(hostWithPort string, size int64) BodyLimitAction
+	// fired if exceeded is called
+	fired bool
+}
+
+func (l *bodyLimiter) reset(host string, limit int64,
+	exceeded func(hostWithPort string, size int64) BodyLimitAction) {
+	*l = bodyLimiter{host: host, limit: limit, exceeded: exceeded}
+}
+
+func (l *bodyLimiter) Write(b []byte) (int, error) {
+	if !l.fired && l.written+int64(len(b)) > l.limit {
+		l.fired = true
+		switch l.exceeded(l.host, l.written+int64(len(b))) {
+		case BodyLimitTruncate:
+			n, err := l.w.Write(b[:l.limit-l.written])
+			l.written += int64(n)
+			if err == nil {
+				err = ErrBodySizeExceeded
+			}
+			return n, err
+		case BodyLimitAbort:
+			return 0, ErrBodySizeExceeded
+		}
+	}
+	n, err := l.w.Write(b)
+	l.written += int64(n)
+	return n, err
+}
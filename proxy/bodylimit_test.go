@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseBodyLimit(t *testing.T) {
+	chunk := strings.Repeat("a", 1000)
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		for i := 0; i < 10; i++ {
+			w.Write([]byte(chunk))
+			w.(nethttp.Flusher).Flush()
+		}
+	}))
+	defer origin.Close()
+
+	// get the raw body relayed until the connection is closed
+	get := func(action BodyLimitAction) (body []byte, sizes []int64, err error) {
+		p := newTestProxy(t, func(p *Proxy) {
+			p.ResponseBodyLimit = 2500
+			p.OnBodySizeExceeded = func(hostWithPort string, size int64) BodyLimitAction {
+				if hostWithPort != origin.Listener.Addr().String() {
+					t.Fatalf("unexpected host %s", hostWithPort)
+				}
+				sizes = append(sizes, size)
+				return action
+			}
+		})
+		client, server := net.Pipe()
+		defer client.Close()
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- p.serveConn(server)
+			server.Close()
+		}()
+		go client.Write([]byte("GET " + origin.URL + "/ HTTP/1.1\r\nConnection: close\r\n\r\n"))
+		resp, _ := ioutil.ReadAll(client)
+		i := bytes.Index(resp, []byte("\r\n\r\n"))
+		if i < 0 {
+			t.Fatalf("unexpected response %q", resp)
+		}
+		err = <-errChan
+		return resp[i+4:], sizes, err
+	}
+
+	body, sizes, err := get(BodyLimitContinue)
+	if err != nil || !bytes.HasSuffix(body, []byte("0\r\n\r\n")) || len(sizes) != 1 || sizes[0] <= 2500 {
+		t.Fatalf("unexpected continued body of %d bytes, sizes %v, error %v", len(body), sizes, err)
+	}
+	body, sizes, err = get(BodyLimitTruncate)
+	if !errors.Is(err, ErrBodySizeExceeded) || len(body) != 2500 || len(sizes) != 1 {
+		t.Fatalf("unexpected truncated body of %d bytes, sizes %v, error %v", len(body), sizes, err)
+	}
+	body, sizes, err = get(BodyLimitAbort)
+	if !errors.Is(err, ErrBodySizeExceeded) || len(body) >= 2500 || len(sizes) != 1 {
+		t.Fatalf("unexpected aborted body of %d bytes, sizes %v, error %v", len(body), sizes, err)
+	}
+}
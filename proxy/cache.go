@@ -0,0 +1,690 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+const (
+	// DefaultCacheMaxBytes max size of the responses kept by LRUCacheStore by default
+	DefaultCacheMaxBytes = 64 << 20
+	// DefaultCacheMaxObjectSize max size of a single response cached by default
+	DefaultCacheMaxObjectSize = 1 << 20
+)
+
+// CachedResponse a response stored in the cache
+type CachedResponse struct {
+	// Vary lower-cased names of the request header fields selecting the
+	// response variant, the variants are stored with keys of their own
+	// while the entry of the URL keeps Vary only
+	Vary []string
+
+	// Header raw status line and header fields ends with an empty line,
+	// hop-by-hop and Age fields excluded
+	Header []byte
+	// Body raw body as sent by the origin, transfer encoding kept
+	Body []byte
+
+	// ResponseTime time the response was generated by the origin,
+	// i.e. the time it's requested corrected by its Age
+	ResponseTime time.Time
+	// Expires time the response becomes stale and must be revalidated
+	Expires time.Time
+}
+
+// size approximate memory used by the response
+func (r *CachedResponse) size() int64 {
+	size := int64(len(r.Header) + len(r.Body))
+	for _, v := range r.Vary {
+		size += int64(len(v))
+	}
+	return size
+}
+
+// field value of the header field key, empty if not found
+func (r *CachedResponse) field(key string) string {
+	var header http.Header
+	if _, err := header.Parse(r.headerFields()); err != nil {
+		return ""
+	}
+	return string(header.Peek(key))
+}
+
+// headerFields header fields without the status line
+func (r *CachedResponse) headerFields() []byte {
+	if i := bytes.IndexByte(r.Header, '\n'); i >= 0 {
+		return r.Header[i+1:]
+	}
+	return nil
+}
+
+// CacheStore stores the cached responses by key, which must be safe for
+// concurrent use, the responses got must not be modified
+type CacheStore interface {
+	// Get the response of key, nil if not found
+	Get(key string) *CachedResponse
+	// Set the response of key, replacing the existing one
+	Set(key string, resp *CachedResponse)
+	// Delete the response of key
+	Delete(key string)
+}
+
+// LRUCacheStore in-memory CacheStore evicting the least recently used
+// responses when it's over MaxBytes
+type LRUCacheStore struct {
+	// MaxBytes max size of the responses kept
+	//
+	// DefaultCacheMaxBytes is used if not set.
+	MaxBytes int64
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+	size    int64
+}
+
+type lruCacheEntry struct {
+	key  string
+	resp *CachedResponse
+}
+
+// Get implements CacheStore
+func (s *LRUCacheStore) Get(key string) *CachedResponse {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(e)
+	return e.Value.(*lruCacheEntry).resp
+}
+
+// Set implements CacheStore
+func (s *LRUCacheStore) Set(key string, resp *CachedResponse) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]*list.Element)
+	}
+	s.remove(key)
+	s.entries[key] = s.lru.PushFront(&lruCacheEntry{key: key, resp: resp})
+	s.size += int64(len(key)) + resp.size()
+
+	maxBytes := s.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultCacheMaxBytes
+	}
+	for s.size > maxBytes {
+		s.remove(s.lru.Back().Value.(*lruCacheEntry).key)
+	}
+}
+
+// Delete implements CacheStore
+func (s *LRUCacheStore) Delete(key string) {
+	s.lock.Lock()
+	s.remove(key)
+	s.lock.Unlock()
+}
+
+// Len number of responses kept
+func (s *LRUCacheStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lru.Len()
+}
+
+// Size approximate memory used by the responses kept
+func (s *LRUCacheStore) Size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+// Flush removes all the responses
+func (s *LRUCacheStore) Flush() {
+	s.lock.Lock()
+	s.entries = nil
+	s.lru.Init()
+	s.size = 0
+	s.lock.Unlock()
+}
+
+func (s *LRUCacheStore) remove(key string) {
+	e, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	entry := s.lru.Remove(e).(*lruCacheEntry)
+	delete(s.entries, key)
+	s.size -= int64(len(key)) + entry.resp.size()
+}
+
+// Cache caches the responses of plain and decrypted GET requests.
+//
+// Responses are stored if they are explicitly fresh or have a validator,
+// and are not marked no-store or private, not setting cookies and not
+// varying on all the fields. Fresh responses are served from the cache,
+// answering conditional requests with 304, stale ones are revalidated
+// with the origin using If-None-Match and If-Modified-Since.
+// Requests with unsafe methods invalidate the responses of their URLs.
+//
+// Responses served from the cache or coalesced are not passed to the
+// hijacker's OnResponse.
+type Cache struct {
+	// Store stores the responses
+	//
+	// An LRUCacheStore of DefaultCacheMaxBytes is used if not set.
+	Store CacheStore
+	// MaxObjectSize max size of a single response cached, header included
+	//
+	// DefaultCacheMaxObjectSize is used if not set.
+	MaxObjectSize int
+	// Coalesce coalesces the identical GET requests missing the cache into
+	// the first one forwarded, whose response is streamed to all of them as
+	// it arrives if it's cacheable and no larger than MaxObjectSize. The
+	// requests waiting are forwarded on their own if it's not, and the ones
+	// with their own conditional header fields are never coalesced.
+	Coalesce bool
+
+	storeOnce   sync.Once
+	flightsLock sync.Mutex
+	flights     map[string]*cacheFlight
+
+	// now used by tests
+	now func() time.Time
+}
+
+func (c *Cache) store() CacheStore {
+	c.storeOnce.Do(func() {
+		if c.Store == nil {
+			c.Store = &LRUCacheStore{}
+		}
+	})
+	return c.Store
+}
+
+func (c *Cache) currentTime() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *Cache) maxObjectSize() int {
+	if c.MaxObjectSize > 0 {
+		return c.MaxObjectSize
+	}
+	return DefaultCacheMaxObjectSize
+}
+
+// Invalidate removes the response of rawURL, e.g. `http://example.com/a?b`,
+// from the cache
+func (c *Cache) Invalidate(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	isTLS := strings.EqualFold(u.Scheme, "https")
+	if !isTLS && !strings.EqualFold(u.Scheme, "http") {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	hostWithPort := u.Host
+	if len(u.Port()) == 0 {
+		port := "80"
+		if isTLS {
+			port = "443"
+		}
+		hostWithPort = u.Host + ":" + port
+	}
+	c.store().Delete(cacheKey(isTLS, strings.ToLower(hostWithPort), u.RequestURI()))
+	return nil
+}
+
+// cacheKey key of the responses of a URL
+func cacheKey(isTLS bool, hostWithPort, pathWithQuery string) string {
+	scheme := "http://"
+	if isTLS {
+		scheme = "https://"
+	}
+	return scheme + hostWithPort + pathWithQuery
+}
+
+// variantKey key of the response variant selected by header
+func variantKey(key string, vary []string, header *http.Header) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ":")
+		b.Write(header.Peek(name))
+	}
+	return b.String()
+}
+
+// cacheExchange cache state of a request forwarded to the origin
+type cacheExchange struct {
+	key string
+	// invalidate the responses of key if the unsafe request succeeds
+	invalidate bool
+	// stale the stale response revalidated, the request's conditional
+	// header fields are set by the cache if revalidating
+	stale        *CachedResponse
+	revalidating bool
+	// requestTime time the request is forwarded
+	requestTime time.Time
+	// writer records the response forwarded to the client
+	writer cacheWriter
+	// flight the response streamed to the requests coalesced, if leading one
+	flight       *cacheFlight
+	flightWriter flightWriter
+}
+
+// clientWriter the writer of the client c, which streams to the flight too if leading one
+func (ce *cacheExchange) clientWriter(c io.Writer) io.Writer {
+	if ce.flight == nil {
+		return c
+	}
+	ce.flightWriter.f, ce.flightWriter.w = ce.flight, c
+	return &ce.flightWriter
+}
+
+// begin serves req from the cache into w if possible, otherwise returns the
+// cache state of the request forwarded, nil if the request doesn't
+// involve the cache
+func (c *Cache) begin(w io.Writer, req *Request) (ce *cacheExchange, served bool, err error) {
+	hostInfo := req.reqLine.HostInfo()
+	key := cacheKey(req.isTLS, strings.ToLower(hostInfo.HostWithPort()),
+		string(req.reqLine.PathWithQueryFragment()))
+	method := req.Method()
+	if !bytes.Equal(method, methodGet) {
+		if isSafeMethod(method) {
+			return nil, false, nil
+		}
+		return &cacheExchange{key: key, invalidate: true}, false, nil
+	}
+
+	// the range requests bypass the cache, so the partial responses are
+	// never cached nor the full ones cached served to them
+	reqCacheControl := CacheControlOf(&req.header)
+	if reqCacheControl.NoStore() || len(req.header.Peek("Authorization")) > 0 ||
+		len(req.header.Peek("Range")) > 0 ||
+		req.header.BodyType() != http.BodyTypeFixedSize || req.header.ContentLength() > 0 {
+		return nil, false, nil
+	}
+	now := c.currentTime()
+	ce = &cacheExchange{key: key, requestTime: now}
+	ce.writer.max = c.maxObjectSize()
+
+	// look up the response variant
+	store := c.store()
+	cached := store.Get(key)
+	if cached != nil && len(cached.Vary) > 0 {
+		cached = store.Get(variantKey(key, cached.Vary, &req.header))
+	}
+	if cached == nil || len(cached.Header) == 0 {
+		return ce, false, nil
+	}
+
+	// serve the fresh response
+	noCache := reqCacheControl.Has("no-cache")
+	noCache = noCache || bytes.EqualFold(req.header.Peek("Pragma"), []byte("no-cache"))
+	if maxAge, ok := reqCacheControl["max-age"]; ok {
+		if seconds, err := strconv.Atoi(maxAge); err == nil &&
+			now.Sub(cached.ResponseTime) > time.Duration(seconds)*time.Second {
+			noCache = true
+		}
+	}
+	if !noCache && now.Before(cached.Expires) {
+		if err = req.discardRawHeader(); err != nil {
+			return nil, true, err
+		}
+		return nil, true, writeCachedResponse(w, cached, now, notModified(&req.header, cached))
+	}
+
+	// revalidate the stale one if possible, the client's own conditional
+	// request is forwarded as is
+	etag, lastModified := cached.field("ETag"), cached.field("Last-Modified")
+	if len(etag) == 0 && len(lastModified) == 0 {
+		return ce, false, nil
+	}
+	ce.stale = cached
+	if len(req.header.Peek("If-None-Match")) == 0 && len(req.header.Peek("If-Modified-Since")) == 0 {
+		if len(etag) > 0 {
+			if err = req.header.Set("If-None-Match", etag); err != nil {
+				return nil, false, err
+			}
+		}
+		if len(lastModified) > 0 {
+			if err = req.header.Set("If-Modified-Since", lastModified); err != nil {
+				return nil, false, err
+			}
+		}
+		req.rawHeader = req.header.Raw()
+		ce.revalidating = true
+		ce.writer.hold = true
+	}
+	return ce, false, nil
+}
+
+// finish stores or invalidates the response forwarded, the stale response
+// validated is served into w if the origin responds 304 to the
+// revalidation made by the cache
+func (c *Cache) finish(w io.Writer, req *Request, resp *Response, ce *cacheExchange) error {
+	store := c.store()
+	statusCode := resp.respLine.GetStatusCode()
+	if ce.invalidate {
+		if statusCode < 400 {
+			store.Delete(ce.key)
+		}
+		return nil
+	}
+
+	if statusCode == http.StatusNotModified && ce.stale != nil {
+		refreshed := c.refresh(ce.stale, resp, ce.requestTime)
+		c.set(ce.key, refreshed, &req.header)
+		if ce.revalidating {
+			return writeCachedResponse(w, refreshed, c.currentTime(), false)
+		}
+		return nil
+	}
+
+	cached := c.makeCachedResponse(resp, ce.writer.buf, ce.requestTime)
+	if cached == nil {
+		return nil
+	}
+	c.set(ce.key, cached, &req.header)
+	return nil
+}
+
+// set stores resp of the request with header, with the key of its variant if it varies
+func (c *Cache) set(key string, resp *CachedResponse, header *http.Header) {
+	store := c.store()
+	if len(resp.Vary) == 0 {
+		store.Set(key, resp)
+		return
+	}
+	store.Set(key, &CachedResponse{Vary: resp.Vary})
+	store.Set(variantKey(key, resp.Vary, header), resp)
+}
+
+// cacheableStatus status codes cacheable by default, RFC 7231 6.1
+var cacheableStatus = map[int]bool{200: true, 203: true, 204: true, 300: true,
+	301: true, 404: true, 405: true, 410: true, 414: true, 501: true}
+
+// makeCachedResponse makes the response recorded cacheable, nil if not storable
+func (c *Cache) makeCachedResponse(resp *Response, recorded []byte, requestTime time.Time) *CachedResponse {
+	header := &resp.header
+	headerSize := int(resp.headerWrittenSize)
+	if !cacheableStatus[resp.respLine.GetStatusCode()] || len(recorded) < headerSize || resp.transformed ||
+		resp.bodyType() == http.BodyTypeIdentity || len(header.Peek("Set-Cookie")) > 0 {
+		return nil
+	}
+	cacheControl := CacheControlOf(header)
+	if cacheControl.NoStore() || cacheControl.Has("private") {
+		return nil
+	}
+
+	var vary []string
+	for _, name := range bytes.Split(header.Peek("Vary"), []byte(",")) {
+		name = bytes.TrimSpace(name)
+		if bytes.Equal(name, []byte("*")) {
+			return nil
+		}
+		if len(name) > 0 {
+			vary = append(vary, strings.ToLower(string(name)))
+		}
+	}
+	sort.Strings(vary)
+
+	cached := &CachedResponse{
+		Vary:   vary,
+		Header: cachedHeader(resp.respLine.GetResponseLine(), header),
+		Body:   append([]byte(nil), recorded[headerSize:]...),
+	}
+	lifetime, explicit := freshnessLifetime(header, cacheControl)
+	if !explicit && len(header.Peek("ETag")) == 0 && len(header.Peek("Last-Modified")) == 0 {
+		return nil
+	}
+	cached.ResponseTime = requestTime.Add(-ageOf(header))
+	cached.Expires = cached.ResponseTime.Add(lifetime)
+	return cached
+}
+
+// refresh updates the stale response with the header fields of the 304 response
+func (c *Cache) refresh(stale *CachedResponse, resp *Response, requestTime time.Time) *CachedResponse {
+	var header http.Header
+	if _, err := header.Parse(append([]byte(nil), stale.headerFields()...)); err != nil {
+		return stale
+	}
+	for _, key := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified"} {
+		if v := resp.header.Peek(key); len(v) > 0 {
+			if err := header.Set(key, string(v)); err != nil {
+				return stale
+			}
+		}
+	}
+	statusLine := stale.Header[:len(stale.Header)-len(stale.headerFields())]
+	refreshed := *stale
+	refreshed.Header = append(append([]byte(nil), statusLine...), header.Raw()...)
+	lifetime, _ := freshnessLifetime(&header, CacheControlOf(&header))
+	refreshed.ResponseTime = requestTime.Add(-ageOf(&resp.header))
+	refreshed.Expires = refreshed.ResponseTime.Add(lifetime)
+	return &refreshed
+}
+
+// cachedHeader the status line and header fields stored, without the
+// hop-by-hop and Age fields
+func cachedHeader(statusLine []byte, header *http.Header) []byte {
+	raw := append([]byte(nil), statusLine...)
+	header.VisitAll(func(key, value []byte) {
+		if isHopByHopHeader(key) || bytes.EqualFold(key, []byte("Age")) {
+			return
+		}
+		raw = append(raw, key...)
+		raw = append(raw, ": "...)
+		raw = append(raw, value...)
+		raw = append(raw, "\r\n"...)
+	})
+	return append(raw, "\r\n"...)
+}
+
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection",
+	"Proxy-Authenticate", "Proxy-Authorization", "TE", "Trailer", "Upgrade"}
+
+func isHopByHopHeader(key []byte) bool {
+	for _, h := range hopByHopHeaders {
+		if bytes.EqualFold(key, []byte(h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// freshnessLifetime the freshness lifetime of the response header,
+// explicit is false if neither max-age nor Expires is set
+func freshnessLifetime(header *http.Header, cacheControl CacheControl) (lifetime time.Duration, explicit bool) {
+	if cacheControl.Has("no-cache") {
+		return 0, true
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cacheControl[directive]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds < 0 {
+				return 0, true
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if expires := header.Peek("Expires"); len(expires) > 0 {
+		expiresTime, err := parseHTTPDate(expires)
+		if err != nil {
+			return 0, true
+		}
+		date, err := parseHTTPDate(header.Peek("Date"))
+		if err != nil {
+			return 0, true
+		}
+		if lifetime = expiresTime.Sub(date); lifetime < 0 {
+			lifetime = 0
+		}
+		return lifetime, true
+	}
+	return 0, false
+}
+
+// ageOf the Age of the response header
+func ageOf(header *http.Header) time.Duration {
+	if seconds, err := strconv.Atoi(string(header.Peek("Age"))); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+// notModified if the conditional request with header is satisfied by
+// the cached response
+func notModified(header *http.Header, cached *CachedResponse) bool {
+	if ifNoneMatch := header.Peek("If-None-Match"); len(ifNoneMatch) > 0 {
+		etag := cached.field("ETag")
+		if len(etag) == 0 {
+			return false
+		}
+		for _, tag := range bytes.Split(ifNoneMatch, []byte(",")) {
+			tag = bytes.TrimSpace(tag)
+			if bytes.Equal(tag, []byte("*")) ||
+				strings.TrimPrefix(string(tag), "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ifModifiedSince := header.Peek("If-Modified-Since"); len(ifModifiedSince) > 0 {
+		since, err := parseHTTPDate(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		lastModified, err := parseHTTPDate([]byte(cached.field("Last-Modified")))
+		return err == nil && !lastModified.After(since)
+	}
+	return false
+}
+
+// notModifiedHeaders header fields sent with 304 responses, RFC 7232 4.1
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date",
+	"ETag", "Expires", "Last-Modified", "Vary"}
+
+// writeCachedResponse writes the cached response into w with its Age, a 304
+// response with the validators is written if notModified
+func writeCachedResponse(w io.Writer, cached *CachedResponse, now time.Time, notModified bool) error {
+	age := now.Sub(cached.ResponseTime) / time.Second
+	if age < 0 {
+		age = 0
+	}
+	ageField := "Age: " + strconv.FormatInt(int64(age), 10) + "\r\n\r\n"
+	if notModified {
+		var header http.Header
+		if _, err := header.Parse(cached.headerFields()); err != nil {
+			return err
+		}
+		raw := append([]byte(nil), http.StatusLine(http.StatusNotModified)...)
+		for _, key := range notModifiedHeaders {
+			if v := header.Peek(key); len(v) > 0 {
+				raw = append(raw, key+": "+string(v)+"\r\n"...)
+			}
+		}
+		_, err := w.Write(append(raw, ageField...))
+		return err
+	}
+	// replace the empty line ending the header with Age
+	header := bytes.TrimSuffix(bytes.TrimSuffix(cached.Header, []byte("\n")), []byte("\r"))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, ageField); err != nil {
+		return err
+	}
+	_, err := w.Write(cached.Body)
+	return err
+}
+
+func parseHTTPDate(date []byte) (time.Time, error) {
+	return time.Parse(time.RFC1123, string(date))
+}
+
+var methodGet = []byte("GET")
+
+// isSafeMethod if the method doesn't change the state of the origin
+func isSafeMethod(method []byte) bool {
+	for _, m := range []string{"GET", "HEAD", "OPTIONS", "TRACE"} {
+		if bytes.Equal(method, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheWriter forwards the response to the client and records it if it's
+// no larger than max, the response is held until its status line is
+// written if hold, and dropped if it's 304
+type cacheWriter struct {
+	w   io.Writer
+	max int
+	buf []byte
+
+	hold        bool
+	held        []byte
+	notModified bool
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if cw.buf != nil || cw.max > 0 {
+		if len(cw.buf)+len(b) > cw.max {
+			cw.buf, cw.max = nil, 0
+		} else {
+			cw.buf = append(cw.buf, b...)
+		}
+	}
+	if cw.notModified {
+		return len(b), nil
+	}
+	if !cw.hold {
+		return cw.w.Write(b)
+	}
+
+	// wait for the status line
+	cw.held = append(cw.held, b...)
+	i := bytes.IndexByte(cw.held, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	cw.hold = false
+	if statusCodeOf(cw.held[:i]) == http.StatusNotModified {
+		cw.notModified = true
+		return len(b), nil
+	}
+	held := cw.held
+	cw.held = nil
+	if _, err := cw.w.Write(held); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// statusCodeOf the status code of the status line, 0 if malformed
+func statusCodeOf(statusLine []byte) int {
+	fields := bytes.Fields(statusLine)
+	if len(fields) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(string(fields[1]))
+	return code
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/bufiopool"
+)
+
+// newTestProxy makes a proxy with a fresh buffer pool for the tests, applying
+// the opts on it in order
+func newTestProxy(t testing.TB, opts ...func(p *Proxy)) *Proxy {
+	t.Helper()
+	p := &Proxy{bufioPool: bufiopool.New(0, 0)}
+	p.client.BufioPool = p.bufioPool
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// proxyTestRequest makes a request through p, returns the response and its body
+// after the connection is served
+func proxyTestRequest(t *testing.T, p *Proxy, method, url, header, body string) (*nethttp.Response, string) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		p.serveConn(server)
+		server.Close()
+		close(done)
+	}()
+	go client.Write([]byte(method + " " + url + " HTTP/1.1\r\n" + header + "Connection: close\r\n\r\n" + body))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	// wait for the response to be cached
+	<-done
+	return resp, string(respBody)
+}
+
+func TestCache(t *testing.T) {
+	var hits int32
+	var ifNoneMatch atomic.Value
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		atomic.AddInt32(&hits, 1)
+		ifNoneMatch.Store(r.Header.Get("If-None-Match"))
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(nethttp.StatusNotModified)
+				return
+			}
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+			return
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	now := time.Now()
+	cache := &Cache{now: func() time.Time { return now }}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.Cache = cache
+	})
+	expect := func(method, path, header string, statusCode int, body string, originHits int32) *nethttp.Response {
+		resp, b := proxyTestRequest(t, p, method, origin.URL+path, header, "")
+		if resp.StatusCode != statusCode || b != body {
+			t.Fatalf("unexpected response of %s %s: %d %q", method, path, resp.StatusCode, b)
+		}
+		if h := atomic.LoadInt32(&hits); h != originHits {
+			t.Fatalf("unexpected origin hits of %s %s: %d", method, path, h)
+		}
+		return resp
+	}
+
+	// fresh responses are served from the cache
+	expect("GET", "/fresh", "", 200, "hello", 1)
+	now = now.Add(10 * time.Second)
+	if resp := expect("GET", "/fresh", "", 200, "hello", 1); resp.Header.Get("Age") != "10" {
+		t.Fatalf("unexpected age %q", resp.Header.Get("Age"))
+	}
+	if resp := expect("GET", "/fresh", "If-None-Match: \"v1\"\r\n", 304, "", 1); resp.Header.Get("ETag") != `"v1"` {
+		t.Fatalf("unexpected ETag %q", resp.Header.Get("ETag"))
+	}
+	expect("GET", "/fresh", "Cache-Control: no-cache\r\n", 200, "hello", 2)
+
+	// stale responses are revalidated
+	now = now.Add(time.Minute)
+	if resp := expect("GET", "/fresh", "", 200, "hello", 3); resp.Header.Get("Age") != "0" {
+		t.Fatalf("unexpected age %q", resp.Header.Get("Age"))
+	}
+	if v := ifNoneMatch.Load(); v != `"v1"` {
+		t.Fatalf("unexpected If-None-Match %q", v)
+	}
+	expect("GET", "/fresh", "", 200, "hello", 3)
+
+	// unsafe requests invalidate the response
+	expect("POST", "/fresh", "Content-Length: 0\r\n", 200, "hello", 4)
+	expect("GET", "/fresh", "", 200, "hello", 5)
+	if err := cache.Invalidate(origin.URL + "/fresh"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expect("GET", "/fresh", "", 200, "hello", 6)
+
+	// variants
+	expect("GET", "/vary", "Accept-Language: en\r\n", 200, "en", 7)
+	expect("GET", "/vary", "Accept-Language: fr\r\n", 200, "fr", 8)
+	expect("GET", "/vary", "Accept-Language: en\r\n", 200, "en", 8)
+	expect("GET", "/vary", "Accept-Language: fr\r\n", 200, "fr", 8)
+
+	// responses not storable
+	expect("GET", "/no-store", "", 200, "hello", 9)
+	expect("GET", "/no-store", "", 200, "hello", 10)
+}
+
+func TestLRUCacheStore(t *testing.T) {
+	s := &LRUCacheStore{MaxBytes: 20}
+	s.Set("a", &CachedResponse{Body: []byte("123456789")})
+	s.Set("b", &CachedResponse{Body: []byte("123456789")})
+	s.Get("a")
+	s.Set("c", &CachedResponse{Body: []byte("123456789")})
+	if s.Get("b") != nil || s.Get("a") == nil || s.Get("c") == nil || s.Len() != 2 {
+		t.Fatalf("unexpected entries kept")
+	}
+	s.Delete("a")
+	if s.Get("a") != nil || s.Len() != 1 {
+		t.Fatalf("unexpected entries kept")
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"io"
+	"strings"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// CacheControl the Cache-Control directives of a request or response,
+// directive names are lower-cased, and the arguments unquoted
+type CacheControl map[string]string
+
+// ParseCacheControl parses the Cache-Control header value
+func ParseCacheControl(value []byte) CacheControl {
+	directives := make(CacheControl)
+	for _, directive := range strings.Split(string(value), ",") {
+		directive = strings.TrimSpace(directive)
+		if len(directive) == 0 {
+			continue
+		}
+		name, arg := directive, ""
+		if i := strings.IndexByte(directive, '='); i >= 0 {
+			name, arg = directive[:i], strings.Trim(directive[i+1:], `"`)
+		}
+		directives[strings.ToLower(name)] = arg
+	}
+	return directives
+}
+
+// CacheControlOf parses the Cache-Control directives of header
+func CacheControlOf(header *http.Header) CacheControl {
+	return ParseCacheControl(header.Peek("Cache-Control"))
+}
+
+// Has if the directive is set
+func (cc CacheControl) Has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// NoStore if the no-store directive is set, which asks not to store
+// any part of the request or response, the bodies of such exchanges
+// are not passed to the hijacker's OnRequest and OnResponse writers
+func (cc CacheControl) NoStore() bool {
+	return cc.Has("no-store")
+}
+
+// bypassBodyCapture closes the body writer of the hijacker for the
+// exchange marked no-store, returns nil to skip writing the body
+func bypassBodyCapture(w io.WriteCloser) io.WriteCloser {
+	if w != nil {
+		w.Close()
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	cc := ParseCacheControl([]byte(`No-Store, max-age=60, private="Set-Cookie",`))
+	if !reflect.DeepEqual(cc, CacheControl{"no-store": "", "max-age": "60", "private": "Set-Cookie"}) {
+		t.Fatalf("unexpected directives %v", cc)
+	}
+	if !cc.NoStore() || !cc.Has("max-age") || cc.Has("no-cache") {
+		t.Fatalf("unexpected directives %v", cc)
+	}
+	if len(ParseCacheControl(nil)) != 0 {
+		t.Fatal("expected no directives")
+	}
+}
+
+// captureBuffer body captured by the sniffer
+type captureBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *captureBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+// sniffingHijacker captures the request and response bodies
+type sniffingHijacker struct {
+	tlsTestHijacker
+	lock          sync.Mutex
+	reqBody       *captureBuffer
+	respBody      *captureBuffer
+	cacheControls []CacheControl
+}
+
+func (h *sniffingHijacker) SSLBump() bool { return false }
+
+func (h *sniffingHijacker) OnRequest(path []byte, header http.Header, rawHeader []byte) io.WriteCloser {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.cacheControls = append(h.cacheControls, CacheControlOf(&header))
+	h.reqBody = &captureBuffer{}
+	return h.reqBody
+}
+
+func (h *sniffingHijacker) OnResponse(respLine http.ResponseLine, header http.Header, rawHeader []byte) io.WriteCloser {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.respBody = &captureBuffer{}
+	return h.respBody
+}
+
+type sniffingHijackerPool struct{ h *sniffingHijacker }
+
+func (p *sniffingHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p *sniffingHijackerPool) Put(Hijacker) {}
+
+func TestNoStoreBypassesBodyCapture(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.URL.Path == "/no-store" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write([]byte("secret"))
+	}))
+	defer origin.Close()
+
+	h := &sniffingHijacker{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = &sniffingHijackerPool{h}
+	})
+	expect := func(path, header, reqBody, respBody string) {
+		proxyTestRequest(t, p, "POST", origin.URL+path, header+"Content-Length: 4\r\n", "ping")
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if h.reqBody.String() != reqBody || !h.reqBody.closed {
+			t.Fatalf("unexpected request body captured of %s: %q", path, h.reqBody.String())
+		}
+		if h.respBody.String() != respBody || !h.respBody.closed {
+			t.Fatalf("unexpected response body captured of %s: %q", path, h.respBody.String())
+		}
+	}
+	expect("/", "", "ping", "secret")
+	expect("/no-store", "", "ping", "")
+	expect("/", "Cache-Control: no-store\r\n", "", "")
+	if len(h.cacheControls) != 3 || !h.cacheControls[2].NoStore() {
+		t.Fatalf("unexpected directives %v", h.cacheControls)
+	}
+}
@@ -0,0 +1,393 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+// HijackerChain composes several hijackers into one, like a middleware stack.
+// The hijackers are called in order, except AfterResponse, which is called
+// in the reverse order. Each method is resolved as follows:
+// - RewriteHost: the first rewrite wins, an empty host or port ends the request
+// - OnConnect: false if any returns false, the rest are skipped
+// - SSLBump: true if any returns true, so that every sniffer gets the traffic
+// - RewriteTLSServerName, BeforeRequest: the results are passed down the chain
+// - Resolve, SuperProxy, HijackResponse, Dial, DialTLS: the first non-nil wins,
+// the rest are skipped
+// - Block: true if any returns true, the rest are skipped
+// - OnRequest, OnResponse: the body is tee'd to all the non-nil writers
+// - AfterResponse: called on all, in the reverse order
+//
+// The optional interfaces are applied to the hijackers implementing them:
+// the first non-empty field of each Route wins except RaceDirect and Debug,
+// which are set if any sets them, OnTLS, OnRequestTarget, HandleRequest
+// and OnRaceWon are called on all, the first non-nil BodyTransform wins,
+// and the connections are closed if any CloseConnections asks. The SSLBump
+// decision is shared only if all the hijackers are SSLBumpSharer.
+type HijackerChain struct {
+	host, port string
+	hijackers  []Hijacker
+}
+
+// NewHijackerChain chains the hijackers of the request to host and port
+func NewHijackerChain(host, port string, hijackers ...Hijacker) *HijackerChain {
+	return &HijackerChain{host: host, port: port, hijackers: hijackers}
+}
+
+// RewriteHost see Hijacker
+func (c *HijackerChain) RewriteHost() (newHost, newPort string) {
+	newHost, newPort = c.host, c.port
+	rewritten := false
+	for _, h := range c.hijackers {
+		host, port := h.RewriteHost()
+		if len(host) == 0 || len(port) == 0 {
+			return "", ""
+		}
+		if !rewritten && (host != c.host || port != c.port) {
+			newHost, newPort = host, port
+			rewritten = true
+		}
+	}
+	return
+}
+
+// OnConnect see Hijacker
+func (c *HijackerChain) OnConnect(header http.Header, rawHeader []byte) bool {
+	for _, h := range c.hijackers {
+		if !h.OnConnect(header, rawHeader) {
+			return false
+		}
+	}
+	return true
+}
+
+// SSLBump see Hijacker
+func (c *HijackerChain) SSLBump() bool {
+	bump := false
+	for _, h := range c.hijackers {
+		if h.SSLBump() {
+			bump = true
+		}
+	}
+	return bump
+}
+
+// RewriteTLSServerName see Hijacker
+func (c *HijackerChain) RewriteTLSServerName(serverName string) string {
+	for _, h := range c.hijackers {
+		serverName = h.RewriteTLSServerName(serverName)
+	}
+	return serverName
+}
+
+// BeforeRequest see Hijacker, the header is re-parsed for the next
+// hijacker once changed
+func (c *HijackerChain) BeforeRequest(method, path []byte, header http.Header,
+	rawHeader []byte) (newPath, newRawHeader []byte) {
+	for _, h := range c.hijackers {
+		p, raw := h.BeforeRequest(method, path, header, rawHeader)
+		if p != nil {
+			path = p
+		}
+		if raw == nil || bytes.Equal(raw, rawHeader) {
+			continue
+		}
+		if n, err := header.Parse(raw); err == nil {
+			rawHeader = raw[:n]
+		}
+	}
+	return path, rawHeader
+}
+
+// Resolve see Hijacker
+func (c *HijackerChain) Resolve() net.IP {
+	for _, h := range c.hijackers {
+		if ip := h.Resolve(); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// SuperProxy see Hijacker
+func (c *HijackerChain) SuperProxy() *superproxy.SuperProxy {
+	for _, h := range c.hijackers {
+		if p := h.SuperProxy(); p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// Block see Hijacker
+func (c *HijackerChain) Block() bool {
+	for _, h := range c.hijackers {
+		if h.Block() {
+			return true
+		}
+	}
+	return false
+}
+
+// HijackResponse see Hijacker
+func (c *HijackerChain) HijackResponse() io.ReadCloser {
+	for _, h := range c.hijackers {
+		if r := h.HijackResponse(); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// Dial see Hijacker
+func (c *HijackerChain) Dial() func(addr string) (net.Conn, error) {
+	for _, h := range c.hijackers {
+		if dial := h.Dial(); dial != nil {
+			return dial
+		}
+	}
+	return nil
+}
+
+// DialTLS see Hijacker
+func (c *HijackerChain) DialTLS() func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	for _, h := range c.hijackers {
+		if dial := h.DialTLS(); dial != nil {
+			return dial
+		}
+	}
+	return nil
+}
+
+// OnRequest see Hijacker
+func (c *HijackerChain) OnRequest(path []byte, header http.Header, rawHeader []byte) io.WriteCloser {
+	var w teeWriter
+	for _, h := range c.hijackers {
+		w = w.add(h.OnRequest(path, header, rawHeader))
+	}
+	return w.writeCloser()
+}
+
+// OnResponse see Hijacker
+func (c *HijackerChain) OnResponse(statusLine http.ResponseLine, header http.Header,
+	rawHeader []byte) io.WriteCloser {
+	var w teeWriter
+	for _, h := range c.hijackers {
+		w = w.add(h.OnResponse(statusLine, header, rawHeader))
+	}
+	return w.writeCloser()
+}
+
+// AfterResponse see Hijacker
+func (c *HijackerChain) AfterResponse(err error) {
+	for i := len(c.hijackers) - 1; i >= 0; i-- {
+		c.hijackers[i].AfterResponse(err)
+	}
+}
+
+// Route see RouteHijacker
+func (c *HijackerChain) Route() Route {
+	var route Route
+	for _, h := range c.hijackers {
+		rh, ok := h.(RouteHijacker)
+		if !ok {
+			continue
+		}
+		r := rh.Route()
+		if route.ForceIP == nil {
+			route.ForceIP = r.ForceIP
+		}
+		if len(route.ForcePort) == 0 {
+			route.ForcePort = r.ForcePort
+		}
+		if len(route.ForceSNI) == 0 {
+			route.ForceSNI = r.ForceSNI
+		}
+		if route.ResponseHeaderTimeout == 0 {
+			route.ResponseHeaderTimeout = r.ResponseHeaderTimeout
+		}
+		if route.BodyInactivityTimeout == 0 {
+			route.BodyInactivityTimeout = r.BodyInactivityTimeout
+		}
+		route.RaceDirect = route.RaceDirect || r.RaceDirect
+		route.Debug = route.Debug || r.Debug
+		if route.RaceHeadStart == 0 {
+			route.RaceHeadStart = r.RaceHeadStart
+		}
+	}
+	return route
+}
+
+// OnRaceWon see RaceHijacker
+func (c *HijackerChain) OnRaceWon(direct bool) {
+	for _, h := range c.hijackers {
+		if rh, ok := h.(RaceHijacker); ok {
+			rh.OnRaceWon(direct)
+		}
+	}
+}
+
+// SetSSLBump see SSLBumpSharer
+func (c *HijackerChain) SetSSLBump(sslBump bool) {
+	for _, h := range c.hijackers {
+		if sh, ok := h.(SSLBumpSharer); ok {
+			sh.SetSSLBump(sslBump)
+		}
+	}
+}
+
+// sharesSSLBump if all the hijackers share the SSLBump decision
+func (c *HijackerChain) sharesSSLBump() bool {
+	for _, h := range c.hijackers {
+		if _, ok := h.(SSLBumpSharer); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// OnTLS see TLSHijacker
+func (c *HijackerChain) OnTLS(clientTLS, originTLS *TLSInfo) {
+	for _, h := range c.hijackers {
+		if th, ok := h.(TLSHijacker); ok {
+			th.OnTLS(clientTLS, originTLS)
+		}
+	}
+}
+
+// OnRequestTarget see TargetHijacker
+func (c *HijackerChain) OnRequestTarget(target []byte) {
+	for _, h := range c.hijackers {
+		if th, ok := h.(TargetHijacker); ok {
+			th.OnRequestTarget(target)
+		}
+	}
+}
+
+// HandleRequest see RequestHijacker
+func (c *HijackerChain) HandleRequest(req RequestView) {
+	for _, h := range c.hijackers {
+		if rh, ok := h.(RequestHijacker); ok {
+			rh.HandleRequest(req)
+		}
+	}
+}
+
+// TransformResponse see ResponseTransformHijacker
+func (c *HijackerChain) TransformResponse(statusLine http.ResponseLine, header http.Header) *BodyTransform {
+	for _, h := range c.hijackers {
+		if th, ok := h.(ResponseTransformHijacker); ok {
+			if t := th.TransformResponse(statusLine, header); t != nil {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// CloseConnections see ReuseHijacker
+func (c *HijackerChain) CloseConnections() (closeUpstream, closeClient bool) {
+	for _, h := range c.hijackers {
+		if rh, ok := h.(ReuseHijacker); ok {
+			u, c := rh.CloseConnections()
+			closeUpstream, closeClient = closeUpstream || u, closeClient || c
+		}
+	}
+	return
+}
+
+// TapOptions see AsyncTapHijacker, the options of the first hijacker asking
+// for the async taps apply to the bodies written to all of them
+func (c *HijackerChain) TapOptions() *TapOptions {
+	for _, h := range c.hijackers {
+		if th, ok := h.(AsyncTapHijacker); ok {
+			if opts := th.TapOptions(); opts != nil {
+				return opts
+			}
+		}
+	}
+	return nil
+}
+
+// teeWriter writes the body to all the writers, a writer is dropped
+// once failed so that the others keep going
+type teeWriter []io.WriteCloser
+
+func (w teeWriter) add(writer io.WriteCloser) teeWriter {
+	if writer == nil {
+		return w
+	}
+	return append(w, writer)
+}
+
+// writeCloser nil if no writers, so the body is not copied at all
+func (w teeWriter) writeCloser() io.WriteCloser {
+	switch len(w) {
+	case 0:
+		return nil
+	case 1:
+		return w[0]
+	}
+	return &w
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	for i, writer := range *w {
+		if writer == nil {
+			continue
+		}
+		if _, err := writer.Write(p); err != nil {
+			writer.Close()
+			(*w)[i] = nil
+		}
+	}
+	return len(p), nil
+}
+
+// OnTrailer passes the trailer to the writers, see TrailerReceiver
+func (w *teeWriter) OnTrailer(trailer http.Header) {
+	for _, writer := range *w {
+		if tr, ok := writer.(TrailerReceiver); ok {
+			tr.OnTrailer(trailer)
+		}
+	}
+}
+
+func (w *teeWriter) Close() error {
+	for i, writer := range *w {
+		if writer != nil {
+			writer.Close()
+			(*w)[i] = nil
+		}
+	}
+	return nil
+}
+
+// HijackerChainPool pools the hijackers of each pool as a HijackerChain,
+// in the order of the pools
+type HijackerChainPool []HijackerPool
+
+// Get see HijackerPool
+func (pools HijackerChainPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	hijackers := make([]Hijacker, len(pools))
+	for i, pool := range pools {
+		hijackers[i] = pool.Get(clientAddr, isHTTPS, host, port)
+	}
+	return NewHijackerChain(host, port, hijackers...)
+}
+
+// Put see HijackerPool
+func (pools HijackerChainPool) Put(h Hijacker) {
+	c, ok := h.(*HijackerChain)
+	if !ok || len(c.hijackers) != len(pools) {
+		return
+	}
+	for i, pool := range pools {
+		pool.Put(c.hijackers[i])
+	}
+}
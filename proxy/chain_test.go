@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// chainTestHijacker logs the calls, adds its header and captures the bodies
+type chainTestHijacker struct {
+	tlsTestHijacker
+	name     string
+	log      *[]string
+	block    bool
+	respBody *captureBuffer
+}
+
+func (h *chainTestHijacker) SSLBump() bool { return false }
+
+func (h *chainTestHijacker) BeforeRequest(method, path []byte, header http.Header,
+	rawHeader []byte) ([]byte, []byte) {
+	*h.log = append(*h.log, "before "+h.name+" "+strings.Join(headerNames(&header), ","))
+	header.Add("X-"+h.name, "1")
+	return path, header.Raw()
+}
+
+func (h *chainTestHijacker) Block() bool {
+	*h.log = append(*h.log, "block "+h.name)
+	return h.block
+}
+
+func (h *chainTestHijacker) OnResponse(http.ResponseLine, http.Header, []byte) io.WriteCloser {
+	h.respBody = &captureBuffer{}
+	return h.respBody
+}
+
+func (h *chainTestHijacker) AfterResponse(error) {
+	*h.log = append(*h.log, "after "+h.name)
+}
+
+func headerNames(header *http.Header) []string {
+	var names []string
+	header.VisitAll(func(key, value []byte) {
+		if strings.HasPrefix(string(key), "X-") {
+			names = append(names, string(key))
+		}
+	})
+	return names
+}
+
+type chainTestHijackerPool struct{ h *chainTestHijacker }
+
+func (p chainTestHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p chainTestHijackerPool) Put(Hijacker) {}
+
+func TestHijackerChain(t *testing.T) {
+	var received []string
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		received = []string{r.Header.Get("X-a"), r.Header.Get("X-b")}
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	var log []string
+	a := &chainTestHijacker{name: "a", log: &log}
+	b := &chainTestHijacker{name: "b", log: &log}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = HijackerChainPool{chainTestHijackerPool{a}, chainTestHijackerPool{b}}
+	})
+
+	if _, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "", ""); body != "ok" {
+		t.Fatalf("unexpected body %s", body)
+	}
+	if !reflect.DeepEqual(received, []string{"1", "1"}) {
+		t.Fatalf("unexpected headers received %v", received)
+	}
+	expectLog := []string{"before a ", "before b X-a", "block a", "block b", "after b", "after a"}
+	if !reflect.DeepEqual(log, expectLog) {
+		t.Fatalf("unexpected calls %q", log)
+	}
+	for _, h := range []*chainTestHijacker{a, b} {
+		if h.respBody.String() != "ok" || !h.respBody.closed {
+			t.Fatalf("unexpected response body captured by %s: %q", h.name, h.respBody.String())
+		}
+	}
+
+	// blocked by the first hijacker, the second is skipped
+	log = nil
+	a.block = true
+	resp, _ := proxyTestRequest(t, p, "GET", origin.URL+"/", "", "")
+	if resp.StatusCode != nethttp.StatusBadGateway {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	expectLog = []string{"before a ", "before b X-a", "block a", "after b", "after a"}
+	if !reflect.DeepEqual(log, expectLog) {
+		t.Fatalf("unexpected calls %q", log)
+	}
+}
+
+// chainRouteHijacker routes the request, recording the winners of its races
+type chainRouteHijacker struct {
+	tlsTestHijacker
+	route Route
+	won   []bool
+}
+
+func (h *chainRouteHijacker) Route() Route          { return h.route }
+func (h *chainRouteHijacker) OnRaceWon(direct bool) { h.won = append(h.won, direct) }
+
+func TestHijackerChainRoute(t *testing.T) {
+	a := &chainRouteHijacker{route: Route{ForcePort: "8080", RaceHeadStart: time.Second}}
+	b := &chainRouteHijacker{route: Route{ForcePort: "9090", RaceDirect: true,
+		RaceHeadStart: 2 * time.Second, Debug: true}}
+	c := NewHijackerChain("example.com", "80", a, &tlsTestHijacker{}, b)
+	route := c.Route()
+	if route.ForcePort != "8080" || !route.RaceDirect || route.RaceHeadStart != time.Second ||
+		!route.Debug {
+		t.Fatalf("unexpected route %+v", route)
+	}
+
+	// the winner is reported to all the race hijackers
+	var h Hijacker = c
+	rh, ok := h.(RaceHijacker)
+	if !ok {
+		t.Fatal("expected the chain to be a RaceHijacker")
+	}
+	rh.OnRaceWon(true)
+	if !reflect.DeepEqual(a.won, []bool{true}) || !reflect.DeepEqual(b.won, []bool{true}) {
+		t.Fatalf("unexpected winners reported %v %v", a.won, b.won)
+	}
+}
+
+// chainSSLBumpHijacker records the SSLBump decisions shared
+type chainSSLBumpHijacker struct {
+	tlsTestHijacker
+	shared []bool
+}
+
+func (h *chainSSLBumpHijacker) SetSSLBump(sslBump bool) { h.shared = append(h.shared, sslBump) }
+
+func TestHijackerChainSSLBumpSharer(t *testing.T) {
+	a, b := &chainSSLBumpHijacker{}, &chainSSLBumpHijacker{}
+	c := NewHijackerChain("example.com", "443", a, b)
+	if !c.sharesSSLBump() {
+		t.Fatal("expected the decision shared by the sharers")
+	}
+	c.SetSSLBump(true)
+	if !reflect.DeepEqual(a.shared, []bool{true}) || !reflect.DeepEqual(b.shared, []bool{true}) {
+		t.Fatalf("unexpected decisions shared %v %v", a.shared, b.shared)
+	}
+
+	// a hijacker deciding by itself is never given another's decision
+	if NewHijackerChain("example.com", "443", a, &tlsTestHijacker{}).sharesSSLBump() {
+		t.Fatal("expected the decision not shared")
+	}
+}
+
+func TestTeeWriter(t *testing.T) {
+	var w teeWriter
+	if w.add(nil).writeCloser() != nil {
+		t.Fatal("expected no writer")
+	}
+	a, b := &captureBuffer{}, &captureBuffer{}
+	wc := w.add(a).add(nil).add(b).writeCloser()
+	io.Copy(wc, strings.NewReader("body"))
+	wc.Close()
+	if a.String() != "body" || b.String() != "body" || !a.closed || !b.closed {
+		t.Fatalf("unexpected bodies %q %q", a.String(), b.String())
+	}
+}
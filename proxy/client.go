@@ -3,12 +3,22 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/haxii/fastproxy/client"
 	"github.com/haxii/fastproxy/http"
 	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/uri"
 	"github.com/haxii/fastproxy/util"
 )
 
@@ -26,7 +36,12 @@ func (r *RequestPool) Acquire() *Request {
 
 // Release put a request back into pool
 func (r *RequestPool) Release(req *Request) {
+	req.checkReleased()
 	req.Reset()
+	if poolCheck {
+		req.released = true
+		return
+	}
 	r.pool.Put(req)
 }
 
@@ -44,10 +59,19 @@ func (r *ResponsePool) Acquire() *Response {
 
 // Release put a response back into pool
 func (r *ResponsePool) Release(resp *Response) {
+	resp.checkReleased()
 	resp.Reset()
+	if poolCheck {
+		resp.released = true
+		return
+	}
 	r.pool.Put(resp)
 }
 
+// errUseAfterRelease the request or response is used after released into
+// its pool, see poolCheck
+const errUseAfterRelease = "proxy: %s used after released into its pool"
+
 /*
  * implements basic http request & response based on client
  */
@@ -78,30 +102,140 @@ type Request struct {
 
 	// proxy super proxy used for target connection
 	proxy *superproxy.SuperProxy
+	// rules rewriting the request after the hijacker, and ruleProxy the
+	// super proxy they route it through, nil if none
+	rules     *RulesEngine
+	ruleProxy *superproxy.SuperProxy
 
 	// TLS request settings
 	isTLS         bool
 	tlsServerName string
+
+	// writtenSize bytes written to the target, header and body included
+	writtenSize int64
+
+	// connInfo state of the client connection, nil if not tracked
+	connInfo *connInfo
+	// clientAddr address of the client
+	clientAddr net.Addr
+	// connTLS TLS state of the client connection served over TLS,
+	// nil if served in plaintext
+	connTLS *tls.ConnectionState
+	// closeClient if the client connection is closed to end the response
+	closeClient bool
+	// memGuard stops the body capture of the hijacker when shedding
+	memGuard *MemoryGuard
+	// tapDropped counts the bytes dropped by the async tap, see AsyncTapHijacker
+	tapDropped *uint64
+
+	// clientTLS and originTLS TLS details of decrypted requests,
+	// collected only for the TLSHijacker
+	clientTLS *TLSInfo
+	originTLS *TLSInfo
+	// clientSNI the SNI the client sent in the tunnel decrypted, empty if none
+	clientSNI string
+	// timing the overhead reported to the client, nil if not reported
+	timing *serverTiming
+	// headerCache the header cache of the connection the request is being
+	// written to, nil if none, see client.HeaderCacheUser
+	headerCache *transport.HeaderCache
+	// dialers making the connections of the request, see Proxy.setDialers
+	dialers client.Dialers
+
+	// deadline total deadline of the upstream round trip, zero if none
+	deadline time.Time
+	// budgetSpent time spent by each phase of the round trip with
+	// a deadline, and budgetRemaining the time left afterwards
+	budgetSpent     [client.NumPhases]time.Duration
+	budgetRemaining time.Duration
+	// headerTimeout and bodyTimeout the response timeouts of the route,
+	// zero for the ones of the proxy
+	headerTimeout time.Duration
+	bodyTimeout   time.Duration
+	// acceptEncoding the Accept-Encoding sent instead of the client's, see
+	// Proxy.AcceptEncodingForHost, nil to leave it untouched
+	acceptEncoding []byte
+	// raceDirect and raceHeadStart the race of the route, see Route.RaceDirect
+	raceDirect    bool
+	raceHeadStart time.Duration
+	// trace the events of the request traced, nil if not, see RequestTracing
+	trace *requestTrace
+	// replay the state of the request replayed by Proxy.Replay, nil for
+	// the ones of the clients
+	replay *replayState
+
+	// bodyRead if the body has been read, skipBody skips reading the
+	// body in WriteBodyTo, leaving it to drainBody
+	bodyRead bool
+	skipBody bool
+	// permissiveTrailers forwards the trailer fields not announced
+	permissiveTrailers bool
+
+	// released once released into the pool, see poolCheck
+	released bool
 }
 
 // Reset reset request
 func (r *Request) Reset() {
+	r.resetExchange()
+	r.hijacker = nil
+	r.connInfo = nil
+	r.clientAddr = nil
+	r.connTLS = nil
+	r.clientTLS = nil
+	r.clientSNI = ""
+	r.isTLS = false
+	r.tlsServerName = ""
+	r.replay = nil
+}
+
+// checkReleased panics if the request is released, see poolCheck
+func (r *Request) checkReleased() {
+	if poolCheck && r.released {
+		panic(fmt.Sprintf(errUseAfterRelease, "request"))
+	}
+}
+
+// resetExchange resets the state of the request served, keeping the one of
+// the client connection, i.e. of the tunnel the requests are decrypted from
+func (r *Request) resetExchange() {
 	r.reader = nil
 	r.reqLine.Reset()
 	r.header.Reset()
 	r.rawHeader = nil
 	r.originalHeaderLength = 0
-	r.hijacker = nil
 	r.hijackerBodyWriter = nil
+	r.closeClient = false
+	r.memGuard = nil
+	r.tapDropped = nil
+	r.originTLS = nil
 	r.isBeforeRequestCalled = false
 	r.proxy = nil
-	r.isTLS = false
-	r.tlsServerName = ""
+	r.rules = nil
+	r.ruleProxy = nil
+	r.writtenSize = 0
+	r.deadline = time.Time{}
+	r.budgetSpent = [client.NumPhases]time.Duration{}
+	r.budgetRemaining = 0
+	r.headerTimeout = 0
+	r.bodyTimeout = 0
+	r.raceDirect = false
+	r.raceHeadStart = 0
+	r.acceptEncoding = nil
+	r.trace = nil
+	r.timing = nil
+	r.headerCache = nil
+	r.dialers = client.Dialers{}
+	r.bodyRead = false
+	r.skipBody = false
+	r.permissiveTrailers = false
+	r.body = http.Body{}
 }
 
 // parseStartLine inits request with provided reader
 // then parse the start line of the http request
 func (r *Request) parseStartLine(reader *bufio.Reader) (int, error) {
+	r.checkReleased()
 	var rn int
 	if r.reader != nil {
 		return rn, errors.New("request already initialized")
@@ -133,6 +267,55 @@ func (r *Request) SetHijacker(h Hijacker) {
 	r.hijacker = h
 }
 
+// Deadline total deadline of the upstream round trip, see client.Deadliner
+func (r *Request) Deadline() time.Time {
+	return r.deadline
+}
+
+// RecordBudget records how the deadline is spent, see client.BudgetRecorder
+func (r *Request) RecordBudget(spent [client.NumPhases]time.Duration, remaining time.Duration) {
+	r.budgetSpent = spent
+	r.budgetRemaining = remaining
+}
+
+// ResponseTimeouts implements client.ResponseTimeouter
+func (r *Request) ResponseTimeouts() (header, bodyInactivity time.Duration) {
+	return r.headerTimeout, r.bodyTimeout
+}
+
+// RaceDirect implements client.DirectRacer
+func (r *Request) RaceDirect() (race bool, headStart time.Duration) {
+	return r.raceDirect, r.raceHeadStart
+}
+
+// SetRaceWinner drops the super proxy of the request won by the direct
+// connection, and reports the winner to the RaceHijacker
+func (r *Request) SetRaceWinner(direct bool) {
+	if direct {
+		r.proxy = nil
+		r.connInfo.setUpstream(r.reqLine.HostInfo().HostWithPort(), nil)
+	}
+	if rh, ok := r.hijacker.(RaceHijacker); ok {
+		rh.OnRaceWon(direct)
+	}
+}
+
+// budgetTrace the time spent by each phase of the round trip with a
+// deadline, e.g. `dial 1ms, tls 0s, write 0s, ttfb 2s, read 0s, 7s left`
+func (r *Request) budgetTrace() string {
+	var b strings.Builder
+	for phase, spent := range r.budgetSpent {
+		fmt.Fprintf(&b, "%s %s, ", client.Phase(phase), spent)
+	}
+	fmt.Fprintf(&b, "%s left", r.budgetRemaining)
+	return b.String()
+}
+
+// deadlineExceeded if the request has a deadline which is exceeded
+func (r *Request) deadlineExceeded() bool {
+	return !r.deadline.IsZero() && !time.Now().Before(r.deadline)
+}
+
 // SetProxy set super proxy for this request
 func (r *Request) SetProxy(p *superproxy.SuperProxy) {
 	r.proxy = p
@@ -153,6 +336,11 @@ func (r *Request) TargetWithPort() string {
 	return r.reqLine.HostInfo().TargetWithPort()
 }
 
+// HostWithPort the domain with port
+func (r *Request) HostWithPort() string {
+	return r.reqLine.HostInfo().HostWithPort()
+}
+
 // PathWithQueryFragment request path with query and fragment
 func (r *Request) PathWithQueryFragment() []byte {
 	return r.reqLine.PathWithQueryFragment()
@@ -194,18 +382,75 @@ func (r *Request) discardRawHeader() error {
 	return err
 }
 
+// setOriginalDst targets the request of an intercepted connection at its
+// original destination dst, the host name is taken from the Host header
+func (r *Request) setOriginalDst(dst *net.TCPAddr) error {
+	if err := r.peekRawHeader(); err != nil {
+		return err
+	}
+	host := string(r.header.Host())
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if len(host) == 0 {
+		host = (&net.IPAddr{IP: dst.IP, Zone: dst.Zone}).String()
+	}
+	r.reqLine.HostInfo().ParseHostWithPort(net.JoinHostPort(host, strconv.Itoa(dst.Port)), false)
+	r.reqLine.HostInfo().SetIP(dst.IP)
+	return nil
+}
+
+// pinTunnelIP pins the target of the tunnel made directly to the IP of
+// upstream it's connected to, so that it's never resolved again for the
+// tunnel, e.g. by the requests served inside it. The IP pinned is
+// returned, nil for the tunnels made through a super proxy.
+func (r *Request) pinTunnelIP(upstream net.Conn) net.IP {
+	if r.proxy != nil {
+		return nil
+	}
+	addr, ok := upstream.RemoteAddr().(*net.TCPAddr)
+	if !ok || addr.IP == nil {
+		return nil
+	}
+	r.reqLine.HostInfo().SetIP(addr.IP)
+	return addr.IP
+}
+
 // PrePare pre-process the request header, hijack the request if available
 func (r *Request) PrePare() error {
+	r.checkReleased()
 	r.isBeforeRequestCalled = false
 	if err := r.peekRawHeader(); err != nil {
 		return err
 	}
 	// hijack the request URL and header
-	if r.hijacker == nil {
-		return nil
+	if r.hijacker != nil {
+		r.handleRequest()
+		if err := r.hijackRequest(); err != nil {
+			return err
+		}
+	}
+	if r.rules != nil {
+		if err := r.rules.apply(r); err != nil {
+			return util.ErrWrapper(err, "fail to apply the rules to the request")
+		}
+	}
+	if err := r.setHostHeader(); err != nil {
+		return util.ErrWrapper(err, "fail to set the request host header")
 	}
+	return nil
+}
+
+// reportTarget reports the request target sent by the client to TargetHijacker
+func (r *Request) reportTarget() {
+	if th, ok := r.hijacker.(TargetHijacker); ok {
+		th.OnRequestTarget(r.reqLine.URI().Full())
+	}
+}
 
-	// modify request header and change super proxy if needed
+// hijackRequest modifies request header and path using hijacker
+func (r *Request) hijackRequest() error {
 	newPath, newHeader := r.hijacker.BeforeRequest(r.Method(),
 		r.reqLine.PathWithQueryFragment(), r.header, r.rawHeader)
 	r.isBeforeRequestCalled = true
@@ -227,6 +472,52 @@ func (r *Request) PrePare() error {
 	return nil
 }
 
+// setHostHeader makes the Host header consistent with the request target,
+// a missing Host header is added, and it's replaced by the host in the
+// request URI if the request is made in absolute-form or its target rewritten,
+// as the rewrite puts the host into the URI, e.g. by a rule Target or the
+// RewriteHost of the hijacker. The Host header of the other origin-form
+// requests is kept, and the duplicated ones are collapsed into one.
+func (r *Request) setHostHeader() error {
+	hostWithPort := r.reqLine.HostInfo().HostWithPort()
+	if len(hostWithPort) == 0 {
+		return nil
+	}
+	host := uri.AuthorityOf(hostWithPort, r.isTLS)
+	if len(r.reqLine.URI().Host()) == 0 && r.header.HostCount() > 1 {
+		host = string(r.header.Host())
+	} else if headerHost := r.header.Host(); len(headerHost) > 0 && r.header.HostCount() == 1 &&
+		(len(r.reqLine.URI().Host()) == 0 || string(headerHost) == host) {
+		return nil
+	}
+	if err := r.header.Set("Host", host); err != nil {
+		return err
+	}
+	r.rawHeader = r.header.Raw()
+	return nil
+}
+
+var (
+	expectHeaderValueContinue = []byte("100-continue")
+	protocolHTTP11            = []byte("HTTP/1.1")
+)
+
+// expectContinue if the request's "Expect" header value is `100-continue`,
+// which is ignored in HTTP/1.0 requests
+func (r *Request) expectContinue() bool {
+	return bytes.Equal(r.Protocol(), protocolHTTP11) &&
+		bytes.EqualFold(r.header.Peek("Expect"), expectHeaderValueContinue)
+}
+
+// stripExpect removes the "Expect" header from the request forwarded
+func (r *Request) stripExpect() error {
+	if err := r.header.Del("Expect"); err != nil {
+		return err
+	}
+	r.rawHeader = r.header.Raw()
+	return nil
+}
+
 func (r *Request) IsBeforeRequestCalled() bool {
 	return r.isBeforeRequestCalled
 }
@@ -248,12 +539,12 @@ func (r *Request) makeDNSLookUpAndSetSuperProxy(defaultSuperProxy *superproxy.Su
 	// set requests proxy
 	superProxy := hijacker.SuperProxy()
 	r.SetProxy(superProxy)
-
 }
 
 // WriteHeaderTo write raw http request header to http client
 // implemented client's request interface
 func (r *Request) WriteHeaderTo(writer *bufio.Writer) (int, int, error) {
+	r.checkReleased()
 	if r.reader == nil {
 		return 0, 0, ErrNilRequestReader
 	}
@@ -261,42 +552,121 @@ func (r *Request) WriteHeaderTo(writer *bufio.Writer) (int, int, error) {
 	// the header only peeks for parsing in `PrePare`, discard it after using
 	defer r.discardRawHeader()
 
-	copiedHeaderLen, err := parallelWriteHeader(
+	// the hijacker sees the Accept-Encoding of the client, not the one sent
+	drop, extra := acceptEncodingRewriter(r.acceptEncoding)
+	// the cache of the connection is only valid while writing to it
+	cache := r.headerCache
+	r.headerCache = nil
+	copiedHeaderLen, err := parallelWriteCachedHeader(
 		writer,
 		func(header []byte) {
+			if r.trace != nil {
+				r.trace.header("request-header", nil, header)
+			}
 			if r.hijacker != nil {
 				r.hijackerBodyWriter = r.hijacker.OnRequest(r.reqLine.PathWithQueryFragment(), r.header, header)
+				if CacheControlOf(&r.header).NoStore() {
+					r.hijackerBodyWriter = bypassBodyCapture(r.hijackerBodyWriter)
+				} else {
+					r.hijackerBodyWriter = multipartTap(r.hijackerBodyWriter, &r.header)
+				}
+				r.hijackerBodyWriter = asyncTap(r.hijacker,
+					r.memGuard.guardCapture(r.hijackerBodyWriter), r.tapDropped)
 			}
 		},
-		r.rawHeader)
+		r.rawHeader, drop, extra, cache)
+	r.writtenSize += int64(copiedHeaderLen)
 	return r.originalHeaderLength, copiedHeaderLen, err
 }
 
 // WriteBodyTo write raw http request body to http client
 // implemented client's request interface
 func (r *Request) WriteBodyTo(writer *bufio.Writer) (int, error) {
+	r.checkReleased()
 	if r.reader == nil {
 		return 0, errors.New("empty request")
 	}
+	if r.skipBody {
+		return 0, nil
+	}
+	n, err := r.copyBody(writer)
+	r.writtenSize += int64(n)
+	return n, err
+}
+
+// copyBody copies the request body (if any) to w and the hijacker,
+// with the trailer fields of the chunked body filtered
+func (r *Request) copyBody(w io.Writer) (int, error) {
+	r.bodyRead = true
 	defer func() {
 		if r.hijackerBodyWriter != nil {
 			r.hijackerBodyWriter.Close()
 		}
 	}()
-	// write the request body (if any)
-	return copyBody(&r.header, &r.body, r.reader, writer,
-		func(rawBody []byte) {
-			if _, err := util.WriteWithValidation(r.hijackerBodyWriter, rawBody); err != nil {
-				// TODO: log the sniffer error
-			}
-		},
-	)
+	bodyType := r.header.BodyType()
+	var trailer []byte
+	var filter http.TrailerFilter
+	if bodyType == http.BodyTypeChunked {
+		// the header is parsed before the body overwrites its buffer
+		filter = r.trailerFilter(r.permissiveTrailers, &trailer)
+	}
+	n, err := r.body.ParseWithTrailer(r.reader, bodyType, r.header.ContentLength(),
+		func(isChunkHeader bool, data []byte) (int, error) {
+			return parallelWriteBody(w, func(rawBody []byte) {
+				if _, err := util.WriteWithValidation(r.hijackerBodyWriter, rawBody); err != nil {
+					// TODO: log the sniffer error
+				}
+			}, data)
+		}, filter)
+	if tr, ok := r.hijackerBodyWriter.(TrailerReceiver); ok && err == nil && filter != nil {
+		var header http.Header
+		if _, e := header.Parse(append(trailer, crlf...)); e == nil {
+			tr.OnTrailer(header)
+		}
+	}
+	return n, err
+}
+
+// errDrainLimitExceeded the request body is larger than the drain limit
+var errDrainLimitExceeded = errors.New("request body drain limit exceeded")
+
+// drainBody discards the unread request body up to limit bytes, so that
+// the next request can be read from the connection, the body is still
+// passed to the hijacker. Returns false if the body is larger or can't
+// be read, the connection should be closed then.
+func (r *Request) drainBody(limit int64) bool {
+	r.checkReleased()
+	if r.bodyRead {
+		return true
+	}
+	if limit < 0 || r.header.BodyType() == http.BodyTypeIdentity ||
+		(r.header.BodyType() == http.BodyTypeFixedSize && r.header.ContentLength() > limit) {
+		r.bodyRead = true
+		if r.hijackerBodyWriter != nil {
+			r.hijackerBodyWriter.Close()
+		}
+		return false
+	}
+	_, err := r.copyBody(&limitedDiscard{n: limit})
+	return err == nil
+}
+
+// limitedDiscard discards the data written up to n bytes
+type limitedDiscard struct{ n int64 }
+
+func (w *limitedDiscard) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.n {
+		return 0, errDrainLimitExceeded
+	}
+	w.n -= int64(len(p))
+	return len(p), nil
 }
 
 // ConnectionClose if the request's "Connection" or "Proxy-Connection" header value is set as "close".
 // this determines how the client reusing the connections.
 // this func. result is only valid after `WriteTo` method is called
 func (r *Request) ConnectionClose() bool {
+	r.checkReleased()
 	return r.header.IsConnectionClose() || r.header.IsProxyConnectionClose()
 }
 
@@ -305,6 +675,35 @@ func (r *Request) IsTLS() bool {
 	return r.isTLS
 }
 
+// WantTLSState implements client.TLSStateRecorder, the TLS state of the
+// origin is recorded only for the TLSHijacker
+func (r *Request) WantTLSState() bool {
+	_, ok := r.hijacker.(TLSHijacker)
+	return ok
+}
+
+// SetTLSState implements client.TLSStateRecorder
+func (r *Request) SetTLSState(state tls.ConnectionState) {
+	r.originTLS = newTLSInfo(&state)
+}
+
+// Dialers implements client.DialersRequest
+func (r *Request) Dialers() *client.Dialers {
+	return &r.dialers
+}
+
+// SetHeaderCache implements client.HeaderCacheUser
+func (r *Request) SetHeaderCache(cache *transport.HeaderCache) {
+	r.headerCache = cache
+}
+
+// SetTLSProfile implements client.TLSProfileRecorder
+func (r *Request) SetTLSProfile(name string) {
+	if r.originTLS != nil {
+		r.originTLS.Profile = name
+	}
+}
+
 // TLSServerName server name for handshaking
 func (r *Request) TLSServerName() string {
 	return r.tlsServerName
@@ -324,17 +723,99 @@ type Response struct {
 
 	// body http body parser
 	body http.Body
+
+	// firstByteTime time when the response starts to be read
+	firstByteTime time.Time
+	// readSize bytes read from the target, header and body included
+	readSize int64
+	// headerWrittenSize bytes of the status line and header written
+	headerWrittenSize int
+
+	// reqNoStore if the request is marked no-store
+	reqNoStore bool
+	// noBody if the response has no body whatever its header tells, i.e.
+	// the one to HEAD and the bodyless statuses, see isBodylessStatus
+	noBody bool
+
+	// connInfo state of the client connection, nil if not tracked
+	connInfo *connInfo
+
+	// bodyLimiter limits the body relayed if its limit is set
+	bodyLimiter bodyLimiter
+
+	// keepClientAlive if the client connection is kept alive whatever the
+	// target does, closeClient if it's closed to end the body relayed
+	keepClientAlive bool
+	closeClient     bool
+	// clientHTTP10 if the client speaks HTTP/1.0, which knows no interim
+	// responses, so they're never forwarded to it
+	clientHTTP10 bool
+
+	// memGuard stops the body capture of the hijacker when shedding
+	memGuard *MemoryGuard
+	// tapDropped counts the bytes dropped by the async tap, see AsyncTapHijacker
+	tapDropped *uint64
+
+	// keepHeader keeps the header fields valid after the body is read,
+	// which are parsed in place of the reader buffer otherwise
+	keepHeader bool
+	// transformed if the body is transformed for the hijacker
+	transformed bool
+	// closeUpstream and forceCloseClient close the connections after the
+	// response as the hijacker asked, see ReuseHijacker
+	closeUpstream    bool
+	forceCloseClient bool
+	// onHeaderRead called once the final header is read,
+	// see client.HeaderReadNotifier
+	onHeaderRead func()
+	// trace the events of the request traced, nil if not
+	trace *requestTrace
+	// timing the overhead of the proxy appended to the header as
+	// Server-Timing, nil if not reported
+	timing *serverTiming
+
+	// released once released into the pool, see poolCheck
+	released bool
 }
 
 // Reset reset response
 func (r *Response) Reset() {
 	r.writer = nil
+	r.hijacker = nil
 	r.respLine.Reset()
 	r.header.Reset()
+	r.body = http.Body{}
+	r.firstByteTime = time.Time{}
+	r.readSize = 0
+	r.headerWrittenSize = 0
+	r.reqNoStore = false
+	r.noBody = false
+	r.connInfo = nil
+	r.bodyLimiter = bodyLimiter{}
+	r.keepClientAlive = false
+	r.closeClient = false
+	r.clientHTTP10 = false
+	r.memGuard = nil
+	r.tapDropped = nil
+	r.keepHeader = false
+	r.transformed = false
+	r.closeUpstream = false
+	r.forceCloseClient = false
+	r.onHeaderRead = nil
+	r.trace = nil
+	r.timing = nil
+}
+
+// checkReleased panics if the response is released, see poolCheck
+func (r *Response) checkReleased() {
+	if poolCheck && r.released {
+		panic(fmt.Sprintf(errUseAfterRelease, "response"))
+	}
 }
 
 // WriteTo init response with writer which would write to
 func (r *Response) WriteTo(writer *bufio.Writer) error {
+	r.checkReleased()
 	if r.writer != nil {
 		return errors.New("response already initialized")
 	}
@@ -352,22 +833,66 @@ func (r *Response) SetHijacker(h Hijacker) {
 	r.hijacker = h
 }
 
+// OnHeaderRead implements client.HeaderReadNotifier
+func (r *Response) OnHeaderRead(f func()) {
+	r.onHeaderRead = f
+}
+
 // ReadFrom read data from http response got
-func (r *Response) ReadFrom(discardBody bool, reader *bufio.Reader) (int, error) {
-	var num, wn int
-	var err error
-	// write back the start line to writer(i.e. net/connection)
-	if err = r.respLine.Parse(reader); err != nil {
-		return num, util.ErrWrapper(err, "fail to read start line of response")
-	}
+func (r *Response) ReadFrom(discardBody bool, reader *bufio.Reader) (num int, err error) {
+	r.checkReleased()
+	r.firstByteTime = time.Now()
+	defer func() { r.readSize += int64(num) }()
+	var wn int
+	for {
+		// write back the start line to writer(i.e. net/connection)
+		if err = r.respLine.Parse(reader); err != nil {
+			return num, util.ErrWrapper(err, "fail to read start line of response")
+		}
 
-	// rebuild  the start line
-	respLineBytes := r.respLine.GetResponseLine()
-	// write start line
-	if wn, err = util.WriteWithValidation(r.writer, respLineBytes); err != nil {
-		return num, util.ErrWrapper(err, "fail to write start line of response")
+		// the interim responses are dropped for the HTTP/1.0 client
+		interim := isInterimStatus(r.respLine.GetStatusCode())
+		var w io.Writer = r.writer
+		if interim && r.clientHTTP10 {
+			w = ioutil.Discard
+		}
+
+		// rebuild  the start line, the client kept alive is answered
+		// in HTTP/1.1 whatever the target speaks
+		respLineBytes := r.respLine.GetResponseLine()
+		if protocol := r.respLine.GetProtocol(); r.keepClientAlive && !bytes.Equal(protocol, http11) {
+			if wn, err = util.WriteWithValidation(w, http11); err != nil {
+				return num, util.ErrWrapper(err, "fail to write start line of response")
+			}
+			num += wn
+			respLineBytes = respLineBytes[len(protocol):]
+		}
+		// write start line
+		if wn, err = util.WriteWithValidation(w, respLineBytes); err != nil {
+			return num, util.ErrWrapper(err, "fail to write start line of response")
+		}
+		num += wn
+		if !interim {
+			break
+		}
+
+		// forward the interim response, e.g. 100 Continue, to client
+		// immediately, then wait for the final one
+		if _, wn, err = copyHeader(&r.header, reader, w, func([]byte) {}, nil); err != nil {
+			return num, err
+		}
+		num += wn
+		if w == r.writer {
+			if err = r.writer.Flush(); err != nil {
+				return num, util.ErrWrapper(err, "fail to write interim response")
+			}
+		}
 	}
-	num += wn
+
+	// the body framing of the bodyless responses is not read, keeping the
+	// connections reusable
+	r.noBody = discardBody || isBodylessStatus(r.respLine.GetStatusCode())
+	discardBody = r.noBody
 
 	// read & write the headers
 	var hijackerBodyWriter io.WriteCloser
@@ -376,45 +901,200 @@ func (r *Response) ReadFrom(discardBody bool, reader *bufio.Reader) (int, error)
 			hijackerBodyWriter.Close()
 		}
 	}()
+	// the per hop headers of the target are dropped for the client kept
+	// alive, and the body read until the target closes is chunked for it
+	chunked := false
+	var transform *BodyTransform
+	var transformEncoding string
+	rewriteHeader := func() (drop func([]byte) bool, extra []byte) {
+		// the length of the body transformed is unknown
+		if !discardBody {
+			transform, transformEncoding = r.bodyTransform()
+		}
+		if transform != nil {
+			r.transformed = true
+			drop = isPerHopOrPayloadLength
+			if transform.DropEncoding && len(transformEncoding) > 0 {
+				drop = isPerHopOrPayloadFraming
+			}
+			if r.keepClientAlive {
+				chunked = true
+				return drop, chunkedHeader
+			}
+			return drop, connectionCloseHeader
+		}
+		if !r.keepClientAlive {
+			return nil, nil
+		}
+		if !discardBody && r.bodyType() == http.BodyTypeIdentity {
+			chunked = true
+			return isPerHopOrTransferEncoding, chunkedHeader
+		}
+		return http.IsPerHopHeader, nil
+	}
+	if r.timing != nil {
+		// the Server-Timing of the target is kept, the one of the proxy
+		// is added as another field
+		rewrite := rewriteHeader
+		rewriteHeader = func() (drop func([]byte) bool, extra []byte) {
+			drop, extra = rewrite()
+			return drop, append(append([]byte(nil), extra...), r.timing.header(r.firstByteTime)...)
+		}
+	}
 	if _, wn, err = copyHeader(&r.header, reader, r.writer,
 		func(rawHeader []byte) {
+			if r.trace != nil {
+				r.trace.header("response-header", r.respLine.GetResponseLine(), rawHeader)
+			}
 			if r.hijacker != nil {
 				hijackerBodyWriter = r.hijacker.OnResponse(
 					r.respLine, r.header, rawHeader)
+				if r.reqNoStore || CacheControlOf(&r.header).NoStore() {
+					hijackerBodyWriter = bypassBodyCapture(hijackerBodyWriter)
+				}
+				hijackerBodyWriter = asyncTap(r.hijacker,
+					r.memGuard.guardCapture(hijackerBodyWriter), r.tapDropped)
 			}
 		},
+		rewriteHeader,
 	); err != nil {
 		return num, err
 	}
 	num += wn
+	r.headerWrittenSize = num
+	if r.onHeaderRead != nil {
+		r.onHeaderRead()
+	}
+	if r.keepHeader {
+		if _, err = r.header.Parse(append([]byte(nil), r.header.Raw()...)); err != nil {
+			return num, util.ErrWrapper(err, "fail to keep http headers")
+		}
+	}
+	r.closeConnections()
+	r.closeClient = r.forceCloseClient
+	r.connInfo.setState(ConnStateRelayingBody)
 
 	if discardBody {
 		return num, nil
 	}
 
-	// write the request body (if any)
-	wn, err = copyBody(&r.header, &r.body, reader, r.writer,
-		func(rawBody []byte) {
-			if _, err := util.WriteWithValidation(hijackerBodyWriter, rawBody); err != nil {
-				// TODO: log the sniffer error
-			}
-		},
-	)
+	// write the response body (if any)
+	var bodyWriter io.Writer = r.writer
+	if r.bodyLimiter.limit > 0 {
+		r.bodyLimiter.w = r.writer
+		bodyWriter = &r.bodyLimiter
+	}
+	rawBodyWriter := bodyWriter
+	if chunked {
+		bodyWriter = chunkedWriter{rawBodyWriter}
+	}
+	bodyType := r.bodyType()
+	sniffBody := func(rawBody []byte) {
+		if _, err := util.WriteWithValidation(hijackerBodyWriter, rawBody); err != nil {
+			// TODO: log the sniffer error
+		}
+	}
+	if transform != nil {
+		wn, err = r.copyTransformedBody(bodyType, reader,
+			newTransformWriter(transform, transformEncoding, bodyWriter), sniffBody)
+	} else {
+		wn, err = copyBody(bodyType, r.header.ContentLength(), &r.body, reader, bodyWriter, sniffBody)
+	}
 	num += wn
+	if err == nil && chunked {
+		_, err = util.WriteWithValidation(rawBodyWriter, lastChunk)
+	}
+	// the client knows the end of the body only once it's closed
+	if !chunked && (transform != nil || bodyType == http.BodyTypeIdentity) {
+		r.closeClient = true
+	}
 	return num, err
 }
 
+// bodyType how the body is delimited, it's read until the target closes
+// the connection if neither Content-Length nor Transfer-Encoding is set,
+// the responses never having a body have none whatever the header tells,
+// RFC 7230 3.3.3
+func (r *Response) bodyType() http.BodyType {
+	if r.noBody || isBodylessStatus(r.respLine.GetStatusCode()) {
+		return http.BodyTypeFixedSize
+	}
+	bodyType := r.header.BodyType()
+	if bodyType != http.BodyTypeFixedSize || r.header.HasContentLength() {
+		return bodyType
+	}
+	return http.BodyTypeIdentity
+}
+
+// isBodylessStatus if the response of statusCode never has a body, i.e.
+// the 1xx, 204 No Content and 304 Not Modified ones
+func isBodylessStatus(statusCode int) bool {
+	return statusCode < 200 || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified
+}
+
+var (
+	http10        = []byte("HTTP/1.0")
+	http11        = []byte("HTTP/1.1")
+	chunkedHeader = []byte("Transfer-Encoding: chunked\r\n")
+	lastChunk     = []byte("0\r\n\r\n")
+	crlf          = []byte("\r\n")
+)
+
+// isPerHopOrTransferEncoding is the header line a per hop or
+// Transfer-Encoding one
+func isPerHopOrTransferEncoding(line []byte) bool {
+	return http.IsPerHopHeader(line) || http.IsTransferEncodingHeader(line)
+}
+
+// chunkedWriter writes every write as a chunk, without the last one
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func (c chunkedWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var sizeBuf [20]byte
+	size := append(strconv.AppendInt(sizeBuf[:0], int64(len(b)), 16), '\r', '\n')
+	if _, err := util.WriteWithValidation(c.w, size); err != nil {
+		return 0, err
+	}
+	n, err := util.WriteWithValidation(c.w, b)
+	if err != nil {
+		return n, err
+	}
+	if _, err = util.WriteWithValidation(c.w, crlf); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// isInterimStatus if the status code is a 1xx informational one which is
+// followed by the final response, 101 Switching Protocols is final
+func isInterimStatus(statusCode int) bool {
+	return statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols
+}
+
 // ConnectionClose if the request's "Connection" header value is set as "Close"
 // this determines how the client reusing the connections
 func (r *Response) ConnectionClose() bool {
-	return false
+	r.checkReleased()
+	// identity body is read until the connection closes, a HTTP/1.0
+	// target is not expected to keep it alive, and the hijacker may veto
+	return r.header.IsConnectionClose() || r.bodyType() == http.BodyTypeIdentity ||
+		!bytes.Equal(r.respLine.GetProtocol(), http11) || r.closeUpstream
 }
 
 // additionalDst used by copyHeader and copyBody for additional write
 type additionalDst func([]byte)
 
+// headerRewriter used by copyHeader once the header parsed, returns the
+// lines dropped and the extra ones appended to the header written to dst1
+type headerRewriter func() (drop func([]byte) bool, extra []byte)
+
 func copyHeader(header *http.Header,
-	src *bufio.Reader, dst1 io.Writer, dst2 additionalDst) (int, int, error) {
+	src *bufio.Reader, dst1 io.Writer, dst2 additionalDst, rewrite headerRewriter) (int, int, error) {
 	// read and write header
 	var originalHeaderLen, copiedHeaderLen int
 	var err error
@@ -429,57 +1109,113 @@ func copyHeader(header *http.Header,
 	}
 	defer src.Discard(originalHeaderLen)
 
-	copiedHeaderLen, err = parallelWriteHeader(dst1, dst2, rawHeader)
+	var drop func([]byte) bool
+	var extra []byte
+	if rewrite != nil {
+		drop, extra = rewrite()
+	}
+	copiedHeaderLen, err = parallelWriteHeader(dst1, dst2, rawHeader, drop, extra)
 	return originalHeaderLen, copiedHeaderLen, err
 }
 
 // parallelWriteBody write body data to dst1 dst2 concurrently
 // TODO: @daizong with timeout
-func parallelWriteHeader(dst1 io.Writer, dst2 additionalDst, header []byte) (int, error) {
+// the lines matching drop are not written to dst1, and extra is written
+// before the blank line ending the header
+func parallelWriteHeader(dst1 io.Writer, dst2 additionalDst, header []byte,
+	drop func([]byte) bool, extra []byte) (int, error) {
+	return parallelWriteCachedHeader(dst1, dst2, header, drop, extra, nil)
+}
+
+// parallelWriteCachedHeader same as parallelWriteHeader, the header written
+// to dst1 is serialized once into cache for the identical header and extra
+// written again, drop must be the same for them, no cache if nil
+func parallelWriteCachedHeader(dst1 io.Writer, dst2 additionalDst, header []byte,
+	drop func([]byte) bool, extra []byte, cache *transport.HeaderCache) (int, error) {
+	if serialized := cache.Header(header, extra); serialized != nil {
+		return writeSerializedHeader(dst1, dst2, header, serialized)
+	}
 	var wg sync.WaitGroup
 	var wn int
 	var err error
 	wg.Add(2)
 	go func() {
-		m := 0
-		unReadHeader := header
-		for {
-			unReadHeader = unReadHeader[m:]
-			m = bytes.IndexByte(unReadHeader, '\n')
-			if m < 0 {
-				break
-			}
-			m++
-			headerLine := unReadHeader[:m]
-			if !http.IsProxyHeader(headerLine) {
-				n, e := util.WriteWithValidation(dst1, headerLine)
+		if cache != nil {
+			serialized := cache.Build(header, extra, func(b []byte) []byte {
+				eachHeaderLine(header, drop, extra, func(line []byte) error {
+					b = append(b, line...)
+					return nil
+				})
+				return b
+			})
+			wn, err = util.WriteWithValidation(dst1, serialized)
+		} else {
+			err = eachHeaderLine(header, drop, extra, func(line []byte) error {
+				n, e := util.WriteWithValidation(dst1, line)
 				wn += n
-				if e != nil {
-					err = e
-					break
-				}
-			}
-
+				return e
+			})
 		}
 		wg.Done()
 	}()
-	go func() {
-		dst2(header)
-		wg.Done()
-	}()
+	repanic := goWithPanic(&wg, func() { dst2(header) })
+	wg.Wait()
+	repanic()
+	if err != nil {
+		return wn, util.ErrWrapper(err, "error occurred when write to dst")
+	}
+	return wn, nil
+}
+
+// writeSerializedHeader writes the header serialized to dst1 in place
+// while dst2 runs with the raw header
+func writeSerializedHeader(dst1 io.Writer, dst2 additionalDst, header, serialized []byte) (int, error) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	repanic := goWithPanic(&wg, func() { dst2(header) })
+	wn, err := util.WriteWithValidation(dst1, serialized)
 	wg.Wait()
+	repanic()
 	if err != nil {
 		return wn, util.ErrWrapper(err, "error occurred when write to dst")
 	}
 	return wn, nil
 }
 
-func copyBody(header *http.Header, body *http.Body,
+// eachHeaderLine calls write with the lines of header written, i.e. the
+// ones neither proxy headers nor matching drop, and extra before the blank
+// line ending the header, stops at the first error of write
+func eachHeaderLine(header []byte, drop func([]byte) bool, extra []byte,
+	write func(line []byte) error) error {
+	m := 0
+	unReadHeader := header
+	for {
+		unReadHeader = unReadHeader[m:]
+		m = bytes.IndexByte(unReadHeader, '\n')
+		if m < 0 {
+			return nil
+		}
+		m++
+		headerLine := unReadHeader[:m]
+		if len(extra) > 0 && m <= 2 && len(bytes.TrimSpace(headerLine)) == 0 {
+			if err := write(extra); err != nil {
+				return err
+			}
+		}
+		if !http.IsProxyHeader(headerLine) && (drop == nil || !drop(headerLine)) {
+			if err := write(headerLine); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func copyBody(bodyType http.BodyType, contentLength int64, body *http.Body,
 	src *bufio.Reader, dst1 io.Writer, dst2 additionalDst) (int, error) {
 	w := func(isChunkHeader bool, data []byte) (int, error) {
 		return parallelWriteBody(dst1, dst2, data)
 	}
-	return body.Parse(src, header.BodyType(), header.ContentLength(), w)
+	return body.Parse(src, bodyType, contentLength, w)
 }
 
 // parallelWriteBody write body data to dst1 dst2 concurrently
@@ -493,11 +1229,9 @@ func parallelWriteBody(dst1 io.Writer, dst2 additionalDst, data []byte) (int, er
 		wn, err = util.WriteWithValidation(dst1, data)
 		wg.Done()
 	}()
-	go func() {
-		dst2(data)
-		wg.Done()
-	}()
+	repanic := goWithPanic(&wg, func() { dst2(data) })
 	wg.Wait()
+	repanic()
 	if err != nil {
 		return wn, util.ErrWrapper(err, "error occurred when write to dst")
 	}
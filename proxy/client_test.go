@@ -33,7 +33,7 @@ func TestParallelWriteHeader(t *testing.T) {
 func testParallelWriteHeader(t *testing.T, buffer *bytebufferpool.ByteBuffer, fixedsizeB *bytebufferpool.FixedSizeByteBuffer, header []byte, expErr, expResult string) {
 	var additionalDst string
 	if buffer != nil {
-		n, err := parallelWriteHeader(buffer, func(p []byte) { additionalDst += string(p) }, header)
+		n, err := parallelWriteHeader(buffer, func(p []byte) { additionalDst += string(p) }, header, nil, nil)
 		if err != nil {
 			if !strings.Contains(err.Error(), expErr) {
 				t.Fatalf("expected error: error short buffer, but error: %s", err)
@@ -55,7 +55,7 @@ func testParallelWriteHeader(t *testing.T, buffer *bytebufferpool.ByteBuffer, fi
 			}
 		}
 	} else {
-		_, err := parallelWriteHeader(fixedsizeB, func(p []byte) { additionalDst += string(p) }, header)
+		_, err := parallelWriteHeader(fixedsizeB, func(p []byte) { additionalDst += string(p) }, header, nil, nil)
 		if err != nil {
 			if !strings.Contains(err.Error(), expErr) {
 				t.Fatalf("expected error: error short buffer, but error: %s", err)
@@ -277,7 +277,7 @@ func TestCopyHeader(t *testing.T) {
 	testF := func(b []byte) {
 		return
 	}
-	n, _, err := copyHeader(h, br, bw, testF)
+	n, _, err := copyHeader(h, br, bw, testF, nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -293,7 +293,7 @@ func TestCopyHeader(t *testing.T) {
 	testF = func(b []byte) {
 		return
 	}
-	n, _, err = copyHeader(h, ebr, bw, testF)
+	n, _, err = copyHeader(h, ebr, bw, testF, nil)
 	if err == nil {
 		t.Fatalf("unexpected error: fail to parse header")
 	}
@@ -312,8 +312,7 @@ func TestRequestPool(t *testing.T) {
 	request.header.ParseHeaderFields(bufio.NewReader(strings.NewReader("Connection: close\r\n\r\n")))
 	request.SetHijacker(&simpleHijacker{})
 	request.reader = bufio.NewReader(strings.NewReader("reader"))
-	reqline, _ := http.ParseRequestLine(bufio.NewReader(strings.NewReader("GET / HTTP1.1\r\n")))
-	request.reqLine = *reqline
+	request.reqLine.Parse(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n")))
 	request.proxy = &superproxy.SuperProxy{}
 	request.isTLS = true
 	request.tlsServerName = "localhost"
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// errFlightTooLarge the response coalesced exceeds the MaxObjectSize of the
+// cache, so it's cut off for the requests following it
+var errFlightTooLarge = errors.New("coalesced response too large")
+
+// cacheFlight the response of a request forwarded, i.e. the leader, which
+// is streamed to the identical requests following it, see Cache.Coalesce
+type cacheFlight struct {
+	key string
+	// header of the leader's request selecting the variant
+	header http.Header
+	max    int
+
+	lock sync.Mutex
+	cond sync.Cond
+	// buf the response written to the leader's client so far
+	buf       []byte
+	headerEnd int
+	// shared if the response is shared with the followers,
+	// known once the header is written
+	shared      bool
+	vary        []string
+	closeClient bool
+	followers   int
+	done        bool
+	err         error
+}
+
+func newCacheFlight(key string, header *http.Header, max int) *cacheFlight {
+	f := &cacheFlight{key: key, max: max}
+	f.header.Parse(append([]byte(nil), header.Raw()...))
+	f.cond.L = &f.lock
+	return f
+}
+
+// coalesce serves req with the response of the identical request in flight
+// streamed into w, otherwise req leads a flight of its own if coalescable.
+// served is false if req is to be forwarded, e.g. the response in flight
+// turns out not shared.
+func (c *Cache) coalesce(w *bufio.Writer, req *Request, ce *cacheExchange) (served bool, err error) {
+	// the conditional requests made by the clients expect responses of their own
+	if !c.Coalesce || !ce.revalidating && (ce.stale != nil ||
+		len(req.header.Peek("If-None-Match")) > 0 || len(req.header.Peek("If-Modified-Since")) > 0) {
+		return false, nil
+	}
+	key := ce.key + " " + string(req.Protocol())
+	c.flightsLock.Lock()
+	f := c.flights[key]
+	if f == nil {
+		if c.flights == nil {
+			c.flights = make(map[string]*cacheFlight)
+		}
+		f = newCacheFlight(key, &req.header, ce.writer.max)
+		c.flights[key] = f
+		c.flightsLock.Unlock()
+		ce.flight = f
+		return false, nil
+	}
+	f.lock.Lock()
+	f.followers++
+	f.lock.Unlock()
+	c.flightsLock.Unlock()
+	return f.follow(w, req)
+}
+
+// land ends the flight led by the request ended by err
+func (c *Cache) land(f *cacheFlight, err error) {
+	c.flightsLock.Lock()
+	if c.flights[f.key] == f {
+		delete(c.flights, f.key)
+	}
+	c.flightsLock.Unlock()
+
+	f.lock.Lock()
+	f.done = true
+	if f.err == nil {
+		f.err = err
+	}
+	f.cond.Broadcast()
+	f.lock.Unlock()
+}
+
+// write appends the response written to the leader's client
+func (f *cacheFlight) write(b []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return
+	}
+	if len(f.buf)+len(b) > f.max {
+		f.err = errFlightTooLarge
+		f.cond.Broadcast()
+		return
+	}
+	f.buf = append(f.buf, b...)
+	if f.headerEnd == 0 {
+		if i := bytes.Index(f.buf, []byte("\r\n\r\n")); i >= 0 {
+			f.headerEnd = i + 4
+			f.shared, f.vary, f.closeClient = sharedResponse(f.buf[:f.headerEnd], f.max)
+		}
+	}
+	f.cond.Broadcast()
+}
+
+// followed if any request is following the flight
+func (f *cacheFlight) followed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.followers > 0
+}
+
+func (f *cacheFlight) leave() {
+	f.lock.Lock()
+	f.followers--
+	f.lock.Unlock()
+}
+
+// follow streams the response of the flight into w as it's written to the
+// leader's client, served is false if the response is not shared with req
+// or the flight fails before any of it is streamed
+func (f *cacheFlight) follow(w *bufio.Writer, req *Request) (served bool, err error) {
+	defer f.leave()
+	f.lock.Lock()
+	for f.headerEnd == 0 && !f.done && f.err == nil {
+		f.cond.Wait()
+	}
+	shared := f.headerEnd > 0 && f.shared
+	for _, name := range f.vary {
+		shared = shared && bytes.Equal(f.header.Peek(name), req.header.Peek(name))
+	}
+	f.lock.Unlock()
+	if !shared {
+		return false, nil
+	}
+
+	for n := 0; ; {
+		f.lock.Lock()
+		for n == len(f.buf) && !f.done && f.err == nil {
+			f.cond.Wait()
+		}
+		b, done, flightErr := f.buf[n:], f.done, f.err
+		f.lock.Unlock()
+		if flightErr != nil && n == 0 {
+			return false, nil
+		} else if flightErr != nil {
+			return true, flightErr
+		}
+		if len(b) == 0 && done {
+			break
+		}
+		if n == 0 {
+			if err = req.discardRawHeader(); err != nil {
+				return true, err
+			}
+		}
+		if _, err = w.Write(b); err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			return true, err
+		}
+		n += len(b)
+	}
+	if f.closeClient {
+		// close the connection like the leader's client told to
+		return true, io.EOF
+	}
+	return true, nil
+}
+
+// sharedResponse if the raw response header is shared with the requests
+// coalesced, i.e. it's cacheable and its body of a known size no larger
+// than max, with the request header fields it varies by
+func sharedResponse(raw []byte, max int) (shared bool, vary []string, closeClient bool) {
+	i := bytes.IndexByte(raw, '\n')
+	if !cacheableStatus[statusCodeOf(raw[:i])] {
+		return false, nil, false
+	}
+	var header http.Header
+	if _, err := header.Parse(append([]byte(nil), raw[i+1:]...)); err != nil {
+		return false, nil, false
+	}
+	cacheControl := CacheControlOf(&header)
+	if cacheControl.NoStore() || cacheControl.Has("private") || len(header.Peek("Set-Cookie")) > 0 {
+		return false, nil, false
+	}
+	switch header.BodyType() {
+	case http.BodyTypeChunked:
+	case http.BodyTypeFixedSize:
+		if !header.HasContentLength() || len(raw)+int(header.ContentLength()) > max {
+			return false, nil, false
+		}
+	default:
+		return false, nil, false
+	}
+	for _, name := range bytes.Split(header.Peek("Vary"), []byte(",")) {
+		name = bytes.TrimSpace(name)
+		if bytes.Equal(name, []byte("*")) {
+			return false, nil, false
+		}
+		if len(name) > 0 {
+			vary = append(vary, string(name))
+		}
+	}
+	return true, vary, header.IsConnectionClose()
+}
+
+// flightWriter writes the response of the leader into its client and the
+// flight, the client failing is left alone while the flight is followed,
+// so that the response is still streamed to the followers
+type flightWriter struct {
+	f *cacheFlight
+	w io.Writer
+	// err the error writing into the client
+	err   error
+	abort bool
+}
+
+func (fw *flightWriter) Write(b []byte) (int, error) {
+	if fw.abort {
+		return 0, fw.err
+	}
+	fw.f.write(b)
+	if fw.err == nil {
+		_, fw.err = fw.w.Write(b)
+	}
+	if fw.err != nil && !fw.f.followed() {
+		fw.abort = true
+		return 0, fw.err
+	}
+	return len(b), nil
+}
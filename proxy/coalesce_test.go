@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheCoalesce(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	body := strings.Repeat("hot", 1000)
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		atomic.AddInt32(&hits, 1)
+		if strings.HasPrefix(r.URL.Path, "/private") {
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		sent := 0
+		if !strings.HasSuffix(r.URL.Path, "/silent") {
+			// the leader's response is in flight when followed
+			sent, _ = w.Write([]byte(body[:100]))
+			w.(nethttp.Flusher).Flush()
+		}
+		<-release
+		w.Write([]byte(body[sent:]))
+	}))
+	defer origin.Close()
+
+	p := newTestProxy(t, func(p *Proxy) {
+		p.Cache = &Cache{Coalesce: true}
+	})
+	// send the request through p by the client returned
+	send := func(path string) net.Conn {
+		client, server := net.Pipe()
+		go func() {
+			p.serveConn(server)
+			server.Close()
+		}()
+		go client.Write([]byte("GET " + origin.URL + path + " HTTP/1.1\r\nConnection: close\r\n\r\n"))
+		return client
+	}
+	bodies := make(chan string, 10)
+	get := func(path string) {
+		client := send(path)
+		defer client.Close()
+		resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			bodies <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		bodies <- string(b)
+	}
+	waitFor := func(what string, cond func() bool) {
+		for i := 0; !cond(); i++ {
+			if i == 200 {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	followers := func() (n int) {
+		p.Cache.flightsLock.Lock()
+		defer p.Cache.flightsLock.Unlock()
+		for _, f := range p.Cache.flights {
+			f.lock.Lock()
+			n += f.followers
+			f.lock.Unlock()
+		}
+		return
+	}
+	coalesce := func(path string, n int) {
+		go get(path)
+		waitFor("the leader", func() bool { return atomic.LoadInt32(&hits) == 1 })
+		for i := 0; i < n; i++ {
+			go get(path)
+		}
+		waitFor("the followers", func() bool { return followers() == n })
+	}
+	expectBodies := func(name string, n int) {
+		for i := 0; i < n; i++ {
+			if b := <-bodies; b != body {
+				t.Fatalf("%s: unexpected body %q", name, b)
+			}
+		}
+	}
+
+	// the response is fetched once for all
+	coalesce("/hot", 5)
+	close(release)
+	expectBodies("cacheable", 6)
+	if hits != 1 {
+		t.Fatalf("unexpected %d upstream requests", hits)
+	}
+	// and cached
+	if _, b := proxyTestRequest(t, p, "GET", origin.URL+"/hot", "", ""); b != body || hits != 1 {
+		t.Fatalf("unexpected body %q after %d upstream requests", b, hits)
+	}
+
+	// the ones waiting for the response not cacheable are forwarded on their own
+	release = make(chan struct{})
+	hits = 0
+	coalesce("/private", 3)
+	close(release)
+	expectBodies("private", 4)
+	if hits != 4 {
+		t.Fatalf("unexpected %d upstream requests", hits)
+	}
+
+	// the clients disconnecting leave the others alone, the leader included
+	release = make(chan struct{})
+	hits = 0
+	leader := send("/silent")
+	waitFor("the leader", func() bool { return atomic.LoadInt32(&hits) == 1 })
+	follower := send("/silent")
+	for i := 0; i < 2; i++ {
+		go get("/silent")
+	}
+	waitFor("the followers", func() bool { return followers() == 3 })
+	leader.Close()
+	follower.Close()
+	close(release)
+	expectBodies("disconnected", 2)
+	if hits != 1 {
+		t.Fatalf("unexpected %d upstream requests", hits)
+	}
+}
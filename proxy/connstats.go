@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats traffic of a client connection given to OnConnClose, covering
+// all the requests and tunnels served over it
+type ConnStats struct {
+	// ClientAddr remote address of the client
+	ClientAddr net.Addr
+	// BytesRead bytes read from the client
+	BytesRead int64
+	// BytesWritten bytes written to the client
+	BytesWritten int64
+	// Duration how long the connection has been served
+	Duration time.Duration
+}
+
+// connStats the stats of the connection tracked by info
+func connStats(addr net.Addr, info *connInfo) ConnStats {
+	return ConnStats{
+		ClientAddr:   addr,
+		BytesRead:    atomic.LoadInt64(&info.bytesIn),
+		BytesWritten: atomic.LoadInt64(&info.bytesOut),
+		Duration:     time.Since(info.start),
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingConn counts the bytes the client read and written
+type countingConn struct {
+	net.Conn
+	read, written int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func TestOnConnClose(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	echo := listenLocal(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	defer echo.Close()
+
+	statsChan := make(chan ConnStats, 1)
+	p := newTestProxy(t, func(p *Proxy) {
+		p.OnConnClose = func(stats ConnStats) { statsChan <- stats }
+	})
+	serve := func(talk func(c *countingConn, reader *bufio.Reader)) {
+		client, server := net.Pipe()
+		c := &countingConn{Conn: client}
+		go func() {
+			p.serveConn(server)
+			server.Close()
+		}()
+		talk(c, bufio.NewReader(c))
+		c.Close()
+		stats := <-statsChan
+		read, written := atomic.LoadInt64(&c.read), atomic.LoadInt64(&c.written)
+		if stats.BytesRead != written || stats.BytesWritten != read || stats.Duration <= 0 {
+			t.Fatalf("unexpected stats %+v, client read %d written %d", stats, read, written)
+		}
+	}
+
+	// keep-alive requests
+	serve(func(c *countingConn, reader *bufio.Reader) {
+		for _, header := range []string{"", "Connection: close\r\n"} {
+			go c.Write([]byte("GET " + origin.URL + "/ HTTP/1.1\r\n" + header + "\r\n"))
+			resp, err := nethttp.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			ioutil.ReadAll(resp.Body)
+		}
+		ioutil.ReadAll(reader)
+	})
+
+	// tunnel
+	serve(func(c *countingConn, reader *bufio.Reader) {
+		go c.Write([]byte("CONNECT " + echo.Addr().String() + " HTTP/1.1\r\n\r\n"))
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("unexpected response %v %v", resp, err)
+		}
+		go c.Write([]byte("ping"))
+		pong := make([]byte, 4)
+		if _, err := io.ReadFull(reader, pong); err != nil || string(pong) != "ping" {
+			t.Fatalf("unexpected echo %q %v", pong, err)
+		}
+		// let the relay count the echo written before closing
+		time.Sleep(10 * time.Millisecond)
+	})
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/servertime"
+)
+
+// CORSPreflight answers the CORS preflight requests locally instead of
+// forwarding them to the targets, the other OPTIONS requests are forwarded
+// as is. A preflight is an OPTIONS request with both the Origin and the
+// Access-Control-Request-Method header fields.
+type CORSPreflight struct {
+	// Match selects the preflight requests answered by their target host
+	// with port and path, all of them are answered if not set
+	Match func(hostWithPort, path string) bool
+	// AllowOrigins origins allowed, e.g. `https://app.example.com`, which
+	// are reflected in Access-Control-Allow-Origin, `*` allows any origin
+	AllowOrigins []string
+	// AllowMethods methods allowed, the method requested is reflected if not set
+	AllowMethods []string
+	// AllowHeaders header fields allowed, the ones requested are reflected if not set
+	AllowHeaders []string
+	// AllowCredentials allows the requests with credentials
+	AllowCredentials bool
+	// MaxAge how long the answer is cached by the clients, sent in seconds,
+	// the Access-Control-Max-Age header field is not sent if not set
+	MaxAge time.Duration
+	// RejectDisallowed answers the preflights of the origins not allowed with
+	// 403, they're forwarded to the targets by default
+	RejectDisallowed bool
+}
+
+var (
+	methodOptions            = []byte("OPTIONS")
+	corsDisallowedOriginBody = "CORS preflight from a disallowed origin.\n"
+)
+
+// answer the raw response of the preflight req, nil if it's forwarded
+func (c *CORSPreflight) answer(req *Request) []byte {
+	if !bytes.Equal(req.Method(), methodOptions) {
+		return nil
+	}
+	origin := req.header.Peek("Origin")
+	requestMethod := req.header.Peek("Access-Control-Request-Method")
+	if len(origin) == 0 || len(requestMethod) == 0 {
+		return nil
+	}
+	if c.Match != nil && !c.Match(req.reqLine.HostInfo().HostWithPort(),
+		string(req.reqLine.URI().Path())) {
+		return nil
+	}
+
+	if !c.allowed(string(origin)) {
+		if !c.RejectDisallowed {
+			return nil
+		}
+		return []byte(fmt.Sprintf("%sDate: %s\r\n"+
+			"Vary: Origin\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"Content-Length: %d\r\n"+
+			"\r\n%s",
+			http.StatusLine(http.StatusForbidden), servertime.ServerDate(),
+			len(corsDisallowedOriginBody), corsDisallowedOriginBody))
+	}
+
+	methods := string(requestMethod)
+	if len(c.AllowMethods) > 0 {
+		methods = strings.Join(c.AllowMethods, ", ")
+	}
+	headers := string(req.header.Peek("Access-Control-Request-Headers"))
+	if len(c.AllowHeaders) > 0 {
+		headers = strings.Join(c.AllowHeaders, ", ")
+	}
+	var b bytes.Buffer
+	b.Write(http.StatusLine(http.StatusNoContent))
+	fmt.Fprintf(&b, "Date: %s\r\n", servertime.ServerDate())
+	b.WriteString("Access-Control-Allow-Origin: " + string(origin) + "\r\n")
+	b.WriteString("Vary: Origin\r\n")
+	b.WriteString("Access-Control-Allow-Methods: " + methods + "\r\n")
+	if len(headers) > 0 {
+		b.WriteString("Access-Control-Allow-Headers: " + headers + "\r\n")
+	}
+	if c.AllowCredentials {
+		b.WriteString("Access-Control-Allow-Credentials: true\r\n")
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("Access-Control-Max-Age: " + strconv.Itoa(int(c.MaxAge/time.Second)) + "\r\n")
+	}
+	b.WriteString("Content-Length: 0\r\n\r\n")
+	return b.Bytes()
+}
+
+// allowed if origin is one of AllowOrigins
+func (c *CORSPreflight) allowed(origin string) bool {
+	for _, allowed := range c.AllowOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// finishHijacker records the statuses of the responses finished
+type finishHijacker struct {
+	tlsTestHijacker
+	statuses []int
+	finished int
+}
+
+func (h *finishHijacker) OnResponse(line http.ResponseLine, header http.Header, raw []byte) io.WriteCloser {
+	h.statuses = append(h.statuses, line.GetStatusCode())
+	return nil
+}
+func (h *finishHijacker) AfterResponse(error) { h.finished++ }
+
+type finishHijackerPool struct{ h *finishHijacker }
+
+func (p finishHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p finishHijackerPool) Put(Hijacker) {}
+
+func TestCORSPreflight(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	h := &finishHijacker{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = finishHijackerPool{h}
+		p.HostStats = &HostStats{}
+		p.CORSPreflight = &CORSPreflight{
+			Match:        func(hostWithPort, path string) bool { return strings.HasPrefix(path, "/api/") },
+			AllowOrigins: []string{"https://app.example.com"},
+			AllowMethods: []string{"GET", "POST"},
+			MaxAge:       10 * time.Minute,
+		}
+	})
+	preflight := "Origin: %s\r\nAccess-Control-Request-Method: POST\r\n" +
+		"Access-Control-Request-Headers: X-Token\r\n"
+
+	// answered locally for the allowed origin
+	resp, body := proxyTestRequest(t, p, "OPTIONS", origin.URL+"/api/items",
+		strings.Replace(preflight, "%s", "https://app.example.com", 1), "")
+	if resp.StatusCode != 204 || len(body) != 0 || atomic.LoadInt32(&hits) != 0 {
+		t.Fatalf("unexpected preflight answer %d %q, %d origin hits", resp.StatusCode, body, hits)
+	}
+	for key, value := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "X-Token",
+		"Access-Control-Max-Age":       "600",
+		"Vary":                         "Origin",
+	} {
+		if v := resp.Header.Get(key); v != value {
+			t.Fatalf("unexpected %s %q", key, v)
+		}
+	}
+	if len(resp.Header.Get("Date")) == 0 || resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatalf("unexpected header %v", resp.Header)
+	}
+	if len(h.statuses) != 1 || h.statuses[0] != 204 || h.finished != 1 {
+		t.Fatalf("unexpected hijacker calls %v %d", h.statuses, h.finished)
+	}
+	if top := p.HostStats.TopHosts(1, MetricRequests); len(top) != 1 || top[0].Requests != 1 {
+		t.Fatalf("unexpected host stats %+v", top)
+	}
+
+	// the disallowed origins, the other paths and the plain OPTIONS are forwarded
+	for i, header := range []string{
+		strings.Replace(preflight, "%s", "https://evil.example.com", 1),
+		"Origin: https://app.example.com\r\n",
+		"",
+	} {
+		if _, body = proxyTestRequest(t, p, "OPTIONS", origin.URL+"/api/items", header, ""); body != "origin" {
+			t.Fatalf("unexpected body %q", body)
+		}
+		if n := atomic.LoadInt32(&hits); n != int32(i+1) {
+			t.Fatalf("expected OPTIONS forwarded, got %d origin hits", n)
+		}
+	}
+	if _, body = proxyTestRequest(t, p, "OPTIONS", origin.URL+"/static",
+		strings.Replace(preflight, "%s", "https://app.example.com", 1), ""); body != "origin" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	// the disallowed origins are rejected if asked
+	p.CORSPreflight.RejectDisallowed = true
+	resp, _ = proxyTestRequest(t, p, "OPTIONS", origin.URL+"/api/items",
+		strings.Replace(preflight, "%s", "https://evil.example.com", 1), "")
+	if resp.StatusCode != 403 || resp.Header.Get("Access-Control-Allow-Origin") != "" ||
+		atomic.LoadInt32(&hits) != 4 {
+		t.Fatalf("unexpected rejection %d %v", resp.StatusCode, resp.Header)
+	}
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/client"
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte("timeout header: " + r.Header.Get("X-Proxy-Timeout")))
+	}))
+	defer origin.Close()
+
+	newProxy := func() *Proxy {
+		return newTestProxy(t, func(p *Proxy) {
+			p.RequestTimeoutHeader = "X-Proxy-Timeout"
+		})
+	}
+	expect := func(p *Proxy, path, header string, status int, maxDuration time.Duration) {
+		start := time.Now()
+		resp, body := proxyTestRequest(t, p, "GET", origin.URL+path, header, "")
+		if resp.StatusCode != status {
+			t.Fatalf("unexpected status of %s: %d %s", path, resp.StatusCode, body)
+		}
+		if status == nethttp.StatusOK && body != "timeout header: " {
+			t.Fatalf("unexpected body of %s: %s", path, body)
+		}
+		if d := time.Since(start); d > maxDuration {
+			t.Fatalf("unexpected duration of %s: %s", path, d)
+		}
+	}
+
+	// deadline of the response read
+	p := newProxy()
+	expect(p, "/", "X-Proxy-Timeout: 1s\r\n", nethttp.StatusOK, time.Second)
+	expect(p, "/slow", "X-Proxy-Timeout: 0.1\r\n", nethttp.StatusGatewayTimeout, 250*time.Millisecond)
+	p.RequestTimeout = func(hostWithPort string) time.Duration { return 100 * time.Millisecond }
+	expect(p, "/slow", "", nethttp.StatusGatewayTimeout, 250*time.Millisecond)
+	expect(p, "/slow", "X-Proxy-Timeout: 1s\r\n", nethttp.StatusGatewayTimeout, 250*time.Millisecond)
+
+	// deadline of the dial
+	p = newProxy()
+	p.Dial = func(addr string) (net.Conn, error) {
+		time.Sleep(300 * time.Millisecond)
+		return net.Dial("tcp", addr)
+	}
+	expect(p, "/", "X-Proxy-Timeout: 100ms\r\n", nethttp.StatusGatewayTimeout, 250*time.Millisecond)
+}
+
+// budgetHijacker decrypts the tunnels with dial, dialTLS and superProxy,
+// recording the errors of the requests
+type budgetHijacker struct {
+	tlsTestHijacker
+	dial       func(addr string) (net.Conn, error)
+	dialTLS    func(addr string, tlsConfig *tls.Config) (net.Conn, error)
+	superProxy *superproxy.SuperProxy
+	errs       chan error
+}
+
+func (h *budgetHijacker) Dial() func(addr string) (net.Conn, error) { return h.dial }
+func (h *budgetHijacker) DialTLS() func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	return h.dialTLS
+}
+func (h *budgetHijacker) SuperProxy() *superproxy.SuperProxy { return h.superProxy }
+func (h *budgetHijacker) AfterResponse(err error)            { h.errs <- err }
+
+type budgetHijackerPool struct{ h *budgetHijacker }
+
+func (p budgetHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p budgetHijackerPool) Put(Hijacker) {}
+
+func TestDeadlineBudget(t *testing.T) {
+	const budget, epsilon = 100 * time.Millisecond, 50 * time.Millisecond
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(3 * budget)
+		case "/slow-body":
+			w.Header().Set("Content-Length", "4")
+			w.Write([]byte("ok"))
+			w.(nethttp.Flusher).Flush()
+			time.Sleep(3 * budget)
+		}
+	}))
+	defer origin.Close()
+	// silent accepts connections never responded
+	silent := listenLocal(t, func(c net.Conn) {
+		io.Copy(ioutil.Discard, c)
+	})
+	defer silent.Close()
+
+	logger := &recordingLogger{}
+	h := &budgetHijacker{errs: make(chan error, 1)}
+	newProxy := func() *Proxy {
+		p := newTestProxy(t, func(p *Proxy) {
+			p.HijackerPool = budgetHijackerPool{h}
+			p.RequestTimeout = func(string) time.Duration { return budget }
+		})
+		p.logger = &LeveledLogger{Logger: logger, Level: LogLevelDebug}
+		return p
+	}
+	expect := func(name string, phase client.Phase, do func()) {
+		start := time.Now()
+		do()
+		err := <-h.errs
+		if d := time.Since(start); d > budget+epsilon {
+			t.Fatalf("%s: budget exceeded by %s", name, d-budget)
+		}
+		var deadlineErr *client.DeadlineError
+		if !errors.As(err, &deadlineErr) || deadlineErr.Phase != phase {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+	}
+
+	// slow dial
+	p := newProxy()
+	h.dial = func(addr string) (net.Conn, error) {
+		time.Sleep(3 * budget)
+		return net.Dial("tcp", addr)
+	}
+	expect("dial", client.PhaseDial, func() { proxyTestRequest(t, p, "GET", origin.URL+"/", "", "") })
+	h.dial = nil
+
+	// super proxy never answers the handshake
+	p = newProxy()
+	port := silent.Addr().(*net.TCPAddr).Port
+	h.superProxy, _ = superproxy.NewSuperProxy("127.0.0.1", uint16(port), superproxy.ProxyTypeSOCKS5, "", "", "")
+	expect("super proxy", client.PhaseDial, func() { proxyTestRequest(t, p, "GET", origin.URL+"/", "", "") })
+	h.superProxy = nil
+
+	// target never answers the TLS handshake, the MITM certificate
+	// is made beforehand so that only the upstream is timed
+	p = newProxy()
+	tlsOrigin := httptest.NewTLSServer(nethttp.HandlerFunc(func(nethttp.ResponseWriter, *nethttp.Request) {}))
+	defer tlsOrigin.Close()
+	h.dialTLS = h.tlsTestHijacker.DialTLS()
+	decryptedGet(t, p, tlsOrigin.Listener.Addr().String(), "example.com")
+	<-h.errs
+	h.dialTLS = nil
+	expect("tls", client.PhaseTLS, func() { decryptedGet(t, p, silent.Addr().String(), "example.com") })
+
+	// slow first byte, then slow body
+	p = newProxy()
+	expect("ttfb", client.PhaseTTFB, func() { proxyTestRequest(t, p, "GET", origin.URL+"/slow", "", "") })
+	expect("read", client.PhaseRead, func() { proxyTestRequest(t, p, "GET", origin.URL+"/slow-body", "", "") })
+
+	// the time spent is traced
+	traced := false
+	for _, l := range logger.logged() {
+		traced = traced || strings.Contains(l, "budget: dial")
+	}
+	if !traced {
+		t.Fatalf("budget not traced in %q", logger.logged())
+	}
+}
@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+const (
+	// DebugConnectionsPath path of the connection dump endpoint
+	DebugConnectionsPath = "/debug/connections"
+	// DebugConfigPath path of the effective configuration endpoint
+	DebugConfigPath = "/debug/config"
+	// DebugTracesPath path of the trace events kept by RequestTracing
+	DebugTracesPath = "/debug/traces"
+)
+
+// DebugEndpoints self-diagnostics endpoints served by the proxy itself,
+// i.e. DebugConnectionsPath, DebugConfigPath and DebugTracesPath
+type DebugEndpoints struct {
+	// Host optional host name of the endpoints for absolute-form requests,
+	// requests sent to the proxy directly always match.
+	Host string
+
+	// Token debug token required in the `Authorization: Bearer <token>`
+	// header, ignored if Authorize is set
+	Token string
+
+	// Authorize optional access check of the endpoints, all requests are
+	// denied if neither Authorize nor Token is set
+	Authorize func(clientAddr net.Addr, header http.Header) bool
+}
+
+// match whether the request is asking for a debug endpoint
+func (d *DebugEndpoints) match(req *Request) bool {
+	if d == nil || http.IsMethodConnect(req.Method()) {
+		return false
+	}
+	path := req.reqLine.URI().Path()
+	if !bytes.Equal(path, []byte(DebugConnectionsPath)) &&
+		!bytes.Equal(path, []byte(DebugConfigPath)) &&
+		!bytes.Equal(path, []byte(DebugTracesPath)) {
+		return false
+	}
+	domain := req.reqLine.HostInfo().Domain()
+	return len(domain) == 0 || (len(d.Host) > 0 && strings.EqualFold(domain, d.Host))
+}
+
+// authorize whether the client is allowed to access the endpoints
+func (d *DebugEndpoints) authorize(clientAddr net.Addr, header *http.Header) bool {
+	if d.Authorize != nil {
+		return d.Authorize(clientAddr, *header)
+	}
+	if len(d.Token) == 0 {
+		return false
+	}
+	auth := header.Peek("Authorization")
+	if !bytes.HasPrefix(auth, []byte("Bearer ")) {
+		return false
+	}
+	return subtle.ConstantTimeCompare(auth[len("Bearer "):], []byte(d.Token)) == 1
+}
+
+// serveDebug serves the debug endpoint asked by the request
+func (p *Proxy) serveDebug(c net.Conn, req *Request) error {
+	if !p.DebugEndpoints.authorize(c.RemoteAddr(), &req.header) {
+		return writeFastError(c, http.StatusForbidden, "Forbidden.\n")
+	}
+	var v interface{}
+	switch path := req.reqLine.URI().Path(); {
+	case bytes.Equal(path, []byte(DebugConnectionsPath)):
+		v = p.connTracker.dump()
+	case bytes.Equal(path, []byte(DebugTracesPath)):
+		v = p.RequestTracing.Events()
+	default:
+		v = p.debugConfig()
+	}
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeLocalResponse(c, "application/json", content)
+}
+
+// ConnState phase of a client connection served by the proxy
+type ConnState int32
+
+const (
+	// ConnStateReadingHeader waiting for or reading the request header
+	ConnStateReadingHeader ConnState = iota
+	// ConnStateAwaitingUpstream request forwarded, waiting for the response
+	ConnStateAwaitingUpstream
+	// ConnStateRelayingBody relaying the response body to the client
+	ConnStateRelayingBody
+	// ConnStateTunnel relaying a CONNECT tunnel
+	ConnStateTunnel
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateReadingHeader:
+		return "reading-header"
+	case ConnStateAwaitingUpstream:
+		return "awaiting-upstream"
+	case ConnStateRelayingBody:
+		return "relaying-body"
+	case ConnStateTunnel:
+		return "tunnel"
+	}
+	return "unknown"
+}
+
+// connInfo lightweight state of a client connection updated at phase
+// transitions, a nil *connInfo ignores all the updates
+type connInfo struct {
+	state      int32
+	bytesIn    int64
+	bytesOut   int64
+	target     atomic.Value
+	superProxy atomic.Value
+	clientAddr string
+	start      time.Time
+}
+
+func (i *connInfo) setState(s ConnState) {
+	if i != nil {
+		atomic.StoreInt32(&i.state, int32(s))
+	}
+}
+
+// setUpstream sets the target host and super proxy the connection is using
+func (i *connInfo) setUpstream(hostWithPort string, proxy *superproxy.SuperProxy) {
+	if i == nil {
+		return
+	}
+	i.target.Store(hostWithPort)
+	proxyHostWithPort := ""
+	if proxy != nil {
+		proxyHostWithPort = proxy.HostWithPort()
+	}
+	i.superProxy.Store(proxyHostWithPort)
+}
+
+// trackedConn counts the bytes read from and written to the client
+type trackedConn struct {
+	net.Conn
+	info *connInfo
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.info.bytesIn, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.info.bytesOut, int64(n))
+	return n, err
+}
+
+// connTracker tracks the client connections being served
+type connTracker struct {
+	conns sync.Map
+}
+
+func (t *connTracker) register(c net.Conn) *connInfo {
+	info := &connInfo{clientAddr: c.RemoteAddr().String(), start: time.Now()}
+	t.conns.Store(info, struct{}{})
+	return info
+}
+
+func (t *connTracker) unregister(info *connInfo) {
+	t.conns.Delete(info)
+}
+
+// DebugConn a client connection dumped by DebugConnectionsPath
+type DebugConn struct {
+	ClientAddr string `json:"client_addr"`
+	State      string `json:"state"`
+	Target     string `json:"target,omitempty"`
+	SuperProxy string `json:"super_proxy,omitempty"`
+	BytesIn    int64  `json:"bytes_in"`
+	BytesOut   int64  `json:"bytes_out"`
+	AgeMillis  int64  `json:"age_ms"`
+}
+
+func (t *connTracker) dump() []DebugConn {
+	now := time.Now()
+	conns := make([]DebugConn, 0)
+	t.conns.Range(func(k, _ interface{}) bool {
+		info := k.(*connInfo)
+		conn := DebugConn{
+			ClientAddr: info.clientAddr,
+			State:      ConnState(atomic.LoadInt32(&info.state)).String(),
+			BytesIn:    atomic.LoadInt64(&info.bytesIn),
+			BytesOut:   atomic.LoadInt64(&info.bytesOut),
+			AgeMillis:  int64(now.Sub(info.start) / time.Millisecond),
+		}
+		conn.Target, _ = info.target.Load().(string)
+		conn.SuperProxy, _ = info.superProxy.Load().(string)
+		conns = append(conns, conn)
+		return true
+	})
+	return conns
+}
+
+// DebugConfig effective non-secret configuration dumped by DebugConfigPath
+type DebugConfig struct {
+	ReadBufferSize               int    `json:"read_buffer_size"`
+	WriteBufferSize              int    `json:"write_buffer_size"`
+	ServerIdleDuration           string `json:"server_idle_duration"`
+	ServerReadTimeout            string `json:"server_read_timeout"`
+	ServerWriteTimeout           string `json:"server_write_timeout"`
+	ServerConcurrency            int    `json:"server_concurrency"`
+	ServerShutdownWaitTime       string `json:"server_shutdown_wait_time"`
+	ForwardConcurrencyPerHost    int    `json:"forward_concurrency_per_host"`
+	ForwardIdleConnDuration      string `json:"forward_idle_conn_duration"`
+	ForwardReadTimeout           string `json:"forward_read_timeout"`
+	ForwardWriteTimeout          string `json:"forward_write_timeout"`
+	ForwardResponseHeaderTimeout string `json:"forward_response_header_timeout"`
+	ForwardBodyInactivityTimeout string `json:"forward_body_inactivity_timeout"`
+	SuperProxyHandshakeTimeout   string `json:"super_proxy_handshake_timeout"`
+	MaxConcurrentRequestsPerHost int    `json:"max_concurrent_requests_per_host"`
+	PerHostQueueTimeout          string `json:"per_host_queue_timeout"`
+	PerHostRetryAfter            string `json:"per_host_retry_after"`
+	StripExpectContinue          bool   `json:"strip_expect_continue"`
+	TLSHandshakeTimeout          string `json:"tls_handshake_timeout"`
+	TunnelClientToServerBufSize  int    `json:"tunnel_client_to_server_buf_size"`
+	TunnelServerToClientBufSize  int    `json:"tunnel_server_to_client_buf_size"`
+	TunnelWriteCoalesceWindow    string `json:"tunnel_write_coalesce_window"`
+	RequestBodyBufSize           int    `json:"request_body_buf_size"`
+	SuperProxy                   string `json:"super_proxy,omitempty"`
+	SuperProxyType               string `json:"super_proxy_type,omitempty"`
+	MITMEnabled                  bool   `json:"mitm_enabled"`
+	HijackerEnabled              bool   `json:"hijacker_enabled"`
+	HostStatsEnabled             bool   `json:"host_stats_enabled"`
+	PACFilePath                  string `json:"pac_file_path,omitempty"`
+}
+
+func (p *Proxy) debugConfig() *DebugConfig {
+	cfg := &DebugConfig{
+		ReadBufferSize:               p.ReadBufferSize,
+		WriteBufferSize:              p.WriteBufferSize,
+		ServerIdleDuration:           p.ServerIdleDuration.String(),
+		ServerReadTimeout:            p.ServerReadTimeout.String(),
+		ServerWriteTimeout:           p.ServerWriteTimeout.String(),
+		ServerConcurrency:            p.ServerConcurrency,
+		ServerShutdownWaitTime:       p.ServerShutdownWaitTime.String(),
+		ForwardConcurrencyPerHost:    p.ForwardConcurrencyPerHost,
+		ForwardIdleConnDuration:      p.ForwardIdleConnDuration.String(),
+		ForwardReadTimeout:           p.ForwardReadTimeout.String(),
+		ForwardWriteTimeout:          p.ForwardWriteTimeout.String(),
+		ForwardResponseHeaderTimeout: p.ForwardResponseHeaderTimeout.String(),
+		ForwardBodyInactivityTimeout: p.ForwardBodyInactivityTimeout.String(),
+		SuperProxyHandshakeTimeout:   p.SuperProxyHandshakeTimeout.String(),
+		MaxConcurrentRequestsPerHost: p.MaxConcurrentRequestsPerHost,
+		PerHostQueueTimeout:          p.PerHostQueueTimeout.String(),
+		PerHostRetryAfter:            p.perHostRetryAfter().String(),
+		StripExpectContinue:          p.StripExpectContinue,
+		TLSHandshakeTimeout:          p.TLSHandshakeTimeout.String(),
+		TunnelClientToServerBufSize:  p.TunnelClientToServerBufSize,
+		TunnelServerToClientBufSize:  p.TunnelServerToClientBufSize,
+		TunnelWriteCoalesceWindow:    p.TunnelWriteCoalesceWindow.String(),
+		RequestBodyBufSize:           p.RequestBodyBufSize,
+		MITMEnabled:                  p.MITMCertAuthority != nil,
+		HijackerEnabled:              p.HijackerPool != nil,
+		HostStatsEnabled:             p.HostStats != nil,
+	}
+	if p.SuperProxy != nil {
+		// credentials of the super proxy are left out
+		cfg.SuperProxy = p.SuperProxy.HostWithPort()
+		switch p.SuperProxy.GetProxyType() {
+		case superproxy.ProxyTypeHTTP:
+			cfg.SuperProxyType = "http"
+		case superproxy.ProxyTypeHTTPS:
+			cfg.SuperProxyType = "https"
+		case superproxy.ProxyTypeSOCKS5:
+			cfg.SuperProxyType = "socks5"
+		}
+	}
+	if p.PACFile != nil {
+		cfg.PACFilePath = p.PACFile.Path
+	}
+	return cfg
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	p := newTestProxy(t, func(p *Proxy) {
+		p.StripExpectContinue = true
+		p.DebugEndpoints = &DebugEndpoints{Token: "secret"}
+	})
+
+	// keep a tunnel open while dumping the connections
+	tunnelClient, tunnelServer := net.Pipe()
+	defer tunnelClient.Close()
+	go func() {
+		p.serveConn(tunnelServer)
+		tunnelServer.Close()
+	}()
+	target := ln.Addr().String()
+	go tunnelClient.Write([]byte("CONNECT " + target + " HTTP/1.1\r\n\r\n"))
+	br := bufio.NewReader(tunnelClient)
+	resp, err := nethttp.ReadResponse(br, &nethttp.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("unexpected tunnel response %v %v", resp, err)
+	}
+	go tunnelClient.Write([]byte("ping"))
+	if _, err := io.ReadFull(br, make([]byte, 4)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if code, _ := getDebugEndpoint(t, p, DebugConnectionsPath, ""); code != 403 {
+		t.Fatalf("expected 403 without token, got %d", code)
+	}
+	if code, _ := getDebugEndpoint(t, p, DebugConnectionsPath, "Bearer wrong"); code != 403 {
+		t.Fatalf("expected 403 with wrong token, got %d", code)
+	}
+	if code, _ := getDebugEndpoint(t, p, DebugConnectionsPath, "Basic secret"); code != 403 {
+		t.Fatalf("expected 403 with wrong scheme, got %d", code)
+	}
+
+	code, body := getDebugEndpoint(t, p, DebugConnectionsPath, "Bearer secret")
+	if code != 200 {
+		t.Fatalf("unexpected status code %d", code)
+	}
+	var conns []DebugConn
+	if err := json.Unmarshal(body, &conns); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var tunnel *DebugConn
+	for i := range conns {
+		if conns[i].State == ConnStateTunnel.String() {
+			tunnel = &conns[i]
+		}
+	}
+	if len(conns) != 2 || tunnel == nil {
+		t.Fatalf("unexpected connections %+v", conns)
+	}
+	if tunnel.Target != target || tunnel.BytesIn == 0 || tunnel.BytesOut == 0 {
+		t.Fatalf("unexpected tunnel connection %+v", tunnel)
+	}
+
+	code, body = getDebugEndpoint(t, p, DebugConfigPath, "Bearer secret")
+	if code != 200 {
+		t.Fatalf("unexpected status code %d", code)
+	}
+	var cfg DebugConfig
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !cfg.StripExpectContinue || cfg.PerHostRetryAfter != DefaultPerHostRetryAfter.String() {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	// authorize hook takes precedence over the token
+	p.DebugEndpoints.Authorize = func(net.Addr, http.Header) bool { return false }
+	if code, _ := getDebugEndpoint(t, p, DebugConfigPath, "Bearer secret"); code != 403 {
+		t.Fatalf("expected 403 when denied by authorize hook, got %d", code)
+	}
+}
+
+func getDebugEndpoint(t *testing.T, p *Proxy, path, authorization string) (int, []byte) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	rawReq := "GET " + path + " HTTP/1.1\r\nHost: 127.0.0.1:8080\r\n"
+	if len(authorization) > 0 {
+		rawReq += "Authorization: " + authorization + "\r\n"
+	}
+	go client.Write([]byte(rawReq + "\r\n"))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
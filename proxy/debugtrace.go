@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestTracing fine-grained events of the requests traced only, e.g. for
+// debugging a single client in production without the debug logs of all.
+// A request is traced if Match returns true or its Route.Debug is set, the
+// events are the parse results, the rewrite outcome, the route decision,
+// the dials with their timings, the header bytes in both directions and
+// the outcome. The tunnels are not traced, the requests decrypted are.
+type RequestTracing struct {
+	// Match optional check if the request is traced, called once the
+	// request is hijacked and routed, e.g. by a magic header or the
+	// client address
+	Match func(req RequestView) bool
+	// RedactAuth replaces the values of the Authorization,
+	// Proxy-Authorization and Cookie headers traced
+	RedactAuth bool
+	// RingSize number of the latest events kept for Events and
+	// DebugTracesPath, the events are logged at info level if not set
+	RingSize int
+
+	lastID uint64
+
+	lock sync.Mutex
+	ring []TraceEvent
+	next int
+}
+
+// TraceEvent an event of a request traced
+type TraceEvent struct {
+	// RequestID identifies the request traced among the others
+	RequestID  uint64    `json:"request_id"`
+	ClientAddr string    `json:"client_addr"`
+	Time       time.Time `json:"time"`
+	// Name of the event, i.e. parse, rewrite, route, dial,
+	// request-header, response-header or done
+	Name   string `json:"name"`
+	Detail string `json:"detail"`
+}
+
+// Events the events kept in the ring, oldest first
+func (t *RequestTracing) Events() []TraceEvent {
+	events := make([]TraceEvent, 0)
+	if t == nil {
+		return events
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.ring) == t.RingSize {
+		events = append(events, t.ring[t.next:]...)
+		return append(events, t.ring[:t.next]...)
+	}
+	return append(events, t.ring...)
+}
+
+// match whether req is traced by Match
+func (t *RequestTracing) match(req *Request) bool {
+	return t != nil && t.Match != nil && t.Match(RequestView{req: req})
+}
+
+// keep keeps e in the ring, replacing the oldest one once it's full
+func (t *RequestTracing) keep(e TraceEvent) {
+	t.lock.Lock()
+	if len(t.ring) < t.RingSize {
+		t.ring = append(t.ring, e)
+	} else {
+		t.ring[t.next] = e
+		t.next = (t.next + 1) % t.RingSize
+	}
+	t.lock.Unlock()
+}
+
+// requestTrace the events of a request traced, kept by its RequestTracing
+// or logged if it keeps none, e.g. traced by Route.Debug without one
+type requestTrace struct {
+	tracing    *RequestTracing
+	logger     *LeveledLogger
+	id         uint64
+	clientAddr string
+	host       string
+}
+
+var requestTraceIDs uint64
+
+// newTrace starts tracing req
+func (t *RequestTracing) newTrace(req *Request, logger *LeveledLogger) *requestTrace {
+	trace := &requestTrace{tracing: t, logger: logger,
+		host: req.reqLine.HostInfo().HostWithPort()}
+	if req.clientAddr != nil {
+		trace.clientAddr = req.clientAddr.String()
+	}
+	if t != nil {
+		trace.id = atomic.AddUint64(&t.lastID, 1)
+	} else {
+		trace.id = atomic.AddUint64(&requestTraceIDs, 1)
+	}
+	return trace
+}
+
+// event records the event of the request, it may be called by the dials
+// racing each other
+func (t *requestTrace) event(name, format string, v ...interface{}) {
+	detail := fmt.Sprintf(format, v...)
+	if t.tracing == nil || t.tracing.RingSize <= 0 {
+		t.logger.Info(t.host, "trace #%d %s %s: %s", t.id, t.clientAddr, name, detail)
+		return
+	}
+	t.tracing.keep(TraceEvent{RequestID: t.id, ClientAddr: t.clientAddr,
+		Time: time.Now(), Name: name, Detail: detail})
+}
+
+// header records the raw header, redacted if asked
+func (t *requestTrace) header(name string, startLine, rawHeader []byte) {
+	if t.tracing != nil && t.tracing.RedactAuth {
+		rawHeader = redactAuthHeaders(rawHeader)
+	}
+	t.event(name, "%s%s", startLine, rawHeader)
+}
+
+// begin records how the request is parsed, rewritten and routed
+func (t *requestTrace) begin(req *Request) {
+	t.event("parse", "%s, %d header bytes",
+		bytes.TrimSpace(req.reqLine.GetRequestLine()), req.originalHeaderLength)
+	t.event("rewrite", "%s %s %s", req.Method(), req.HostWithPort(), req.PathWithQueryFragment())
+	superProxy := ""
+	if p := req.GetProxy(); p != nil {
+		superProxy = " " + p.HostWithPort()
+	}
+	t.event("route", "%s via %s%s, race direct: %v",
+		req.TargetWithPort(), egressOf(req.GetProxy()), superProxy, req.raceDirect)
+}
+
+// end records the outcome of the request
+func (t *requestTrace) end(req *Request, resp *Response, start time.Time, err error) {
+	t.event("done", "%d via %s, %d bytes out, %d bytes in, %s, error: %v",
+		resp.respLine.GetStatusCode(), egressOf(req.GetProxy()),
+		req.writtenSize, resp.readSize, time.Since(start), err)
+}
+
+var (
+	redactedValue = []byte(" [redacted]\r\n")
+	authHeaders   = [][]byte{[]byte("Authorization:"), []byte("Proxy-Authorization:"), []byte("Cookie:")}
+)
+
+// redactAuthHeaders a copy of the raw header with the values of the auth
+// headers replaced
+func redactAuthHeaders(rawHeader []byte) []byte {
+	redacted := make([]byte, 0, len(rawHeader))
+	for len(rawHeader) > 0 {
+		line := rawHeader
+		if i := bytes.IndexByte(rawHeader, '\n'); i >= 0 {
+			line = rawHeader[:i+1]
+		}
+		rawHeader = rawHeader[len(line):]
+		for _, auth := range authHeaders {
+			if len(line) >= len(auth) && bytes.EqualFold(line[:len(auth)], auth) {
+				redacted = append(redacted, auth...)
+				line = redactedValue
+				break
+			}
+		}
+		redacted = append(redacted, line...)
+	}
+	return redacted
+}
+
+// WantDialRecord implements client.DialRecorder, for the requests traced
+// or reporting the Server-Timing
+func (r *Request) WantDialRecord() bool {
+	return r.trace != nil || r.timing != nil
+}
+
+// RecordDial implements client.DialRecorder
+func (r *Request) RecordDial(addr string, took time.Duration, err error) {
+	if r.timing != nil {
+		r.timing.recordDial(took)
+	}
+	if r.trace != nil {
+		r.trace.event("dial", "%s in %s, error: %v", addr, took, err)
+	}
+}
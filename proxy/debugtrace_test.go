@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestTracing(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("X-Origin", "1")
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	tracing := &RequestTracing{RedactAuth: true, RingSize: 16,
+		Match: func(req RequestView) bool { return len(req.Header().Peek("X-Debug-Trace")) > 0 }}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.RequestTracing = tracing
+	})
+
+	// the events of the request traced only
+	if resp, body := proxyTestRequest(t, p, "GET", origin.URL+"/traced",
+		"X-Debug-Trace: 1\r\nAuthorization: Basic c2VjcmV0\r\n", ""); resp.StatusCode != 200 || body != "origin" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := proxyTestRequest(t, p, "GET", origin.URL+"/untraced", "", ""); resp.StatusCode != 200 {
+		t.Fatalf("unexpected response %d", resp.StatusCode)
+	}
+	events := tracing.Events()
+	var names []string
+	for _, e := range events {
+		names = append(names, e.Name)
+		if e.RequestID != events[0].RequestID || strings.Contains(e.Detail, "/untraced") {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+	if n := strings.Join(names, " "); n != "parse rewrite route dial request-header response-header done" {
+		t.Fatalf("unexpected events %s", n)
+	}
+	if d := events[0].Detail; !strings.HasPrefix(d, "GET "+origin.URL+"/traced HTTP/1.1") {
+		t.Fatalf("unexpected parse event %q", d)
+	}
+	if d := events[4].Detail; !strings.Contains(d, "Authorization: [redacted]\r\n") || strings.Contains(d, "c2VjcmV0") {
+		t.Fatalf("unexpected request header event %q", d)
+	}
+	if d := events[5].Detail; !strings.HasPrefix(d, "HTTP/1.1 200 OK\r\n") || !strings.Contains(d, "X-Origin: 1") {
+		t.Fatalf("unexpected response header event %q", d)
+	}
+	if d := events[6].Detail; !strings.HasPrefix(d, "200 via direct") {
+		t.Fatalf("unexpected done event %q", d)
+	}
+
+	// traced by the route, logged without RequestTracing
+	p, _ = newRouteTestProxy(t, Route{Debug: true}, false)
+	logger := &recordingLogger{}
+	p.logger = &LeveledLogger{Logger: logger}
+	proxyTestRequest(t, p, "GET", origin.URL+"/routed", "", "")
+	var traced []string
+	for _, l := range logger.logged() {
+		if strings.HasPrefix(l, "INFO trace #") {
+			traced = append(traced, l)
+		}
+	}
+	if len(traced) != 7 || !strings.Contains(traced[0], "parse: GET "+origin.URL+"/routed") {
+		t.Fatalf("unexpected logs %q", traced)
+	}
+}
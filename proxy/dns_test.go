@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+// resolveHijacker resolves the target with resolve, pinning its IP if pin
+type resolveHijacker struct {
+	budgetHijacker
+	resolver *transport.Resolver
+	pin      bool
+}
+
+func (h *resolveHijacker) Resolve() net.IP {
+	ip := h.resolver.ResolveIP(h.host)
+	if !h.pin {
+		return nil
+	}
+	return ip
+}
+
+type resolveHijackerPool struct{ h *resolveHijacker }
+
+func (p resolveHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p resolveHijackerPool) Put(Hijacker) {}
+
+func TestSharedDNSCache(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	for _, pin := range []bool{true, false} {
+		var lookups int32
+		lookupIPAddr := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			atomic.AddInt32(&lookups, 1)
+			return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+		}
+		cache := &transport.DNSCache{}
+		dialer := &transport.Dialer{DNSCache: cache, LookupIPAddr: lookupIPAddr}
+		h := &resolveHijacker{pin: pin,
+			resolver: &transport.Resolver{Cache: cache, LookupIPAddr: lookupIPAddr}}
+		h.errs = make(chan error, 1)
+		h.dial = func(addr string) (net.Conn, error) { return dialer.Dial(addr, time.Second, false, nil) }
+
+		p := newTestProxy(t, func(p *Proxy) {
+			p.HijackerPool = resolveHijackerPool{h}
+		})
+		if _, body := proxyTestRequest(t, p, "GET", "http://origin.test:"+port+"/", "", ""); body != "ok" {
+			t.Fatalf("pin %v: unexpected body %s", pin, body)
+		}
+		if err := <-h.errs; err != nil {
+			t.Fatalf("pin %v: unexpected error: %s", pin, err)
+		}
+		if n := atomic.LoadInt32(&lookups); n != 1 {
+			t.Fatalf("pin %v: expected a single lookup, got %d", pin, n)
+		}
+	}
+}
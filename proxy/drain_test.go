@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// forbiddingHijacker responds 403 to every request, capturing the bodies
+type forbiddingHijacker struct {
+	tlsTestHijacker
+	bodies []*captureBuffer
+}
+
+func (h *forbiddingHijacker) SSLBump() bool { return false }
+
+func (h *forbiddingHijacker) HijackResponse() io.ReadCloser {
+	return ioutil.NopCloser(strings.NewReader("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+}
+
+func (h *forbiddingHijacker) OnRequest([]byte, http.Header, []byte) io.WriteCloser {
+	body := &captureBuffer{}
+	h.bodies = append(h.bodies, body)
+	return body
+}
+
+type forbiddingHijackerPool struct{ h *forbiddingHijacker }
+
+func (p forbiddingHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p forbiddingHijackerPool) Put(Hijacker) {}
+
+func TestDrainRequestBody(t *testing.T) {
+	test := func(limit int64, expResponses int) *forbiddingHijacker {
+		h := &forbiddingHijacker{}
+		p := newTestProxy(t, func(p *Proxy) {
+			p.HijackerPool = forbiddingHijackerPool{h}
+			p.RequestBodyDrainLimit = limit
+		})
+		client, server := net.Pipe()
+		defer client.Close()
+		done := make(chan struct{})
+		go func() {
+			p.serveConn(server)
+			server.Close()
+			close(done)
+		}()
+		reader := bufio.NewReader(client)
+		responses := 0
+		for _, req := range []string{
+			"POST http://www.example.com/upload HTTP/1.1\r\nContent-Length: 4\r\n\r\nbody",
+			"GET http://www.example.com/ HTTP/1.1\r\nConnection: close\r\n\r\n",
+		} {
+			go client.Write([]byte(req))
+			resp, err := nethttp.ReadResponse(reader, nil)
+			if err != nil {
+				break
+			}
+			if resp.StatusCode != nethttp.StatusForbidden {
+				t.Fatalf("unexpected status %d", resp.StatusCode)
+			}
+			responses++
+		}
+		<-done
+		if responses != expResponses {
+			t.Fatalf("expected %d responses with limit %d, got %d", expResponses, limit, responses)
+		}
+		return h
+	}
+
+	// drained, the connection is kept alive
+	h := test(0, 2)
+	if h.bodies[0].String() != "body" || !h.bodies[0].closed {
+		t.Fatalf("unexpected body captured %q", h.bodies[0].String())
+	}
+	// too large to drain, the connection is closed
+	test(2, 1)
+	test(-1, 1)
+}
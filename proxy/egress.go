@@ -0,0 +1,36 @@
+package proxy
+
+import "github.com/haxii/fastproxy/superproxy"
+
+// Egress path the requests and tunnels leave the proxy by
+type Egress int
+
+const (
+	// EgressDirect connected to the target directly
+	EgressDirect Egress = iota
+	// EgressHTTPProxy via an HTTP or HTTPS super proxy
+	EgressHTTPProxy
+	// EgressSOCKS5Proxy via a SOCKS5 super proxy
+	EgressSOCKS5Proxy
+)
+
+func (e Egress) String() string {
+	switch e {
+	case EgressHTTPProxy:
+		return "http-proxy"
+	case EgressSOCKS5Proxy:
+		return "socks5-proxy"
+	}
+	return "direct"
+}
+
+// egressOf the egress via the super proxy p, direct if nil
+func egressOf(p *superproxy.SuperProxy) Egress {
+	if p == nil {
+		return EgressDirect
+	}
+	if p.GetProxyType() == superproxy.ProxyTypeSOCKS5 {
+		return EgressSOCKS5Proxy
+	}
+	return EgressHTTPProxy
+}
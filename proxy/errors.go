@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+
+	"github.com/haxii/fastproxy/client"
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/util"
+)
+
+// Errors terminating the proxy exchanges, they wrap the underlying causes
+// and are returned by the connection handler into the server's logger,
+// as well as passed to the hijacker's AfterResponse.
+//
+// Use errors.Is to find the kind of an error and errors.As for its cause.
+var (
+	// ErrClientMalformedRequest the request sent by the client can't be parsed
+	ErrClientMalformedRequest = errors.New("malformed client request")
+	// ErrUpstreamDial the connection to the target host can't be made,
+	// including the SOCKS5 super proxy failing to reach it
+	ErrUpstreamDial = client.ErrDial
+	// ErrUpstreamPrelude the prelude of the new connection to the target
+	// host failed, which is ErrUpstreamDial too, see OnNewOriginConn
+	ErrUpstreamPrelude = client.ErrOriginPrelude
+	// ErrUpstreamTimeout reading from or writing to the target host timed out,
+	// or the request deadline is exceeded
+	ErrUpstreamTimeout = errors.New("upstream timeout")
+	// ErrUpstreamHeaderTimeout and ErrUpstreamBodyTimeout the timeouts of the
+	// response header and body inactivity, which are ErrUpstreamTimeout too,
+	// see ForwardResponseHeaderTimeout and ForwardBodyInactivityTimeout
+	ErrUpstreamHeaderTimeout = client.ErrResponseHeaderTimeout
+	ErrUpstreamBodyTimeout   = client.ErrBodyInactivityTimeout
+	// ErrSuperProxyHandshake the tunnel request made to the super proxy failed,
+	// the status of the CONNECT rejected is found as a *superproxy.StatusError
+	// and the reply of the SOCKS5 command as a *superproxy.SOCKS5Error
+	ErrSuperProxyHandshake = superproxy.ErrHandshake
+	// ErrACLRejected the request is rejected by the hijacker
+	ErrACLRejected = errors.New("request rejected by hijacker")
+	// ErrShutdown the proxy is closed
+	ErrShutdown = errors.New("proxy shut down")
+	// ErrBodySizeExceeded the response body relayed is stopped at
+	// ResponseBodyLimit, see BodyLimitAction
+	ErrBodySizeExceeded = errors.New("response body size exceeded")
+	// ErrMemoryLimitExceeded the connection is rejected by the MemoryGuard
+	ErrMemoryLimitExceeded = errors.New("memory limit exceeded")
+	// ErrFDBudgetExceeded the connection or tunnel is refused by the FDGuard
+	ErrFDBudgetExceeded = errors.New("file descriptor budget exceeded")
+	// ErrPanic serving the connection panicked, the panic is recovered,
+	// see CrashOnPanic
+	ErrPanic = errors.New("panic serving connection")
+	// ErrNoUpstream the request is left without a super proxy while the
+	// direct connections are disallowed, see DisallowDirect
+	ErrNoUpstream = errors.New("no upstream available")
+	// ErrSchemeNotImplemented the request targets a scheme other than http
+	// and https without a handler, see RegisterSchemeHandler
+	ErrSchemeNotImplemented = errors.New("scheme not implemented")
+)
+
+// errUserInfoInTarget the request target carries userinfo, see RejectUserInfo
+var errUserInfoInTarget = errors.New("userinfo in request target")
+
+// upstreamError marks the error of the request forwarded as ErrUpstreamTimeout
+// if it's a timeout, the dial and handshake errors are kept as is
+func upstreamError(err error) error {
+	if err == nil || errors.Is(err, ErrUpstreamDial) || errors.Is(err, ErrSuperProxyHandshake) {
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return util.ErrKind(ErrUpstreamTimeout, err)
+	}
+	return err
+}
+
+// clientRequestError marks the error reading the client request as
+// ErrClientMalformedRequest, network errors are kept as is
+func clientRequestError(err error) error {
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) {
+		return err
+	}
+	return util.ErrKind(ErrClientMalformedRequest, err)
+}
+
+// superProxyTimedOut if the handshake with the super proxy timed out, e.g.
+// the CONNECT request is never answered, see SuperProxyHandshakeTimeout
+func superProxyTimedOut(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrSuperProxyHandshake) && errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// superProxyRejectedStatus the status answered to the client whose request is
+// rejected by the super proxy, 0 if err isn't a rejection. The 403 and 5xx
+// statuses are relayed as is, the others, e.g. 407 asking for the super
+// proxy's credentials the client doesn't own, are answered with 502, so are
+// the failures replied by the SOCKS5 super proxies.
+func superProxyRejectedStatus(err error) int {
+	var socksErr *superproxy.SOCKS5Error
+	if errors.As(err, &socksErr) {
+		return http.StatusBadGateway
+	}
+	var statusErr *superproxy.StatusError
+	if !errors.As(err, &statusErr) {
+		return 0
+	}
+	switch statusErr.StatusCode {
+	case http.StatusForbidden, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return statusErr.StatusCode
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+// blockingHijacker blocks every request
+type blockingHijacker struct{ tlsTestHijacker }
+
+func (h *blockingHijacker) SSLBump() bool { return false }
+func (h *blockingHijacker) Block() bool   { return true }
+
+type blockingHijackerPool struct{}
+
+func (blockingHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	return &blockingHijacker{tlsTestHijacker{host: host, port: port}}
+}
+func (blockingHijackerPool) Put(Hijacker) {}
+
+// serveRawRequest serves the raw request with p, returns the error of the connection
+func serveRawRequest(p *Proxy, rawReq string) error {
+	client, server := net.Pipe()
+	defer client.Close()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- p.handleConn(server)
+		server.Close()
+	}()
+	go client.Write([]byte(rawReq))
+	go io.Copy(ioutil.Discard, client)
+	return <-errChan
+}
+
+// listenLocal accepts connections on a local address handled by serve
+func listenLocal(t *testing.T, serve func(c net.Conn)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln
+}
+
+func TestErrorTaxonomy(t *testing.T) {
+	newProxy := func() *Proxy {
+		return newTestProxy(t)
+	}
+	expect := func(name string, err, kind error) {
+		if !errors.Is(err, kind) {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+	}
+
+	// malformed request line
+	p := newProxy()
+	expect("malformed", serveRawRequest(p, "GET\r\n\r\n"), ErrClientMalformedRequest)
+
+	// nothing listening on the target
+	ln := listenLocal(t, func(c net.Conn) { c.Close() })
+	addr := ln.Addr().String()
+	ln.Close()
+	err := serveRawRequest(p, "GET http://"+addr+"/ HTTP/1.1\r\n\r\n")
+	expect("dial", err, ErrUpstreamDial)
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Fatalf("expected the cause kept in %v", err)
+	}
+
+	// target never responds
+	ln = listenLocal(t, func(c net.Conn) {
+		io.Copy(ioutil.Discard, c)
+	})
+	defer ln.Close()
+	p = newProxy()
+	p.client.ReadTimeout = 50 * time.Millisecond
+	expect("timeout", serveRawRequest(p, "GET http://"+ln.Addr().String()+"/ HTTP/1.1\r\n\r\n"),
+		ErrUpstreamTimeout)
+
+	// super proxy rejects the tunnel
+	sp := listenLocal(t, func(c net.Conn) {
+		c.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+		c.Close()
+	})
+	defer sp.Close()
+	p = newProxy()
+	port := sp.Addr().(*net.TCPAddr).Port
+	if p.SuperProxy, err = superproxy.NewSuperProxy("127.0.0.1", uint16(port),
+		superproxy.ProxyTypeHTTP, "", "", ""); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expect("handshake", serveRawRequest(p, "CONNECT www.example.com:443 HTTP/1.1\r\n\r\n"),
+		ErrSuperProxyHandshake)
+
+	// blocked by hijacker
+	p = newProxy()
+	p.HijackerPool = blockingHijackerPool{}
+	expect("acl", serveRawRequest(p, "GET http://www.example.com/ HTTP/1.1\r\n\r\n"), ErrACLRejected)
+	expect("acl tunnel", serveRawRequest(p, "CONNECT www.example.com:443 HTTP/1.1\r\n\r\n"), ErrACLRejected)
+
+	// proxy closed
+	p = newProxy()
+	atomic.StoreInt32(&p.closed, 1)
+	err = serveRawRequest(p, "GET\r\n\r\n")
+	expect("shutdown", err, ErrShutdown)
+	expect("shutdown", err, ErrClientMalformedRequest)
+}
+
+func TestSuperProxyRejectedStatus(t *testing.T) {
+	for upstream, expected := range map[string]int{
+		"407 Proxy Authentication Required": 502,
+		"403 Forbidden":                     403,
+		"503 Service Unavailable":           503,
+	} {
+		sp := listenLocal(t, func(c net.Conn) {
+			c.Write([]byte("HTTP/1.1 " + upstream + "\r\nContent-Length: 0\r\n\r\n"))
+			c.Close()
+		})
+		p := newTestProxy(t)
+		port := sp.Addr().(*net.TCPAddr).Port
+		p.SuperProxy, _ = superproxy.NewSuperProxy("127.0.0.1", uint16(port), superproxy.ProxyTypeHTTP, "", "", "")
+
+		client, server := net.Pipe()
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- p.serveConn(server)
+			server.Close()
+		}()
+		go client.Write([]byte("CONNECT www.example.com:443 HTTP/1.1\r\n\r\n"))
+		resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil || resp.StatusCode != expected {
+			t.Fatalf("upstream %s: unexpected response %v %v", upstream, resp, err)
+		}
+		go io.Copy(ioutil.Discard, client)
+		var statusErr *superproxy.StatusError
+		if err := <-errChan; !errors.As(err, &statusErr) || statusErr.StatusLine != "HTTP/1.1 "+upstream {
+			t.Fatalf("upstream %s: unexpected error %v", upstream, err)
+		}
+		client.Close()
+		sp.Close()
+	}
+}
+
+func TestSOCKS5ReplyStatus(t *testing.T) {
+	for _, c := range []struct {
+		code byte
+		kind error
+	}{
+		{superproxy.SOCKS5ConnectionRefused, ErrUpstreamDial},
+		{superproxy.SOCKS5HostUnreachable, ErrUpstreamDial},
+		{superproxy.SOCKS5GeneralFailure, ErrSuperProxyHandshake},
+		{superproxy.SOCKS5NotAllowed, ErrSuperProxyHandshake},
+	} {
+		// greets with no auth, then fails the connect request of a domain
+		sp := listenLocal(t, func(conn net.Conn) {
+			defer conn.Close()
+			b := make([]byte, 5)
+			if _, err := io.ReadFull(conn, b[:3]); err != nil {
+				return
+			}
+			conn.Write([]byte{5, 0})
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return
+			}
+			io.ReadFull(conn, make([]byte, int(b[4])+2))
+			conn.Write([]byte{5, c.code, 0, 1, 0, 0, 0, 0, 0, 0})
+		})
+		p := newTestProxy(t)
+		port := sp.Addr().(*net.TCPAddr).Port
+		p.SuperProxy, _ = superproxy.NewSuperProxy("127.0.0.1", uint16(port), superproxy.ProxyTypeSOCKS5, "", "", "")
+
+		for _, raw := range []string{
+			"GET http://www.example.com/ HTTP/1.1\r\nHost: www.example.com\r\n\r\n",
+			"CONNECT www.example.com:443 HTTP/1.1\r\n\r\n",
+		} {
+			client, server := net.Pipe()
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- p.serveConn(server)
+				server.Close()
+			}()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			go client.Write([]byte(raw))
+			resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil || resp.StatusCode != nethttp.StatusBadGateway {
+				t.Fatalf("code %d: unexpected response %v %v", c.code, resp, err)
+			}
+			go io.Copy(ioutil.Discard, client)
+			var replyErr *superproxy.SOCKS5Error
+			if err := <-errChan; !errors.Is(err, c.kind) || !errors.As(err, &replyErr) ||
+				replyErr.Code != c.code {
+				t.Fatalf("code %d: unexpected error %v", c.code, err)
+			}
+			client.Close()
+		}
+		sp.Close()
+	}
+}
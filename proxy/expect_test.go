@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+func TestExpectContinue(t *testing.T) {
+	origin := newRecordingOrigin(t)
+	defer origin.ln.Close()
+	rawReq := "POST http://127.0.0.1:" + strconv.Itoa(origin.port()) + "/ HTTP/1.1\r\n" +
+		"Expect: 100-continue\r\nContent-Length: 4\r\nConnection: close\r\n\r\nbody"
+
+	// the interim response of the target is forwarded
+	p := newTestProxy(t)
+	if expect := testExpectContinue(t, p, origin, rawReq); expect != "100-continue" {
+		t.Fatalf("expected Expect header forwarded, got %q", expect)
+	}
+
+	// the proxy signals continue itself with Expect stripped
+	p.StripExpectContinue = true
+	if expect := testExpectContinue(t, p, origin, rawReq); len(expect) != 0 {
+		t.Fatalf("expected Expect header stripped, got %q", expect)
+	}
+}
+
+func testExpectContinue(t *testing.T, p *Proxy, origin *recordingOrigin, rawReq string) string {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	go client.Write([]byte(rawReq))
+	br := bufio.NewReader(client)
+	for _, expStatusCode := range []int{100, 200} {
+		resp, err := nethttp.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if resp.StatusCode != expStatusCode {
+			t.Fatalf("expected status code %d, got %d", expStatusCode, resp.StatusCode)
+		}
+		if expStatusCode == 200 {
+			if body, _ := ioutil.ReadAll(resp.Body); string(body) != "ok" {
+				t.Fatalf("unexpected response body %s", body)
+			}
+		}
+	}
+	return (<-origin.received).header.Get("Expect")
+}
+
+func TestInterimResponses(t *testing.T) {
+	// a keep-alive origin sending several interim responses before each
+	var accepted int32
+	origin := listenLocal(t, func(c net.Conn) {
+		defer c.Close()
+		atomic.AddInt32(&accepted, 1)
+		reader := bufio.NewReader(c)
+		for {
+			if _, err := nethttp.ReadRequest(reader); err != nil {
+				return
+			}
+			c.Write([]byte("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 102 Processing\r\n\r\n" +
+				"HTTP/1.1 103 Early Hints\r\nLink: </a.css>; rel=preload\r\n\r\n"))
+			c.Write([]byte("HTTP/1.1 199 Whatever\r\nX-Interim: 1\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		}
+	})
+	defer origin.Close()
+	// the origin is a HTTP super proxy as well, which pools its connections
+	host := origin.Addr().String()
+	p := newTestProxy(t)
+	p.SuperProxy, _ = superproxy.NewSuperProxy("127.0.0.1", uint16(origin.Addr().(*net.TCPAddr).Port),
+		superproxy.ProxyTypeHTTP, "", "", "")
+
+	exchange := func(protocol string, expected []int) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			p.serveConn(server)
+			server.Close()
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(client)
+		// every request on the kept alive connections sees the same
+		for i := 0; i < 2; i++ {
+			go client.Write([]byte("GET http://" + host + "/ " + protocol + "\r\nHost: " + host +
+				"\r\nConnection: keep-alive\r\n\r\n"))
+			for _, code := range expected {
+				resp, err := nethttp.ReadResponse(br, nil)
+				if err != nil || resp.StatusCode != code {
+					t.Fatalf("%s: unexpected response %v %v, expected %d", protocol, resp, err, code)
+				}
+				if code == 103 && resp.Header.Get("Link") != "</a.css>; rel=preload" {
+					t.Fatalf("%s: unexpected early hints %v", protocol, resp.Header)
+				}
+				if code == 200 {
+					if body, err := ioutil.ReadAll(resp.Body); err != nil || string(body) != "ok" ||
+						resp.Close {
+						t.Fatalf("%s: unexpected final response %q %v %v", protocol, body, resp.Close, err)
+					}
+					// the upstream connection is released after the response is relayed
+					time.Sleep(50 * time.Millisecond)
+				}
+			}
+		}
+	}
+	exchange("HTTP/1.1", []int{100, 102, 103, 199, 200})
+	// the HTTP/1.0 clients never see the interim responses
+	exchange("HTTP/1.0", []int{200})
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("unexpected %d upstream connections", n)
+	}
+}
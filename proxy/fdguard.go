@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+// FDStage the stage of the FDGuard, each stage refuses the load of the
+// previous ones as well
+type FDStage int32
+
+const (
+	// FDNormal nothing is refused
+	FDNormal FDStage = iota
+	// FDHighWater refuses the new CONNECT tunnels with 503 and closes the
+	// idle connections pooled once entered
+	FDHighWater
+	// FDCritical rejects the new connections as the concurrency limit
+	// exceeded
+	FDCritical
+
+	fdStageCount
+)
+
+func (s FDStage) String() string {
+	switch s {
+	case FDHighWater:
+		return "high-water"
+	case FDCritical:
+		return "critical"
+	}
+	return "normal"
+}
+
+// FDGuard file descriptor budget of the proxy, which refuses the load
+// stage by stage as the descriptors used approach Budget, before the
+// accepts and dials start failing for running out of them, and recovers
+// as they're closed.
+//
+// The descriptors counted are the ones owned by the proxy, i.e. the client
+// connections served and the connections dialed upstream, tunnels included.
+// The connections made by a custom DialTLS are not counted. The dials are
+// counted by wrapping them, so the warm connections of the super proxies,
+// see superproxy.SuperProxy.Prewarm, are never used with an FDGuard.
+type FDGuard struct {
+	// Budget number of the file descriptors the proxy may use, the soft
+	// RLIMIT_NOFILE of the process is read once serving if not set
+	Budget int64
+	// HighWater and Critical the marks of the descriptors used entering
+	// the stages, 80% and 95% of the Budget if not set
+	HighWater int64
+	Critical  int64
+	// OnStage called with the descriptors used once the stage changes,
+	// e.g. for the metrics of the refusals
+	OnStage func(stage FDStage, used int64)
+
+	used  int64
+	stage int32
+	// entered number of times each stage is entered
+	entered [fdStageCount]int64
+
+	// lock serializes the stage changes
+	lock sync.Mutex
+}
+
+// FDStats the state of the FDGuard
+type FDStats struct {
+	// Used file descriptors counted
+	Used int64
+	// Budget, HighWater and Critical the budget and the marks in effect
+	Budget    int64
+	HighWater int64
+	Critical  int64
+	// Stage current stage
+	Stage FDStage
+	// Entered number of times each stage is entered, indexed by FDStage
+	Entered [fdStageCount]int64
+}
+
+// Stage current stage
+func (g *FDGuard) Stage() FDStage {
+	if g == nil {
+		return FDNormal
+	}
+	return FDStage(atomic.LoadInt32(&g.stage))
+}
+
+// marks the high-water and critical marks in effect
+func (g *FDGuard) marks() (highWater, critical int64) {
+	highWater, critical = g.HighWater, g.Critical
+	if highWater <= 0 {
+		highWater = g.Budget * 80 / 100
+	}
+	if critical <= 0 {
+		critical = g.Budget * 95 / 100
+	}
+	return highWater, critical
+}
+
+// FDStats the state of the FDGuard, zero if not set
+func (p *Proxy) FDStats() FDStats {
+	g := p.FDGuard
+	if g == nil {
+		return FDStats{}
+	}
+	stats := FDStats{Used: atomic.LoadInt64(&g.used), Budget: g.Budget, Stage: g.Stage()}
+	stats.HighWater, stats.Critical = g.marks()
+	for i := range stats.Entered {
+		stats.Entered[i] = atomic.LoadInt64(&g.entered[i])
+	}
+	return stats
+}
+
+// initFDGuard reads the budget of the FDGuard from the limit of the process
+// if not set
+func (p *Proxy) initFDGuard() {
+	g := p.FDGuard
+	if g == nil || g.Budget > 0 {
+		return
+	}
+	limit, err := transport.FDLimit()
+	if err != nil {
+		p.logger.Warn("FDGuard", "no budget, fail to read the limit: %s", err)
+		return
+	}
+	g.Budget = limit
+	p.logger.Info("FDGuard", "budget of %d file descriptors by RLIMIT_NOFILE", limit)
+}
+
+// checkFDs updates the stage of the FDGuard by the descriptors used
+func (p *Proxy) checkFDs() FDStage {
+	g := p.FDGuard
+	if g == nil || g.Budget <= 0 {
+		return FDNormal
+	}
+	used := atomic.LoadInt64(&g.used)
+	highWater, critical := g.marks()
+	stage := FDNormal
+	if used >= critical {
+		stage = FDCritical
+	} else if used >= highWater {
+		stage = FDHighWater
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	current := g.Stage()
+	if stage == current {
+		return stage
+	}
+	atomic.StoreInt32(&g.stage, int32(stage))
+	if stage > current {
+		for s := current + 1; s <= stage; s++ {
+			atomic.AddInt64(&g.entered[s], 1)
+			p.logger.Warn("FDGuard", "entering %s, %d of %d file descriptors used", s, used, g.Budget)
+		}
+		if current < FDHighWater {
+			p.closeIdleConns()
+		}
+	} else {
+		p.logger.Info("FDGuard", "recovered to %s, %d of %d file descriptors used", stage, used, g.Budget)
+	}
+	if g.OnStage != nil {
+		g.OnStage(stage, used)
+	}
+	return stage
+}
+
+// closeIdleConns closes the idle connections pooled by the client and the
+// default super proxy, the pools of the super proxies of the hijackers
+// are left to their idle timeout
+func (p *Proxy) closeIdleConns() {
+	n := p.client.CloseIdleConns()
+	if p.SuperProxy != nil {
+		n += p.SuperProxy.CloseIdleConns()
+	}
+	if n > 0 {
+		p.logger.Info("FDGuard", "%d idle connections closed", n)
+	}
+}
+
+// countDial counts the connections made by dial, transport.Dial if nil
+func (g *FDGuard) countDial(dial func(addr string) (net.Conn, error)) func(addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = transport.Dial
+	}
+	return func(addr string) (net.Conn, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&g.used, 1)
+		return &fdConn{Conn: conn, g: g}, nil
+	}
+}
+
+// fdConn connection counted by the FDGuard until closed
+type fdConn struct {
+	net.Conn
+	g      *FDGuard
+	closed int32
+}
+
+func (c *fdConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.g.used, -1)
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+func TestFDGuard(t *testing.T) {
+	// the super proxy answering the requests forwarded itself
+	upstream := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	host, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	portN, _ := strconv.Atoi(port)
+	superProxy, err := superproxy.NewSuperProxy(host, uint16(portN), superproxy.ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var stages []FDStage
+	g := &FDGuard{Budget: 4, HighWater: 2, Critical: 3,
+		OnStage: func(stage FDStage, used int64) { stages = append(stages, stage) }}
+	r := &recordingLogger{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.FDGuard = g
+		p.SuperProxy = superProxy
+	})
+	p.logger = &LeveledLogger{Logger: r}
+	serve := func(rawReq string) (string, error) {
+		client, server := net.Pipe()
+		served := make(chan error, 1)
+		go func() {
+			served <- p.serveConn(server)
+			server.Close()
+		}()
+		go client.Write([]byte(rawReq))
+		response, _ := ioutil.ReadAll(client)
+		return string(response), <-served
+	}
+
+	// the connection to the super proxy counted while pooled
+	client, server := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- p.serveConn(server)
+		server.Close()
+	}()
+	go fmt.Fprint(client, "GET http://example.com/ HTTP/1.1\r\n\r\n")
+	resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != 200 || string(body) != "upstream" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	client.Close()
+	<-served
+	if used := p.FDStats().Used; used != 1 {
+		t.Fatalf("unexpected fds used %d", used)
+	}
+	// wait for the connection pooled
+	time.Sleep(50 * time.Millisecond)
+
+	// the new tunnels are refused over the high-water mark, the idle
+	// connections closed
+	atomic.AddInt64(&g.used, 1)
+	response, err := serve("CONNECT example.com:443 HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 503") || !errors.Is(err, ErrFDBudgetExceeded) {
+		t.Fatalf("unexpected response %q, error: %v", response, err)
+	}
+	if used := p.FDStats().Used; used != 1 {
+		t.Fatalf("unexpected fds used %d", used)
+	}
+
+	// all the new connections are rejected over the critical mark
+	atomic.AddInt64(&g.used, 2)
+	response, err = serve("GET http://example.com/ HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 503") || !strings.Contains(response, "concurrency limit exceeded") ||
+		err != ErrFDBudgetExceeded {
+		t.Fatalf("unexpected response %q, error: %v", response, err)
+	}
+
+	// recovered as the fds are closed
+	atomic.AddInt64(&g.used, -3)
+	response, err = serve("GET http://example.com/ HTTP/1.1\r\nConnection: close\r\n\r\n")
+	if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.HasSuffix(response, "upstream") || err != nil {
+		t.Fatalf("unexpected response %q, error: %v", response, err)
+	}
+	if used := p.FDStats().Used; used != 0 {
+		t.Fatalf("unexpected fds used %d", used)
+	}
+
+	stats := p.FDStats()
+	if stats.Stage != FDNormal || stats.Budget != 4 || stats.HighWater != 2 || stats.Critical != 3 ||
+		stats.Entered != [fdStageCount]int64{0, 1, 1} {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if s := fmt.Sprint(stages); s != "[high-water critical normal]" {
+		t.Fatalf("unexpected stages %s", s)
+	}
+	expected := []string{
+		"INFO [WARN] entering high-water, 2 of 4 file descriptors used",
+		"INFO 1 idle connections closed",
+		"INFO [WARN] entering critical, 3 of 4 file descriptors used",
+		"INFO recovered to normal, 0 of 4 file descriptors used",
+	}
+	if s := fmt.Sprint(r.logged()); s != fmt.Sprint(expected) {
+		t.Fatalf("unexpected logs %s", s)
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/haxii/fastproxy/mitm"
+	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/util/singleflight"
+)
+
+// SingleFlightStats the work made once for the concurrent tunnels and
+// requests to the same new host, with the ones waiting for it
+type SingleFlightStats struct {
+	// SSLBump the decisions shared by ShareSSLBump
+	SSLBump singleflight.Stats
+	// Cert the MITM leaf certificates signed
+	Cert singleflight.Stats
+	// DNS the host names looked up by the default dialer, the custom ones
+	// report their own by transport.Dialer.LookupStats
+	DNS singleflight.Stats
+}
+
+// SingleFlightStats the work made once for the concurrent callers so far
+func (p *Proxy) SingleFlightStats() SingleFlightStats {
+	return SingleFlightStats{
+		SSLBump: p.sslBumpFlights.Stats(),
+		Cert:    mitm.CertStats(),
+		DNS:     transport.LookupStats(),
+	}
+}
+
+// sslBump the SSLBump decision of hijacker made for the tunnel to
+// hostWithPort, shared with the concurrent ones if ShareSSLBump
+func (p *Proxy) sslBump(hijacker Hijacker, hostWithPort string) bool {
+	sharer, ok := hijacker.(SSLBumpSharer)
+	if c, chained := hijacker.(*HijackerChain); chained {
+		ok = c.sharesSSLBump()
+	}
+	if !p.ShareSSLBump || !ok {
+		return hijacker.SSLBump()
+	}
+	timeout := p.TLSHandshakeTimeout
+	if timeout <= 0 {
+		timeout = transport.DefaultTLSHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	decision, shared, err := p.sslBumpFlights.Do(ctx, hostWithPort, func() (interface{}, error) {
+		return hijacker.SSLBump(), nil
+	})
+	if err != nil {
+		// decided by itself if the one in flight takes too long
+		return hijacker.SSLBump()
+	}
+	if shared {
+		sharer.SetSSLBump(decision.(bool))
+	}
+	return decision.(bool)
+}
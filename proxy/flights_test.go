@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/mitm"
+	"github.com/haxii/fastproxy/transport"
+)
+
+// flightHijacker decrypts the tunnels once all of them are waiting for
+// its decision, dialing the origin through dialer
+type flightHijacker struct {
+	tlsTestHijacker
+	p         *Proxy
+	waiting   int64
+	decisions *int32
+	shared    *int32
+	dialer    *transport.Dialer
+}
+
+func (h *flightHijacker) SSLBump() bool {
+	atomic.AddInt32(h.decisions, 1)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) &&
+		h.p.SingleFlightStats().SSLBump.Waiting < h.waiting; {
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+func (h *flightHijacker) SetSSLBump(sslBump bool) {
+	if sslBump {
+		atomic.AddInt32(h.shared, 1)
+	}
+}
+func (h *flightHijacker) DialTLS() func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	return func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+		return h.dialer.Dial(addr, 5*time.Second, true, &tls.Config{InsecureSkipVerify: true})
+	}
+}
+
+type flightHijackerPool struct{ h flightHijacker }
+
+func (p *flightHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	h := p.h
+	h.host, h.port = host, port
+	return &h
+}
+func (p *flightHijackerPool) Put(Hijacker) {}
+
+func TestSingleFlightConnects(t *testing.T) {
+	const n = 100
+	origin := httptest.NewTLSServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+	// a host never seen, whose certificate is never signed
+	domain := fmt.Sprintf("flight%d.test", time.Now().UnixNano())
+
+	var decisions, shared, lookups int32
+	dialer := &transport.Dialer{DNSCache: &transport.DNSCache{},
+		LookupIPAddr: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			atomic.AddInt32(&lookups, 1)
+			return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+		}}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.ShareSSLBump = true
+	})
+	p.HijackerPool = &flightHijackerPool{flightHijacker{p: p, waiting: n - 1,
+		decisions: &decisions, shared: &shared, dialer: dialer}}
+	certs := mitm.CertStats()
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			body, err := flightGet(p, net.JoinHostPort(domain, port), domain)
+			if err == nil && body != "ok" {
+				err = fmt.Errorf("unexpected body %q", body)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// the decision, the certificate and the address of the host are made
+	// once for all of the tunnels
+	if decisions != 1 || shared != n-1 {
+		t.Fatalf("expected a single decision shared, got %d decisions, %d shared", decisions, shared)
+	}
+	stats := p.SingleFlightStats()
+	if s := stats.SSLBump; s.Executed != 1 || s.Waited != n-1 || s.Waiting != 0 || s.TimedOut != 0 {
+		t.Fatalf("unexpected SSLBump stats %+v", s)
+	}
+	if signed := stats.Cert.Executed - certs.Executed; signed != 1 {
+		t.Fatalf("expected a single certificate signed, got %d", signed)
+	}
+	if lookups != 1 || dialer.LookupStats().Executed != 1 {
+		t.Fatalf("expected a single lookup, got %d, stats %+v", lookups, dialer.LookupStats())
+	}
+}
+
+// flightGet makes a GET request decrypted by p through the tunnel to
+// connectHost, sending serverName in the TLS handshake, returns the body
+func flightGet(p *Proxy, connectHost, serverName string) (string, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	go client.Write([]byte("CONNECT " + connectHost + " HTTP/1.1\r\n\r\n"))
+	br := bufio.NewReader(client)
+	resp, err := nethttp.ReadResponse(br, &nethttp.Request{Method: "CONNECT"})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", errors.New(resp.Status)
+	}
+	tlsClient := tls.Client(&bufferedConn{client, br}, &tls.Config{
+		InsecureSkipVerify: true, ServerName: serverName})
+	go tlsClient.Write([]byte("GET / HTTP/1.1\r\nHost: " + serverName + "\r\nConnection: close\r\n\r\n"))
+	if resp, err = nethttp.ReadResponse(bufio.NewReader(tlsClient), nil); err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
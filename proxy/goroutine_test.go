@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestConnGoroutines(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	echo := listenLocal(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	defer echo.Close()
+
+	p := newTestProxy(t)
+	tunnel := func() {
+		client, server := net.Pipe()
+		defer client.Close()
+		done := make(chan struct{})
+		go func() {
+			p.serveConn(server)
+			server.Close()
+			close(done)
+		}()
+		client.SetDeadline(time.Now().Add(10 * time.Second))
+		go fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\n\r\n", echo.Addr())
+		reader := bufio.NewReader(client)
+		if resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: "CONNECT"}); err != nil || resp.StatusCode != 200 {
+			t.Fatalf("unexpected tunnel response %v, error: %v", resp, err)
+		}
+		go client.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(reader, b); err != nil || string(b) != "ping" {
+			t.Fatalf("unexpected echo %q, error: %v", b, err)
+		}
+		client.Close()
+		<-done
+	}
+	churn := func(n int) {
+		for i := 0; i < n; i++ {
+			if resp, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "", ""); resp.StatusCode != 200 || body != "origin" {
+				t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+			}
+			tunnel()
+		}
+	}
+
+	// the goroutines of the connections served end with them, the origin
+	// connection pooled and the background ones started by the first
+	churn(1)
+	baseline := runtime.NumGoroutine()
+	churn(50)
+	for i := 0; runtime.NumGoroutine() > baseline; i++ {
+		if i == 100 {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("goroutines leaked, %d from %d\n%s", runtime.NumGoroutine(), baseline,
+				buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/transport"
+)
+
+// steadyHeader a header of the requests repeated to the same origin
+var steadyHeader = []byte("Host: api.example.com\r\n" +
+	"User-Agent: fastproxy-test/1.0\r\n" +
+	"X-Api-Key: " + strings.Repeat("k", 1024) + "\r\n" +
+	"Proxy-Connection: Keep-Alive\r\n" +
+	"Accept-Encoding: gzip\r\n" +
+	"Accept: application/json\r\n\r\n")
+
+func TestParallelWriteCachedHeader(t *testing.T) {
+	var cache transport.HeaderCache
+	extra := []byte("Accept-Encoding: br\r\n")
+	changed := bytes.Replace(steadyHeader, []byte("1.0"), []byte("2.0"), 1)
+	for i, c := range []struct {
+		header, extra []byte
+		cached        bool
+	}{
+		{steadyHeader, nil, false},
+		{steadyHeader, nil, true},
+		// the header changed is serialized again
+		{changed, nil, false},
+		{changed, nil, true},
+		{changed, extra, false},
+		{changed, extra, true},
+	} {
+		cached := cache.Header(c.header, c.extra) != nil
+		drop, _ := acceptEncodingRewriter(nil)
+		if c.extra != nil {
+			drop = http.IsAcceptEncodingHeader
+		}
+		var expected, written bytes.Buffer
+		parallelWriteHeader(&expected, func([]byte) {}, c.header, drop, c.extra)
+		n, err := parallelWriteCachedHeader(&written, func([]byte) {}, c.header, drop, c.extra, &cache)
+		if cached != c.cached || err != nil || n != written.Len() || written.String() != expected.String() {
+			t.Fatalf("#%d: unexpected header %q cached %v, expected %q, error: %v",
+				i, written.String(), cached, expected.String(), err)
+		}
+	}
+}
+
+func TestHeaderCache(t *testing.T) {
+	// a super proxy keeping its connections alive, recording the headers
+	var lock sync.Mutex
+	var headers []string
+	sp := listenLocal(t, func(c net.Conn) {
+		defer c.Close()
+		reader := bufio.NewReader(c)
+		for {
+			var header []byte
+			for {
+				line, err := reader.ReadSlice('\n')
+				if err != nil {
+					return
+				}
+				header = append(header, line...)
+				if len(line) == 2 {
+					break
+				}
+			}
+			lock.Lock()
+			headers = append(headers, string(header))
+			lock.Unlock()
+			c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		}
+	})
+	defer sp.Close()
+	p := newTestProxy(t)
+	p.SuperProxy, _ = superproxy.NewSuperProxy("127.0.0.1",
+		uint16(sp.Addr().(*net.TCPAddr).Port), superproxy.ProxyTypeHTTP, "", "", "")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(client)
+	get := func(userAgent string) {
+		go client.Write([]byte("GET http://www.example.com/ HTTP/1.1\r\nHost: www.example.com\r\n" +
+			"User-Agent: " + userAgent + "\r\nProxy-Connection: Keep-Alive\r\n\r\n"))
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if body, err := ioutil.ReadAll(resp.Body); err != nil || string(body) != "ok" {
+			t.Fatalf("unexpected body %q, error: %v", body, err)
+		}
+		// the upstream connection is released after the response is relayed
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the requests of the same connection are written the same whether
+	// their header is cached or not, the one changed is written as is
+	get("a")
+	get("a")
+	get("b")
+	get("a")
+	expected := func(userAgent string) string {
+		return "GET http://www.example.com/ HTTP/1.1\r\nHost: www.example.com\r\n" +
+			"User-Agent: " + userAgent + "\r\n\r\n"
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(headers) != 4 || headers[0] != expected("a") || headers[1] != expected("a") ||
+		headers[2] != expected("b") || headers[3] != expected("a") {
+		t.Fatalf("unexpected headers %q", headers)
+	}
+}
+
+func BenchmarkWriteSteadyHeader(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		cache *transport.HeaderCache
+	}{
+		{"uncached", nil},
+		{"cached", &transport.HeaderCache{}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			w := bufio.NewWriterSize(ioutil.Discard, 4096)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(steadyHeader)))
+			for i := 0; i < b.N; i++ {
+				parallelWriteCachedHeader(w, func([]byte) {}, steadyHeader, nil, nil, bench.cache)
+				w.Flush()
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"io"
 	"net"
+	"time"
 
 	"github.com/haxii/fastproxy/http"
 	"github.com/haxii/fastproxy/superproxy"
@@ -17,6 +18,8 @@ import (
 // For HTTPS Sniffer, the call chain is:
 // - RewriteHost -> BeforeConnect -> SSLBump(true) -> RewriteTLSServerName -> [BeforeRequest -> Resolve -> SuperProxy -> Block -> HijackResponse -> Dial/DialTLS -> OnRequest -> OnResponse -> AfterResponse]
 // the chain in square brackets `[]` can be called more than one time during one connection due to keep-alive
+// With Proxy.DecryptBySNI, SSLBump and the chain after it are called on the hijacker made for the SNI
+// of the tunnel if it differs from the CONNECT target and the tunnel is decrypted
 type Hijacker interface {
 	// RewriteHost rewrites the incoming host and port, return a nil newHost or nil newPort to end the request
 	RewriteHost() (newHost, newPort string)
@@ -34,6 +37,7 @@ type Hijacker interface {
 	// which provides the ability to change the request resources and header.
 	// Return new super header to change the original header, please do NOT change payload related fields
 	// (like Content-Length, Transfer-Encoding etc.) to avoid exceptions.
+	// The header can be changed generically using its Set, Add and Del methods, then return header.Raw().
 	// For advanced Hijack options, use the HijackResponse instead
 	BeforeRequest(method, path []byte, header http.Header, rawHeader []byte) (newPath, newRawHeader []byte)
 
@@ -60,12 +64,18 @@ type Hijacker interface {
 
 	// OnRequest is a sniffer handler.
 	// Which gives the request header in parameters then
-	// write request body in the writer returned
+	// write request body in the writer returned.
+	// The body is not written if the request is marked no-store,
+	// the writer is closed right away, see CacheControl.
+	// The parts of the multipart/form-data bodies are given instead if the
+	// writer is a MultipartSink.
 	OnRequest(path []byte, header http.Header, rawHeader []byte) io.WriteCloser
 
 	// OnResponse is a sniffer handler
 	// Which gives the response header in parameters then
-	// write response body in the writer returned
+	// write response body in the writer returned.
+	// The body is not written if the request or response is marked no-store,
+	// the writer is closed right away, see CacheControl.
 	OnResponse(statusLine http.ResponseLine, header http.Header, rawHeader []byte) io.WriteCloser
 
 	// AfterResponse is defer handler which always paired with BeforeRequest
@@ -73,7 +83,76 @@ type Hijacker interface {
 	AfterResponse(error)
 }
 
-// HijackerPool pooling hijacker instances
+// Route routing decision forcing the target of a single request
+type Route struct {
+	// ForceIP IP dialed, overriding the DNS and Resolve
+	ForceIP net.IP
+	// ForcePort port dialed, the Host header keeps the original one
+	ForcePort string
+	// ForceSNI TLS server name sent to the origin, applies to the decrypted
+	// requests only, ignored for plain HTTP requests and tunnels
+	ForceSNI string
+	// ResponseHeaderTimeout and BodyInactivityTimeout response timeouts of
+	// the request, see Proxy.ForwardResponseHeaderTimeout and
+	// Proxy.ForwardBodyInactivityTimeout, ignored for tunnels
+	ResponseHeaderTimeout time.Duration
+	BodyInactivityTimeout time.Duration
+	// RaceDirect races a direct connection to the target against the one
+	// through the super proxy of the request, which has a head start of
+	// RaceHeadStart, client.DefaultRaceHeadStart if not set. The request is
+	// written to the connection made first only, the winner is reported to
+	// RaceHijacker. Ignored for tunnels, the requests without a super proxy
+	// and with Proxy.DisallowDirect.
+	RaceDirect    bool
+	RaceHeadStart time.Duration
+	// Debug traces the request, see RequestTracing, its events are logged
+	// at info level if the proxy has none. Ignored for tunnels.
+	Debug bool
+}
+
+// RouteHijacker optional interface of Hijacker forcing the route
+type RouteHijacker interface {
+	// Route called after Resolve, the non-empty fields of the route
+	// returned are applied to this request, including the tunnel dial
+	Route() Route
+}
+
+// RaceHijacker optional interface of Hijacker observing the races of
+// Route.RaceDirect
+type RaceHijacker interface {
+	// OnRaceWon called with the winner of the race before the request is
+	// written, direct if the super proxy lost
+	OnRaceWon(direct bool)
+}
+
+// TargetHijacker optional interface of Hijacker observing the request
+// targets as sent by the clients, the userinfo and fragment included,
+// which are never forwarded
+type TargetHijacker interface {
+	// OnRequestTarget called with the request target before RewriteHost,
+	// as well as before every request decrypted
+	OnRequestTarget(target []byte)
+}
+
+// RequestHijacker optional interface of Hijacker inspecting the whole
+// request in one place, e.g. a single routing function deciding what the
+// other methods of the hijacker return
+type RequestHijacker interface {
+	// HandleRequest called once the request header is read, after RewriteHost
+	// and before OnConnect or BeforeRequest, as well as before every
+	// request decrypted
+	HandleRequest(req RequestView)
+}
+
+// SSLBumpSharer optional interface of Hijacker taking the SSLBump decision
+// of another one made for the same target, see Proxy.ShareSSLBump
+type SSLBumpSharer interface {
+	// SetSSLBump called with the decision shared instead of SSLBump
+	SetSSLBump(sslBump bool)
+}
+
+// HijackerPool pooling hijacker instances,
+// use HijackerChainPool to compose the hijackers of several pools
 type HijackerPool interface {
 	// Get get a hijacker with client address
 	Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/haxii/fastproxy/uri"
+)
+
+// HostMismatch which host wins if the Host header of a request made in
+// absolute-form disagrees with the host of its target
+type HostMismatch int
+
+const (
+	// HostMismatchPreferURI forwards the request to the host of its target
+	// with the Host header replaced, as required by RFC 7230 5.4
+	HostMismatchPreferURI HostMismatch = iota
+	// HostMismatchPreferHost forwards the request to the host of its Host
+	// header instead, e.g. for the clients putting the proxy in the target
+	HostMismatchPreferHost
+	// HostMismatchReject rejects the request with 400
+	HostMismatchReject
+)
+
+var (
+	// errConflictingHosts the request has several different Host headers
+	errConflictingHosts = errors.New("conflicting Host headers")
+	// errHostMismatch the Host header disagrees with the request target,
+	// see HostMismatchReject
+	errHostMismatch = errors.New("Host header mismatches request target")
+	// errConnectPortMissing the CONNECT target has no port, see
+	// DefaultConnectPort
+	errConnectPortMissing = errors.New("port missing in CONNECT target")
+	// errConnectPortZero the CONNECT target has port 0
+	errConnectPortZero = errors.New("port 0 in CONNECT target")
+)
+
+// checkConnectPort rejects the CONNECT target h without a valid port, the
+// missing one is defaulted to 443 if DefaultConnectPort
+func (p *Proxy) checkConnectPort(h *uri.HostInfo) error {
+	if len(h.HostWithPort()) == 0 {
+		return nil
+	}
+	if h.PortDefaulted() {
+		if p.DefaultConnectPort {
+			return nil
+		}
+		return errConnectPortMissing
+	}
+	if strings.Trim(h.Port(), "0") == "" {
+		return errConnectPortZero
+	}
+	return nil
+}
+
+// checkHost rejects the request with several different Host headers, which
+// is a smuggling vector, then reconciles the Host header with the host of
+// the request target in mode. The identical Host headers are collapsed
+// into one by setHostHeader.
+func (r *Request) checkHost(mode HostMismatch) error {
+	if r.header.HasConflictingHosts() {
+		return errConflictingHosts
+	}
+	headerHost := r.header.Host()
+	if len(headerHost) == 0 || len(r.reqLine.URI().Host()) == 0 ||
+		mode == HostMismatchPreferURI {
+		return nil
+	}
+	var h uri.HostInfo
+	h.ParseHostWithPort(string(headerHost), r.isTLS)
+	if strings.EqualFold(h.HostWithPort(), r.reqLine.HostInfo().HostWithPort()) {
+		return nil
+	}
+	if mode == HostMismatchReject || len(h.HostWithPort()) == 0 {
+		return errHostMismatch
+	}
+	r.reqLine.ChangeHost(h.HostWithPort())
+	return nil
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHostHeaders(t *testing.T) {
+	echoHost := func(name string) *httptest.Server {
+		return httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			w.Write([]byte(name + " " + r.Host))
+		}))
+	}
+	const rejected = "Ambiguous Host header.\n"
+	origin, other := echoHost("origin"), echoHost("other")
+	defer origin.Close()
+	defer other.Close()
+	originHost := strings.TrimPrefix(origin.URL, "http://")
+	otherHost := strings.TrimPrefix(other.URL, "http://")
+
+	p := newTestProxy(t)
+	for _, c := range []struct {
+		mode   HostMismatch
+		header string
+		status int
+		body   string
+	}{
+		// the identical Host headers are collapsed, the different ones rejected
+		{HostMismatchPreferURI, "Host: " + originHost + "\r\nHost: " + originHost + "\r\n",
+			200, "origin " + originHost},
+		{HostMismatchPreferHost, "Host: " + originHost + "\r\nHost: " + otherHost + "\r\n", 400, rejected},
+		// the Host header agreeing with the target is kept whatever the mode
+		{HostMismatchReject, "Host: " + originHost + "\r\n", 200, "origin " + originHost},
+		{HostMismatchReject, "", 200, "origin " + originHost},
+		// the disagreeing Host header is resolved by the mode
+		{HostMismatchPreferURI, "Host: " + otherHost + "\r\n", 200, "origin " + originHost},
+		{HostMismatchPreferHost, "Host: " + otherHost + "\r\n", 200, "other " + otherHost},
+		{HostMismatchPreferHost, "Host: [bad\r\n", 400, rejected},
+		{HostMismatchReject, "Host: " + otherHost + "\r\n", 400, rejected},
+	} {
+		p.HostMismatch = c.mode
+		resp, body := proxyTestRequest(t, p, "GET", origin.URL+"/", c.header, "")
+		if resp.StatusCode != c.status || body != c.body {
+			t.Fatalf("unexpected response of %d %q: %d %q", c.mode, c.header, resp.StatusCode, body)
+		}
+	}
+
+	// the ambiguous requests are rejected in origin-form as well
+	p.HostMismatch = HostMismatchPreferURI
+	resp, body := proxyTestRequest(t, p, "GET", "/", "Host: a.com\r\nHost: b.com\r\n", "")
+	if resp.StatusCode != 400 || body != rejected {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestConnectPort(t *testing.T) {
+	dialed := make(chan string, 1)
+	p := newTestProxy(t, func(p *Proxy) {
+		p.Dial = func(addr string) (net.Conn, error) {
+			dialed <- addr
+			return nil, errors.New("no route")
+		}
+	})
+	serve := func(target string) (string, error) {
+		client, server := net.Pipe()
+		served := make(chan error, 1)
+		go func() {
+			served <- p.serveConn(server)
+			server.Close()
+		}()
+		go client.Write([]byte("CONNECT " + target + " HTTP/1.1\r\n\r\n"))
+		response, _ := ioutil.ReadAll(client)
+		return string(response), <-served
+	}
+
+	// the targets without a valid port are rejected
+	for target, expected := range map[string]error{
+		"example.com":      errConnectPortMissing,
+		"example.com:":     errConnectPortMissing,
+		"example.com:0":    errConnectPortZero,
+		"[::1]:00":         errConnectPortZero,
+		"127.0.0.1":        errConnectPortMissing,
+		"[fe80::1%25eth0]": errConnectPortMissing,
+	} {
+		response, err := serve(target)
+		if !strings.HasPrefix(response, "HTTP/1.1 400") || !errors.Is(err, expected) ||
+			!errors.Is(err, ErrClientMalformedRequest) {
+			t.Fatalf("unexpected response of %s %q, error: %v", target, response, err)
+		}
+	}
+
+	// the missing port is defaulted if asked, never the port 0
+	p.DefaultConnectPort = true
+	if response, _ := serve("example.com"); strings.HasPrefix(response, "HTTP/1.1 400") {
+		t.Fatalf("unexpected response %q", response)
+	}
+	if addr := <-dialed; addr != "example.com:443" {
+		t.Fatalf("unexpected address dialed %s", addr)
+	}
+	if response, err := serve("example.com:0"); !strings.HasPrefix(response, "HTTP/1.1 400") ||
+		!errors.Is(err, errConnectPortZero) {
+		t.Fatalf("unexpected response %q, error: %v", response, err)
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPerHostRetryAfter Retry-After sent with requests rejected by the
+// per host concurrency limit by default
+const DefaultPerHostRetryAfter = time.Second
+
+// ErrPerHostConcurrencyLimit returned when a request is rejected because
+// too many requests to its target host are in flight
+var ErrPerHostConcurrencyLimit = errors.New("too many concurrent requests to host")
+
+// hostLimiter limits the in-flight requests per target host using a
+// semaphore per host, the semaphore is removed once the host goes idle.
+type hostLimiter struct {
+	lock  sync.Mutex
+	hosts map[string]*hostSemaphore
+}
+
+type hostSemaphore struct {
+	// keep 64-bit fields on top for atomic alignment on 32-bit platforms
+	inFlight int64
+	queued   int64
+
+	tokens chan struct{}
+	// refs requests holding or waiting for a token, guarded by hostLimiter.lock
+	refs int
+}
+
+// acquire acquires a token of host, waiting at most timeout for a free one,
+// limit is only applied when the host's semaphore is created, so a changed
+// limit takes effect once the host goes idle.
+func (l *hostLimiter) acquire(hostWithPort string, limit int, timeout time.Duration) (release func(), err error) {
+	l.lock.Lock()
+	if l.hosts == nil {
+		l.hosts = make(map[string]*hostSemaphore)
+	}
+	s, ok := l.hosts[hostWithPort]
+	if !ok {
+		s = &hostSemaphore{tokens: make(chan struct{}, limit)}
+		l.hosts[hostWithPort] = s
+	}
+	s.refs++
+	l.lock.Unlock()
+
+	select {
+	case s.tokens <- struct{}{}:
+	default:
+		if timeout <= 0 {
+			l.unref(hostWithPort, s)
+			return nil, ErrPerHostConcurrencyLimit
+		}
+		atomic.AddInt64(&s.queued, 1)
+		timer := time.NewTimer(timeout)
+		select {
+		case s.tokens <- struct{}{}:
+			timer.Stop()
+			atomic.AddInt64(&s.queued, -1)
+		case <-timer.C:
+			atomic.AddInt64(&s.queued, -1)
+			l.unref(hostWithPort, s)
+			return nil, ErrPerHostConcurrencyLimit
+		}
+	}
+	atomic.AddInt64(&s.inFlight, 1)
+	return func() {
+		atomic.AddInt64(&s.inFlight, -1)
+		<-s.tokens
+		l.unref(hostWithPort, s)
+	}, nil
+}
+
+// unref removes the semaphore of host if no one is using it
+func (l *hostLimiter) unref(hostWithPort string, s *hostSemaphore) {
+	l.lock.Lock()
+	s.refs--
+	if s.refs == 0 {
+		delete(l.hosts, hostWithPort)
+	}
+	l.lock.Unlock()
+}
+
+// counts returns the number of in-flight and queued requests of host
+func (l *hostLimiter) counts(hostWithPort string) (inFlight, queued int64) {
+	l.lock.Lock()
+	s, ok := l.hosts[hostWithPort]
+	l.lock.Unlock()
+	if !ok {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&s.inFlight), atomic.LoadInt64(&s.queued)
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+func TestHostLimiter(t *testing.T) {
+	var l hostLimiter
+	release, err := l.acquire("a.com:80", 1, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := l.acquire("a.com:80", 1, 0); err != ErrPerHostConcurrencyLimit {
+		t.Fatalf("expected error %s, got %v", ErrPerHostConcurrencyLimit, err)
+	}
+	releaseB, err := l.acquire("b.com:80", 1, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	releaseB()
+
+	// queued request gets the token once released
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		if inFlight, queued := l.counts("a.com:80"); inFlight != 1 || queued != 1 {
+			t.Errorf("unexpected counts %d %d", inFlight, queued)
+		}
+		release()
+	}()
+	release, err = l.acquire("a.com:80", 1, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := l.acquire("a.com:80", 1, 10*time.Millisecond); err != ErrPerHostConcurrencyLimit {
+		t.Fatalf("expected error %s, got %v", ErrPerHostConcurrencyLimit, err)
+	}
+	release()
+
+	// semaphores are removed once idle
+	if len(l.hosts) != 0 {
+		t.Fatalf("expected idle semaphores removed, got %d", len(l.hosts))
+	}
+}
+
+func TestWriteRetryAfterError(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeRetryAfterError(&b, http.StatusServiceUnavailable, 1500*time.Millisecond, "busy"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp := b.String(); !strings.HasPrefix(resp, "HTTP/1.1 503") ||
+		!strings.Contains(resp, "\r\nRetry-After: 2\r\n") || !strings.HasSuffix(resp, "\r\n\r\nbusy") {
+		t.Fatalf("unexpected response %q", resp)
+	}
+}
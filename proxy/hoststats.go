@@ -0,0 +1,470 @@
+package proxy
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metric metric used to rank hosts in HostStats.TopHosts
+type Metric int
+
+const (
+	// MetricRequests number of requests made to the host
+	MetricRequests Metric = iota
+	// MetricBytesIn bytes received from the host
+	MetricBytesIn
+	// MetricBytesOut bytes sent to the host
+	MetricBytesOut
+	// MetricErrors number of failed requests made to the host
+	MetricErrors
+	// MetricTTFBP95 approximate 95th percentile time to first byte
+	MetricTTFBP95
+	// MetricRejected number of requests rejected by the per host concurrency limit
+	MetricRejected
+	// MetricInFlight number of requests in flight to the host currently
+	MetricInFlight
+	// MetricTunnelBytesUp bytes relayed from the clients to the host by tunnels
+	MetricTunnelBytesUp
+	// MetricTunnelBytesDown bytes relayed from the host to the clients by tunnels
+	MetricTunnelBytesDown
+	// MetricDirect number of requests and tunnels made to the host directly
+	MetricDirect
+)
+
+const (
+	// DefaultHostStatsBucketCount number of buckets kept per host by default
+	DefaultHostStatsBucketCount = 5
+	// DefaultHostStatsBucketDuration time range covered by a single bucket by default
+	DefaultHostStatsBucketDuration = time.Minute
+	// DefaultHostStatsMaxHosts max number of hosts tracked individually by default
+	DefaultHostStatsMaxHosts = 1024
+
+	// HostStatsOtherHost pseudo host collecting the stats of hosts
+	// evicted or not tracked due to the cardinality limit
+	HostStatsOtherHost = "other"
+)
+
+// ttfbBucketCount number of log2 millisecond buckets used for TTFB,
+// the last bucket covers everything above ~9 minutes
+const ttfbBucketCount = 20
+
+// HostStats time-bucketed per-destination-host statistics collector
+//
+// Every host owns a ring of buckets, each covering BucketDuration, only
+// the latest BucketCount buckets are reported. The number of hosts is
+// bounded by MaxHosts using a LRU, stats of the least recently used hosts
+// are merged into the HostStatsOtherHost entry. A host moved to the front
+// of the LRU within the latest MaxHosts/2 moves is recorded under the read
+// lock without moving it again, as it's far from being evicted.
+//
+// It is safe calling HostStats methods from concurrently running go routines.
+type HostStats struct {
+	// BucketCount number of buckets kept for each host
+	//
+	// DefaultHostStatsBucketCount is used if not set.
+	BucketCount int
+	// BucketDuration time range covered by a single bucket
+	//
+	// DefaultHostStatsBucketDuration is used if not set.
+	BucketDuration time.Duration
+	// MaxHosts max number of hosts tracked individually
+	//
+	// DefaultHostStatsMaxHosts is used if not set.
+	MaxHosts int
+
+	hostsLock sync.RWMutex
+	hosts     map[string]*list.Element
+	lru       list.List
+	other     *hostStatsEntry
+	// moves number of the entries moved to the front of lru
+	moves uint64
+
+	// now used by tests
+	now func() time.Time
+
+	// concurrency reports the in-flight and queued requests of host if set
+	concurrency func(hostWithPort string) (inFlight, queued int64)
+
+	once sync.Once
+}
+
+// HostStat stats summary of a single host within the reported time range
+type HostStat struct {
+	HostWithPort string
+	Requests     int64
+	BytesIn      int64
+	BytesOut     int64
+	Errors       int64
+	TTFBP95      time.Duration
+	Rejected     int64
+
+	// Tunnels number of CONNECT tunnels made to the host, the bytes relayed
+	// in each direction are also counted in BytesOut and BytesIn
+	Tunnels         int64
+	TunnelBytesUp   int64
+	TunnelBytesDown int64
+	// PlainHTTPTunnels and OtherProtocolTunnels number of the tunnels whose
+	// clients spoke plaintext HTTP or neither TLS nor HTTP, counted only
+	// with ClassifyTunnels set
+	PlainHTTPTunnels     int64
+	OtherProtocolTunnels int64
+
+	// Direct, ViaHTTPProxy and ViaSOCKS5Proxy number of the requests and
+	// tunnels made to the host by each Egress, i.e. directly or through the
+	// super proxy actually used, the ones answered locally are not counted
+	Direct         int64
+	ViaHTTPProxy   int64
+	ViaSOCKS5Proxy int64
+
+	// InFlight and Queued are current values rather than summaries,
+	// reported when the proxy limits the concurrent requests per host
+	InFlight int64
+	Queued   int64
+}
+
+// value the value of the given metric
+func (s *HostStat) value(by Metric) int64 {
+	switch by {
+	case MetricRequests:
+		return s.Requests
+	case MetricBytesIn:
+		return s.BytesIn
+	case MetricBytesOut:
+		return s.BytesOut
+	case MetricErrors:
+		return s.Errors
+	case MetricTTFBP95:
+		return int64(s.TTFBP95)
+	case MetricRejected:
+		return s.Rejected
+	case MetricInFlight:
+		return s.InFlight
+	case MetricTunnelBytesUp:
+		return s.TunnelBytesUp
+	case MetricTunnelBytesDown:
+		return s.TunnelBytesDown
+	case MetricDirect:
+		return s.Direct
+	}
+	return 0
+}
+
+// active if the host has any requests within the reported time range
+func (s *HostStat) active() bool {
+	return s.Requests > 0 || s.Rejected > 0 || s.InFlight > 0 || s.Queued > 0
+}
+
+type hostStatsEntry struct {
+	// moved the moves when the entry was moved to the front the last time,
+	// on top for atomic alignment
+	moved        uint64
+	hostWithPort string
+	buckets      []hostStatsBucket
+}
+
+type hostStatsBucket struct {
+	// keep 64-bit fields on top for atomic alignment on 32-bit platforms
+	epoch    int64
+	requests int64
+	bytesIn  int64
+	bytesOut int64
+	errors   int64
+	rejected int64
+	tunnels  int64
+	// tunnelUp and tunnelDown bytes relayed by tunnels in each direction
+	tunnelUp   int64
+	tunnelDown int64
+	// plainTunnels and otherTunnels tunnels classified as plaintext HTTP or other
+	plainTunnels int64
+	otherTunnels int64
+	// egress requests and tunnels made by each Egress
+	egress [3]int64
+	ttfb   [ttfbBucketCount]int64
+}
+
+func (s *HostStats) init() {
+	s.once.Do(func() {
+		if s.BucketCount <= 0 {
+			s.BucketCount = DefaultHostStatsBucketCount
+		}
+		if s.BucketDuration <= 0 {
+			s.BucketDuration = DefaultHostStatsBucketDuration
+		}
+		if s.MaxHosts <= 0 {
+			s.MaxHosts = DefaultHostStatsMaxHosts
+		}
+		if s.now == nil {
+			s.now = time.Now
+		}
+		s.hosts = make(map[string]*list.Element)
+		s.other = s.newEntry(HostStatsOtherHost)
+	})
+}
+
+func (s *HostStats) newEntry(hostWithPort string) *hostStatsEntry {
+	return &hostStatsEntry{
+		hostWithPort: hostWithPort,
+		buckets:      make([]hostStatsBucket, s.BucketCount),
+	}
+}
+
+// getEntry get the entry of host, evicts the least recently used one if needed
+//
+// Samples recorded into an entry while it's being evicted may be lost,
+// which is fine for an approximate view.
+func (s *HostStats) getEntry(hostWithPort string) *hostStatsEntry {
+	s.hostsLock.RLock()
+	el, ok := s.hosts[hostWithPort]
+	s.hostsLock.RUnlock()
+	if ok {
+		e := el.Value.(*hostStatsEntry)
+		if atomic.LoadUint64(&s.moves)-atomic.LoadUint64(&e.moved) < uint64(s.MaxHosts/2) {
+			return e
+		}
+	}
+
+	s.hostsLock.Lock()
+	defer s.hostsLock.Unlock()
+	if el, ok = s.hosts[hostWithPort]; ok {
+		s.lru.MoveToFront(el)
+	} else {
+		if s.lru.Len() >= s.MaxHosts {
+			evicted := s.lru.Remove(s.lru.Back()).(*hostStatsEntry)
+			delete(s.hosts, evicted.hostWithPort)
+			s.mergeIntoOther(evicted)
+		}
+		el = s.lru.PushFront(s.newEntry(hostWithPort))
+		s.hosts[hostWithPort] = el
+	}
+	e := el.Value.(*hostStatsEntry)
+	atomic.StoreUint64(&e.moved, atomic.AddUint64(&s.moves, 1))
+	return e
+}
+
+// mergeIntoOther merge the evicted host into the other entry, hostsLock required
+func (s *HostStats) mergeIntoOther(e *hostStatsEntry) {
+	for i := range e.buckets {
+		src := &e.buckets[i]
+		epoch := atomic.LoadInt64(&src.epoch)
+		if epoch == 0 {
+			continue
+		}
+		dst := s.other.bucket(epoch)
+		atomic.AddInt64(&dst.requests, atomic.LoadInt64(&src.requests))
+		atomic.AddInt64(&dst.bytesIn, atomic.LoadInt64(&src.bytesIn))
+		atomic.AddInt64(&dst.bytesOut, atomic.LoadInt64(&src.bytesOut))
+		atomic.AddInt64(&dst.errors, atomic.LoadInt64(&src.errors))
+		atomic.AddInt64(&dst.rejected, atomic.LoadInt64(&src.rejected))
+		atomic.AddInt64(&dst.tunnels, atomic.LoadInt64(&src.tunnels))
+		atomic.AddInt64(&dst.tunnelUp, atomic.LoadInt64(&src.tunnelUp))
+		atomic.AddInt64(&dst.tunnelDown, atomic.LoadInt64(&src.tunnelDown))
+		atomic.AddInt64(&dst.plainTunnels, atomic.LoadInt64(&src.plainTunnels))
+		atomic.AddInt64(&dst.otherTunnels, atomic.LoadInt64(&src.otherTunnels))
+		for j := range src.egress {
+			atomic.AddInt64(&dst.egress[j], atomic.LoadInt64(&src.egress[j]))
+		}
+		for j := range src.ttfb {
+			atomic.AddInt64(&dst.ttfb[j], atomic.LoadInt64(&src.ttfb[j]))
+		}
+	}
+}
+
+// bucket returns the bucket for epoch, recycling the stale one in its slot.
+//
+// Recycling is not strictly atomic, a few samples recorded concurrently
+// with the rollover may be lost, which is fine for an approximate view.
+func (e *hostStatsEntry) bucket(epoch int64) *hostStatsBucket {
+	b := &e.buckets[epoch%int64(len(e.buckets))]
+	old := atomic.LoadInt64(&b.epoch)
+	if old < epoch && atomic.CompareAndSwapInt64(&b.epoch, old, epoch) {
+		atomic.StoreInt64(&b.requests, 0)
+		atomic.StoreInt64(&b.bytesIn, 0)
+		atomic.StoreInt64(&b.bytesOut, 0)
+		atomic.StoreInt64(&b.errors, 0)
+		atomic.StoreInt64(&b.rejected, 0)
+		atomic.StoreInt64(&b.tunnels, 0)
+		atomic.StoreInt64(&b.tunnelUp, 0)
+		atomic.StoreInt64(&b.tunnelDown, 0)
+		atomic.StoreInt64(&b.plainTunnels, 0)
+		atomic.StoreInt64(&b.otherTunnels, 0)
+		for i := range b.egress {
+			atomic.StoreInt64(&b.egress[i], 0)
+		}
+		for i := range b.ttfb {
+			atomic.StoreInt64(&b.ttfb[i], 0)
+		}
+	}
+	return b
+}
+
+func (s *HostStats) epoch() int64 {
+	return s.now().UnixNano()/int64(s.BucketDuration) + 1
+}
+
+// Record records a finished exchange with host, a zero ttfb is not
+// counted in the TTFB percentile, e.g. failed or tunneled requests
+func (s *HostStats) Record(hostWithPort string, bytesIn, bytesOut int64, ttfb time.Duration, err error) {
+	if s == nil || len(hostWithPort) == 0 {
+		return
+	}
+	s.init()
+	s.getEntry(hostWithPort).bucket(s.epoch()).add(bytesIn, bytesOut, ttfb, err)
+}
+
+// RecordTunnel records a finished tunnel with host, bytesUp relayed from the
+// client to host and bytesDown relayed from host to the client
+func (s *HostStats) RecordTunnel(hostWithPort string, bytesUp, bytesDown int64, err error) {
+	if s == nil || len(hostWithPort) == 0 {
+		return
+	}
+	s.init()
+	b := s.getEntry(hostWithPort).bucket(s.epoch())
+	b.add(bytesDown, bytesUp, 0, err)
+	atomic.AddInt64(&b.tunnels, 1)
+	atomic.AddInt64(&b.tunnelUp, bytesUp)
+	atomic.AddInt64(&b.tunnelDown, bytesDown)
+}
+
+// RecordTunnelProtocol records the protocol classified of a tunnel made to
+// host, only plaintext HTTP and other protocols are counted
+func (s *HostStats) RecordTunnelProtocol(hostWithPort string, protocol TunnelProtocol) {
+	if s == nil || len(hostWithPort) == 0 ||
+		(protocol != TunnelProtocolHTTP && protocol != TunnelProtocolOther) {
+		return
+	}
+	s.init()
+	b := s.getEntry(hostWithPort).bucket(s.epoch())
+	if protocol == TunnelProtocolHTTP {
+		atomic.AddInt64(&b.plainTunnels, 1)
+	} else {
+		atomic.AddInt64(&b.otherTunnels, 1)
+	}
+}
+
+// RecordEgress records the egress a request or tunnel made to host took
+func (s *HostStats) RecordEgress(hostWithPort string, egress Egress) {
+	if s == nil || len(hostWithPort) == 0 || egress < EgressDirect || egress > EgressSOCKS5Proxy {
+		return
+	}
+	s.init()
+	b := s.getEntry(hostWithPort).bucket(s.epoch())
+	atomic.AddInt64(&b.egress[egress], 1)
+}
+
+func (b *hostStatsBucket) add(bytesIn, bytesOut int64, ttfb time.Duration, err error) {
+	atomic.AddInt64(&b.requests, 1)
+	atomic.AddInt64(&b.bytesIn, bytesIn)
+	atomic.AddInt64(&b.bytesOut, bytesOut)
+	if err != nil {
+		atomic.AddInt64(&b.errors, 1)
+	}
+	if ttfb > 0 {
+		atomic.AddInt64(&b.ttfb[ttfbBucketIndex(ttfb)], 1)
+	}
+}
+
+// RecordRejected records a request rejected before reaching host
+func (s *HostStats) RecordRejected(hostWithPort string) {
+	if s == nil || len(hostWithPort) == 0 {
+		return
+	}
+	s.init()
+	b := s.getEntry(hostWithPort).bucket(s.epoch())
+	atomic.AddInt64(&b.rejected, 1)
+}
+
+// ttfbBucketIndex log2 bucket of ttfb in milliseconds
+func ttfbBucketIndex(ttfb time.Duration) int {
+	ms := int64(ttfb / time.Millisecond)
+	i := 0
+	for ms > 0 && i < ttfbBucketCount-1 {
+		ms >>= 1
+		i++
+	}
+	return i
+}
+
+// ttfbBucketUpperBound upper bound of the i-th TTFB bucket
+func ttfbBucketUpperBound(i int) time.Duration {
+	return time.Duration(int64(1)<<uint(i)) * time.Millisecond
+}
+
+// summary summarize the buckets within the latest BucketCount epochs
+func (s *HostStats) summary(e *hostStatsEntry, epoch int64) HostStat {
+	stat := HostStat{HostWithPort: e.hostWithPort}
+	var ttfb [ttfbBucketCount]int64
+	minEpoch := epoch - int64(len(e.buckets)) + 1
+	for i := range e.buckets {
+		b := &e.buckets[i]
+		if be := atomic.LoadInt64(&b.epoch); be < minEpoch || be > epoch {
+			continue
+		}
+		stat.Requests += atomic.LoadInt64(&b.requests)
+		stat.BytesIn += atomic.LoadInt64(&b.bytesIn)
+		stat.BytesOut += atomic.LoadInt64(&b.bytesOut)
+		stat.Errors += atomic.LoadInt64(&b.errors)
+		stat.Rejected += atomic.LoadInt64(&b.rejected)
+		stat.Tunnels += atomic.LoadInt64(&b.tunnels)
+		stat.TunnelBytesUp += atomic.LoadInt64(&b.tunnelUp)
+		stat.TunnelBytesDown += atomic.LoadInt64(&b.tunnelDown)
+		stat.PlainHTTPTunnels += atomic.LoadInt64(&b.plainTunnels)
+		stat.OtherProtocolTunnels += atomic.LoadInt64(&b.otherTunnels)
+		stat.Direct += atomic.LoadInt64(&b.egress[EgressDirect])
+		stat.ViaHTTPProxy += atomic.LoadInt64(&b.egress[EgressHTTPProxy])
+		stat.ViaSOCKS5Proxy += atomic.LoadInt64(&b.egress[EgressSOCKS5Proxy])
+		for j := range b.ttfb {
+			ttfb[j] += atomic.LoadInt64(&b.ttfb[j])
+		}
+	}
+	var total int64
+	for _, n := range ttfb {
+		total += n
+	}
+	if total > 0 {
+		threshold := (total*95 + 99) / 100
+		var cumulative int64
+		for i, n := range ttfb {
+			cumulative += n
+			if cumulative >= threshold {
+				stat.TTFBP95 = ttfbBucketUpperBound(i)
+				break
+			}
+		}
+	}
+	if s.concurrency != nil && e != s.other {
+		stat.InFlight, stat.Queued = s.concurrency(e.hostWithPort)
+	}
+	return stat
+}
+
+// TopHosts returns at most n hosts with the largest value of metric by,
+// the HostStatsOtherHost entry is included when it has any requests
+func (s *HostStats) TopHosts(n int, by Metric) []HostStat {
+	if s == nil || n <= 0 {
+		return nil
+	}
+	s.init()
+	epoch := s.epoch()
+	s.hostsLock.RLock()
+	stats := make([]HostStat, 0, s.lru.Len()+1)
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		if stat := s.summary(el.Value.(*hostStatsEntry), epoch); stat.active() {
+			stats = append(stats, stat)
+		}
+	}
+	if stat := s.summary(s.other, epoch); stat.active() {
+		stats = append(stats, stat)
+	}
+	s.hostsLock.RUnlock()
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].value(by) > stats[j].value(by)
+	})
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
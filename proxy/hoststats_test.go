@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+func TestHostStatsTopHosts(t *testing.T) {
+	now := time.Unix(1000*60, 0)
+	s := &HostStats{BucketCount: 2, MaxHosts: 2, now: func() time.Time { return now }}
+
+	s.Record("a.com:80", 100, 10, 3*time.Millisecond, nil)
+	s.Record("a.com:80", 100, 10, 3*time.Millisecond, nil)
+	s.Record("b.com:443", 1000, 20, 0, errors.New("fail"))
+
+	top := s.TopHosts(10, MetricRequests)
+	if len(top) != 2 || top[0].HostWithPort != "a.com:80" || top[0].Requests != 2 {
+		t.Fatalf("unexpected top hosts by requests %+v", top)
+	}
+	if top[0].TTFBP95 != 4*time.Millisecond {
+		t.Fatalf("unexpected ttfb p95 %s", top[0].TTFBP95)
+	}
+	top = s.TopHosts(1, MetricBytesIn)
+	if len(top) != 1 || top[0].HostWithPort != "b.com:443" || top[0].Errors != 1 {
+		t.Fatalf("unexpected top hosts by bytes in %+v", top)
+	}
+
+	// a.com is evicted into the other bucket
+	s.Record("b.com:443", 1, 1, 0, nil)
+	s.Record("c.com:80", 1, 1, 0, nil)
+	top = s.TopHosts(10, MetricTTFBP95)
+	if len(top) != 3 || top[0].HostWithPort != HostStatsOtherHost || top[0].Requests != 2 {
+		t.Fatalf("unexpected top hosts after eviction %+v", top)
+	}
+
+	// stats expire after bucket count buckets
+	now = now.Add(2 * DefaultHostStatsBucketDuration)
+	if top = s.TopHosts(10, MetricRequests); len(top) != 0 {
+		t.Fatalf("expected expired stats, got %+v", top)
+	}
+}
+
+func TestHostStatsConcurrentRecord(t *testing.T) {
+	s := &HostStats{MaxHosts: 2}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.Record(host, 1, 1, 0, nil)
+				s.TopHosts(1, MetricRequests)
+			}
+		}([]string{"a.com:80", "b.com:80"}[i%2])
+	}
+	wg.Wait()
+	top := s.TopHosts(10, MetricRequests)
+	if len(top) != 2 || top[0].Requests != 4000 || top[1].Requests != 4000 {
+		t.Fatalf("unexpected top hosts %+v", top)
+	}
+
+	// the least recently used host is evicted once a new one comes
+	s.Record("a.com:80", 1, 1, 0, nil)
+	s.Record("c.com:80", 1, 1, 0, nil)
+	top = s.TopHosts(10, MetricRequests)
+	if len(top) != 3 || top[0].HostWithPort != "a.com:80" || top[1].HostWithPort != HostStatsOtherHost {
+		t.Fatalf("unexpected top hosts after eviction %+v", top)
+	}
+
+	// the hosts far from the back are recorded without moving them
+	s = &HostStats{MaxHosts: 4}
+	s.Record("a.com:80", 1, 1, 0, nil)
+	s.Record("b.com:80", 1, 1, 0, nil)
+	for i := 0; i < 10; i++ {
+		s.Record("a.com:80", 1, 1, 0, nil)
+	}
+	if s.moves != 2 {
+		t.Fatalf("unexpected %d moves", s.moves)
+	}
+}
+
+func TestHostStatsRecordTunnel(t *testing.T) {
+	s := &HostStats{}
+	s.Record("a.com:443", 100, 10, 0, nil)
+	s.RecordTunnel("a.com:443", 20, 2000, nil)
+	top := s.TopHosts(1, MetricTunnelBytesDown)
+	if len(top) != 1 || top[0].Requests != 2 || top[0].Tunnels != 1 {
+		t.Fatalf("unexpected top hosts by tunnel bytes %+v", top)
+	}
+	if top[0].TunnelBytesUp != 20 || top[0].TunnelBytesDown != 2000 ||
+		top[0].BytesOut != 30 || top[0].BytesIn != 2100 {
+		t.Fatalf("unexpected tunnel bytes %+v", top[0])
+	}
+}
+
+func TestHostStatsRecordEgress(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	// a super proxy answering the requests itself
+	sp := listenLocal(t, func(c net.Conn) {
+		defer c.Close()
+		if _, err := nethttp.ReadRequest(bufio.NewReader(c)); err == nil {
+			c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nproxy"))
+		}
+	})
+	defer sp.Close()
+
+	s := &HostStats{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HostStats = s
+	})
+	if _, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "", ""); body != "origin" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	p.SuperProxy, _ = superproxy.NewSuperProxy("127.0.0.1",
+		uint16(sp.Addr().(*net.TCPAddr).Port), superproxy.ProxyTypeHTTP, "", "", "")
+	for i := 0; i < 2; i++ {
+		if _, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "", ""); body != "proxy" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	}
+	s.RecordTunnel("a.com:443", 1, 1, nil)
+	s.RecordEgress("a.com:443", EgressSOCKS5Proxy)
+
+	top := s.TopHosts(2, MetricDirect)
+	if len(top) != 2 || top[0].Direct != 1 || top[0].ViaHTTPProxy != 2 ||
+		top[1].ViaSOCKS5Proxy != 1 || top[1].Direct != 0 {
+		t.Fatalf("unexpected top hosts by egress %+v", top)
+	}
+}
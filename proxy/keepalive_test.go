@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepClientAlive(t *testing.T) {
+	// a HTTP/1.0 target closing the connection to end the body
+	ln := listenLocal(t, func(c net.Conn) {
+		defer c.Close()
+		if _, err := nethttp.ReadRequest(bufio.NewReader(c)); err != nil {
+			return
+		}
+		c.Write([]byte("HTTP/1.0 200 OK\r\nConnection: close\r\nKeep-Alive: timeout=5\r\n\r\nhello"))
+	})
+	defer ln.Close()
+
+	p := newTestProxy(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- p.serveConn(server)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(client)
+	get := func(connHeader string) *nethttp.Response {
+		go fmt.Fprintf(client, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n%s\r\n",
+			ln.Addr(), ln.Addr(), connHeader)
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil || string(body) != "hello" {
+			t.Fatalf("unexpected body %q, error: %v", body, err)
+		}
+		return resp
+	}
+
+	// the client is kept alive with the body chunked
+	for i := 0; i < 2; i++ {
+		resp := get("")
+		if resp.Proto != "HTTP/1.1" || resp.Close || len(resp.TransferEncoding) != 1 ||
+			resp.Header.Get("Keep-Alive") != "" {
+			t.Fatalf("unexpected response %s %v %v %v", resp.Proto, resp.Close,
+				resp.TransferEncoding, resp.Header)
+		}
+	}
+
+	// the client asking for close gets the response as is
+	if resp := get("Connection: close\r\n"); resp.Proto != "HTTP/1.0" || !resp.Close {
+		t.Fatalf("unexpected response %s %v", resp.Proto, resp.Close)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client connection not closed")
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	var inFlight, maxInFlight int32
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for m := atomic.LoadInt32(&maxInFlight); n > m; m = atomic.LoadInt32(&maxInFlight) {
+			if atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+
+	p := newTestProxy(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// the requests pipelined are answered in order, one at a time
+	const n = 20
+	var pipelined bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&pipelined, "GET %s/%d HTTP/1.1\r\nHost: %s\r\n\r\n",
+			origin.URL, i, strings.TrimPrefix(origin.URL, "http://"))
+	}
+	go client.Write(pipelined.Bytes())
+	reader := bufio.NewReader(client)
+	for i := 0; i < n; i++ {
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != fmt.Sprintf("/%d", i) {
+			t.Fatalf("unexpected body %q of request %d", body, i)
+		}
+	}
+	if m := atomic.LoadInt32(&maxInFlight); m != 1 {
+		t.Fatalf("expected one request in flight at most, got %d", m)
+	}
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// lifetimeConn the client connection closing at its end of life, see
+// Proxy.MaxConnLifetime. The deadlines set afterwards are capped at the end
+// of life, so that the ones cleared or pushed back by the handshakes, the
+// keep-alive loop or the tunnels never extend it.
+type lifetimeConn struct {
+	net.Conn
+	end time.Time
+}
+
+// newLifetimeConn sets the deadline of c at lifetime from now
+func newLifetimeConn(c net.Conn, lifetime time.Duration) (*lifetimeConn, error) {
+	lc := &lifetimeConn{Conn: c, end: time.Now().Add(lifetime)}
+	return lc, c.SetDeadline(lc.end)
+}
+
+func (c *lifetimeConn) capped(t time.Time) time.Time {
+	if t.IsZero() || t.After(c.end) {
+		return c.end
+	}
+	return t
+}
+
+func (c *lifetimeConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetDeadline(c.capped(t))
+}
+
+func (c *lifetimeConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(c.capped(t))
+}
+
+func (c *lifetimeConn) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(c.capped(t))
+}
+
+// expired if c is at its end of life
+func (c *lifetimeConn) expired() bool {
+	return !time.Now().Before(c.end)
+}
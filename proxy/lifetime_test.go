@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaxConnLifetime(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	echo := listenLocal(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	defer echo.Close()
+
+	const lifetime = 300 * time.Millisecond
+	p := newTestProxy(t, func(p *Proxy) {
+		p.MaxConnLifetime = lifetime
+	})
+	// serve a client connection, the error it ends with is sent into done
+	serve := func() (net.Conn, *bufio.Reader, chan error) {
+		client, server := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- p.serveConn(server)
+			server.Close()
+		}()
+		return client, bufio.NewReader(client), done
+	}
+	expectClosed := func(name string, br *bufio.Reader, done chan error, start time.Time) {
+		if _, err := io.Copy(ioutil.Discard, br); err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+		if d := time.Since(start); d < lifetime || d > lifetime+time.Second {
+			t.Fatalf("%s: closed after %s", name, d)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+	}
+
+	// the keep-alive connection is closed however busy
+	start := time.Now()
+	client, br, done := serve()
+	for time.Since(start) < lifetime-100*time.Millisecond {
+		go client.Write([]byte("GET " + origin.URL + "/ HTTP/1.1\r\nHost: " + origin.Listener.Addr().String() + "\r\n\r\n"))
+		resp, err := nethttp.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if body, _ := ioutil.ReadAll(resp.Body); string(body) != "origin" {
+			t.Fatalf("unexpected body %q", body)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	expectClosed("keep-alive", br, done, start)
+	client.Close()
+
+	// so is the tunnel
+	start = time.Now()
+	client, br, done = serve()
+	defer client.Close()
+	go client.Write([]byte("CONNECT " + echo.Addr().String() + " HTTP/1.1\r\n\r\n"))
+	resp, err := nethttp.ReadResponse(br, &nethttp.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("unexpected tunnel response %v %v", resp, err)
+	}
+	go client.Write([]byte("ping"))
+	pong := make([]byte, 4)
+	if _, err := io.ReadFull(br, pong); err != nil || string(pong) != "ping" {
+		t.Fatalf("unexpected tunnel data %s %v", pong, err)
+	}
+	expectClosed("tunnel", br, done, start)
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"errors"
+
+	"github.com/haxii/log"
+)
+
+// LogLevel verbosity of the logs
+type LogLevel int
+
+const (
+	// LogLevelDebug connection lifecycle and per request details
+	LogLevelDebug LogLevel = iota - 1
+	// LogLevelInfo notable proxy events, the default level
+	LogLevelInfo
+	// LogLevelWarn unexpected but handled events, e.g. requests rejected
+	LogLevelWarn
+	// LogLevelError errors only
+	LogLevelError
+)
+
+// warnLogger optional Warn of the wrapped logger
+type warnLogger interface {
+	Warn(who, format string, v ...interface{})
+}
+
+// LeveledLogger wraps a log.Logger dropping the logs below Level,
+// raw logs are at debug level, errors and fatal ones are always kept
+// unless suppressed by the ErrorLogLimit of the proxy.
+//
+// The wrapped logger's Warn is used if it has one, otherwise the
+// warnings are logged by its Info.
+type LeveledLogger struct {
+	log.Logger
+	Level LogLevel
+}
+
+// Enabled if the logs of level are kept, which can be used to skip
+// building the log arguments, it's false for a nil logger
+func (l *LeveledLogger) Enabled(level LogLevel) bool {
+	return l != nil && l.Logger != nil && level >= l.Level
+}
+
+// Raw log the raw message at debug level
+func (l *LeveledLogger) Raw(rawMessage []byte, format string, v ...interface{}) {
+	if l.Enabled(LogLevelDebug) {
+		l.Logger.Raw(rawMessage, format, v...)
+	}
+}
+
+// Debug log at debug level
+func (l *LeveledLogger) Debug(who, format string, v ...interface{}) {
+	if l.Enabled(LogLevelDebug) {
+		l.Logger.Debug(who, format, v...)
+	}
+}
+
+// Info log at info level
+func (l *LeveledLogger) Info(who, format string, v ...interface{}) {
+	if l.Enabled(LogLevelInfo) {
+		l.Logger.Info(who, format, v...)
+	}
+}
+
+// Warn log at warn level
+func (l *LeveledLogger) Warn(who, format string, v ...interface{}) {
+	if !l.Enabled(LogLevelWarn) {
+		return
+	}
+	if w, ok := l.Logger.(warnLogger); ok {
+		w.Warn(who, format, v...)
+		return
+	}
+	l.Logger.Info(who, "[WARN] "+format, v...)
+}
+
+// Error log at error level, the errors suppressed by the ErrorLogLimit
+// of the proxy are dropped
+func (l *LeveledLogger) Error(who string, err error, format string, v ...interface{}) {
+	var suppressed *suppressedError
+	if l.Enabled(LogLevelError) && !errors.As(err, &suppressed) {
+		l.Logger.Error(who, err, format, v...)
+	}
+}
+
+// nopLogger discards all the logs, used if Logger is not set
+type nopLogger struct{}
+
+func (nopLogger) IsProduction() bool                          { return true }
+func (nopLogger) Raw([]byte, string, ...interface{})          {}
+func (nopLogger) Debug(string, string, ...interface{})        {}
+func (nopLogger) Info(string, string, ...interface{})         {}
+func (nopLogger) Error(string, error, string, ...interface{}) {}
+func (nopLogger) Fatal(string, error, string, ...interface{}) {}
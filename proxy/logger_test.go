@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/haxii/log"
+)
+
+// recordingLogger records the logs as "LEVEL message", shared by the
+// connections served concurrently
+type recordingLogger struct {
+	log.DefaultLogger
+	lock sync.Mutex
+	logs []string
+}
+
+func (l *recordingLogger) Debug(who, format string, v ...interface{}) {
+	l.record("DEBUG " + fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Info(who, format string, v ...interface{}) {
+	l.record("INFO " + fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Error(who string, err error, format string, v ...interface{}) {
+	l.record("ERROR " + fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) record(line string) {
+	l.lock.Lock()
+	l.logs = append(l.logs, line)
+	l.lock.Unlock()
+}
+
+// logged a copy of the logs recorded so far
+func (l *recordingLogger) logged() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.logs...)
+}
+
+// reset drops the logs recorded
+func (l *recordingLogger) reset() {
+	l.lock.Lock()
+	l.logs = nil
+	l.lock.Unlock()
+}
+
+func TestLeveledLogger(t *testing.T) {
+	r := &recordingLogger{}
+	l := &LeveledLogger{Logger: r}
+	l.Debug("who", "debug")
+	l.Info("who", "info")
+	l.Warn("who", "warn")
+	l.Error("who", nil, "error")
+	if logs := fmt.Sprint(r.logged()); logs != "[INFO info INFO [WARN] warn ERROR error]" {
+		t.Fatalf("unexpected logs at info level %s", logs)
+	}
+
+	r.reset()
+	l.Level = LogLevelDebug
+	l.Debug("who", "debug")
+	l.Level = LogLevelError
+	l.Info("who", "info")
+	l.Warn("who", "warn")
+	l.Error("who", nil, "error")
+	if logs := fmt.Sprint(r.logged()); logs != "[DEBUG debug ERROR error]" {
+		t.Fatalf("unexpected logs %s", logs)
+	}
+
+	var nilLogger *LeveledLogger
+	if nilLogger.Enabled(LogLevelError) {
+		t.Fatal("expected nil logger disabled")
+	}
+	nilLogger.Debug("who", "debug")
+}
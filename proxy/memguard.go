@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/transport"
+)
+
+// ShedStage the load shedding stage of the MemoryGuard, each stage sheds
+// the load of the previous ones as well
+type ShedStage int32
+
+const (
+	// ShedNone nothing is shed
+	ShedNone ShedStage = iota
+	// ShedCapture stops the hijackers capturing the bodies and the cache
+	// recording the responses forwarded
+	ShedCapture
+	// ShedCaches flushes the DNS and response caches once entered
+	ShedCaches
+	// ShedConnections rejects the new connections with 503
+	ShedConnections
+
+	shedStageCount
+)
+
+func (s ShedStage) String() string {
+	switch s {
+	case ShedCapture:
+		return "capture"
+	case ShedCaches:
+		return "caches"
+	case ShedConnections:
+		return "connections"
+	}
+	return "none"
+}
+
+// shedThresholds percentage of the limit estimated entering each stage
+var shedThresholds = [shedStageCount]int64{ShedCapture: 80, ShedCaches: 90, ShedConnections: 100}
+
+// dnsCacheEntryCost approximate memory used by a host cached by the DNS cache
+const dnsCacheEntryCost = 256
+
+// MemoryGuard soft memory limit of the proxy, which sheds the load stage by
+// stage as the memory estimated approaches Limit, and recovers as it falls.
+//
+// The estimate is tracked by the proxy rather than introspecting the heap,
+// i.e. the buffers of the connections served, the bodies being captured,
+// the responses kept by the LRUCacheStore and the hosts in the DNS cache.
+type MemoryGuard struct {
+	// Limit budget in bytes of the memory estimated, the stages are entered
+	// at 80%, 90% and 100% of it, nothing is shed if not set
+	Limit int64
+	// DNSCache the DNS cache estimated and flushed,
+	// transport.DefaultDNSCache is used if not set
+	DNSCache *transport.DNSCache
+	// OnStage called with the estimate once the stage changes, e.g. for
+	// the metrics of the shedding
+	OnStage func(stage ShedStage, estimate int64)
+
+	// conns and captures bytes estimated of the connection buffers and
+	// the bodies being captured
+	conns    int64
+	captures int64
+	stage    int32
+	// entered number of times each stage is entered
+	entered [shedStageCount]int64
+
+	// lock serializes the stage changes
+	lock sync.Mutex
+}
+
+// MemoryStats the state of the MemoryGuard
+type MemoryStats struct {
+	// Estimate memory estimated in bytes
+	Estimate int64
+	// Stage current load shedding stage
+	Stage ShedStage
+	// Entered number of times each stage is entered, indexed by ShedStage
+	Entered [shedStageCount]int64
+}
+
+// Stage current load shedding stage
+func (g *MemoryGuard) Stage() ShedStage {
+	if g == nil {
+		return ShedNone
+	}
+	return ShedStage(atomic.LoadInt32(&g.stage))
+}
+
+func (g *MemoryGuard) dnsCache() *transport.DNSCache {
+	if g.DNSCache != nil {
+		return g.DNSCache
+	}
+	return transport.DefaultDNSCache
+}
+
+// MemoryStats the state of the MemoryGuard, zero if not set
+func (p *Proxy) MemoryStats() MemoryStats {
+	g := p.MemoryGuard
+	if g == nil {
+		return MemoryStats{}
+	}
+	stats := MemoryStats{Estimate: p.memoryEstimate(), Stage: g.Stage()}
+	for i := range stats.Entered {
+		stats.Entered[i] = atomic.LoadInt64(&g.entered[i])
+	}
+	return stats
+}
+
+// memoryEstimate bytes estimated of the memory tracked
+func (p *Proxy) memoryEstimate() int64 {
+	g := p.MemoryGuard
+	estimate := atomic.LoadInt64(&g.conns) + atomic.LoadInt64(&g.captures)
+	estimate += int64(g.dnsCache().Len()) * dnsCacheEntryCost
+	if p.Cache != nil {
+		if s, ok := p.Cache.store().(interface{ Size() int64 }); ok {
+			estimate += s.Size()
+		}
+	}
+	return estimate
+}
+
+// connBufferCost bytes estimated of the buffers used serving a connection,
+// both to the client and to the target
+func (p *Proxy) connBufferCost() int64 {
+	return 2 * int64(p.bufioPool.ReadBufferSize()+p.bufioPool.WriteBufferSize())
+}
+
+// checkMemory updates the stage of the MemoryGuard by the memory estimated
+func (p *Proxy) checkMemory() ShedStage {
+	g := p.MemoryGuard
+	if g == nil || g.Limit <= 0 {
+		return ShedNone
+	}
+	estimate := p.memoryEstimate()
+	stage := ShedNone
+	for s := ShedCapture; s < shedStageCount; s++ {
+		if estimate*100 >= g.Limit*shedThresholds[s] {
+			stage = s
+		}
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	current := g.Stage()
+	if stage == current {
+		return stage
+	}
+	atomic.StoreInt32(&g.stage, int32(stage))
+	if stage > current {
+		for s := current + 1; s <= stage; s++ {
+			atomic.AddInt64(&g.entered[s], 1)
+			p.logger.Warn("MemoryGuard", "shedding %s, %d of %d bytes estimated", s, estimate, g.Limit)
+		}
+		if current < ShedCaches && stage >= ShedCaches {
+			p.flushCaches()
+		}
+	} else {
+		p.logger.Info("MemoryGuard", "recovered to shedding %s, %d of %d bytes estimated", stage, estimate, g.Limit)
+	}
+	if g.OnStage != nil {
+		g.OnStage(stage, estimate)
+	}
+	return stage
+}
+
+// flushCaches flushes the DNS cache and the response cache if flushable
+func (p *Proxy) flushCaches() {
+	p.MemoryGuard.dnsCache().Flush()
+	if p.Cache != nil {
+		if s, ok := p.Cache.store().(interface{ Flush() }); ok {
+			s.Flush()
+		}
+	}
+}
+
+// guardCapture stops the capture by w if shedding, otherwise counts the
+// bytes captured until it's closed
+func (g *MemoryGuard) guardCapture(w io.WriteCloser) io.WriteCloser {
+	if g == nil || w == nil {
+		return w
+	}
+	if g.Stage() >= ShedCapture {
+		return bypassBodyCapture(w)
+	}
+	return &guardedCapture{w: w, g: g}
+}
+
+// guardedCapture counts the bytes captured by w into the MemoryGuard
+type guardedCapture struct {
+	w io.WriteCloser
+	g *MemoryGuard
+	n int64
+}
+
+func (c *guardedCapture) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	atomic.AddInt64(&c.g.captures, int64(n))
+	return n, err
+}
+
+// OnTrailer passes the trailer to w, see TrailerReceiver
+func (c *guardedCapture) OnTrailer(trailer http.Header) {
+	if tr, ok := c.w.(TrailerReceiver); ok {
+		tr.OnTrailer(trailer)
+	}
+}
+
+func (c *guardedCapture) Close() error {
+	atomic.AddInt64(&c.g.captures, -c.n)
+	c.n = 0
+	return c.w.Close()
+}
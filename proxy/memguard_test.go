@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+// closingBuffer a body capture recording if it's closed
+type closingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closingBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestMemoryGuard(t *testing.T) {
+	dnsCache := &transport.DNSCache{}
+	var stages []ShedStage
+	g := &MemoryGuard{Limit: 100000, DNSCache: dnsCache,
+		OnStage: func(stage ShedStage, estimate int64) { stages = append(stages, stage) }}
+	r := &recordingLogger{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.MemoryGuard = g
+		p.Cache = &Cache{}
+	})
+	p.logger = &LeveledLogger{Logger: r}
+
+	// nothing is shed under the limit
+	dnsCache.Put("example.com", []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, time.Minute)
+	p.Cache.store().Set("key", &CachedResponse{Body: make([]byte, 10000)})
+	if stage := p.checkMemory(); stage != ShedNone {
+		t.Fatalf("unexpected stage %s", stage)
+	}
+	capture := &closingBuffer{}
+	w := g.guardCapture(capture)
+	w.Write(make([]byte, 70000))
+	if capture.Len() != 70000 {
+		t.Fatalf("unexpected bytes captured %d", capture.Len())
+	}
+
+	// the captures are stopped over 80%
+	if stage := p.checkMemory(); stage != ShedCapture {
+		t.Fatalf("unexpected stage %s", stage)
+	}
+	stopped := &closingBuffer{}
+	if g.guardCapture(stopped) != nil || !stopped.closed {
+		t.Fatal("expected the capture stopped")
+	}
+
+	// the caches are flushed over 90%
+	atomic.AddInt64(&g.conns, 10000)
+	if stage := p.checkMemory(); stage != ShedCaches {
+		t.Fatalf("unexpected stage %s", stage)
+	}
+	if dnsCache.Len() != 0 || p.Cache.store().(*LRUCacheStore).Len() != 0 {
+		t.Fatal("expected the caches flushed")
+	}
+
+	// the new connections are rejected over the limit
+	atomic.AddInt64(&g.conns, 30000)
+	client, server := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- p.serveConn(server)
+		server.Close()
+	}()
+	response, _ := ioutil.ReadAll(client)
+	if !strings.HasPrefix(string(response), "HTTP/1.1 503") {
+		t.Fatalf("unexpected response %q", response)
+	}
+	if err := <-served; err != ErrMemoryLimitExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// recovered as the estimate falls
+	w.Close()
+	atomic.AddInt64(&g.conns, -40000)
+	if stage := p.checkMemory(); stage != ShedNone {
+		t.Fatalf("unexpected stage %s", stage)
+	}
+	if !capture.closed || g.guardCapture(&closingBuffer{}) == nil {
+		t.Fatal("expected the capture resumed")
+	}
+
+	stats := p.MemoryStats()
+	if stats.Stage != ShedNone || stats.Estimate != 0 ||
+		stats.Entered != [shedStageCount]int64{0, 1, 1, 1} {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if s := fmt.Sprint(stages); s != "[capture caches connections none]" {
+		t.Fatalf("unexpected stages %s", s)
+	}
+	expected := []string{
+		"INFO [WARN] shedding capture, 80259 of 100000 bytes estimated",
+		"INFO [WARN] shedding caches, 90259 of 100000 bytes estimated",
+		"INFO [WARN] shedding connections, 110000 of 100000 bytes estimated",
+		"INFO recovered to shedding none, 0 of 100000 bytes estimated",
+	}
+	if s := fmt.Sprint(r.logged()); s != fmt.Sprint(expected) {
+		t.Fatalf("unexpected logs %s", s)
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"io"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// MultipartSink optional interface of the request body writer returned by
+// Hijacker.OnRequest, which is given the parts of the multipart/form-data
+// bodies scanned with bounded memory instead of their raw bytes, e.g. for
+// inspecting the uploads without buffering them. The bodies of the other
+// types are written as is.
+type MultipartSink interface {
+	// ScanMultipart called before the body is written with the scanner of
+	// it, whose preview size and callbacks are set by the sink, the errors
+	// scanning it are told by its Err once the writer is closed
+	ScanMultipart(scanner *http.MultipartScanner)
+}
+
+// multipartTap scans the multipart/form-data body of header into w if it's
+// a MultipartSink, each of the sinks tee'd by the hijackers chained scans
+// the body on its own
+func multipartTap(w io.WriteCloser, header *http.Header) io.WriteCloser {
+	if tee, ok := w.(*teeWriter); ok {
+		for i, writer := range *tee {
+			(*tee)[i] = multipartTap(writer, header)
+		}
+		return tee
+	}
+	sink, ok := w.(MultipartSink)
+	if !ok {
+		return w
+	}
+	boundary := http.MultipartBoundary(header.ContentType())
+	if boundary == nil {
+		return w
+	}
+	scanner := http.NewMultipartScanner(boundary)
+	sink.ScanMultipart(scanner)
+	return &multipartWriter{MultipartScanner: scanner, w: w}
+}
+
+// multipartWriter scans the body written for the sink w
+type multipartWriter struct {
+	*http.MultipartScanner
+	w io.WriteCloser
+}
+
+// Close ends the scan then closes w
+func (m *multipartWriter) Close() error {
+	m.MultipartScanner.Close()
+	return m.w.Close()
+}
+
+// OnTrailer passes the trailer to w, see TrailerReceiver
+func (m *multipartWriter) OnTrailer(trailer http.Header) {
+	if tr, ok := m.w.(TrailerReceiver); ok {
+		tr.OnTrailer(trailer)
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// multipartHijacker inspects the parts of the uploads
+type multipartHijacker struct {
+	tlsTestHijacker
+	events []string
+	raw    []byte
+}
+
+func (h *multipartHijacker) OnRequest([]byte, http.Header, []byte) io.WriteCloser {
+	h.events, h.raw = nil, nil
+	return &multipartHijackerSink{h: h}
+}
+
+type multipartHijackerSink struct{ h *multipartHijacker }
+
+func (s *multipartHijackerSink) Write(b []byte) (int, error) {
+	s.h.raw = append(s.h.raw, b...)
+	return len(b), nil
+}
+func (s *multipartHijackerSink) Close() error {
+	s.h.events = append(s.h.events, "close")
+	return nil
+}
+func (s *multipartHijackerSink) ScanMultipart(scanner *http.MultipartScanner) {
+	scanner.PreviewSize = 4
+	scanner.OnPartHeader = func(part *http.MultipartPart) {
+		s.h.events = append(s.h.events, fmt.Sprintf("header %s %s %s", part.Name, part.FileName, part.ContentType))
+	}
+	scanner.OnPartEnd = func(part *http.MultipartPart) {
+		s.h.events = append(s.h.events, fmt.Sprintf("end %s %d", part.Preview, part.Size))
+	}
+}
+
+type multipartHijackerPool struct{ h *multipartHijacker }
+
+func (p multipartHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p multipartHijackerPool) Put(Hijacker) {}
+
+func TestMultipartSink(t *testing.T) {
+	// the origin parses the forms forwarded
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			r.ParseForm()
+			fmt.Fprintf(w, "form %s", r.PostForm.Get("a"))
+			return
+		}
+		file, _, _ := r.FormFile("upload")
+		content, _ := ioutil.ReadAll(file)
+		fmt.Fprintf(w, "multipart %s %d", r.FormValue("comment"), len(content))
+	}))
+	defer origin.Close()
+	h := &multipartHijacker{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = multipartHijackerPool{h}
+	})
+
+	// the parts of the multipart/form-data bodies are given to the sink
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("comment", "hi")
+	file, _ := w.CreateFormFile("upload", "data.bin")
+	file.Write(bytes.Repeat([]byte("0123456789"), 10000))
+	w.Close()
+	resp, respBody := proxyTestRequest(t, p, "POST", origin.URL+"/",
+		"Content-Type: "+w.FormDataContentType()+"\r\nContent-Length: "+strconv.Itoa(body.Len())+"\r\n",
+		body.String())
+	if resp.StatusCode != 200 || respBody != "multipart hi 100000" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, respBody)
+	}
+	expected := []string{"header comment  ", "end hi 2",
+		"header upload data.bin application/octet-stream", "end 0123 100000", "close"}
+	if fmt.Sprint(h.events) != fmt.Sprint(expected) || h.raw != nil {
+		t.Fatalf("unexpected events %q with %d bytes written", h.events, len(h.raw))
+	}
+
+	// the bodies of the other types are written as is
+	resp, respBody = proxyTestRequest(t, p, "POST", origin.URL+"/",
+		"Content-Type: application/x-www-form-urlencoded\r\nContent-Length: 3\r\n", "a=1")
+	if resp.StatusCode != 200 || respBody != "form 1" || string(h.raw) != "a=1" ||
+		fmt.Sprint(h.events) != "[close]" {
+		t.Fatalf("unexpected response %d %q, events %q with %q written", resp.StatusCode, respBody, h.events, h.raw)
+	}
+
+	// the parts are given to all the sinks of the hijackers chained
+	h2 := &multipartHijacker{}
+	p.HijackerPool = HijackerChainPool{multipartHijackerPool{h}, multipartHijackerPool{h2}}
+	resp, respBody = proxyTestRequest(t, p, "POST", origin.URL+"/",
+		"Content-Type: "+w.FormDataContentType()+"\r\nContent-Length: "+strconv.Itoa(body.Len())+"\r\n",
+		body.String())
+	if resp.StatusCode != 200 || respBody != "multipart hi 100000" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, respBody)
+	}
+	for _, h := range []*multipartHijacker{h, h2} {
+		if fmt.Sprint(h.events) != fmt.Sprint(expected) || h.raw != nil {
+			t.Fatalf("unexpected events %q with %d bytes written", h.events, len(h.raw))
+		}
+	}
+}
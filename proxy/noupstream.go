@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// NoUpstreamHandler decides the answer to a request or tunnel left without
+// a super proxy while DisallowDirect is set, returns its status, e.g. 403
+// for the targets the egress policy forbids, and optional body. 502 is
+// answered if the status is not a valid one.
+type NoUpstreamHandler func(req RequestView) (statusCode int, body string)
+
+// rejectNoUpstream answers the request left without a super proxy with
+// the NoUpstreamHandler if DisallowDirect, ErrNoUpstream is returned then
+func (p *Proxy) rejectNoUpstream(c net.Conn, req *Request) (rejected bool, err error) {
+	if !p.DisallowDirect || req.GetProxy() != nil {
+		return false, nil
+	}
+	statusCode, body := http.StatusBadGateway, "No upstream available.\n"
+	if p.NoUpstreamHandler != nil {
+		if code, b := p.NoUpstreamHandler(RequestView{req: req}); code >= 100 && code < 600 {
+			statusCode, body = code, b
+		}
+	}
+	p.logger.Warn(req.reqLine.HostInfo().HostWithPort(), "%s %s rejected with %d: %s",
+		req.Method(), req.PathWithQueryFragment(), statusCode, ErrNoUpstream)
+	if err = writeFastError(c, statusCode, body); err == nil {
+		err = ErrNoUpstream
+	}
+	return true, err
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+func TestDisallowDirect(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer origin.Close()
+
+	p := newTestProxy(t, func(p *Proxy) {
+		p.DisallowDirect = true
+	})
+	if resp, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "", ""); resp.StatusCode != 502 ||
+		body != "No upstream available.\n" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	if err := serveRawRequest(p, "GET "+origin.URL+"/ HTTP/1.1\r\n\r\n"); !errors.Is(err, ErrNoUpstream) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the handler decides the answer
+	var handled []string
+	p.NoUpstreamHandler = func(req RequestView) (int, string) {
+		handled = append(handled, string(req.Method())+" "+string(req.URI().Host()))
+		return nethttp.StatusForbidden, "egress denied\n"
+	}
+	if resp, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "", ""); resp.StatusCode != 403 ||
+		body != "egress denied\n" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := proxyTestRequest(t, p, "CONNECT", "www.example.com:443", "", ""); resp.StatusCode != 403 {
+		t.Fatalf("unexpected tunnel response %d", resp.StatusCode)
+	}
+	if len(handled) != 2 || handled[1] != "CONNECT www.example.com:443" {
+		t.Fatalf("unexpected requests handled %q", handled)
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Fatalf("unexpected %d direct requests", n)
+	}
+
+	// the requests with a super proxy go on
+	sp := listenLocal(t, func(c net.Conn) {
+		defer c.Close()
+		if _, err := nethttp.ReadRequest(bufio.NewReader(c)); err == nil {
+			c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nproxy"))
+		}
+	})
+	defer sp.Close()
+	p.SuperProxy, _ = superproxy.NewSuperProxy("127.0.0.1",
+		uint16(sp.Addr().(*net.TCPAddr).Port), superproxy.ProxyTypeHTTP, "", "", "")
+	if resp, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "", ""); resp.StatusCode != 200 ||
+		body != "proxy" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+
+	// the hijacker picking no super proxy overrides the default one
+	p.HijackerPool = &tlsTestHijackerPool{&tlsTestHijacker{}}
+	if resp, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "", ""); resp.StatusCode != 403 ||
+		body != "egress denied\n" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Fatalf("unexpected %d direct requests", n)
+	}
+}
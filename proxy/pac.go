@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/servertime"
+)
+
+// PACContentType content type of proxy auto-config files
+const PACContentType = "application/x-ns-proxy-autoconfig"
+
+// PACFile a proxy auto-config file served by proxy itself
+type PACFile struct {
+	// Path request path of the PAC file, e.g. `/proxy.pac` or `/wpad.dat`
+	Path string
+
+	// Host optional host name of the PAC file for absolute-form requests,
+	// e.g. `wpad`, requests sent to the proxy directly always match.
+	Host string
+
+	// Content static content of the PAC file
+	Content []byte
+
+	// Generate generates the PAC file for every request, Content is used when nil
+	Generate func(clientAddr net.Addr) []byte
+}
+
+// match whether the request is asking for this PAC file
+func (f *PACFile) match(req *Request) bool {
+	if f == nil || len(f.Path) == 0 || http.IsMethodConnect(req.Method()) {
+		return false
+	}
+	if !bytes.Equal(req.reqLine.URI().Path(), []byte(f.Path)) {
+		return false
+	}
+	domain := req.reqLine.HostInfo().Domain()
+	return len(domain) == 0 || (len(f.Host) > 0 && strings.EqualFold(domain, f.Host))
+}
+
+// writeTo writes the PAC file as an http response into w
+func (f *PACFile) writeTo(w io.Writer, clientAddr net.Addr) error {
+	content := f.Content
+	if f.Generate != nil {
+		content = f.Generate(clientAddr)
+	}
+	return writeLocalResponse(w, PACContentType, content)
+}
+
+// writeLocalResponse writes the content served by proxy itself as an http response into w
+func writeLocalResponse(w io.Writer, contentType string, content []byte) error {
+	if _, err := w.Write(http.StatusLine(http.StatusOK)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Connection: close\r\n"+
+		"Date: %s\r\n"+
+		"Content-Type: %s\r\n"+
+		"Content-Length: %d\r\n"+
+		"\r\n", servertime.ServerDate(), contentType, len(content))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"testing"
+)
+
+func TestServePACFile(t *testing.T) {
+	p := newTestProxy(t, func(p *Proxy) {
+		p.PACFile = &PACFile{
+			Path:    "/proxy.pac",
+			Host:    "wpad",
+			Content: []byte(`function FindProxyForURL(url, host) { return "PROXY 127.0.0.1:8080"; }`),
+		}
+	})
+	testServePACFile(t, p, "GET /proxy.pac HTTP/1.1\r\nHost: 127.0.0.1:8080\r\n\r\n")
+	testServePACFile(t, p, "GET http://wpad/proxy.pac HTTP/1.1\r\nHost: wpad\r\n\r\n")
+}
+
+func testServePACFile(t *testing.T, p *Proxy, rawReq string) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	go client.Write([]byte(rawReq))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != PACContentType {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != string(p.PACFile.Content) {
+		t.Fatalf("unexpected PAC file %s", body)
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+
+	"github.com/haxii/fastproxy/util"
+)
+
+// panicError a panic recovered with the stack of the goroutine panicking
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// recovered the panicError of v, v itself if it's already one
+func recovered(v interface{}) *panicError {
+	if pe, ok := v.(*panicError); ok {
+		return pe
+	}
+	return &panicError{value: v, stack: debug.Stack()}
+}
+
+// goWithPanic runs f in a new goroutine marked done in wg, a panic of f is
+// recovered and passed to the func returned, which re-panics with it in the
+// goroutine waiting for wg, e.g. the one serving the client connection
+func goWithPanic(wg *sync.WaitGroup, f func()) (repanic func()) {
+	var pe *panicError
+	go func() {
+		defer wg.Done()
+		defer func() {
+			if v := recover(); v != nil {
+				pe = recovered(v)
+			}
+		}()
+		f()
+	}()
+	return func() {
+		if pe != nil {
+			panic(pe)
+		}
+	}
+}
+
+// recoverPanic recovers the panic serving the client connection c, which is
+// logged with the request being served and counted by Panics, then err is
+// set to an ErrPanic so that the connection is closed, while the proxy
+// keeps serving the others. It panics again if CrashOnPanic.
+func (p *Proxy) recoverPanic(c net.Conn, req *Request, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	pe := recovered(v)
+	if p.CrashOnPanic {
+		panic(fmt.Sprintf("%v\n\n%s", pe.value, pe.stack))
+	}
+	atomic.AddUint64(&p.panics, 1)
+	phase := ConnStateReadingHeader
+	if req.connInfo != nil {
+		phase = ConnState(atomic.LoadInt32(&req.connInfo.state))
+	}
+	p.logger.Error(c.RemoteAddr().String(), pe, "panic serving %s %s%s when %s\n%s",
+		req.Method(), req.reqLine.HostInfo().HostWithPort(), req.PathWithQueryFragment(),
+		phase, pe.stack)
+	*err = util.ErrKind(ErrPanic, pe)
+}
+
+// Panics number of the panics recovered serving the client connections so far
+func (p *Proxy) Panics() uint64 {
+	return atomic.LoadUint64(&p.panics)
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// panicHijacker panics in OnRequest of the requests to /panic
+type panicHijacker struct{ tlsTestHijacker }
+
+func (h *panicHijacker) OnRequest(path []byte, header http.Header, raw []byte) io.WriteCloser {
+	if string(path) == "/panic" {
+		panic("hijacker failed")
+	}
+	return nil
+}
+
+type panicHijackerPool struct{ h *panicHijacker }
+
+func (p panicHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p panicHijackerPool) Put(Hijacker) {}
+
+func TestPanicRecovery(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	logger := &recordingLogger{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = panicHijackerPool{&panicHijacker{}}
+		p.logger = &LeveledLogger{Logger: logger, Level: LogLevelError}
+	})
+
+	err := serveRawRequest(p, "GET "+origin.URL+"/panic HTTP/1.1\r\nHost: "+
+		strings.TrimPrefix(origin.URL, "http://")+"\r\n\r\n")
+	if !errors.Is(err, ErrPanic) || p.Panics() != 1 {
+		t.Fatalf("unexpected error %v, %d panics", err, p.Panics())
+	}
+	if logs := logger.logged(); len(logs) != 1 || !strings.Contains(logs[0], "panic serving GET") ||
+		!strings.Contains(logs[0], "/panic when awaiting-upstream") ||
+		!strings.Contains(logs[0], "panicHijacker).OnRequest") {
+		t.Fatalf("unexpected logs %q", logs)
+	}
+
+	// the proxy keeps serving
+	if _, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "", ""); body != "origin" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	// the panic crashes if asked
+	p.CrashOnPanic = true
+	defer func() {
+		if v := recover(); v == nil || !strings.Contains(v.(string), "hijacker failed") {
+			t.Fatalf("unexpected panic %v", v)
+		}
+	}()
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("GET " + origin.URL + "/panic HTTP/1.1\r\n\r\n"))
+	go io.Copy(ioutil.Discard, client)
+	p.serveConn(server)
+	t.Fatal("expected panic")
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"github.com/haxii/fastproxy/uri"
+)
+
+// PathEncoding how the paths and queries of the requests forwarded are
+// percent-encoded following RFC 3986, see uri.AppendPercentEncoded
+type PathEncoding int
+
+const (
+	// PathEncodingAsIs forwards the paths as is
+	PathEncodingAsIs PathEncoding = iota
+	// PathEncodingFix encodes the bytes not allowed, e.g. spaces and
+	// non-ASCII bytes, as well as the `%` not starting a valid encoding
+	PathEncodingFix
+	// PathEncodingStrict encodes the bytes not allowed, but rejects the
+	// requests with invalid percent-encodings with 400
+	PathEncodingStrict
+)
+
+// encodePath percent-encodes the path and query of the request in mode,
+// uri.ErrInvalidPercentEncoding is returned if rejected
+func (r *Request) encodePath(mode PathEncoding) error {
+	if mode == PathEncodingAsIs {
+		return nil
+	}
+	path := r.reqLine.PathWithQueryFragment()
+	if uri.IsPercentEncoded(path) {
+		return nil
+	}
+	encoded, err := uri.AppendPercentEncoded(nil, path, mode == PathEncodingFix)
+	if err != nil {
+		return err
+	}
+	r.reqLine.ChangePathWithFragment(encoded)
+	return nil
+}
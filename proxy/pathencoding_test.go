@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// rewriteHijacker rewrites the path of the requests with rewrite
+type rewriteHijacker struct {
+	tlsTestHijacker
+	rewrite  func(path []byte) []byte
+	original string
+}
+
+func (h *rewriteHijacker) BeforeRequest(method, path []byte, header http.Header,
+	rawHeader []byte) ([]byte, []byte) {
+	h.original = string(path)
+	return h.rewrite(path), rawHeader
+}
+
+type rewriteHijackerPool struct{ h *rewriteHijacker }
+
+func (p rewriteHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p rewriteHijackerPool) Put(Hijacker) {}
+
+func TestPathEncoding(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer origin.Close()
+
+	h := &rewriteHijacker{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = rewriteHijackerPool{h}
+	})
+	for _, c := range []struct {
+		mode                  PathEncoding
+		path, rewritten, sent string
+		status                int
+	}{
+		{PathEncodingAsIs, "/%C3%A9", "", "/%C3%A9", 200},
+		{PathEncodingFix, "/é?q=é", "", "/%C3%A9?q=%C3%A9", 200},
+		{PathEncodingFix, "/%zz", "", "/%25zz", 200},
+		{PathEncodingFix, "/a", "/a b", "/a%20b", 200},
+		{PathEncodingStrict, "/é", "", "/%C3%A9", 200},
+		{PathEncodingStrict, "/%zz", "", "", 400},
+		{PathEncodingStrict, "/a", "/100%", "", 400},
+	} {
+		p.PathEncoding = c.mode
+		h.rewrite = func(path []byte) []byte {
+			if len(c.rewritten) > 0 {
+				return []byte(c.rewritten)
+			}
+			return path
+		}
+		resp, body := proxyTestRequest(t, p, "GET", origin.URL+c.path, "", "")
+		if resp.StatusCode != c.status || (c.status == 200 && body != c.sent) {
+			t.Fatalf("unexpected response of %s in mode %d: %d %s", c.path, c.mode, resp.StatusCode, body)
+		}
+		if h.original != c.path {
+			t.Fatalf("unexpected path %s seen by the hijacker, expected %s", h.original, c.path)
+		}
+	}
+}
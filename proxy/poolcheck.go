@@ -0,0 +1,9 @@
+//go:build poolcheck
+// +build poolcheck
+
+package proxy
+
+// poolCheck poisons the requests and responses released into their pools,
+// which are never reused then, and panics on their use afterwards, built by
+// the poolcheck tag for debugging the state leaking across requests
+const poolCheck = true
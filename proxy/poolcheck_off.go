@@ -0,0 +1,7 @@
+//go:build !poolcheck
+// +build !poolcheck
+
+package proxy
+
+// poolCheck see poolcheck.go
+const poolCheck = false
@@ -0,0 +1,34 @@
+//go:build poolcheck
+// +build poolcheck
+
+package proxy
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestPoolCheck(t *testing.T) {
+	expectPanic := func(name string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("%s: expected panic", name)
+			}
+		}()
+		f()
+	}
+	var reqPool RequestPool
+	req := reqPool.Acquire()
+	reqPool.Release(req)
+	expectPanic("parse", func() { req.parseStartLine(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))) })
+	expectPanic("release twice", func() { reqPool.Release(req) })
+	if reqPool.Acquire() == req {
+		t.Fatal("released request reused")
+	}
+
+	var respPool ResponsePool
+	resp := respPool.Acquire()
+	respPool.Release(resp)
+	expectPanic("write", func() { resp.WriteTo(bufio.NewWriter(nil)) })
+}
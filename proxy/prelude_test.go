@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// bannerListener accepts the connections greeting with the banner only,
+// which is answered before HTTP is spoken
+type bannerListener struct {
+	net.Listener
+	greeted int32
+}
+
+func (l *bannerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		line, err := bufio.NewReader(io.LimitReader(conn, 6)).ReadString('\n')
+		if err != nil || line != "HELLO\n" {
+			conn.Close()
+			continue
+		}
+		atomic.AddInt32(&l.greeted, 1)
+		conn.Write([]byte("OK\n"))
+		return conn, nil
+	}
+}
+
+func TestOriginPrelude(t *testing.T) {
+	origin := httptest.NewUnstartedServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprint(w, "greeted")
+	}))
+	ln := &bannerListener{Listener: origin.Listener}
+	origin.Listener = ln
+	origin.Start()
+	defer origin.Close()
+
+	var preludes int32
+	p := newTestProxy(t)
+	p.client.OnNewOriginConn = func(hostWithPort string, conn net.Conn) (net.Conn, error) {
+		atomic.AddInt32(&preludes, 1)
+		if hostWithPort != origin.Listener.Addr().String() {
+			return nil, errors.New("unexpected host " + hostWithPort)
+		}
+		conn.Write([]byte("HELLO\n"))
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "OK\n" {
+			return nil, fmt.Errorf("unexpected banner %q, error: %v", b, err)
+		}
+		return conn, nil
+	}
+
+	// every new connection is greeted once, the direct ones aren't reused
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	br := bufio.NewReader(client)
+	for i := 0; i < 3; i++ {
+		go io.WriteString(client, "GET "+origin.URL+"/ HTTP/1.1\r\nHost: "+origin.Listener.Addr().String()+"\r\n\r\n")
+		resp, err := nethttp.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if body, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != 200 || string(body) != "greeted" {
+			t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+		}
+	}
+	if preludes != 3 || atomic.LoadInt32(&ln.greeted) != 3 {
+		t.Fatalf("unexpected %d preludes and %d greetings", preludes, ln.greeted)
+	}
+
+	// the connections lacking the prelude are rejected by the origin
+	p = newTestProxy(t)
+	client, server = net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	go io.WriteString(client, "GET "+origin.URL+"/ HTTP/1.1\r\n\r\n")
+	if resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil); err == nil && resp.StatusCode == 200 {
+		t.Fatal("unexpected response without prelude")
+	}
+
+	// the prelude failing is answered with 502
+	p = newTestProxy(t)
+	p.client.OnNewOriginConn = func(string, net.Conn) (net.Conn, error) {
+		return nil, errors.New("no banner")
+	}
+	client, server = net.Pipe()
+	defer client.Close()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- p.serveConn(server)
+		server.Close()
+	}()
+	go io.WriteString(client, "GET "+origin.URL+"/ HTTP/1.1\r\n\r\n")
+	resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil || resp.StatusCode != nethttp.StatusBadGateway {
+		t.Fatalf("unexpected response %v %v", resp, err)
+	}
+	go io.Copy(ioutil.Discard, client)
+	if err := <-errChan; !errors.Is(err, ErrUpstreamPrelude) || !errors.Is(err, ErrUpstreamDial) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+// raceHijacker races the route of its super proxy, recording the
+// addresses dialed and the winners reported
+type raceHijacker struct {
+	tlsTestHijacker
+	route      Route
+	superProxy *superproxy.SuperProxy
+	won        chan bool
+
+	lock   sync.Mutex
+	dialed []string
+}
+
+func (h *raceHijacker) Route() Route                         { return h.route }
+func (h *raceHijacker) SuperProxy() *superproxy.SuperProxy   { return h.superProxy }
+func (h *raceHijacker) OnRaceWon(direct bool)                { h.won <- direct }
+func (h *raceHijacker) Dial() func(string) (net.Conn, error) { return h.dial }
+
+func (h *raceHijacker) dial(addr string) (net.Conn, error) {
+	h.lock.Lock()
+	h.dialed = append(h.dialed, addr)
+	h.lock.Unlock()
+	return net.Dial("tcp", addr)
+}
+
+func (h *raceHijacker) dialedAddr(addr string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, dialed := range h.dialed {
+		if dialed == addr {
+			return true
+		}
+	}
+	return false
+}
+
+type raceHijackerPool struct{ h *raceHijacker }
+
+func (p raceHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p raceHijackerPool) Put(Hijacker) {}
+
+// serveSOCKS5 a SOCKS5 proxy without auth relaying c to the target
+func serveSOCKS5(c net.Conn) {
+	defer c.Close()
+	b := make([]byte, 262)
+	if _, err := io.ReadFull(c, b[:3]); err != nil {
+		return
+	}
+	c.Write([]byte{5, 0})
+	if _, err := io.ReadFull(c, b[:4]); err != nil {
+		return
+	}
+	var host string
+	switch b[3] {
+	case 1, 4:
+		ip := make(net.IP, 4*int(b[3]))
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 3:
+		if _, err := io.ReadFull(c, b[:1]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(c, b[:b[0]]); err != nil {
+			return
+		}
+		host = string(b[:b[0]])
+	}
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[:2])))))
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(target, c)
+	io.Copy(c, target)
+}
+
+func TestRouteRaceDirect(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	socksProxy := func(ln net.Listener) *superproxy.SuperProxy {
+		port := ln.Addr().(*net.TCPAddr).Port
+		sp, _ := superproxy.NewSuperProxy("127.0.0.1", uint16(port), superproxy.ProxyTypeSOCKS5, "", "", "")
+		return sp
+	}
+	newProxy := func(sp *superproxy.SuperProxy, route Route) (*Proxy, *raceHijacker, chan RequestRecord) {
+		h := &raceHijacker{route: route, superProxy: sp, won: make(chan bool, 1)}
+		records := make(chan RequestRecord, 1)
+		p := newTestProxy(t, func(p *Proxy) {
+			p.HijackerPool = raceHijackerPool{h}
+			p.RequestTimeout = func(string) time.Duration { return time.Second }
+			p.OnAccessRecord = func(record RequestRecord) { records <- record }
+		})
+		return p, h, records
+	}
+	expectWinner := func(name string, p *Proxy, h *raceHijacker, records chan RequestRecord,
+		direct bool, within time.Duration) {
+		start := time.Now()
+		resp, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "", "")
+		if d := time.Since(start); resp.StatusCode != 200 || body != "origin" || d > within {
+			t.Fatalf("%s: unexpected response %d %q in %s", name, resp.StatusCode, body, d)
+		}
+		egress := EgressSOCKS5Proxy
+		if direct {
+			egress = EgressDirect
+		}
+		if won := <-h.won; won != direct {
+			t.Fatalf("%s: unexpected winner, direct: %v", name, won)
+		}
+		if record := <-records; record.Egress != egress {
+			t.Fatalf("%s: unexpected egress %s", name, record.Egress)
+		}
+	}
+
+	// the super proxy never answering the handshake loses to the direct
+	// connection made once the head start is over
+	greetings := make(chan []byte, 1)
+	silent := listenLocal(t, func(c net.Conn) {
+		b, _ := ioutil.ReadAll(c)
+		greetings <- b
+	})
+	defer silent.Close()
+	p, h, records := newProxy(socksProxy(silent), Route{RaceDirect: true, RaceHeadStart: 50 * time.Millisecond})
+	expectWinner("slow super proxy", p, h, records, true, 500*time.Millisecond)
+	// with nothing but the greeting written to the loser
+	select {
+	case b := <-greetings:
+		if bytes.Contains(b, []byte("GET")) || len(b) > 4 {
+			t.Fatalf("unexpected bytes %q written to the loser", b)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the loser is never closed")
+	}
+
+	// the super proxy winning within its head start, never dialed directly
+	relay := listenLocal(t, serveSOCKS5)
+	defer relay.Close()
+	p, h, records = newProxy(socksProxy(relay), Route{RaceDirect: true, RaceHeadStart: 5 * time.Second})
+	expectWinner("fast super proxy", p, h, records, false, time.Second)
+	if h.dialedAddr(origin.Listener.Addr().String()) {
+		t.Fatal("unexpected direct connection dialed")
+	}
+
+	// no race with the direct connections disallowed
+	p, h, records = newProxy(socksProxy(relay), Route{RaceDirect: true, RaceHeadStart: time.Nanosecond})
+	p.DisallowDirect = true
+	if resp, _ := proxyTestRequest(t, p, "GET", origin.URL+"/", "", ""); resp.StatusCode != 200 ||
+		len(h.won) > 0 || (<-records).Egress != EgressSOCKS5Proxy {
+		t.Fatalf("unexpected response %d, raced: %v", resp.StatusCode, len(h.won) > 0)
+	}
+}
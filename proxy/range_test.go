@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRangeResponses(t *testing.T) {
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	var hits int32
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		nethttp.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer origin.Close()
+	// the multipart body delimited by closing the connection
+	closeDelimited := listenLocal(t, func(c net.Conn) {
+		defer c.Close()
+		nethttp.ReadRequest(bufio.NewReader(c))
+		fmt.Fprint(c, "HTTP/1.1 206 Partial Content\r\n"+
+			"Content-Type: multipart/byteranges; boundary=B\r\n\r\n"+
+			"--B\r\nContent-Type: video/mp4\r\nContent-Range: bytes 0-4/100000\r\n\r\n")
+		c.Write(content[:5])
+		fmt.Fprint(c, "\r\n--B\r\nContent-Type: video/mp4\r\nContent-Range: bytes 99995-99999/100000\r\n\r\n")
+		c.Write(content[99995:])
+		fmt.Fprint(c, "\r\n--B--\r\n")
+	})
+	defer closeDelimited.Close()
+
+	p := newTestProxy(t, func(p *Proxy) {
+		p.Cache = &Cache{}
+	})
+	// request sends the range request through the proxy, keeping the
+	// client alive for another request if asked
+	request := func(url, ranges string, keepAlive bool) *nethttp.Response {
+		client, server := net.Pipe()
+		go func() {
+			p.serveConn(server)
+			server.Close()
+		}()
+		header := "Range: " + ranges + "\r\n"
+		if !keepAlive {
+			header += "Connection: close\r\n"
+		}
+		go client.Write([]byte("GET " + url + " HTTP/1.1\r\n" + header + "\r\n"))
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %s", ranges, err)
+		}
+		client.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return resp
+	}
+	// expectParts checks the byte ranges of the multipart body
+	expectParts := func(resp *nethttp.Response, ranges [][2]int) {
+		mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if resp.StatusCode != 206 || mediaType != "multipart/byteranges" {
+			t.Fatalf("unexpected response %d %s", resp.StatusCode, mediaType)
+		}
+		r := multipart.NewReader(resp.Body, params["boundary"])
+		for i, rng := range ranges {
+			part, err := r.NextPart()
+			if err != nil {
+				t.Fatalf("unexpected error reading part %d: %s", i, err)
+			}
+			expected := fmt.Sprintf("bytes %d-%d/%d", rng[0], rng[1]-1, len(content))
+			if cr := part.Header.Get("Content-Range"); cr != expected {
+				t.Fatalf("unexpected Content-Range %q of part %d", cr, i)
+			}
+			if b, _ := ioutil.ReadAll(part); !bytes.Equal(b, content[rng[0]:rng[1]]) {
+				t.Fatalf("unexpected bytes of part %d, %d bytes", i, len(b))
+			}
+		}
+		if _, err := r.NextPart(); err != io.EOF {
+			t.Fatalf("expected the end of the parts, got %v", err)
+		}
+	}
+
+	for _, keepAlive := range []bool{false, true} {
+		// a single range by Content-Length, Content-Range untouched
+		resp := request(origin.URL+"/video", "bytes=10-19999", keepAlive)
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != 206 || resp.Header.Get("Content-Range") != "bytes 10-19999/100000" ||
+			resp.ContentLength != 19990 || !bytes.Equal(body, content[10:20000]) {
+			t.Fatalf("unexpected single range %d %q, %d bytes", resp.StatusCode,
+				resp.Header.Get("Content-Range"), len(body))
+		}
+
+		// multiple ranges by Content-Length
+		resp = request(origin.URL+"/video", "bytes=0-99,50000-50999,99900-", keepAlive)
+		if resp.ContentLength <= 0 {
+			t.Fatalf("expected the multipart body delimited by Content-Length, got %d", resp.ContentLength)
+		}
+		expectParts(resp, [][2]int{{0, 100}, {50000, 51000}, {99900, 100000}})
+
+		// multiple ranges delimited by closing the target
+		resp = request("http://"+closeDelimited.Addr().String()+"/video", "bytes=0-4,-5", keepAlive)
+		expectParts(resp, [][2]int{{0, 5}, {99995, 100000}})
+	}
+
+	// the range requests bypass the cache, so the partial responses are
+	// never cached nor served the full response cached
+	atomic.StoreInt32(&hits, 0)
+	if resp := request(origin.URL+"/full", "bytes=0-9", false); resp.StatusCode != 206 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	request(origin.URL+"/full", "bytes=0-9", false)
+	if _, body := proxyTestRequest(t, p, "GET", origin.URL+"/full", "", ""); body != string(content) {
+		t.Fatal("unexpected full response")
+	}
+	if resp := request(origin.URL+"/full", "bytes=0-9", false); resp.StatusCode != 206 {
+		t.Fatalf("unexpected status %d of the full response cached", resp.StatusCode)
+	}
+	if _, body := proxyTestRequest(t, p, "GET", origin.URL+"/full", "", ""); body != string(content) {
+		t.Fatal("unexpected full response")
+	}
+	if n := atomic.LoadInt32(&hits); n != 4 {
+		t.Fatalf("unexpected %d origin hits", n)
+	}
+}
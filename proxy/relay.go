@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/uri"
+)
+
+// RelayTunnel and RelayHTTP are the relays of the proxy exported for
+// embedding them into other servers, which accept the clients and dial the
+// upstreams themselves.
+//
+// Their signatures and the documented behaviour of their options are stable,
+// new options may be added whose zero values keep the current behaviour.
+
+// TunnelOptions options of RelayTunnel, the zero value relays as is
+type TunnelOptions struct {
+	// IdleTimeout max idle duration of each direction, which ends the tunnel,
+	// no limit if not set
+	IdleTimeout time.Duration
+	// ClientToUpstreamBufSize and UpstreamToClientBufSize buffer sizes of each
+	// direction, bytebufferpool.DefaultCopyBufSize is used if not set
+	ClientToUpstreamBufSize int
+	UpstreamToClientBufSize int
+	// WriteCoalesceWindow optional window coalescing the tiny writes of each
+	// direction, see transport.ForwardWithCoalescing
+	WriteCoalesceWindow time.Duration
+	// UpstreamTap and ClientTap optional copies of the bytes relayed to the
+	// upstream and to the client, their errors are ignored
+	UpstreamTap io.Writer
+	ClientTap   io.Writer
+	// Classify classifies the protocol of the tunnel by the first bytes of
+	// the client, see TunnelStats.Protocol
+	Classify bool
+	// StopAtPlainHTTP stops relaying once the client turns out to speak
+	// plaintext HTTP, see TunnelStats.PlainHTTP, implies Classify
+	StopAtPlainHTTP bool
+}
+
+// TunnelStats the tunnel relayed by RelayTunnel
+type TunnelStats struct {
+	// Up and Down bytes relayed from the client to the upstream and back
+	Up   int64
+	Down int64
+	// Duration how long the tunnel is relayed
+	Duration time.Duration
+	// Protocol the protocol of the client, unknown if not classified
+	Protocol TunnelProtocol
+	// PlainHTTP the first bytes of the plaintext HTTP the relay stopped at,
+	// which are not relayed, nil if not stopped
+	PlainHTTP []byte
+}
+
+// deadlinePassed interrupts the pending reads and writes of a connection
+var deadlinePassed = time.Unix(1, 0)
+
+// RelayTunnel relays the bytes between clientConn and upstreamConn in both
+// directions until either direction ends, fails or idles out, or ctx is done.
+//
+// upstreamConn is closed once relayed, while clientConn is left open with its
+// deadlines cleared, so the caller may keep serving it, e.g. the plaintext
+// HTTP the relay stopped at. Either side closing the tunnel is not an error.
+func RelayTunnel(ctx context.Context, clientConn, upstreamConn net.Conn,
+	opts TunnelOptions) (stats TunnelStats, err error) {
+	start := time.Now()
+	var client net.Conn = clientConn
+	var cc *classifyingConn
+	if opts.Classify || opts.StopAtPlainHTTP {
+		cc = &classifyingConn{Conn: clientConn, serveHTTP: opts.StopAtPlainHTTP}
+		client = cc
+	}
+
+	errChan := make(chan error, 2)
+	go func() {
+		_, e := transport.ForwardWithCoalescing(upstreamConn,
+			&relayReader{r: client, n: &stats.Up, tap: opts.UpstreamTap},
+			opts.IdleTimeout, opts.ClientToUpstreamBufSize, opts.WriteCoalesceWindow)
+		errChan <- e
+	}()
+	go func() {
+		_, e := transport.ForwardWithCoalescing(
+			&relayWriter{w: clientConn, n: &stats.Down, tap: opts.ClientTap}, upstreamConn,
+			opts.IdleTimeout, opts.UpstreamToClientBufSize, opts.WriteCoalesceWindow)
+		errChan <- e
+	}()
+	pending := 2
+	select {
+	case err = <-errChan:
+		pending--
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// interrupt the other direction before handing the client back
+	upstreamConn.Close()
+	clientConn.SetDeadline(deadlinePassed)
+	for ; pending > 0; pending-- {
+		<-errChan
+	}
+	clientConn.SetDeadline(time.Time{})
+
+	stats.Duration = time.Since(start)
+	if cc != nil {
+		stats.Protocol = cc.classified()
+		if errors.Is(err, errPlainHTTPTunnel) {
+			stats.PlainHTTP, err = cc.peeked, nil
+		}
+	}
+	return stats, err
+}
+
+// relayReader counts the bytes read from r and copies them to tap
+type relayReader struct {
+	r   io.Reader
+	n   *int64
+	tap io.Writer
+}
+
+func (r *relayReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	*r.n += int64(n)
+	if n > 0 && r.tap != nil {
+		r.tap.Write(b[:n])
+	}
+	return n, err
+}
+
+// relayWriter counts the bytes written into w and copies them to tap
+type relayWriter struct {
+	w   io.Writer
+	n   *int64
+	tap io.Writer
+}
+
+func (w *relayWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	*w.n += int64(n)
+	if n > 0 && w.tap != nil {
+		w.tap.Write(b[:n])
+	}
+	return n, err
+}
+
+// RelayOptions options of RelayHTTP, the zero value relays as is
+type RelayOptions struct {
+	// Hijacker optional hijacker of the exchange, e.g. tapping the bodies by
+	// OnRequest and OnResponse or rewriting the request by BeforeRequest.
+	// Its Block, HijackResponse and dialers are not consulted.
+	Hijacker Hijacker
+	// PathEncoding optional percent-encoding of the request target,
+	// see Proxy.PathEncoding
+	PathEncoding PathEncoding
+	// HostMismatch which host wins if the Host header disagrees with the
+	// request target, see Proxy.HostMismatch
+	HostMismatch HostMismatch
+	// PermissiveTrailers forwards all the trailer fields of the chunked
+	// request body, see Proxy.PermissiveTrailers
+	PermissiveTrailers bool
+	// RequestBodyBufSize optional size of the buffer the large request bodies
+	// are read into, see Proxy.RequestBodyBufSize
+	RequestBodyBufSize int
+	// ResponseBodyLimit and OnBodySizeExceeded optional limit of the response
+	// body relayed, see Proxy.ResponseBodyLimit
+	ResponseBodyLimit  int64
+	OnBodySizeExceeded func(hostWithPort string, size int64) BodyLimitAction
+}
+
+// RequestRecord the exchange relayed by RelayHTTP or forwarded by the proxy,
+// see Proxy.OnAccessRecord
+type RequestRecord struct {
+	Method       string
+	HostWithPort string
+	// ServerName the SNI the client sent in the tunnel the request is
+	// decrypted from, which may name another host than HostWithPort, e.g.
+	// by DecryptBySNI, empty if none
+	ServerName string
+	Path       string
+	StatusCode int
+	// RequestSize and ResponseSize bytes written to and read from the
+	// upstream, the headers included
+	RequestSize  int64
+	ResponseSize int64
+	// TTFB time to the first byte of the response, Duration of the exchange
+	TTFB     time.Duration
+	Duration time.Duration
+	// ConnectionClose if the client connection should be closed afterwards
+	ConnectionClose bool
+	// ForcedClose if the hijacker vetoed the reuse of the connections,
+	// see ReuseHijacker
+	ForcedClose bool
+	// Egress the path the request left the proxy by, e.g. the winner of
+	// Route.RaceDirect, always direct for RelayHTTP
+	Egress Egress
+	// Err the error ending the exchange, nil if it succeeded
+	Err error
+}
+
+var methodHead = []byte("HEAD")
+
+// RelayHTTP relays a single HTTP/1.x exchange, i.e. reads a request from
+// client, writes it into upstream, then relays the response read from
+// upstream back into client, both flushed.
+//
+// The request is expected in absolute-form like the ones sent to proxies,
+// io.EOF is returned if the client sends nothing. The response is relayed
+// keeping the HTTP/1.1 client alive whatever the upstream does, unless
+// RequestRecord.ConnectionClose is set. ctx is checked before the request is
+// written, the blocked reads and writes are interrupted by the deadlines of
+// the connections under the pairs.
+func RelayHTTP(ctx context.Context, client, upstream *bufio.ReadWriter,
+	opts RelayOptions) (record RequestRecord, err error) {
+	var (
+		req  Request
+		resp Response
+	)
+	start := time.Now()
+	if _, err = req.parseStartLine(client.Reader); err != nil {
+		if err != io.EOF {
+			err = clientRequestError(err)
+		}
+		return
+	}
+	resp.WriteTo(client.Writer)
+	req.SetHijacker(opts.Hijacker)
+	resp.SetHijacker(opts.Hijacker)
+	if err = req.peekRawHeader(); err == nil {
+		if err = req.checkHost(opts.HostMismatch); err == nil {
+			err = req.PrePare()
+		}
+	}
+	if err != nil {
+		err = clientRequestError(err)
+	} else if err = req.encodePath(opts.PathEncoding); err != nil {
+		err = clientRequestError(err)
+	} else if err = ctx.Err(); err == nil {
+		resp.keepClientAlive = !req.ConnectionClose() && bytes.Equal(req.Protocol(), http11)
+		resp.clientHTTP10 = bytes.Equal(req.Protocol(), http10)
+		req.permissiveTrailers = opts.PermissiveTrailers
+		req.body.CopyBufSize = opts.RequestBodyBufSize
+		if opts.ResponseBodyLimit > 0 && opts.OnBodySizeExceeded != nil {
+			resp.bodyLimiter.reset(req.reqLine.HostInfo().HostWithPort(),
+				opts.ResponseBodyLimit, opts.OnBodySizeExceeded)
+		}
+		if err = relayExchange(&req, &resp, upstream, bytes.Equal(req.Method(), methodHead)); err == nil {
+			err = client.Flush()
+		}
+	}
+	if opts.Hijacker != nil && req.isBeforeRequestCalled {
+		opts.Hijacker.AfterResponse(err)
+	}
+
+	record = newRequestRecord(&req, &resp, start, err)
+	return
+}
+
+// newRequestRecord the record of the exchange started at start ended by err
+func newRequestRecord(req *Request, resp *Response, start time.Time, err error) RequestRecord {
+	record := RequestRecord{
+		Method:       string(req.Method()),
+		HostWithPort: req.reqLine.HostInfo().HostWithPort(),
+		ServerName:   req.clientSNI,
+		Path:         string(req.PathWithQueryFragment()),
+		StatusCode:   resp.respLine.GetStatusCode(),
+		RequestSize:  req.writtenSize,
+		ResponseSize: resp.readSize,
+		Duration:     time.Since(start),
+		ConnectionClose: err != nil || req.ConnectionClose() || resp.closeClient ||
+			!resp.keepClientAlive && resp.ConnectionClose(),
+		ForcedClose: resp.forcedClose(),
+		Egress:      egressOf(req.GetProxy()),
+		Err:         err,
+	}
+	if !resp.firstByteTime.IsZero() {
+		record.TTFB = resp.firstByteTime.Sub(start)
+	}
+	return record
+}
+
+// relayExchange writes req in origin-form into upstream then reads the
+// response from upstream into resp, the body of which is discarded if discardBody
+func relayExchange(req *Request, resp *Response, upstream *bufio.ReadWriter, discardBody bool) error {
+	line := bytebufferpool.Get()
+	defer bytebufferpool.Put(line)
+	line.B = append(append(line.B, req.Method()...), ' ')
+	line.B = append(append(uri.AppendOrigin(line.B, req.PathWithQueryFragment()), ' '), req.Protocol()...)
+	line.B = append(line.B, crlf...)
+	if _, err := upstream.Write(line.B); err != nil {
+		return err
+	}
+	if _, _, err := req.WriteHeaderTo(upstream.Writer); err != nil {
+		return err
+	}
+	if _, err := req.WriteBodyTo(upstream.Writer); err != nil {
+		return err
+	}
+	if err := upstream.Flush(); err != nil {
+		return err
+	}
+	_, err := resp.ReadFrom(discardBody, upstream.Reader)
+	return err
+}
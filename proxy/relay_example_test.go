@@ -0,0 +1,69 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"strings"
+
+	"github.com/haxii/fastproxy/proxy"
+)
+
+func ExampleRelayTunnel() {
+	// client is the client of the tunnel and clientEnd its accepted end,
+	// upstream is the dialed end of the upstream serving upstreamEnd
+	client, clientEnd := net.Pipe()
+	upstream, upstreamEnd := net.Pipe()
+	go func() {
+		line, _ := bufio.NewReader(upstreamEnd).ReadString('\n')
+		upstreamEnd.Write([]byte(strings.ToUpper(line)))
+		upstreamEnd.Close()
+	}()
+	go client.Write([]byte("hello\n"))
+
+	relayed := make(chan proxy.TunnelStats)
+	go func() {
+		stats, _ := proxy.RelayTunnel(context.Background(), clientEnd, upstream,
+			proxy.TunnelOptions{Classify: true})
+		relayed <- stats
+	}()
+	reply, _ := bufio.NewReader(client).ReadString('\n')
+	stats := <-relayed
+	fmt.Print(reply)
+	fmt.Println(stats.Up, stats.Down, stats.Protocol)
+	// Output:
+	// HELLO
+	// 6 6 other
+}
+
+func ExampleRelayHTTP() {
+	client, clientEnd := net.Pipe()
+	upstream, upstreamEnd := net.Pipe()
+	go func() {
+		req, _ := nethttp.ReadRequest(bufio.NewReader(upstreamEnd))
+		io.Copy(ioutil.Discard, req.Body)
+		fmt.Fprint(upstreamEnd, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+	}()
+	go fmt.Fprint(client, "GET http://example.com/greeting HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	relayed := make(chan proxy.RequestRecord)
+	go func() {
+		record, _ := proxy.RelayHTTP(context.Background(),
+			bufio.NewReadWriter(bufio.NewReader(clientEnd), bufio.NewWriter(clientEnd)),
+			bufio.NewReadWriter(bufio.NewReader(upstream), bufio.NewWriter(upstream)),
+			proxy.RelayOptions{})
+		relayed <- record
+	}()
+	resp, _ := nethttp.ReadResponse(bufio.NewReader(client), nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	record := <-relayed
+	fmt.Println(resp.StatusCode, string(body))
+	fmt.Println(record.Method, record.HostWithPort, record.Path, record.StatusCode, record.ConnectionClose)
+	// Output:
+	// 200 hello
+	// GET example.com:80 /greeting 200 false
+}
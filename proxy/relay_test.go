@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"testing"
+	"time"
+)
+
+func TestRelayTunnelCanceled(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	upstream, upstreamEnd := net.Pipe()
+	defer client.Close()
+	go func() {
+		b := make([]byte, 5)
+		upstreamEnd.Read(b)
+		upstreamEnd.Write([]byte("pong"))
+	}()
+	go func() {
+		client.Write([]byte("ping!"))
+		client.Read(make([]byte, 4))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var up, down bytes.Buffer
+	relayed := make(chan error, 1)
+	var stats TunnelStats
+	go func() {
+		var err error
+		stats, err = RelayTunnel(ctx, clientEnd, upstream,
+			TunnelOptions{UpstreamTap: &up, ClientTap: &down})
+		relayed <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-relayed:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not canceled")
+	}
+	if stats.Up != 5 || stats.Down != 4 || up.String() != "ping!" || down.String() != "pong" {
+		t.Fatalf("unexpected relay %+v, tapped %q %q", stats, up.String(), down.String())
+	}
+	// the client is handed back usable, the upstream closed
+	if _, err := upstreamEnd.Write([]byte("x")); err == nil {
+		t.Fatal("expected the upstream closed")
+	}
+	go client.Write([]byte("again"))
+	b := make([]byte, 5)
+	if _, err := clientEnd.Read(b); err != nil || string(b) != "again" {
+		t.Fatalf("unexpected client read %q, error: %v", b, err)
+	}
+}
+
+func TestRelayBodylessResponses(t *testing.T) {
+	for _, c := range []struct {
+		name, method, head string
+		// closed if the upstream can't be reused, e.g. speaking HTTP/1.0
+		closed bool
+	}{
+		{"HEAD sized", "HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n", false},
+		{"HEAD unsized", "HEAD", "HTTP/1.1 200 OK\r\n\r\n", false},
+		{"HEAD chunked", "HEAD", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", false},
+		{"204 sized", "POST", "HTTP/1.1 204 No Content\r\nContent-Length: 5\r\n\r\n", false},
+		{"204 chunked", "DELETE", "HTTP/1.1 204 No Content\r\nTransfer-Encoding: chunked\r\n\r\n", false},
+		{"304 sized", "GET", "HTTP/1.1 304 Not Modified\r\nContent-Length: 100\r\nETag: \"v1\"\r\n\r\n", false},
+		{"304 chunked", "GET", "HTTP/1.1 304 Not Modified\r\nTransfer-Encoding: chunked\r\n\r\n", false},
+		{"304 HTTP/1.0", "GET", "HTTP/1.0 304 Not Modified\r\nContent-Length: 100\r\n\r\n", true},
+	} {
+		// the HTTP/1.0 client is kept alive only as long as the upstream
+		for _, protocol := range []string{"HTTP/1.1", "HTTP/1.0"} {
+			t.Run(c.name+" "+protocol, func(t *testing.T) {
+				testRelayBodylessResponse(t, c.method, c.head, protocol, protocol == "HTTP/1.0" && c.closed)
+			})
+		}
+	}
+}
+
+// testRelayBodylessResponse relays the bodyless response head to the request
+// of method then another exchange over the same connections, the client
+// connection of the first one is expected closed if closed
+func testRelayBodylessResponse(t *testing.T, method, head, protocol string, closed bool) {
+	client, clientEnd := net.Pipe()
+	upstream, upstreamEnd := net.Pipe()
+	defer client.Close()
+	defer upstreamEnd.Close()
+	// a stall fails the exchange instead of hanging the test
+	deadline := time.Now().Add(2 * time.Second)
+	for _, conn := range []net.Conn{client, clientEnd, upstream, upstreamEnd} {
+		conn.SetDeadline(deadline)
+	}
+
+	// the origin scripted answers the bodyless response then another one
+	// on the same connection
+	go func() {
+		reader := bufio.NewReader(upstreamEnd)
+		for _, resp := range []string{head, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"} {
+			if _, err := nethttp.ReadRequest(reader); err != nil {
+				return
+			}
+			upstreamEnd.Write([]byte(resp))
+		}
+	}()
+	clientRW := bufio.NewReadWriter(bufio.NewReader(clientEnd), bufio.NewWriter(clientEnd))
+	upstreamRW := bufio.NewReadWriter(bufio.NewReader(upstream), bufio.NewWriter(upstream))
+	reader := bufio.NewReader(client)
+	for i, method := range []string{method, "GET"} {
+		go fmt.Fprintf(client, "%s http://example.com/ %s\r\nHost: example.com\r\nConnection: keep-alive\r\n\r\n",
+			method, protocol)
+		relayed := make(chan RequestRecord, 1)
+		go func() {
+			record, _ := RelayHTTP(context.Background(), clientRW, upstreamRW, RelayOptions{})
+			relayed <- record
+		}()
+		resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: method})
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %s", i, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		record := <-relayed
+		if err != nil || record.Err != nil || record.ConnectionClose != (i == 0 && closed) {
+			t.Fatalf("#%d: unexpected record %+v of %q, error: %v", i, record, body, err)
+		}
+		if i == 1 && string(body) != "ok" {
+			t.Fatalf("unexpected body %q after the bodyless response", body)
+		}
+	}
+}
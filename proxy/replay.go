@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// DefaultReplayMaxBodySize is the size of the response body kept by
+// Proxy.Replay if ReplayRequest.MaxBodySize is not set
+const DefaultReplayMaxBodySize = 1 << 20
+
+// replayTraceEvents number of the trace events kept of a replay
+const replayTraceEvents = 64
+
+// ReplayRequest a request re-sent by Proxy.Replay, e.g. one captured by a
+// hijacker, for debugging how the proxy serves it
+type ReplayRequest struct {
+	// Method of the request, GET if not set
+	Method string
+	// URL absolute URL of the request, the https ones are replayed as the
+	// requests decrypted from a tunnel to their hosts
+	URL string
+	// Header header fields of the request, the Host and Content-Length
+	// are set by the URL and Body
+	Header nethttp.Header
+	// Body of the request
+	Body []byte
+	// ClientAddr address of the client the hijacker is made for,
+	// 127.0.0.1:0 if not set
+	ClientAddr net.Addr
+	// HonorACL rejects the request as the ones of the clients if the
+	// hijacker rejects it by RewriteHost, OnConnect or Block, which are
+	// still called but overridden if not set
+	HonorACL bool
+	// MaxBodySize size of the response body kept,
+	// DefaultReplayMaxBodySize if not set
+	MaxBodySize int
+}
+
+// ReplayResult the response of a request replayed
+type ReplayResult struct {
+	StatusCode int
+	Header     nethttp.Header
+	// Body the response body up to ReplayRequest.MaxBodySize, Truncated if
+	// it's longer
+	Body      []byte
+	Truncated bool
+	// Trace the events of the request replayed, see RequestTracing
+	Trace []TraceEvent
+}
+
+// replayState the state of a request replayed
+type replayState struct {
+	tracing  *RequestTracing
+	honorACL bool
+}
+
+// bypassACL whether the rejections of the hijacker are overridden
+func (s *replayState) bypassACL() bool {
+	return s != nil && !s.honorACL
+}
+
+var errReplayURL = errors.New("replay URL not absolute http or https")
+
+var replayClientAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// Replay re-sends req through the pipeline of the client requests, i.e. the
+// hijacker, the rules, the route and the super proxy selection, and returns
+// its response with the trace of the events. The client connection is
+// simulated: the replay is neither counted by the connection limits, the
+// guards and the stats, nor served from the cache. It's safe to call
+// concurrently, and while serving.
+func (p *Proxy) Replay(req ReplayRequest) (ReplayResult, error) {
+	if err := p.validate(); err != nil {
+		return ReplayResult{}, err
+	}
+	p.init()
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return ReplayResult{}, errReplayURL
+	}
+	method := req.Method
+	if len(method) == 0 {
+		method = "GET"
+	}
+	clientAddr := req.ClientAddr
+	if clientAddr == nil {
+		clientAddr = replayClientAddr
+	}
+	maxBodySize := req.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultReplayMaxBodySize
+	}
+	tracing := &RequestTracing{RingSize: replayTraceEvents}
+	if p.RequestTracing != nil {
+		tracing.RedactAuth = p.RequestTracing.RedactAuth
+	}
+
+	// the response written to the client is read as the one of the replay
+	pr, pw := io.Pipe()
+	c := &replayConn{w: pw, addr: clientAddr}
+	read := make(chan replayRead, 1)
+	go func() {
+		var r replayRead
+		r.resp, r.err = nethttp.ReadResponse(bufio.NewReader(pr), &nethttp.Request{Method: method})
+		if r.err == nil {
+			r.body, r.err = ioutil.ReadAll(io.LimitReader(r.resp.Body, int64(maxBodySize)+1))
+		}
+		io.Copy(ioutil.Discard, pr)
+		read <- r
+	}()
+
+	var raw bytes.Buffer
+	raw.WriteString(method + " " + u.String() + " HTTP/1.1\r\nHost: " + u.Host + "\r\n")
+	header := req.Header.Clone()
+	header.Del("Host")
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	if len(req.Body) > 0 {
+		header.Set("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+	header.Write(&raw)
+	raw.WriteString("\r\n")
+	raw.Write(req.Body)
+	serveErr := p.serveReplay(c, bufio.NewReader(&raw), u.Scheme == "https",
+		&replayState{tracing: tracing, honorACL: req.HonorACL})
+	pw.Close()
+
+	r := <-read
+	result := ReplayResult{Trace: tracing.Events()}
+	if r.err != nil {
+		if serveErr != nil {
+			return result, serveErr
+		}
+		return result, r.err
+	}
+	result.StatusCode, result.Header, result.Body = r.resp.StatusCode, r.resp.Header, r.body
+	if len(result.Body) > maxBodySize {
+		result.Body, result.Truncated = result.Body[:maxBodySize], true
+	}
+	return result, serveErr
+}
+
+// ReplayRaw replays the raw request captured, i.e. its request line, header
+// and body, to target, whose scheme and host replace the ones of the
+// request, e.g. for reproducing a request against another origin. The
+// absolute URL of the request, or its Host over http, is used if target is
+// empty. The chunked body is replayed by its length, see Replay.
+func (p *Proxy) ReplayRaw(raw []byte, target string) (ReplayResult, error) {
+	r, err := nethttp.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	u := *r.URL
+	if len(u.Host) == 0 {
+		u.Scheme, u.Host = "http", r.Host
+	}
+	if len(target) > 0 {
+		t, err := url.Parse(target)
+		if err != nil {
+			return ReplayResult{}, err
+		}
+		u.Scheme, u.Host = t.Scheme, t.Host
+	}
+	return p.Replay(ReplayRequest{Method: r.Method, URL: u.String(), Header: r.Header, Body: body})
+}
+
+// replayRead the response of a replay read
+type replayRead struct {
+	resp *nethttp.Response
+	body []byte
+	err  error
+}
+
+// serveReplay serves the request read from reader as the ones of the clients
+// to the proxy, or as a request decrypted if isTLS
+func (p *Proxy) serveReplay(c net.Conn, reader *bufio.Reader, isTLS bool, replay *replayState) (err error) {
+	req := p.reqPool.Acquire()
+	defer p.reqPool.Release(req)
+	defer p.recoverPanic(c, req, &err)
+	req.connInfo = &connInfo{}
+	req.clientAddr = c.RemoteAddr()
+	req.replay = replay
+	if _, err = req.parseStartLine(reader); err != nil {
+		return err
+	}
+	if err = req.peekRawHeader(); err != nil {
+		return err
+	}
+	if !isTLS {
+		return p.do(c, req)
+	}
+
+	// replay the request decrypted as if the tunnel to the host is made
+	hostWithPort := req.reqLine.HostInfo().HostWithPort()
+	if p.HijackerPool != nil {
+		req.hijacker = p.HijackerPool.Get(c.RemoteAddr(), true,
+			req.reqLine.HostInfo().Domain(), req.reqLine.HostInfo().Port())
+		defer p.HijackerPool.Put(req.hijacker)
+		req.reportTarget()
+		if err = p.rewriteHost(c, req); err != nil {
+			return err
+		}
+		hostWithPort = req.reqLine.HostInfo().HostWithPort()
+		if !req.hijacker.OnConnect(req.header, req.rawHeader) && replay.honorACL {
+			if e := writeFastError(c, http.StatusBadGateway, "Bad Gateway.\n"); e != nil {
+				return e
+			}
+			return ErrACLRejected
+		}
+	}
+	serverName := req.reqLine.HostInfo().Domain()
+	if req.hijacker != nil {
+		serverName = req.hijacker.RewriteTLSServerName(serverName)
+	}
+	req.SetTLS(serverName)
+	req.reqLine.HostInfo().ParseHostWithPort(hostWithPort, true)
+	return p.proxyHTTP(c, req)
+}
+
+// replayConn the client connection simulated for a replay, nothing is read
+// from it and the response is written into w
+type replayConn struct {
+	w    io.Writer
+	addr net.Addr
+}
+
+func (c *replayConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (c *replayConn) Write(b []byte) (int, error)        { return c.w.Write(b) }
+func (c *replayConn) Close() error                       { return nil }
+func (c *replayConn) LocalAddr() net.Addr                { return replayClientAddr }
+func (c *replayConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
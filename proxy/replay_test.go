@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+// replayTestHijacker logs the routing hooks consulted, resolving every
+// host to the local origin
+type replayTestHijacker struct {
+	tlsTestHijacker
+	log   []string
+	block bool
+}
+
+func (h *replayTestHijacker) RewriteHost() (string, string) {
+	h.log = append(h.log, "RewriteHost "+h.host+":"+h.port)
+	return h.host, h.port
+}
+
+func (h *replayTestHijacker) BeforeRequest(method, path []byte, header http.Header,
+	rawHeader []byte) ([]byte, []byte) {
+	h.log = append(h.log, fmt.Sprintf("BeforeRequest %s %s", method, path))
+	return path, rawHeader
+}
+
+func (h *replayTestHijacker) Resolve() net.IP {
+	h.log = append(h.log, "Resolve")
+	return net.IPv4(127, 0, 0, 1)
+}
+
+func (h *replayTestHijacker) SuperProxy() *superproxy.SuperProxy {
+	h.log = append(h.log, "SuperProxy")
+	return nil
+}
+
+func (h *replayTestHijacker) Block() bool {
+	h.log = append(h.log, "Block")
+	return h.block
+}
+
+func (h *replayTestHijacker) Route() Route {
+	h.log = append(h.log, "Route")
+	return Route{}
+}
+
+func (h *replayTestHijacker) AfterResponse(err error) {
+	h.log = append(h.log, fmt.Sprintf("AfterResponse %v", err))
+}
+
+type replayTestHijackerPool struct{ h *replayTestHijacker }
+
+func (p *replayTestHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	p.h.log = append(p.h.log, fmt.Sprintf("Get %s %v", clientAddr, isHTTPS))
+	return p.h
+}
+func (p *replayTestHijackerPool) Put(Hijacker) {}
+
+func TestReplay(t *testing.T) {
+	origin := newRecordingOrigin(t)
+	defer origin.ln.Close()
+	target := "http://replay.test:" + strconv.Itoa(origin.port()) + "/path?q=1"
+
+	h := &replayTestHijacker{}
+	p := &Proxy{HijackerPool: &replayTestHijackerPool{h}}
+	p.init()
+
+	// the live request
+	if resp, body := proxyTestRequest(t, p, "GET", target, "X-Debug: 1\r\n", ""); resp.StatusCode != 200 || body != "ok" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	live := <-origin.received
+	liveLog := strings.Join(h.log, "\n")
+	liveLog = liveLog[strings.Index(liveLog, "\n"):] // the client address differs
+	h.log = nil
+
+	// the replay consults the same hooks and sends the same request
+	result, err := p.Replay(ReplayRequest{URL: target,
+		Header: nethttp.Header{"X-Debug": {"1"}, "Connection": {"close"}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result.StatusCode != 200 || string(result.Body) != "ok" || result.Truncated ||
+		result.Header.Get("Content-Length") != "2" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	replayed := <-origin.received
+	if replayed.reqLine != live.reqLine || replayed.header.Get("X-Debug") != "1" ||
+		replayed.header.Get("Host") != live.header.Get("Host") {
+		t.Fatalf("unexpected request replayed %+v, live %+v", replayed, live)
+	}
+	if !strings.HasPrefix(h.log[0], "Get 127.0.0.1:0 false") {
+		t.Fatalf("unexpected hijacker %s", h.log[0])
+	}
+	if log := strings.Join(h.log, "\n"); log[strings.Index(log, "\n"):] != liveLog {
+		t.Fatalf("unexpected hooks consulted %q, live %q", log, liveLog)
+	}
+	var names []string
+	for _, e := range result.Trace {
+		names = append(names, e.Name)
+	}
+	if n := strings.Join(names, " "); n != "parse rewrite route dial request-header response-header done" {
+		t.Fatalf("unexpected trace %s", n)
+	}
+
+	// the block of the hijacker overridden unless the ACL honored
+	h.block = true
+	result, err = p.Replay(ReplayRequest{URL: target, MaxBodySize: 1})
+	if err != nil || result.StatusCode != 200 || string(result.Body) != "o" || !result.Truncated {
+		t.Fatalf("unexpected result %+v, error: %v", result, err)
+	}
+	<-origin.received
+	result, err = p.Replay(ReplayRequest{URL: target, HonorACL: true})
+	if !errors.Is(err, ErrACLRejected) || result.StatusCode != 502 {
+		t.Fatalf("unexpected result %+v, error: %v", result, err)
+	}
+	if _, err = p.Replay(ReplayRequest{URL: "/path"}); err != errReplayURL {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestReplayRaw(t *testing.T) {
+	origin := newRecordingOrigin(t)
+	defer origin.ln.Close()
+	p := &Proxy{}
+	p.init()
+	captured := "POST /upload?id=1 HTTP/1.1\r\nHost: captured.test\r\nX-Debug: 1\r\n" +
+		"Transfer-Encoding: chunked\r\nConnection: close\r\n\r\n5\r\nhello\r\n0\r\n\r\n"
+
+	// the request captured is replayed to the target by the length of its body
+	target := "http://127.0.0.1:" + strconv.Itoa(origin.port())
+	result, err := p.ReplayRaw([]byte(captured), target)
+	if err != nil || result.StatusCode != 200 || string(result.Body) != "ok" {
+		t.Fatalf("unexpected result %+v, error: %v", result, err)
+	}
+	replayed := <-origin.received
+	if replayed.reqLine != "POST /upload?id=1 HTTP/1.1" || replayed.header.Get("X-Debug") != "1" ||
+		replayed.header.Get("Host") != "127.0.0.1:"+strconv.Itoa(origin.port()) ||
+		replayed.header.Get("Content-Length") != "5" || replayed.header.Get("Transfer-Encoding") != "" {
+		t.Fatalf("unexpected request replayed %+v", replayed)
+	}
+
+	// to the host of the request itself without target
+	captured = "GET " + target + "/ HTTP/1.1\r\nHost: " + target[len("http://"):] + "\r\nConnection: close\r\n\r\n"
+	if result, err = p.ReplayRaw([]byte(captured), ""); err != nil || result.StatusCode != 200 {
+		t.Fatalf("unexpected result %+v, error: %v", result, err)
+	}
+	if replayed = <-origin.received; replayed.reqLine != "GET / HTTP/1.1" {
+		t.Fatalf("unexpected request replayed %+v", replayed)
+	}
+
+	// the truncated capture is not replayed
+	if _, err = p.ReplayRaw([]byte("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 9\r\n\r\nhi"), target); err == nil {
+		t.Fatal("expected truncated body rejected")
+	}
+}
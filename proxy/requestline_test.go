@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+// recordingOrigin records the request line and header of every request,
+// and sends an interim 100 Continue if the request expects it
+type recordingOrigin struct {
+	ln       net.Listener
+	received chan recordedRequest
+}
+
+type recordedRequest struct {
+	reqLine string
+	header  textproto.MIMEHeader
+}
+
+func newRecordingOrigin(t *testing.T) *recordingOrigin {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	o := &recordingOrigin{ln: ln, received: make(chan recordedRequest, 1)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go o.serve(conn)
+		}
+	}()
+	return o
+}
+
+func (o *recordingOrigin) serve(conn net.Conn) {
+	defer conn.Close()
+	r := textproto.NewReader(bufio.NewReader(conn))
+	reqLine, err := r.ReadLine()
+	if err != nil {
+		return
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+	o.received <- recordedRequest{reqLine, header}
+	if strings.EqualFold(header.Get("Expect"), "100-continue") {
+		conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	}
+	conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"))
+}
+
+func (o *recordingOrigin) port() int {
+	return o.ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestRequestLineForm(t *testing.T) {
+	origin := newRecordingOrigin(t)
+	defer origin.ln.Close()
+	originHost := "127.0.0.1:" + strconv.Itoa(origin.port())
+
+	p := newTestProxy(t)
+
+	// direct: origin-form with a Host header
+	testRequestLineForm(t, p, origin,
+		"GET http://"+originHost+"/path?q=1 HTTP/1.1\r\nConnection: close\r\n\r\n",
+		"GET /path?q=1 HTTP/1.1", originHost)
+	testRequestLineForm(t, p, origin,
+		"GET http://"+originHost+" HTTP/1.1\r\nHost: www.example.com\r\nConnection: close\r\n\r\n",
+		"GET / HTTP/1.1", originHost)
+
+	// via a HTTP super proxy: absolute-form with a Host header
+	superProxy, err := superproxy.NewSuperProxy("127.0.0.1", uint16(origin.port()),
+		superproxy.ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p.SuperProxy = superProxy
+	testRequestLineForm(t, p, origin,
+		"GET http://www.example.com/path?q=1 HTTP/1.1\r\nConnection: close\r\n\r\n",
+		"GET http://www.example.com/path?q=1 HTTP/1.1", "www.example.com")
+	testRequestLineForm(t, p, origin,
+		"GET http://www.example.com:8080 HTTP/1.1\r\nHost: www.example.com:8080\r\nConnection: close\r\n\r\n",
+		"GET http://www.example.com:8080/ HTTP/1.1", "www.example.com:8080")
+}
+
+func testRequestLineForm(t *testing.T, p *Proxy, origin *recordingOrigin,
+	rawReq, expReqLine, expHost string) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	go client.Write([]byte(rawReq))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "ok" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, body)
+	}
+	received := <-origin.received
+	if received.reqLine != expReqLine {
+		t.Fatalf("expected request line %q, got %q", expReqLine, received.reqLine)
+	}
+	if host := received.header.Get("Host"); host != expHost {
+		t.Fatalf("expected host %q, got %q", expHost, host)
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/uri"
+)
+
+// RequestView read-only view of a request served, backed by the parsed
+// request without copies, so it's valid only during the call it's passed
+// to, and nothing returned should be modified
+type RequestView struct {
+	req *Request
+}
+
+// Method request method in UPPER case
+func (v RequestView) Method() []byte {
+	return v.req.reqLine.Method()
+}
+
+// URI the request target, its host is the one rewritten by RewriteHost
+func (v RequestView) URI() *uri.URI {
+	return v.req.reqLine.URI()
+}
+
+// HostInfo the target host of the request, the port defaults to the one of
+// the scheme if omitted, i.e. 443 for CONNECT and https targets, 80 otherwise
+func (v RequestView) HostInfo() *uri.HostInfo {
+	return v.req.reqLine.HostInfo()
+}
+
+// Header the parsed request header, changed by BeforeRequest only
+func (v RequestView) Header() *http.Header {
+	return &v.req.header
+}
+
+// RawHeader the raw request header as sent by the client
+func (v RequestView) RawHeader() []byte {
+	return v.req.rawHeader
+}
+
+// ClientAddr address of the client
+func (v RequestView) ClientAddr() net.Addr {
+	return v.req.clientAddr
+}
+
+// ConnTLS TLS state of the client connection to the proxy served over TLS,
+// see Proxy.TLSConfig, e.g. the certificate the client authenticates with
+// if TLSConfig.ClientAuth asks for one, nil if served in plaintext
+func (v RequestView) ConnTLS() *tls.ConnectionState {
+	return v.req.connTLS
+}
+
+// IsConnect if it's a CONNECT request making a tunnel
+func (v RequestView) IsConnect() bool {
+	return http.IsMethodConnect(v.req.reqLine.Method())
+}
+
+// IsTLS if it's a request decrypted from a tunnel
+func (v RequestView) IsTLS() bool {
+	return v.req.isTLS
+}
+
+var schemeHTTPS = []byte("https")
+
+// TargetTLS if the target is reached over TLS as far as the request tells,
+// i.e. it's a CONNECT request, an https target or decrypted from a tunnel,
+// e.g. to route the plaintext HTTP differently
+func (v RequestView) TargetTLS() bool {
+	return v.req.isTLS || v.IsConnect() ||
+		bytes.EqualFold(v.req.reqLine.URI().Scheme(), schemeHTTPS)
+}
+
+// handleRequest passes the request to RequestHijacker
+func (r *Request) handleRequest() {
+	if rh, ok := r.hijacker.(RequestHijacker); ok {
+		rh.HandleRequest(RequestView{req: r})
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+// viewHijacker decrypts every tunnel and records the requests viewed
+type viewHijacker struct {
+	tlsTestHijacker
+	views []string
+}
+
+func (h *viewHijacker) HandleRequest(req RequestView) {
+	if req.ClientAddr() == nil {
+		h.views = append(h.views, "no client addr")
+		return
+	}
+	view := string(req.Method()) + " " + req.URI().HostInfo().HostWithPort() + " " + string(req.Header().Peek("X-Route"))
+	if req.IsConnect() {
+		view += " connect"
+	}
+	if req.IsTLS() {
+		view += " tls"
+	}
+	h.views = append(h.views, view)
+}
+
+type viewHijackerPool struct{ h *viewHijacker }
+
+func (p viewHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p viewHijackerPool) Put(Hijacker) {}
+
+func TestRequestHijacker(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(origin.Config.Handler)
+	defer tlsOrigin.Close()
+
+	h := &viewHijacker{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = viewHijackerPool{h}
+	})
+	addr := origin.Listener.Addr().String()
+	if _, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "X-Route: a\r\n", ""); body != "ok" {
+		t.Fatalf("unexpected body %s", body)
+	}
+	tlsAddr := tlsOrigin.Listener.Addr().String()
+	if body := decryptedGet(t, p, tlsAddr, "example.com"); body != "ok" {
+		t.Fatalf("unexpected decrypted body %s", body)
+	}
+
+	expected := []string{"GET " + addr + " a", "CONNECT " + tlsAddr + "  connect", "GET " + tlsAddr + "  tls"}
+	if len(h.views) != len(expected) {
+		t.Fatalf("unexpected views %q", h.views)
+	}
+	for i, view := range expected {
+		if h.views[i] != view {
+			t.Fatalf("unexpected view %q, expected %q", h.views[i], view)
+		}
+	}
+}
+
+// portRouteHijacker routes the requests by the port and TLS-ness of their
+// targets, the plaintext HTTP to scrub regardless of the host
+type portRouteHijacker struct {
+	tlsTestHijacker
+	byPort map[string]*superproxy.SuperProxy
+	scrub  *superproxy.SuperProxy
+	route  *superproxy.SuperProxy
+}
+
+func (h *portRouteHijacker) SSLBump() bool { return false }
+func (h *portRouteHijacker) HandleRequest(req RequestView) {
+	h.route = h.scrub
+	if req.TargetTLS() {
+		h.route = h.byPort[req.HostInfo().Port()]
+	}
+}
+func (h *portRouteHijacker) SuperProxy() *superproxy.SuperProxy { return h.route }
+
+type portRouteHijackerPool struct{ h *portRouteHijacker }
+
+func (p portRouteHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p portRouteHijackerPool) Put(Hijacker) {}
+
+func TestRouteByPortAndTLS(t *testing.T) {
+	// fake super proxies recording the request lines they get
+	lines := make(chan string, 8)
+	newSuperProxy := func(name string) (*superproxy.SuperProxy, net.Listener) {
+		ln := listenLocal(t, func(c net.Conn) {
+			defer c.Close()
+			req, err := nethttp.ReadRequest(bufio.NewReader(c))
+			if err != nil {
+				return
+			}
+			lines <- name + " " + req.Method + " " + req.RequestURI
+			c.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		})
+		sp, _ := superproxy.NewSuperProxy("127.0.0.1", uint16(ln.Addr().(*net.TCPAddr).Port),
+			superproxy.ProxyTypeHTTP, "", "", "")
+		return sp, ln
+	}
+	a, lnA := newSuperProxy("a")
+	defer lnA.Close()
+	b, lnB := newSuperProxy("b")
+	defer lnB.Close()
+	scrub, lnScrub := newSuperProxy("scrub")
+	defer lnScrub.Close()
+	h := &portRouteHijacker{byPort: map[string]*superproxy.SuperProxy{"443": a, "8443": b}, scrub: scrub}
+	// the CONNECT target without port is routed by the port defaulted
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = portRouteHijackerPool{h}
+		p.DefaultConnectPort = true
+	})
+
+	for _, c := range []struct{ raw, expected string }{
+		{"CONNECT www.example.com:443 HTTP/1.1\r\n\r\n", "a CONNECT www.example.com:443"},
+		{"CONNECT www.example.com HTTP/1.1\r\n\r\n", "a CONNECT www.example.com:443"},
+		{"CONNECT www.example.com:8443 HTTP/1.1\r\n\r\n", "b CONNECT www.example.com:8443"},
+		{"GET http://www.example.com/ HTTP/1.1\r\nHost: www.example.com\r\n\r\n",
+			"scrub GET http://www.example.com/"},
+		{"GET http://www.example.com:8443/ HTTP/1.1\r\nHost: www.example.com:8443\r\n\r\n",
+			"scrub GET http://www.example.com:8443/"},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			p.serveConn(server)
+			server.Close()
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		go client.Write([]byte(c.raw))
+		if resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil); err != nil ||
+			resp.StatusCode != nethttp.StatusForbidden {
+			t.Fatalf("%q: unexpected response %v %v", c.raw, resp, err)
+		}
+		client.Close()
+		if line := <-lines; line != c.expected {
+			t.Fatalf("%q: unexpected request %q, expected %q", c.raw, line, c.expected)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+var leakToken = regexp.MustCompile(`tok\d{6}`)
+
+// leakRecorder records what's seen of each request, which must carry
+// nothing but the token of the request
+type leakRecorder struct {
+	sync.Mutex
+	errs []string
+}
+
+func (r *leakRecorder) check(where string, seen []byte) {
+	tokens := leakToken.FindAll(seen, -1)
+	for _, tok := range tokens[1:] {
+		if string(tok) != string(tokens[0]) {
+			r.Lock()
+			r.errs = append(r.errs, fmt.Sprintf("%s of %s sees %s", where, tokens[0], tok))
+			r.Unlock()
+			return
+		}
+	}
+}
+
+// leakHijacker records each request and response it sees
+type leakHijacker struct {
+	tlsTestHijacker
+	recorder *leakRecorder
+	seen     *leakWriter
+	hijack   string
+}
+
+type leakWriter struct{ b []byte }
+
+func (w *leakWriter) Write(b []byte) (int, error) { w.b = append(w.b, b...); return len(b), nil }
+func (w *leakWriter) Close() error                { return nil }
+
+func (h *leakHijacker) BeforeRequest(method, path []byte, header http.Header,
+	rawHeader []byte) ([]byte, []byte) {
+	h.seen = &leakWriter{b: append(append([]byte(nil), path...), rawHeader...)}
+	h.hijack = ""
+	if strings.Contains(string(rawHeader), "X-Hijack") {
+		h.hijack = strings.TrimPrefix(string(path), "/")
+	}
+	return path, rawHeader
+}
+
+// HijackResponse answers the requests asking for it, their bodies are drained
+func (h *leakHijacker) HijackResponse() io.ReadCloser {
+	if len(h.hijack) == 0 {
+		return nil
+	}
+	return ioutil.NopCloser(strings.NewReader(fmt.Sprintf(
+		"HTTP/1.1 200 OK\r\nX-Echo: %s\r\nContent-Length: %d\r\n\r\nresp-%s", h.hijack, len(h.hijack)+5, h.hijack)))
+}
+func (h *leakHijacker) OnRequest([]byte, http.Header, []byte) io.WriteCloser { return h.seen }
+func (h *leakHijacker) OnResponse(_ http.ResponseLine, _ http.Header, rawHeader []byte) io.WriteCloser {
+	h.seen.Write(rawHeader)
+	return h.seen
+}
+func (h *leakHijacker) AfterResponse(error) {
+	h.recorder.check("hijacker", h.seen.b)
+}
+
+type leakHijackerPool struct{ recorder *leakRecorder }
+
+func (p leakHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	h := &leakHijacker{recorder: p.recorder}
+	h.host, h.port = host, port
+	return h
+}
+func (p leakHijackerPool) Put(Hijacker) {}
+
+// leakRequest the i-th request of a varied kind carrying tok
+func leakRequest(i int, host, tok string) string {
+	switch i % 5 {
+	case 1:
+		// every other one is answered by the hijacker
+		hijack := ""
+		if i%10 == 1 {
+			hijack = "X-Hijack: 1\r\n"
+		}
+		body := "body-" + tok
+		return fmt.Sprintf("POST http://%s/%s HTTP/1.1\r\nHost: %s\r\n%sContent-Length: %d\r\n\r\n%s",
+			host, tok, host, hijack, len(body), body)
+	case 2:
+		return fmt.Sprintf("POST http://%s/%s HTTP/1.1\r\nHost: %s\r\nTransfer-Encoding: chunked\r\n"+
+			"Trailer: X-Trailer\r\n\r\n%x\r\n%s\r\n0\r\nX-Trailer: %s\r\n\r\n", host, tok, host, len(tok), tok, tok)
+	case 3:
+		return fmt.Sprintf("HEAD http://%s/%s HTTP/1.1\r\nHost: %s\r\n\r\n", host, tok, host)
+	case 4:
+		var extra strings.Builder
+		for j := 0; j < i%7; j++ {
+			fmt.Fprintf(&extra, "X-Extra-%d: %s\r\n", j, tok)
+		}
+		return fmt.Sprintf("GET http://%s/%s HTTP/1.1\r\nHost: %s\r\n%s\r\n", host, tok, host, extra.String())
+	}
+	return fmt.Sprintf("GET http://%s/%s?q=%s HTTP/1.1\r\nHost: %s\r\nX-Token: %s\r\n\r\n", host, tok, tok, host, tok)
+}
+
+func TestNoStateLeaksAcrossRequests(t *testing.T) {
+	recorder := &leakRecorder{}
+	handler := nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		var seen strings.Builder
+		fmt.Fprintf(&seen, "%s %s\n", r.Method, r.URL)
+		r.Header.Write(&seen)
+		body, _ := ioutil.ReadAll(r.Body)
+		seen.Write(body)
+		r.Trailer.Write(&seen)
+		recorder.check("origin", []byte(seen.String()))
+
+		tok := strings.TrimPrefix(r.URL.Path, "/")
+		w.Header().Set("X-Echo", tok)
+		switch len(tok) % 3 {
+		case 0:
+			w.(nethttp.Flusher).Flush()
+		case 1:
+			w.Header().Set("Set-Cookie", "c="+tok)
+		}
+		io.WriteString(w, "resp-"+tok)
+	})
+	origin := httptest.NewServer(handler)
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(handler)
+	defer tlsOrigin.Close()
+
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = leakHijackerPool{recorder}
+	})
+
+	// exchange sends n requests through rw one by one
+	exchange := func(conn int, rw io.ReadWriter, br *bufio.Reader, host string, n int) {
+		for i := 0; i < n; i++ {
+			tok := fmt.Sprintf("tok%06d", conn*100000+i)
+			req := leakRequest(i, host, tok)
+			go io.WriteString(rw, req)
+			resp, err := nethttp.ReadResponse(br, &nethttp.Request{Method: strings.Fields(req)[0]})
+			if err != nil {
+				t.Errorf("request %s: unexpected error: %s", tok, err)
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil || resp.StatusCode != 200 || resp.Header.Get("X-Echo") != tok ||
+				(i%5 != 3 && string(body) != "resp-"+tok) {
+				t.Errorf("request %s: unexpected response %d %q %q, error: %v",
+					tok, resp.StatusCode, resp.Header.Get("X-Echo"), body, err)
+				return
+			}
+		}
+	}
+	serve := func() net.Conn {
+		client, server := net.Pipe()
+		go func() {
+			p.serveConn(server)
+			server.Close()
+		}()
+		client.SetDeadline(time.Now().Add(30 * time.Second))
+		return client
+	}
+
+	var wg sync.WaitGroup
+	// plain keep-alive connections
+	for conn := 0; conn < 4; conn++ {
+		wg.Add(1)
+		go func(conn int) {
+			defer wg.Done()
+			client := serve()
+			defer client.Close()
+			exchange(conn, client, bufio.NewReader(client), origin.Listener.Addr().String(), 400)
+		}(conn)
+	}
+	// requests decrypted from keep-alive tunnels
+	for conn := 4; conn < 6; conn++ {
+		wg.Add(1)
+		go func(conn int) {
+			defer wg.Done()
+			client := serve()
+			defer client.Close()
+			host := tlsOrigin.Listener.Addr().String()
+			go io.WriteString(client, "CONNECT "+host+" HTTP/1.1\r\n\r\n")
+			br := bufio.NewReader(client)
+			if resp, err := nethttp.ReadResponse(br, &nethttp.Request{Method: "CONNECT"}); err != nil ||
+				resp.StatusCode != 200 {
+				t.Errorf("unexpected tunnel response %v %v", resp, err)
+				return
+			}
+			tlsClient := tls.Client(&bufferedConn{client, br}, &tls.Config{
+				InsecureSkipVerify: true, ServerName: "example.com"})
+			exchange(conn, tlsClient, bufio.NewReader(tlsClient), host, 200)
+		}(conn)
+	}
+	wg.Wait()
+
+	if len(recorder.errs) > 0 {
+		t.Fatalf("%d leaks, e.g. %s", len(recorder.errs), recorder.errs[0])
+	}
+}
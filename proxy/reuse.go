@@ -0,0 +1,24 @@
+package proxy
+
+// ReuseHijacker optional interface of Hijacker vetoing the reuse of the
+// connections of a request, e.g. after an auth challenge, a Set-Cookie
+// pinning a session or a response suspected of smuggling
+type ReuseHijacker interface {
+	// CloseConnections called once the response header is read, after
+	// OnResponse, returns if the connection to the target or super proxy,
+	// and the client connection, are closed after the response instead of
+	// being reused, whatever their keep-alive header fields say
+	CloseConnections() (closeUpstream, closeClient bool)
+}
+
+// closeConnections asks the hijacker if the connections are closed
+func (r *Response) closeConnections() {
+	if rh, ok := r.hijacker.(ReuseHijacker); ok {
+		r.closeUpstream, r.forceCloseClient = rh.CloseConnections()
+	}
+}
+
+// forcedClose if the hijacker vetoed the reuse of the connections
+func (r *Response) forcedClose() bool {
+	return r.closeUpstream || r.forceCloseClient
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+// reuseHijacker forwards via an HTTP super proxy and vetoes the reuse
+type reuseHijacker struct {
+	tlsTestHijacker
+	superProxy                 *superproxy.SuperProxy
+	closeUpstream, closeClient bool
+}
+
+func (h *reuseHijacker) SuperProxy() *superproxy.SuperProxy { return h.superProxy }
+func (h *reuseHijacker) CloseConnections() (bool, bool)     { return h.closeUpstream, h.closeClient }
+
+type reuseHijackerPool struct{ h *reuseHijacker }
+
+func (p reuseHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p reuseHijackerPool) Put(Hijacker) {}
+
+func TestReuseHijacker(t *testing.T) {
+	// a super proxy keeping its connections alive
+	var accepted int32
+	sp := listenLocal(t, func(c net.Conn) {
+		defer c.Close()
+		atomic.AddInt32(&accepted, 1)
+		reader := bufio.NewReader(c)
+		for {
+			if _, err := nethttp.ReadRequest(reader); err != nil {
+				return
+			}
+			c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		}
+	})
+	defer sp.Close()
+	h := &reuseHijacker{}
+	h.superProxy, _ = superproxy.NewSuperProxy("127.0.0.1",
+		uint16(sp.Addr().(*net.TCPAddr).Port), superproxy.ProxyTypeHTTP, "", "", "")
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = reuseHijackerPool{h}
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- p.serveConn(server)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(client)
+	get := func() {
+		go fmt.Fprint(client, "GET http://www.example.com/ HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if body, err := ioutil.ReadAll(resp.Body); err != nil || string(body) != "ok" {
+			t.Fatalf("unexpected body %q, error: %v", body, err)
+		}
+		// the upstream connection is released after the response is relayed
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the super proxy connection is reused
+	get()
+	get()
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("unexpected %d upstream connections", n)
+	}
+
+	// vetoed, the pooled connection is closed instead
+	h.closeUpstream = true
+	get()
+	h.closeUpstream = false
+	get()
+	if n := atomic.LoadInt32(&accepted); n != 2 {
+		t.Fatalf("unexpected %d upstream connections", n)
+	}
+
+	// the client connection is closed after the response
+	h.closeClient = true
+	get()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client connection not closed")
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// routeTestHijacker forces the route and records the addresses dialed
+type routeTestHijacker struct {
+	tlsTestHijacker
+	route  Route
+	bump   bool
+	dialed chan string
+}
+
+func (h *routeTestHijacker) Route() Route  { return h.route }
+func (h *routeTestHijacker) SSLBump() bool { return h.bump }
+
+func (h *routeTestHijacker) Dial() func(addr string) (net.Conn, error) {
+	return func(addr string) (net.Conn, error) {
+		h.dialed <- addr
+		return net.Dial("tcp", addr)
+	}
+}
+
+func (h *routeTestHijacker) DialTLS() func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	return func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+		h.dialed <- addr
+		config := tlsConfig.Clone()
+		config.InsecureSkipVerify = true
+		return tls.Dial("tcp", addr, config)
+	}
+}
+
+type routeTestHijackerPool struct{ h *routeTestHijacker }
+
+func (p *routeTestHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p *routeTestHijackerPool) Put(Hijacker) {}
+
+func newRouteTestProxy(t *testing.T, route Route, bump bool) (*Proxy, *routeTestHijacker) {
+	h := &routeTestHijacker{route: route, bump: bump, dialed: make(chan string, 8)}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = &routeTestHijackerPool{h}
+	})
+	return p, h
+}
+
+func TestRouteForceIP(t *testing.T) {
+	origin := newRecordingOrigin(t)
+	defer origin.ln.Close()
+	port := strconv.Itoa(origin.port())
+
+	// plain HTTP, the SNI forced is ignored
+	p, h := newRouteTestProxy(t, Route{ForceIP: net.ParseIP("127.0.0.1"), ForcePort: port, ForceSNI: "edge.example.net"}, false)
+	testRequestLineForm(t, p, origin,
+		"GET http://www.example.com/path HTTP/1.1\r\nConnection: close\r\n\r\n",
+		"GET /path HTTP/1.1", "www.example.com")
+	if addr := <-h.dialed; addr != "127.0.0.1:"+port {
+		t.Fatalf("unexpected address dialed %s", addr)
+	}
+
+	// tunnel
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	p, h = newRouteTestProxy(t, Route{ForceIP: net.ParseIP("127.0.0.1"), ForcePort: port}, false)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	go client.Write([]byte("CONNECT www.example.com:443 HTTP/1.1\r\n\r\n"))
+	br := bufio.NewReader(client)
+	resp, err := nethttp.ReadResponse(br, &nethttp.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("unexpected tunnel response %v %v", resp, err)
+	}
+	go client.Write([]byte("ping"))
+	pong := make([]byte, 4)
+	if _, err := io.ReadFull(br, pong); err != nil || string(pong) != "ping" {
+		t.Fatalf("unexpected tunnel data %s %v", pong, err)
+	}
+	if addr := <-h.dialed; addr != "127.0.0.1:"+port {
+		t.Fatalf("unexpected address dialed %s", addr)
+	}
+}
+
+func TestRouteForceSNI(t *testing.T) {
+	serverNames := make(chan string, 1)
+	origin := httptest.NewUnstartedServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	origin.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	}
+	origin.StartTLS()
+	defer origin.Close()
+	port := strconv.Itoa(origin.Listener.Addr().(*net.TCPAddr).Port)
+
+	p, h := newRouteTestProxy(t, Route{ForceIP: net.ParseIP("127.0.0.1"), ForcePort: port, ForceSNI: "edge.example.net"}, true)
+	if body := decryptedGet(t, p, "www.example.com:443", "www.example.com"); body != "ok" {
+		t.Fatalf("unexpected body %s", body)
+	}
+	if addr := <-h.dialed; addr != "127.0.0.1:"+port {
+		t.Fatalf("unexpected address dialed %s", addr)
+	}
+	if serverName := <-serverNames; serverName != "edge.example.net" {
+		t.Fatalf("unexpected server name %s", serverName)
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+// RuleMatching how the rules of the RulesEngine are applied
+type RuleMatching int
+
+const (
+	// FirstMatch applies the first rule matching the request only
+	FirstMatch RuleMatching = iota
+	// AllMatch applies every rule matching the request in order, each rule
+	// is matched against the request rewritten by the previous ones
+	AllMatch
+)
+
+// Rule a declarative rewrite of the requests matching all its non-empty
+// conditions, the actions are applied in the order of the fields
+type Rule struct {
+	// Host matches the target host case-insensitively, the port excluded,
+	// a leading `*.` matches the subdomains, e.g. `*.example.com`
+	Host string
+	// PathPrefix matches the path of the request target, e.g. `/api/`
+	PathPrefix string
+	// Methods matches any of the methods, e.g. `GET`
+	Methods []string
+
+	// SetHeader header fields set, replacing the existing ones
+	SetHeader map[string]string
+	// DelHeader header fields deleted
+	DelHeader []string
+	// ReplacePathPrefix replaces the PathPrefix matched, the query kept,
+	// e.g. `/` forwards `/api/users?id=1` matched by `/api/` as `/users?id=1`
+	ReplacePathPrefix string
+	// Target host with port the request is forwarded to instead,
+	// the Host header follows it
+	Target string
+	// SuperProxy super proxy the request is forwarded through instead of
+	// the one of the hijacker or the proxy, the tunnels are never routed
+	// by the rules, only the requests decrypted from them
+	SuperProxy *superproxy.SuperProxy
+}
+
+// RulesEngine rewrites the HTTP requests by rules instead of code, e.g. the
+// ones loaded from a config file. It's consulted for every request forwarded,
+// the decrypted ones included, after the BeforeRequest of the hijacker, while
+// the tunnels are left alone. It's safe for concurrent use.
+type RulesEngine struct {
+	rules    []compiledRule
+	matching RuleMatching
+}
+
+type compiledRule struct {
+	Rule
+	host     string
+	wildcard bool
+	methods  [][]byte
+	setNames []string
+}
+
+// framing header fields the rules can't touch, the Host header is
+// rewritten by Target instead
+var ruleForbiddenHeaders = []string{"Host", "Content-Length", "Transfer-Encoding"}
+
+// NewRulesEngine compiles the rules applied with matching,
+// the invalid rules are rejected
+func NewRulesEngine(rules []Rule, matching RuleMatching) (*RulesEngine, error) {
+	e := &RulesEngine{matching: matching}
+	for i, rule := range rules {
+		c, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		e.rules = append(e.rules, c)
+	}
+	return e, nil
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	c := compiledRule{Rule: rule, host: strings.ToLower(rule.Host)}
+	if strings.HasPrefix(c.host, "*.") {
+		c.host, c.wildcard = c.host[1:], true
+	}
+	if len(rule.PathPrefix) > 0 && rule.PathPrefix[0] != '/' {
+		return c, errors.New("path prefix not starting with /: " + rule.PathPrefix)
+	}
+	if len(rule.ReplacePathPrefix) > 0 && (len(rule.PathPrefix) == 0 || rule.ReplacePathPrefix[0] != '/') {
+		return c, errors.New("path prefix replacement without a path prefix or not starting with /")
+	}
+	for _, m := range rule.Methods {
+		c.methods = append(c.methods, []byte(strings.ToUpper(m)))
+	}
+	for name := range rule.SetHeader {
+		c.setNames = append(c.setNames, name)
+	}
+	sort.Strings(c.setNames)
+	for _, name := range append(append([]string(nil), c.setNames...), rule.DelHeader...) {
+		if len(name) == 0 || strings.ContainsAny(name, ": \t\r\n") {
+			return c, fmt.Errorf("invalid header field name %q", name)
+		}
+		for _, forbidden := range ruleForbiddenHeaders {
+			if strings.EqualFold(name, forbidden) {
+				return c, errors.New("header field not rewritable: " + name)
+			}
+		}
+	}
+	for _, value := range rule.SetHeader {
+		if strings.ContainsAny(value, "\r\n") {
+			return c, fmt.Errorf("invalid header field value %q", value)
+		}
+	}
+	if len(rule.Target) > 0 {
+		if host, port, err := net.SplitHostPort(rule.Target); err != nil || len(host) == 0 || len(port) == 0 {
+			return c, errors.New("invalid target, expected host with port: " + rule.Target)
+		}
+	}
+	return c, nil
+}
+
+// match if the request matches all the conditions of the rule
+func (c *compiledRule) match(req *Request) bool {
+	if len(c.host) > 0 {
+		host := req.reqLine.HostInfo().HostWithPort()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if c.wildcard && !strings.HasSuffix(host, c.host) || !c.wildcard && host != c.host {
+			return false
+		}
+	}
+	if len(c.PathPrefix) > 0 && !bytes.HasPrefix(req.reqLine.URI().Path(), []byte(c.PathPrefix)) {
+		return false
+	}
+	if len(c.methods) == 0 {
+		return true
+	}
+	for _, m := range c.methods {
+		if bytes.Equal(req.Method(), m) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply rewrites req by the rules matching it
+func (e *RulesEngine) apply(req *Request) error {
+	for i := range e.rules {
+		rule := &e.rules[i]
+		if !rule.match(req) {
+			continue
+		}
+		if err := rule.apply(req); err != nil {
+			return err
+		}
+		if e.matching == FirstMatch {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (c *compiledRule) apply(req *Request) error {
+	header := &req.header
+	if len(c.setNames) > 0 || len(c.DelHeader) > 0 {
+		for _, name := range c.setNames {
+			if err := header.Set(name, c.SetHeader[name]); err != nil {
+				return err
+			}
+		}
+		for _, name := range c.DelHeader {
+			if err := header.Del(name); err != nil {
+				return err
+			}
+		}
+		req.rawHeader = header.Raw()
+	}
+	if len(c.ReplacePathPrefix) > 0 {
+		path := req.reqLine.PathWithQueryFragment()
+		newPath := make([]byte, 0, len(c.ReplacePathPrefix)+len(path)-len(c.PathPrefix))
+		newPath = append(append(newPath, c.ReplacePathPrefix...), path[len(c.PathPrefix):]...)
+		req.reqLine.ChangePathWithFragment(newPath)
+	}
+	if len(c.Target) > 0 && c.Target != req.reqLine.HostInfo().HostWithPort() {
+		req.reqLine.ChangeHost(c.Target)
+	}
+	if c.SuperProxy != nil {
+		req.ruleProxy = c.SuperProxy
+	}
+	return nil
+}
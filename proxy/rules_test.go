@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+func TestRulesEngine(t *testing.T) {
+	// the origin echoes what it's sent
+	handler := nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprintf(w, "%s %s %s a=%q b=%q secret=%q", r.Method, r.Host, r.URL.RequestURI(),
+			r.Header.Get("X-A"), r.Header.Get("X-B"), r.Header.Get("X-Secret"))
+	})
+	origin := httptest.NewServer(handler)
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(handler)
+	defer tlsOrigin.Close()
+	originAddr := origin.Listener.Addr().String()
+
+	rules := []Rule{
+		{Host: "api.example.com", PathPrefix: "/v1/", Methods: []string{"post"},
+			SetHeader: map[string]string{"X-A": "post"}, Target: originAddr},
+		{Host: "api.example.com", PathPrefix: "/v1/", ReplacePathPrefix: "/",
+			SetHeader: map[string]string{"X-A": "api"}, Target: originAddr},
+		{Host: "127.0.0.1", SetHeader: map[string]string{"X-B": "local"}, DelHeader: []string{"X-Secret"}},
+		{Host: "*.example.com", SetHeader: map[string]string{"X-B": "any"}, Target: originAddr},
+	}
+	newProxy := func(matching RuleMatching) *Proxy {
+		p := newTestProxy(t)
+		var err error
+		if p.Rules, err = NewRulesEngine(rules, matching); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return p
+	}
+	expect := func(name string, p *Proxy, url, expected string) {
+		_, body := proxyTestRequest(t, p, "GET", url, "X-Secret: s\r\n", "")
+		if body != expected {
+			t.Fatalf("%s: unexpected response %q", name, body)
+		}
+	}
+
+	p := newProxy(FirstMatch)
+	expect("first match", p, "http://API.example.com/v1/users?id=1",
+		`GET `+originAddr+` /users?id=1 a="api" b="" secret="s"`)
+	expect("wildcard", p, "http://www.example.com/v1/users",
+		`GET `+originAddr+` /v1/users a="" b="any" secret="s"`)
+	expect("host", p, "http://"+originAddr+"/v1/users",
+		`GET `+originAddr+` /v1/users a="" b="local" secret=""`)
+	localhost := "localhost:" + strings.Split(originAddr, ":")[1]
+	expect("no match", p, "http://"+localhost+"/v1/users",
+		`GET `+localhost+` /v1/users a="" b="" secret="s"`)
+	// the later rules see the request rewritten by the earlier ones
+	p = newProxy(AllMatch)
+	expect("all match", p, "http://api.example.com/v1/users?id=1",
+		`GET `+originAddr+` /users?id=1 a="api" b="local" secret=""`)
+
+	// the decrypted requests are rewritten too
+	p = newProxy(FirstMatch)
+	p.HijackerPool = &tlsTestHijackerPool{&tlsTestHijacker{}}
+	rules[3].Target = tlsOrigin.Listener.Addr().String()
+	p.Rules, _ = NewRulesEngine(rules[3:], FirstMatch)
+	if body := decryptedGet(t, p, "www.example.com:443", "www.example.com"); body !=
+		`GET `+rules[3].Target+` / a="" b="any" secret=""` {
+		t.Fatalf("decrypted: unexpected response %q", body)
+	}
+
+	// routed through the super proxy of the rule
+	sp := listenLocal(t, func(c net.Conn) {
+		c.Write([]byte("HTTP/1.1 418 I'm a teapot\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		c.Close()
+	})
+	defer sp.Close()
+	superProxy, _ := superproxy.NewSuperProxy("127.0.0.1", uint16(sp.Addr().(*net.TCPAddr).Port),
+		superproxy.ProxyTypeHTTP, "", "", "")
+	p = newProxy(FirstMatch)
+	p.Rules, _ = NewRulesEngine([]Rule{{PathPrefix: "/teapot", SuperProxy: superProxy}}, FirstMatch)
+	if resp, _ := proxyTestRequest(t, p, "GET", origin.URL+"/teapot", "", ""); resp.StatusCode != 418 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	// the invalid rules are rejected
+	for _, rule := range []Rule{
+		{PathPrefix: "api/"},
+		{ReplacePathPrefix: "/"},
+		{SetHeader: map[string]string{"Content-Length": "1"}},
+		{DelHeader: []string{"host"}},
+		{SetHeader: map[string]string{"X-A": "a\r\nX-B: b"}},
+		{Target: "example.com"},
+	} {
+		if _, err := NewRulesEngine([]Rule{rule}, FirstMatch); err == nil {
+			t.Fatalf("expected %+v rejected", rule)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultErrorLogRate identical error logs allowed per second by default
+	DefaultErrorLogRate = 1.0
+	// DefaultErrorLogBurst identical error logs allowed at once by default
+	DefaultErrorLogBurst = 10
+	// DefaultErrorLogSummaryInterval interval the suppressed error logs are
+	// summarized by default
+	DefaultErrorLogSummaryInterval = time.Minute
+)
+
+// errorLogMaxKeys max number of the error classes and hosts limited
+// individually, the others share the HostStatsOtherHost ones
+const errorLogMaxKeys = 1024
+
+// ErrorLogLimit token bucket rate limit of the identical error logs, i.e.
+// the ones of the same error class and target host, e.g. an upstream refusing
+// every connection. The logs suppressed are counted, see ErrorLogsSuppressed,
+// and summarized per class and host every SummaryInterval.
+//
+// The errors of the connections suppressed are still returned by ServeConn,
+// they are dropped by the LeveledLogger only.
+type ErrorLogLimit struct {
+	// Rate identical logs allowed per second
+	//
+	// DefaultErrorLogRate is used if not set.
+	Rate float64
+	// Burst identical logs allowed at once
+	//
+	// DefaultErrorLogBurst is used if not set.
+	Burst int
+	// SummaryInterval interval the suppressed logs are summarized
+	//
+	// DefaultErrorLogSummaryInterval is used if not set.
+	SummaryInterval time.Duration
+
+	suppressed     uint64
+	lock           sync.Mutex
+	buckets        map[errorLogKey]*errorLogBucket
+	summaryPending bool
+}
+
+type errorLogKey struct {
+	level LogLevel
+	class string
+	host  string
+}
+
+type errorLogBucket struct {
+	tokens     float64
+	last       time.Time
+	suppressed uint64
+}
+
+func (l *ErrorLogLimit) rate() float64 {
+	if l.Rate > 0 {
+		return l.Rate
+	}
+	return DefaultErrorLogRate
+}
+
+func (l *ErrorLogLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return DefaultErrorLogBurst
+}
+
+func (l *ErrorLogLimit) summaryInterval() time.Duration {
+	if l.SummaryInterval > 0 {
+		return l.SummaryInterval
+	}
+	return DefaultErrorLogSummaryInterval
+}
+
+// allow if the log of class and host at level is allowed, the one suppressed
+// is counted and summarized into logger later, all are allowed if l is nil
+func (l *ErrorLogLimit) allow(logger *LeveledLogger, level LogLevel, class, host string) bool {
+	if l == nil || !logger.Enabled(level) {
+		return true
+	}
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[errorLogKey]*errorLogBucket)
+	}
+	key := errorLogKey{level: level, class: class, host: host}
+	b := l.buckets[key]
+	if b == nil && len(l.buckets) >= errorLogMaxKeys {
+		key.host = HostStatsOtherHost
+		b = l.buckets[key]
+	}
+	if b == nil {
+		b = &errorLogBucket{tokens: l.burst(), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate()
+	if burst := l.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+
+	b.suppressed++
+	atomic.AddUint64(&l.suppressed, 1)
+	if !l.summaryPending {
+		l.summaryPending = true
+		time.AfterFunc(l.summaryInterval(), func() { l.summarize(logger) })
+	}
+	return false
+}
+
+// summarize logs the number of the logs suppressed of each class and host
+// since the last summary at their level
+func (l *ErrorLogLimit) summarize(logger *LeveledLogger) {
+	type summary struct {
+		key        errorLogKey
+		suppressed uint64
+	}
+	var summaries []summary
+	l.lock.Lock()
+	for key, b := range l.buckets {
+		if b.suppressed > 0 {
+			summaries = append(summaries, summary{key, b.suppressed})
+			b.suppressed = 0
+		}
+	}
+	l.summaryPending = false
+	l.lock.Unlock()
+
+	for _, s := range summaries {
+		if s.key.level == LogLevelWarn {
+			logger.Warn(s.key.host, "%d logs of %s suppressed", s.suppressed, s.key.class)
+		} else {
+			logger.Error(s.key.host, nil, "%d logs of %s suppressed", s.suppressed, s.key.class)
+		}
+	}
+}
+
+// ErrorLogsSuppressed number of the error logs suppressed by the
+// ErrorLogLimit so far
+func (p *Proxy) ErrorLogsSuppressed() uint64 {
+	if p.ErrorLogLimit == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&p.ErrorLogLimit.suppressed)
+}
+
+// errorClasses the error kinds the logs are limited by, the specific
+// ones before the general ones they are
+var errorClasses = []error{
+	ErrClientMalformedRequest,
+	ErrUpstreamPrelude,
+	ErrUpstreamDial,
+	ErrUpstreamHeaderTimeout,
+	ErrUpstreamBodyTimeout,
+	ErrUpstreamTimeout,
+	ErrSuperProxyHandshake,
+	ErrACLRejected,
+	ErrBodySizeExceeded,
+	ErrMemoryLimitExceeded,
+	ErrFDBudgetExceeded,
+	ErrPanic,
+	ErrNoUpstream,
+	ErrSchemeNotImplemented,
+}
+
+// errorClass the kind of err the logs are limited by, `other error` if unknown
+func errorClass(err error) string {
+	for _, kind := range errorClasses {
+		if errors.Is(err, kind) {
+			return kind.Error()
+		}
+	}
+	return "other error"
+}
+
+// suppressedError the error of the connection whose log is suppressed
+// by the ErrorLogLimit, which is dropped by the LeveledLogger
+type suppressedError struct {
+	error
+}
+
+func (e *suppressedError) Unwrap() error {
+	return e.error
+}
+
+// limitErrorLog marks err of the connection described by info as suppressed
+// if the logs of its class and target host are over the ErrorLogLimit
+func (p *Proxy) limitErrorLog(info *connInfo, err error) error {
+	if err == nil {
+		return nil
+	}
+	host, _ := info.target.Load().(string)
+	if p.ErrorLogLimit.allow(p.logger, LogLevelError, errorClass(err), host) {
+		return err
+	}
+	return &suppressedError{err}
+}
+
+// warnLimited logs the warning of err of host unless over the ErrorLogLimit
+func (p *Proxy) warnLimited(host string, err error, format string, v ...interface{}) {
+	if p.ErrorLogLimit.allow(p.logger, LogLevelWarn, errorClass(err), host) {
+		p.logger.Warn(host, format, v...)
+	}
+}
+
+// accessSampled if the URL made of hostWithPort and path is sampled at rate,
+// all are sampled at a rate out of (0, 1)
+func accessSampled(hostWithPort string, path []byte, rate float64) bool {
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	io.WriteString(h, hostWithPort)
+	h.Write(path)
+	// mix the bits, the high bits of FNV alone hardly vary for similar URLs
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return float64(x) < rate*(1<<64)
+}
+
+// recordAccess calls OnAccessRecord with the record of the exchange if sampled
+func (p *Proxy) recordAccess(req *Request, resp *Response, start time.Time, err error) {
+	failed := err != nil || resp.respLine.GetStatusCode() >= 500
+	if !(p.AlwaysRecordErrors && failed) && !accessSampled(req.reqLine.HostInfo().HostWithPort(),
+		req.PathWithQueryFragment(), p.AccessRecordSampleRate) {
+		atomic.AddUint64(&p.accessSampledOut, 1)
+		return
+	}
+	p.OnAccessRecord(newRequestRecord(req, resp, start, err))
+}
+
+// AccessRecordsSampledOut number of the exchanges left out of OnAccessRecord
+// by AccessRecordSampleRate so far
+func (p *Proxy) AccessRecordsSampledOut() uint64 {
+	return atomic.LoadUint64(&p.accessSampledOut)
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAccessRecordSampling(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if strings.HasPrefix(r.URL.Path, "/fail/") {
+			w.WriteHeader(nethttp.StatusServiceUnavailable)
+		}
+	}))
+	defer origin.Close()
+
+	var (
+		lock    sync.Mutex
+		records []RequestRecord
+	)
+	p := newTestProxy(t, func(p *Proxy) {
+		p.AccessRecordSampleRate = 0.5
+	})
+	p.OnAccessRecord = func(record RequestRecord) {
+		lock.Lock()
+		records = append(records, record)
+		lock.Unlock()
+	}
+	sampled := func(prefix string) map[string]bool {
+		lock.Lock()
+		records = nil
+		lock.Unlock()
+		for i := 0; i < 100; i++ {
+			proxyTestRequest(t, p, "GET", fmt.Sprintf("%s%s%d", origin.URL, prefix, i), "", "")
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		paths := make(map[string]bool)
+		for _, record := range records {
+			paths[record.Path] = true
+		}
+		return paths
+	}
+
+	// the same URLs are sampled every time
+	first, second := sampled("/ok/"), sampled("/ok/")
+	if len(first) < 25 || len(first) > 75 {
+		t.Fatalf("unexpected %d of 100 URLs sampled", len(first))
+	}
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Fatalf("unexpected URLs sampled %v, expected %v", second, first)
+	}
+	if out := p.AccessRecordsSampledOut(); out != uint64(200-2*len(first)) {
+		t.Fatalf("unexpected %d records sampled out of %d", out, 200-2*len(first))
+	}
+	if r := records[0]; r.Method != "GET" || r.StatusCode != 200 || r.Err != nil || r.HostWithPort != origin.Listener.Addr().String() {
+		t.Fatalf("unexpected record %+v", r)
+	}
+
+	// the 5xx responses are recorded whatever the sampling
+	if failed := sampled("/fail/"); len(failed) == 100 {
+		t.Fatal("expected the failures sampled")
+	}
+	p.AlwaysRecordErrors = true
+	if failed := sampled("/fail/"); len(failed) != 100 || records[0].StatusCode != 503 {
+		t.Fatalf("unexpected %d failures recorded", len(failed))
+	}
+	if ok := sampled("/ok/"); fmt.Sprint(ok) != fmt.Sprint(first) {
+		t.Fatalf("unexpected URLs sampled %v, expected %v", ok, first)
+	}
+}
+
+// countLogs the logs prefixed by prefix and the logs suppressed by the summaries
+func countLogs(l *recordingLogger, prefix string) (logs, suppressed int) {
+	for _, log := range l.logged() {
+		var n int
+		if strings.HasPrefix(log, prefix) {
+			logs++
+		} else if _, err := fmt.Sscanf(log, "ERROR %d logs of", &n); err == nil {
+			suppressed += n
+		}
+	}
+	return
+}
+
+func TestErrorLogLimit(t *testing.T) {
+	l := &recordingLogger{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.logger = &LeveledLogger{Logger: l}
+		p.ErrorLogLimit = &ErrorLogLimit{Rate: 0.001, Burst: 3, SummaryInterval: 100 * time.Millisecond}
+	})
+
+	// nothing listening on the targets
+	deadTarget := func() string {
+		ln := listenLocal(t, func(c net.Conn) { c.Close() })
+		ln.Close()
+		return ln.Addr().String()
+	}
+	storm := func(target string, n int) {
+		for i := 0; i < n; i++ {
+			err := serveRawRequest(p, "GET http://"+target+"/ HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+			if !errors.Is(err, ErrUpstreamDial) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			// logged like the server does
+			p.logger.Error("client", err, "error when serving connection")
+		}
+	}
+
+	storm(deadTarget(), 50)
+	if logs, _ := countLogs(l, "ERROR error when serving"); logs != 3 {
+		t.Fatalf("unexpected %d errors logged", logs)
+	}
+	if suppressed := p.ErrorLogsSuppressed(); suppressed != 47 {
+		t.Fatalf("unexpected %d errors suppressed", suppressed)
+	}
+	// the other hosts are limited on their own
+	storm(deadTarget(), 5)
+	if logs, _ := countLogs(l, "ERROR error when serving"); logs != 6 {
+		t.Fatalf("unexpected %d errors logged", logs)
+	}
+
+	// the suppressed ones are summarized
+	for i := 0; ; i++ {
+		_, suppressed := countLogs(l, "ERROR error when serving")
+		if suppressed == 49 {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("unexpected %d errors summarized", suppressed)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if suppressed := p.ErrorLogsSuppressed(); suppressed != 49 {
+		t.Fatalf("unexpected %d errors suppressed", suppressed)
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/uri"
+)
+
+// SchemeHandler serves the requests whose absolute-form targets are of a
+// scheme other than http and https, e.g. `GET ftp://host/file HTTP/1.1`,
+// in place of forwarding them, see Proxy.RegisterSchemeHandler
+type SchemeHandler interface {
+	// ServeScheme answers req by w, an error returned before the header
+	// written is answered with 502, otherwise the response is aborted
+	// by closing the client connection. The request body is discarded.
+	ServeScheme(w SchemeResponseWriter, req RequestView) error
+}
+
+// SchemeHandlerFunc adapts a function to SchemeHandler
+type SchemeHandlerFunc func(w SchemeResponseWriter, req RequestView) error
+
+// ServeScheme calls f(w, req)
+func (f SchemeHandlerFunc) ServeScheme(w SchemeResponseWriter, req RequestView) error {
+	return f(w, req)
+}
+
+// SchemeResponseWriter writes the response of a SchemeHandler, which is
+// relayed to the client like the ones forwarded, i.e. to the hijacker and
+// in chunks for the clients kept alive if its length is not set
+type SchemeResponseWriter interface {
+	// SetHeader sets a response header field before WriteHeader,
+	// Content-Length included
+	SetHeader(key, value string)
+	// WriteHeader writes the status line and the header fields set,
+	// only the first call takes effect
+	WriteHeader(statusCode int)
+	// Write writes the body, the header is written with 200 first if not yet
+	Write(b []byte) (int, error)
+}
+
+// schemeResponseWriter writes the raw response into w
+type schemeResponseWriter struct {
+	w           io.Writer
+	header      []byte
+	wroteHeader bool
+	err         error
+}
+
+func (w *schemeResponseWriter) SetHeader(key, value string) {
+	if w.wroteHeader {
+		return
+	}
+	w.header = append(append(append(append(w.header, key...), ": "...), value...), "\r\n"...)
+}
+
+func (w *schemeResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := append(append(append([]byte(nil), http.StatusLine(statusCode)...), w.header...), "\r\n"...)
+	_, w.err = w.w.Write(header)
+}
+
+func (w *schemeResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(b)
+	w.err = err
+	return n, err
+}
+
+// RegisterSchemeHandler serves the requests of scheme by h, e.g. an
+// FTPHandler for ftp, nil h unregisters it. The requests of the schemes
+// without a handler are answered with 501. The http and https requests
+// are always forwarded.
+func (p *Proxy) RegisterSchemeHandler(scheme string, h SchemeHandler) {
+	p.schemeLock.Lock()
+	defer p.schemeLock.Unlock()
+	scheme = strings.ToLower(scheme)
+	if h == nil {
+		delete(p.schemeHandlers, scheme)
+		return
+	}
+	if p.schemeHandlers == nil {
+		p.schemeHandlers = make(map[string]SchemeHandler)
+	}
+	p.schemeHandlers[scheme] = h
+}
+
+// schemeHandler the handler of the scheme of req, handled false for the
+// http and https requests, as well as the ones in origin-form
+func (p *Proxy) schemeHandler(req *Request) (h SchemeHandler, handled bool) {
+	scheme := req.reqLine.URI().Scheme()
+	if len(scheme) == 0 || bytes.EqualFold(scheme, schemeHTTP) || bytes.EqualFold(scheme, schemeHTTPS) {
+		return nil, false
+	}
+	p.schemeLock.RLock()
+	h = p.schemeHandlers[strings.ToLower(string(scheme))]
+	p.schemeLock.RUnlock()
+	return h, true
+}
+
+var schemeHTTP = []byte("http")
+
+// serveScheme answers req by h, its response is relayed like a synthetic one
+func (p *Proxy) serveScheme(writer *bufio.Writer, req *Request, resp *Response, h SchemeHandler) error {
+	pr, pw := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		err := p.serveSynthetic(writer, req, resp, pr)
+		// fail the writes of the handler once the relay is over
+		pr.Close()
+		served <- err
+	}()
+	w := &schemeResponseWriter{w: pw}
+	err := h.ServeScheme(w, RequestView{req: req})
+	if err != nil && !w.wroteHeader {
+		p.logger.Debug(req.reqLine.HostInfo().HostWithPort(), "%s answered with 502: %s",
+			req.reqLine.URI().Full(), err)
+		msg := "Bad Gateway.\n"
+		w.SetHeader("Content-Type", "text/plain")
+		w.SetHeader("Content-Length", strconv.Itoa(len(msg)))
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(msg))
+		pw.Close()
+		if e := <-served; e != nil {
+			return e
+		}
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	pw.CloseWithError(err)
+	return <-served
+}
+
+// FTPHandler SchemeHandler gatewaying the GET and HEAD requests of ftp by
+// Fetch, which does the FTP itself, e.g. by the FTP client of the integrator
+type FTPHandler struct {
+	// Fetch returns the content of the file at u with its size, -1 if
+	// unknown, the credentials are found in the UserInfo of u
+	Fetch func(u *uri.URI) (content io.ReadCloser, size int64, err error)
+}
+
+// ServeScheme implements SchemeHandler, the content type is guessed by
+// the extension of the file
+func (h *FTPHandler) ServeScheme(w SchemeResponseWriter, req RequestView) error {
+	isHead := bytes.Equal(req.Method(), methodHead)
+	if !isHead && !bytes.Equal(req.Method(), methodGet) {
+		msg := "Method Not Allowed.\n"
+		w.SetHeader("Allow", "GET, HEAD")
+		w.SetHeader("Content-Type", "text/plain")
+		w.SetHeader("Content-Length", strconv.Itoa(len(msg)))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, err := w.Write([]byte(msg))
+		return err
+	}
+	content, size, err := h.Fetch(req.URI())
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	contentType := mime.TypeByExtension(path.Ext(string(req.URI().Path())))
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	w.SetHeader("Content-Type", contentType)
+	if size >= 0 {
+		w.SetHeader("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if isHead {
+		return nil
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/uri"
+)
+
+func TestSchemeHandler(t *testing.T) {
+	p, h := newRouteTestProxy(t, Route{}, false)
+	var fetched []string
+	p.RegisterSchemeHandler("FTP", &FTPHandler{Fetch: func(u *uri.URI) (content io.ReadCloser, size int64, err error) {
+		fetched = append(fetched, string(u.Path()))
+		if string(u.Path()) == "/missing.txt" {
+			return nil, 0, errors.New("550 no such file")
+		}
+		return ioutil.NopCloser(strings.NewReader("hello ftp")), 9, nil
+	}})
+
+	// GET and HEAD served by the handler
+	resp, body := proxyTestRequest(t, p, "GET", "ftp://files.example.com/pub/a.txt", "", "")
+	if resp.StatusCode != 200 || body != "hello ftp" || resp.ContentLength != 9 ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected response %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	resp, body = proxyTestRequest(t, p, "HEAD", "ftp://files.example.com/pub/a.txt", "", "")
+	if resp.StatusCode != 200 || body != "" || resp.Header.Get("Content-Length") != "9" {
+		t.Fatalf("unexpected response %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	// the fetch error answered with 502, the other methods with 405
+	if resp, _ = proxyTestRequest(t, p, "GET", "ftp://files.example.com/missing.txt", "", ""); resp.StatusCode != 502 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ = proxyTestRequest(t, p, "POST", "ftp://files.example.com/pub/a.txt", "Content-Length: 0\r\n", ""); resp.StatusCode != 405 ||
+		resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Fatalf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+	if f := strings.Join(fetched, " "); f != "/pub/a.txt /pub/a.txt /missing.txt" {
+		t.Fatalf("unexpected fetches %s", f)
+	}
+
+	// the schemes without a handler answered with 501, never dialed
+	if resp, _ = proxyTestRequest(t, p, "GET", "gopher://files.example.com/", "", ""); resp.StatusCode != 501 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	p.RegisterSchemeHandler("ftp", nil)
+	if resp, _ = proxyTestRequest(t, p, "GET", "ftp://files.example.com/pub/a.txt", "", ""); resp.StatusCode != 501 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	select {
+	case addr := <-h.dialed:
+		t.Fatalf("unexpected dial to %s", addr)
+	default:
+	}
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// serverTiming the overhead of the proxy reported to the client in a
+// Server-Timing header of the response, see Proxy.ServerTiming
+type serverTiming struct {
+	// start when the request starts to be forwarded
+	start time.Time
+	// dial nanoseconds spent dialing new connections for the request,
+	// which are recorded by the dialing goroutines
+	dial int64
+}
+
+// recordDial adds the time took by a dial
+func (t *serverTiming) recordDial(took time.Duration) {
+	atomic.AddInt64(&t.dial, int64(took))
+}
+
+// header the Server-Timing header line of the response starting at
+// firstByte, the dial is left out if the connection is reused
+func (t *serverTiming) header(firstByte time.Time) []byte {
+	b := append([]byte(nil), "Server-Timing: "...)
+	if dial := atomic.LoadInt64(&t.dial); dial > 0 {
+		b = appendServerTimingMetric(b, "proxy-dial", time.Duration(dial))
+		b = append(b, ", "...)
+	}
+	b = appendServerTimingMetric(b, "proxy-ttfb", firstByte.Sub(t.start))
+	return append(b, "\r\n"...)
+}
+
+// appendServerTimingMetric appends the metric of name lasting d in
+// milliseconds
+func appendServerTimingMetric(b []byte, name string, d time.Duration) []byte {
+	b = append(append(b, name...), ";dur="...)
+	return strconv.AppendFloat(b, float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+func TestServerTiming(t *testing.T) {
+	// a super proxy keeping its connections alive, answering with the
+	// Server-Timing of the target
+	sp := listenLocal(t, func(c net.Conn) {
+		defer c.Close()
+		reader := bufio.NewReader(c)
+		for {
+			if _, err := nethttp.ReadRequest(reader); err != nil {
+				return
+			}
+			c.Write([]byte("HTTP/1.1 200 OK\r\nServer-Timing: db;dur=53\r\nContent-Length: 2\r\n\r\nok"))
+		}
+	})
+	defer sp.Close()
+	p := newTestProxy(t, func(p *Proxy) {
+		p.ServerTiming = true
+	})
+	p.SuperProxy, _ = superproxy.NewSuperProxy("127.0.0.1",
+		uint16(sp.Addr().(*net.TCPAddr).Port), superproxy.ProxyTypeHTTP, "", "", "")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(client)
+	get := func() []string {
+		go client.Write([]byte("GET http://www.example.com/ HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if body, err := ioutil.ReadAll(resp.Body); err != nil || string(body) != "ok" {
+			t.Fatalf("unexpected body %q, error: %v", body, err)
+		}
+		// the upstream connection is released after the response is relayed
+		time.Sleep(50 * time.Millisecond)
+		return resp.Header["Server-Timing"]
+	}
+
+	// the dial is reported for the new connection, the one of the target kept
+	withDial := regexp.MustCompile(`^proxy-dial;dur=\d+\.\d{3}, proxy-ttfb;dur=\d+\.\d{3}$`)
+	if timings := get(); len(timings) != 2 || timings[0] != "db;dur=53" || !withDial.MatchString(timings[1]) {
+		t.Fatalf("unexpected Server-Timing %q", timings)
+	}
+
+	// and left out for the connection reused
+	withoutDial := regexp.MustCompile(`^proxy-ttfb;dur=\d+\.\d{3}$`)
+	if timings := get(); len(timings) != 2 || timings[0] != "db;dur=53" || !withoutDial.MatchString(timings[1]) {
+		t.Fatalf("unexpected Server-Timing %q", timings)
+	}
+
+	// nothing is added if not enabled
+	p.ServerTiming = false
+	if timings := get(); len(timings) != 1 {
+		t.Fatalf("unexpected Server-Timing %q", timings)
+	}
+}
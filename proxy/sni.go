@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+// errHelloPeeked ends the handshake peeking the ClientHello
+var errHelloPeeked = errors.New("client hello peeked")
+
+// serveTunnelBySNI answers the tunnel of req, then decides to decrypt it by
+// the SNI the client sends, see DecryptBySNI
+func (p *Proxy) serveTunnelBySNI(c net.Conn, req *Request) error {
+	if _, err := sendTunnelMessage(c, nil); err != nil {
+		return err
+	}
+	c, serverName := p.peekSNI(c)
+	domain := req.reqLine.HostInfo().Domain()
+	if len(serverName) == 0 || strings.EqualFold(serverName, domain) {
+		if p.sslBump(req.hijacker, req.reqLine.HostInfo().HostWithPort()) {
+			return p.decryptHTTPS(c, req, domain, true)
+		}
+		return p.tunnelHTTPS(c, req, true)
+	}
+
+	// the SNI names another host, decided by the hijacker made for it
+	p.logger.Debug(req.reqLine.HostInfo().HostWithPort(), "SNI %s differs from the CONNECT target", serverName)
+	hijacker := p.HijackerPool.Get(c.RemoteAddr(), true, serverName, req.reqLine.HostInfo().Port())
+	defer p.HijackerPool.Put(hijacker)
+	if !p.sslBump(hijacker, net.JoinHostPort(serverName, req.reqLine.HostInfo().Port())) {
+		return p.tunnelHTTPS(c, req, true)
+	}
+	connectHijacker := req.hijacker
+	req.hijacker = hijacker
+	defer func() { req.hijacker = connectHijacker }()
+	return p.decryptHTTPS(c, req, serverName, true)
+}
+
+// peekSNI peeks the ClientHello the client starts the tunnel c with, returns
+// the connection reading the bytes peeked again with the SNI, which is empty
+// if the client sends none, e.g. it doesn't speak TLS
+func (p *Proxy) peekSNI(c net.Conn) (net.Conn, string) {
+	timeout := p.TLSHandshakeTimeout
+	if timeout <= 0 {
+		timeout = transport.DefaultTLSHandshakeTimeout
+	}
+	hc := &helloConn{Conn: c}
+	serverName := ""
+	tlsConn := tls.Server(hc, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloPeeked
+		},
+	})
+	c.SetReadDeadline(time.Now().Add(timeout))
+	tlsConn.Handshake()
+	c.SetReadDeadline(time.Time{})
+	if len(hc.read) == 0 {
+		return c, serverName
+	}
+	return &peekedConn{Conn: c, peeked: hc.read}, serverName
+}
+
+// helloConn records the bytes read from the client for the handshake
+// peeking the ClientHello, and writes nothing to it
+type helloConn struct {
+	net.Conn
+	read []byte
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read = append(c.read, b[:n]...)
+	return n, err
+}
+
+func (c *helloConn) Write(b []byte) (int, error) {
+	return 0, errHelloPeeked
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// sniTestHijacker decrypts the tunnels if bump, sending every connection
+// to origin, and records the requests it sees
+type sniTestHijacker struct {
+	tlsTestHijacker
+	bump   bool
+	origin string
+	pool   *sniTestHijackerPool
+}
+
+func (h *sniTestHijacker) SSLBump() bool { return h.bump }
+func (h *sniTestHijacker) Resolve() net.IP {
+	return net.ParseIP("127.0.0.1")
+}
+func (h *sniTestHijacker) BeforeRequest(method, path []byte, header http.Header,
+	rawHeader []byte) ([]byte, []byte) {
+	h.pool.record("request " + h.host)
+	return path, rawHeader
+}
+func (h *sniTestHijacker) Dial() func(addr string) (net.Conn, error) {
+	return func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", h.origin)
+	}
+}
+func (h *sniTestHijacker) DialTLS() func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	return func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+		return tls.Dial("tcp", h.origin, &tls.Config{InsecureSkipVerify: true})
+	}
+}
+
+// sniTestHijackerPool makes the hijackers decrypting the hosts of bump
+type sniTestHijackerPool struct {
+	bump   map[string]bool
+	origin string
+	lock   sync.Mutex
+	events []string
+}
+
+func (p *sniTestHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.record("get " + host)
+	return &sniTestHijacker{tlsTestHijacker: tlsTestHijacker{host: host, port: port},
+		bump: p.bump[host], origin: p.origin, pool: p}
+}
+func (p *sniTestHijackerPool) Put(Hijacker) {}
+
+func (p *sniTestHijackerPool) record(event string) {
+	p.lock.Lock()
+	p.events = append(p.events, event)
+	p.lock.Unlock()
+}
+
+func TestDecryptBySNI(t *testing.T) {
+	origin := httptest.NewTLSServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	pool := &sniTestHijackerPool{origin: origin.Listener.Addr().String()}
+	var lock sync.Mutex
+	var records []RequestRecord
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = pool
+		p.DecryptBySNI = true
+		p.OnAccessRecord = func(record RequestRecord) {
+			lock.Lock()
+			records = append(records, record)
+			lock.Unlock()
+		}
+	})
+
+	// get makes a request through the tunnel to www.example.com sending
+	// serverName, returns whether it's decrypted, i.e. the certificate is
+	// not the origin's, with the names of the certificate
+	get := func(serverName string) (bool, []string) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			p.serveConn(server)
+			server.Close()
+		}()
+		go client.Write([]byte("CONNECT www.example.com:443 HTTP/1.1\r\n\r\n"))
+		br := bufio.NewReader(client)
+		resp, err := nethttp.ReadResponse(br, &nethttp.Request{Method: "CONNECT"})
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("unexpected tunnel response %v %v", resp, err)
+		}
+		tlsClient := tls.Client(&bufferedConn{client, br}, &tls.Config{
+			InsecureSkipVerify: true, ServerName: serverName, MaxVersion: tls.VersionTLS12})
+		go tlsClient.Write([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\nConnection: close\r\n\r\n"))
+		resp, err = nethttp.ReadResponse(bufio.NewReader(tlsClient), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if body, _ := ioutil.ReadAll(resp.Body); string(body) != "ok" {
+			t.Fatalf("unexpected body %s", body)
+		}
+		leaf := tlsClient.ConnectionState().PeerCertificates[0]
+		return !bytes.Equal(leaf.Raw, origin.Certificate().Raw), leaf.DNSNames
+	}
+	check := func(serverName string, bump map[string]bool, decrypted bool, names, events []string) {
+		pool.bump, pool.events = bump, nil
+		d, n := get(serverName)
+		if d != decrypted || decrypted && fmt.Sprint(n) != fmt.Sprint(names) {
+			t.Fatalf("SNI %q: unexpected decrypted %v with names %v", serverName, d, n)
+		}
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		if fmt.Sprint(pool.events) != fmt.Sprint(events) {
+			t.Fatalf("SNI %q: unexpected events %q", serverName, pool.events)
+		}
+	}
+
+	// the SNI matching the CONNECT target is decided by its hijacker
+	check("www.example.com", map[string]bool{"www.example.com": true}, true,
+		[]string{"www.example.com"}, []string{"get www.example.com", "request www.example.com"})
+	check("WWW.example.com", map[string]bool{}, false, nil, []string{"get www.example.com"})
+
+	// the differing SNI is decided by the hijacker made for it, which
+	// serves the requests decrypted
+	check("front.example.net", map[string]bool{"front.example.net": true}, true,
+		[]string{"front.example.net"}, []string{"get www.example.com", "get front.example.net",
+			"request front.example.net"})
+	check("front.example.net", map[string]bool{"www.example.com": true}, false, nil,
+		[]string{"get www.example.com", "get front.example.net"})
+
+	// the CONNECT target is used without SNI
+	check("", map[string]bool{"www.example.com": true}, true,
+		[]string{"www.example.com"}, []string{"get www.example.com", "request www.example.com"})
+
+	// the access records of the requests decrypted carry both names
+	lock.Lock()
+	defer lock.Unlock()
+	var names []string
+	for _, record := range records {
+		names = append(names, record.HostWithPort+" "+record.ServerName)
+	}
+	expected := []string{"www.example.com:443 www.example.com", "www.example.com:443 front.example.net",
+		"www.example.com:443 "}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected records %q", names)
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+// DefaultSniffTimeout used when SniffTimeout not set
+const DefaultSniffTimeout = 3 * time.Second
+
+// sniffTLS peeks the first byte of c to tell if the client speaks TLS, i.e.
+// the secure web proxy clients, whose connection is returned decrypted
+// with TLSConfig, the plain ones are returned as is. The byte peeked is
+// replayed to the returned connection in both cases.
+func (p *Proxy) sniffTLS(c net.Conn) (net.Conn, error) {
+	timeout := p.SniffTimeout
+	if timeout <= 0 {
+		timeout = DefaultSniffTimeout
+	}
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	var first [1]byte
+	n, err := c.Read(first[:])
+	if err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, err
+		}
+	}
+	if err = c.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	isTLS := p.SniffFallbackTLS
+	if n > 0 {
+		switch b := first[0]; {
+		case b == tlsRecordTypeHandshake:
+			isTLS = true
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z':
+			isTLS = false
+		}
+		c = &peekedConn{Conn: c, peeked: first[:n]}
+	}
+	if !isTLS {
+		return c, nil
+	}
+	p.logger.Debug(c.RemoteAddr().String(), "serving the proxy over TLS")
+	tlsConn := tls.Server(c, p.TLSConfig)
+	if err = transport.TLSHandshake(tlsConn, p.TLSHandshakeTimeout); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// connTLSState the TLS state of the client connection served over TLS,
+// either by TLSConfig or by the caller of ServeConn, whose handshake is
+// completed if not yet, nil if served in plaintext
+func (p *Proxy) connTLSState(c net.Conn) (*tls.ConnectionState, error) {
+	if tc, ok := c.(*trackedConn); ok {
+		c = tc.Conn
+	}
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	if !tlsConn.ConnectionState().HandshakeComplete {
+		if err := transport.TLSHandshake(tlsConn, p.TLSHandshakeTimeout); err != nil {
+			return nil, err
+		}
+	}
+	state := tlsConn.ConnectionState()
+	return &state, nil
+}
+
+// peekedConn a connection whose bytes peeked are read again first
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// pipeListener an in-memory listener accepting the pipes dialed
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error   { close(l.done); return nil }
+func (l *pipeListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func (l *pipeListener) dial(context.Context, string, string) (net.Conn, error) {
+	client, server := net.Pipe()
+	l.conns <- server
+	return client, nil
+}
+
+func TestSniffTLS(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	// borrow the self-signed certificate of a TLS test server
+	certServer := httptest.NewTLSServer(nil)
+	defer certServer.Close()
+
+	p := newTestProxy(t, func(p *Proxy) {
+		p.TLSConfig = certServer.TLS
+		p.SniffTimeout = 50 * time.Millisecond
+	})
+	ln := newPipeListener()
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				p.serveConn(c)
+				c.Close()
+			}()
+		}
+	}()
+
+	get := func(proxyScheme string, dial func(context.Context, string, string) (net.Conn, error)) string {
+		proxyURL := &url.URL{Scheme: proxyScheme, Host: "proxy.local:8080"}
+		tr := &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL), DialContext: dial,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}
+		resp, err := (&nethttp.Client{Transport: tr}).Get(origin.URL)
+		if err != nil {
+			t.Fatalf("unexpected error through %s proxy: %s", proxyScheme, err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if body := get("http", ln.dial); body != "ok" {
+		t.Fatalf("unexpected plain body %s", body)
+	}
+	if body := get("https", ln.dial); body != "ok" {
+		t.Fatalf("unexpected TLS body %s", body)
+	}
+	// silent beyond the sniff timeout, served as plain by default
+	slowDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := ln.dial(ctx, network, addr)
+		time.Sleep(2 * p.SniffTimeout)
+		return c, err
+	}
+	if body := get("http", slowDial); body != "ok" {
+		t.Fatalf("unexpected slow plain body %s", body)
+	}
+	p.SniffFallbackTLS = true
+	if body := get("https", slowDial); body != "ok" {
+		t.Fatalf("unexpected slow TLS body %s", body)
+	}
+}
+
+// connTLSHijacker records the TLS state of the client connections
+type connTLSHijacker struct {
+	tlsTestHijacker
+	states chan *tls.ConnectionState
+}
+
+func (h *connTLSHijacker) HandleRequest(req RequestView) { h.states <- req.ConnTLS() }
+
+type connTLSHijackerPool struct{ h *connTLSHijacker }
+
+func (p connTLSHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p connTLSHijackerPool) Put(Hijacker) {}
+
+func TestConnTLS(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	certServer := httptest.NewTLSServer(nil)
+	defer certServer.Close()
+
+	// the clients authenticate with the certificate of the test server
+	tlsConfig := certServer.TLS.Clone()
+	tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	h := &connTLSHijacker{states: make(chan *tls.ConnectionState, 1)}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.TLSConfig = tlsConfig
+		p.HijackerPool = connTLSHijackerPool{h}
+	})
+	ln := newPipeListener()
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				p.serveConn(c)
+				c.Close()
+			}()
+		}
+	}()
+
+	get := func(proxyScheme string) *tls.ConnectionState {
+		proxyURL := &url.URL{Scheme: proxyScheme, Host: "proxy.local:8080"}
+		tr := &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL), DialContext: ln.dial,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true,
+				Certificates: certServer.TLS.Certificates}, DisableKeepAlives: true}
+		resp, err := (&nethttp.Client{Transport: tr}).Get(origin.URL)
+		if err != nil {
+			t.Fatalf("unexpected error through %s proxy: %s", proxyScheme, err)
+		}
+		defer resp.Body.Close()
+		if body, _ := ioutil.ReadAll(resp.Body); string(body) != "ok" {
+			t.Fatalf("unexpected body %s", body)
+		}
+		return <-h.states
+	}
+
+	if state := get("http"); state != nil {
+		t.Fatalf("unexpected TLS state of the plain client %v", state)
+	}
+	state := get("https")
+	if state == nil || state.Version < tls.VersionTLS12 || len(state.PeerCertificates) != 1 ||
+		!state.PeerCertificates[0].Equal(certServer.Certificate()) {
+		t.Fatalf("unexpected TLS state of the client %v", state)
+	}
+
+	// the TLS connection served by the caller
+	p.TLSConfig = nil
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(tls.Server(server, tlsConfig))
+		server.Close()
+	}()
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true,
+		Certificates: certServer.TLS.Certificates})
+	go tlsClient.Write([]byte("GET " + origin.URL + " HTTP/1.1\r\nHost: " + origin.Listener.Addr().String() +
+		"\r\nConnection: close\r\n\r\n"))
+	go ioutil.ReadAll(tlsClient)
+	if state := <-h.states; state == nil || len(state.PeerCertificates) != 1 {
+		t.Fatalf("unexpected TLS state of the connection served %v", state)
+	}
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/haxii/fastproxy/mitm"
+	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/util"
+)
+
+// stateVersion version of the state exported, bumped on the incompatible
+// changes only, the new sections are added without bumping it
+const stateVersion = 1
+
+// sections of the state exported
+const (
+	stateSectionDNS       = "dns"
+	stateSectionMITMCerts = "mitm_certs"
+)
+
+// ErrStateVersion the state imported is of an unsupported version
+var ErrStateVersion = errors.New("unsupported proxy state version")
+
+// proxyState the state exported, the sections unknown are skipped on import
+type proxyState struct {
+	Version  int                        `json:"version"`
+	Sections map[string]json.RawMessage `json:"sections"`
+}
+
+// mitmCertState a MITM leaf certificate exported, DER encoded
+type mitmCertState struct {
+	Domain string   `json:"domain"`
+	Chain  [][]byte `json:"chain"`
+	Key    []byte   `json:"key"`
+}
+
+// ExportState writes the state of the caches warming up slowly into w, so
+// that the proxy restarted starts warm by ImportState, i.e. the DNS cache of
+// the MemoryGuard, transport.DefaultDNSCache by default, and the MITM leaf
+// certificates if ExportSecrets. The state is versioned JSON.
+func (p *Proxy) ExportState(w io.Writer) error {
+	state := proxyState{Version: stateVersion, Sections: make(map[string]json.RawMessage)}
+	dns, err := json.Marshal(p.dnsCache().Entries())
+	if err != nil {
+		return err
+	}
+	state.Sections[stateSectionDNS] = dns
+
+	if p.ExportSecrets {
+		var certs []mitmCertState
+		for domain, cert := range mitm.LeafCerts() {
+			key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+			if err != nil {
+				continue
+			}
+			certs = append(certs, mitmCertState{Domain: domain, Chain: cert.Certificate, Key: key})
+		}
+		sort.Slice(certs, func(i, j int) bool { return certs[i].Domain < certs[j].Domain })
+		if state.Sections[stateSectionMITMCerts], err = json.Marshal(certs); err != nil {
+			return err
+		}
+	}
+	return json.NewEncoder(w).Encode(&state)
+}
+
+// ImportState restores the state exported by ExportState from r, the
+// entries expired and the MITM certificates not signed by MITMCertAuthority
+// for their domains or not matching their keys are skipped, so are the
+// sections unknown, e.g. the ones exported by the newer versions.
+// ErrStateVersion is returned if the state is incompatible.
+func (p *Proxy) ImportState(r io.Reader) error {
+	var state proxyState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return util.ErrWrapper(err, "fail to decode the proxy state")
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("%w %d", ErrStateVersion, state.Version)
+	}
+
+	if raw, ok := state.Sections[stateSectionDNS]; ok {
+		var entries []transport.DNSCacheEntry
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return util.ErrWrapper(err, "fail to decode the DNS cache state")
+		}
+		p.dnsCache().Restore(entries)
+	}
+
+	if raw, ok := state.Sections[stateSectionMITMCerts]; ok {
+		var certs []mitmCertState
+		if err := json.Unmarshal(raw, &certs); err != nil {
+			return util.ErrWrapper(err, "fail to decode the MITM certificates state")
+		}
+		ca, err := p.mitmCertAuthorityLeaf()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, c := range certs {
+			if cert := importLeafCert(c, ca, now); cert != nil {
+				mitm.StoreLeafCert(c.Domain, cert)
+			}
+		}
+	}
+	return nil
+}
+
+// importLeafCert the certificate of c signed by ca for its domain and valid
+// at now, whose key is the one of the certificate, nil if not
+func importLeafCert(c mitmCertState, ca *x509.Certificate, now time.Time) *tls.Certificate {
+	if len(c.Domain) == 0 || len(c.Chain) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(c.Chain[0])
+	if err != nil || now.After(leaf.NotAfter) || leaf.CheckSignatureFrom(ca) != nil ||
+		leaf.VerifyHostname(c.Domain) != nil {
+		return nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(c.Key)
+	if err != nil {
+		return nil
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil
+	}
+	public, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil
+	}
+	leafPublic, err := x509.MarshalPKIXPublicKey(leaf.PublicKey)
+	if err != nil || !bytes.Equal(public, leafPublic) {
+		return nil
+	}
+	return &tls.Certificate{Certificate: c.Chain, PrivateKey: key, Leaf: leaf}
+}
+
+// mitmCertAuthorityLeaf the certificate of the MITMCertAuthority,
+// the default one if not set
+func (p *Proxy) mitmCertAuthorityLeaf() (*x509.Certificate, error) {
+	if ca := p.MITMCertAuthority; ca != nil {
+		if ca.Leaf != nil {
+			return ca.Leaf, nil
+		}
+		return x509.ParseCertificate(ca.Certificate[0])
+	}
+	block, _ := pem.Decode(mitm.DefaultMITMCertAuthorityPEM())
+	if block == nil {
+		return nil, errors.New("invalid default MITM certificate authority")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// dnsCache the DNS cache of the MemoryGuard, transport.DefaultDNSCache by default
+func (p *Proxy) dnsCache() *transport.DNSCache {
+	if p.MemoryGuard != nil {
+		return p.MemoryGuard.dnsCache()
+	}
+	return transport.DefaultDNSCache
+}
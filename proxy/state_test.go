@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/mitm"
+	"github.com/haxii/fastproxy/transport"
+)
+
+func TestStateExportImport(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("warm"))
+	}))
+	defer origin.Close()
+	newProxy := func() *Proxy {
+		return newTestProxy(t)
+	}
+	export := func(p *Proxy) proxyState {
+		var b bytes.Buffer
+		if err := p.ExportState(&b); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var state proxyState
+		if err := json.Unmarshal(b.Bytes(), &state); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return state
+	}
+	importState := func(p *Proxy, state proxyState) error {
+		b, _ := json.Marshal(&state)
+		return p.ImportState(bytes.NewReader(b))
+	}
+
+	// the host name never resolved is dialed by the DNS cache restored
+	host := "warm-restart.invalid"
+	transport.DefaultDNSCache.Put(host, []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, time.Minute)
+	state := export(newProxy())
+	transport.DefaultDNSCache.Flush()
+	// the sections unknown are skipped
+	state.Sections["future"] = json.RawMessage(`{"unknown":true}`)
+	p := newProxy()
+	if err := importState(p, state); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	port := origin.Listener.Addr().(*net.TCPAddr).Port
+	if resp, body := proxyTestRequest(t, p, "GET", "http://"+host+":"+strconv.Itoa(port)+"/", "", ""); resp.StatusCode != 200 || body != "warm" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	state.Version = stateVersion + 1
+	if err := importState(newProxy(), state); !errors.Is(err, ErrStateVersion) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the MITM certificates are exported with the flag only
+	signed, err := mitm.SignLeafCertUsingCertAuthority(nil, "state.test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := export(newProxy()).Sections[stateSectionMITMCerts]; ok {
+		t.Fatal("unexpected secrets exported")
+	}
+	p = newProxy()
+	p.ExportSecrets = true
+	state = export(p)
+	var certs []mitmCertState
+	json.Unmarshal(state.Sections[stateSectionMITMCerts], &certs)
+	var chain [][]byte
+	for _, c := range certs {
+		if c.Domain == "state.test" {
+			chain = c.Chain
+		}
+	}
+	signedKey, _ := x509.MarshalPKCS8PrivateKey(signed.PrivateKey)
+	// the one cached is replaced by the certificate restored
+	cached, err := mitm.SignLeafCertUsingCertAuthority(nil, "cached.state.test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	restore := func(p *Proxy, domain string, key []byte) *tls.Certificate {
+		mitm.StoreLeafCert(domain, cached)
+		state.Sections[stateSectionMITMCerts], _ = json.Marshal([]mitmCertState{
+			{Domain: domain, Chain: chain, Key: key}})
+		if err := importState(p, state); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return mitm.LeafCerts()[domain]
+	}
+	if cert := restore(newProxy(), "state.test", signedKey); !bytes.Equal(cert.Certificate[0], signed.Certificate[0]) {
+		t.Fatal("expected the certificate restored")
+	}
+	// the ones of another domain or key are skipped
+	if cert := restore(newProxy(), "restored.state.test", signedKey); cert != cached {
+		t.Fatal("unexpected certificate of another domain restored")
+	}
+	cachedKey, _ := x509.MarshalPKCS8PrivateKey(cached.PrivateKey)
+	if cert := restore(newProxy(), "state.test", cachedKey); cert != cached {
+		t.Fatal("unexpected certificate of another key restored")
+	}
+	// the ones not signed by the authority are skipped
+	certPEM, keyPEM, _ := mitm.MakeMITMCertAuthority("", 0)
+	ca, _ := tls.X509KeyPair(certPEM, keyPEM)
+	p = newProxy()
+	p.MITMCertAuthority = &ca
+	if cert := restore(p, "state.test", signedKey); cert != cached {
+		t.Fatal("unexpected certificate of another authority restored")
+	}
+}
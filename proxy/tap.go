@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// DefaultTapBufferSize size of the buffer of each async body tap
+const DefaultTapBufferSize = 64 * 1024
+
+// TapOverflow what the async body tap does with the bytes its full buffer
+// can't take
+type TapOverflow int
+
+const (
+	// TapOverflowDrop drops the bytes, the writer implementing TruncatedTap
+	// is told how many before it's closed
+	TapOverflowDrop TapOverflow = iota
+	// TapOverflowBlock blocks the relay until the writer drains the buffer
+	TapOverflowBlock
+)
+
+// TapOptions options of the async body taps
+type TapOptions struct {
+	// BufferSize bytes buffered for each body,
+	// DefaultTapBufferSize is used if not set
+	BufferSize int
+	// Overflow what's done once the buffer is full
+	Overflow TapOverflow
+}
+
+// AsyncTapHijacker optional interface of Hijacker writing the bodies into
+// the writers returned by OnRequest and OnResponse asynchronously, so that a
+// slow writer, e.g. shipping the bytes to a remote sink, doesn't slow down
+// the relay.
+//
+// The body is buffered and drained into the writer by a goroutine, which
+// closes the writer once the body ends and the buffer is drained, i.e.
+// possibly after AfterResponse. The writers are written inline otherwise,
+// which is exact but as slow as the writer.
+type AsyncTapHijacker interface {
+	// TapOptions called before OnRequest and OnResponse, returns the options
+	// of the async taps, nil to write the bodies inline
+	TapOptions() *TapOptions
+}
+
+// TruncatedTap optional interface of the body writer of an async tap,
+// told the bytes dropped by TapOverflowDrop
+type TruncatedTap interface {
+	// OnTapTruncated called before the writer is closed if any bytes of
+	// the body were dropped
+	OnTapTruncated(dropped int64)
+}
+
+// TapBytesDropped number of the body bytes dropped by the async taps so far
+func (p *Proxy) TapBytesDropped() uint64 {
+	return atomic.LoadUint64(&p.tapDropped)
+}
+
+// tapBufferPool pool of the buffers of asyncTaps
+var tapBufferPool sync.Pool
+
+// asyncTap writes into w asynchronously if the hijacker asks for it, the
+// bytes dropped are added to the optional dropped
+func asyncTap(h Hijacker, w io.WriteCloser, dropped *uint64) io.WriteCloser {
+	th, ok := h.(AsyncTapHijacker)
+	if !ok || w == nil {
+		return w
+	}
+	opts := th.TapOptions()
+	if opts == nil {
+		return w
+	}
+	size := opts.BufferSize
+	if size <= 0 {
+		size = DefaultTapBufferSize
+	}
+	t := &tapWriter{w: w, block: opts.Overflow == TapOverflowBlock, counter: dropped}
+	if v := tapBufferPool.Get(); v != nil {
+		t.bufPtr = v.(*[]byte)
+	} else {
+		t.bufPtr = new([]byte)
+	}
+	if cap(*t.bufPtr) < size {
+		*t.bufPtr = make([]byte, size)
+	}
+	t.buf = (*t.bufPtr)[:size]
+	t.cond.L = &t.mu
+	go t.drain()
+	return t
+}
+
+// tapWriter ring buffer drained into w by a goroutine
+type tapWriter struct {
+	w       io.WriteCloser
+	block   bool
+	counter *uint64
+
+	mu   sync.Mutex
+	cond sync.Cond
+	// buf the ring buffer of n bytes from head, bufPtr its pooled slice
+	buf    []byte
+	bufPtr *[]byte
+	head   int
+	n      int
+	// closed once the body ends, failed once w fails, the rest is dropped
+	closed  bool
+	failed  bool
+	dropped int64
+	trailer *http.Header
+}
+
+func (t *tapWriter) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	written := len(b)
+	for len(b) > 0 && !t.failed {
+		free := len(t.buf) - t.n
+		if free == 0 {
+			if !t.block {
+				break
+			}
+			t.cond.Wait()
+			continue
+		}
+		tail := (t.head + t.n) % len(t.buf)
+		end := len(t.buf)
+		if tail < t.head {
+			end = t.head
+		}
+		c := copy(t.buf[tail:end], b)
+		t.n += c
+		b = b[c:]
+		t.cond.Broadcast()
+	}
+	if len(b) > 0 {
+		t.dropped += int64(len(b))
+		if t.counter != nil {
+			atomic.AddUint64(t.counter, uint64(len(b)))
+		}
+	}
+	return written, nil
+}
+
+// OnTrailer passes the trailer to w after the body, see TrailerReceiver
+func (t *tapWriter) OnTrailer(trailer http.Header) {
+	t.mu.Lock()
+	t.trailer = &trailer
+	t.mu.Unlock()
+}
+
+// Close ends the body without waiting for w to drain it
+func (t *tapWriter) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+	return nil
+}
+
+// drain writes the bytes buffered into w until the body ends, then closes w
+func (t *tapWriter) drain() {
+	t.mu.Lock()
+	for {
+		for t.n == 0 && !t.closed {
+			t.cond.Wait()
+		}
+		if t.n == 0 {
+			break
+		}
+		// the bytes being written are not overwritten until they're freed
+		end := t.head + t.n
+		if end > len(t.buf) {
+			end = len(t.buf)
+		}
+		chunk := t.buf[t.head:end]
+		t.mu.Unlock()
+		_, err := t.w.Write(chunk)
+		t.mu.Lock()
+		t.head = (t.head + len(chunk)) % len(t.buf)
+		t.n -= len(chunk)
+		t.cond.Broadcast()
+		if err != nil {
+			// drop the rest rather than blocking the relay forever
+			t.failed = true
+			t.dropped += int64(t.n)
+			if t.counter != nil {
+				atomic.AddUint64(t.counter, uint64(t.n))
+			}
+			t.head, t.n = 0, 0
+		}
+	}
+	dropped, trailer := t.dropped, t.trailer
+	t.buf = nil
+	t.mu.Unlock()
+	tapBufferPool.Put(t.bufPtr)
+
+	if tr, ok := t.w.(TrailerReceiver); ok && trailer != nil {
+		tr.OnTrailer(*trailer)
+	}
+	if tt, ok := t.w.(TruncatedTap); ok && dropped > 0 {
+		tt.OnTapTruncated(dropped)
+	}
+	t.w.Close()
+}
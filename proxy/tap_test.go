@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// blockedTap tap writer blocked until released
+type blockedTap struct {
+	release chan struct{}
+	closed  chan struct{}
+	n       int64
+	dropped int64
+}
+
+func (w *blockedTap) Write(b []byte) (int, error) {
+	<-w.release
+	w.n += int64(len(b))
+	return len(b), nil
+}
+func (w *blockedTap) OnTapTruncated(dropped int64) { w.dropped = dropped }
+func (w *blockedTap) Close() error                 { close(w.closed); return nil }
+
+type asyncTapHijacker struct {
+	tlsTestHijacker
+	opts *TapOptions
+	tap  *blockedTap
+}
+
+func (h *asyncTapHijacker) TapOptions() *TapOptions { return h.opts }
+func (h *asyncTapHijacker) OnResponse(http.ResponseLine, http.Header, []byte) io.WriteCloser {
+	return h.tap
+}
+
+type asyncTapHijackerPool struct{ h *asyncTapHijacker }
+
+func (p asyncTapHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p asyncTapHijackerPool) Put(Hijacker) {}
+
+func TestAsyncTap(t *testing.T) {
+	const size = 1 << 20
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write(bytes.Repeat([]byte("x"), size))
+	}))
+	defer origin.Close()
+
+	relay := func(opts *TapOptions) (*Proxy, *blockedTap) {
+		tap := &blockedTap{release: make(chan struct{}), closed: make(chan struct{})}
+		p := newTestProxy(t, func(p *Proxy) {
+			p.HijackerPool = asyncTapHijackerPool{&asyncTapHijacker{opts: opts, tap: tap}}
+		})
+		// the relay completes while the tap is blocked
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if resp, body := proxyTestRequest(t, p, "GET", origin.URL+"/", "", ""); resp.StatusCode != 200 ||
+				len(body) != size {
+				t.Errorf("unexpected response %d of %d bytes", resp.StatusCode, len(body))
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay blocked by the tap")
+		}
+		close(tap.release)
+		select {
+		case <-tap.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("tap not closed")
+		}
+		return p, tap
+	}
+
+	// the bytes the buffer can't take are dropped
+	p, tap := relay(&TapOptions{BufferSize: 4096})
+	if tap.dropped == 0 || tap.n+tap.dropped != size || tap.n > 4096 {
+		t.Fatalf("unexpected %d bytes tapped, %d dropped", tap.n, tap.dropped)
+	}
+	if p.TapBytesDropped() != uint64(tap.dropped) {
+		t.Fatalf("unexpected %d bytes dropped counted", p.TapBytesDropped())
+	}
+
+	// nothing dropped by the buffer large enough
+	p, tap = relay(&TapOptions{BufferSize: 2 * size, Overflow: TapOverflowBlock})
+	if tap.n != size || tap.dropped != 0 || p.TapBytesDropped() != 0 {
+		t.Fatalf("unexpected %d bytes tapped, %d dropped", tap.n, tap.dropped)
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// targetHijacker records the request targets and paths it observes
+type targetHijacker struct {
+	tlsTestHijacker
+	targets, paths []string
+}
+
+func (h *targetHijacker) SSLBump() bool { return false }
+
+func (h *targetHijacker) OnRequestTarget(target []byte) {
+	h.targets = append(h.targets, string(target))
+}
+
+func (h *targetHijacker) OnRequest(path []byte, header http.Header, rawHeader []byte) io.WriteCloser {
+	h.paths = append(h.paths, string(path))
+	return nil
+}
+
+type targetHijackerPool struct{ h *targetHijacker }
+
+func (p targetHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p targetHijackerPool) Put(Hijacker) {}
+
+func TestSanitizeRequestTarget(t *testing.T) {
+	var received []string
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		received = append(received, r.Host+" "+r.RequestURI)
+	}))
+	defer origin.Close()
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	h := &targetHijacker{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = targetHijackerPool{h}
+	})
+	for _, target := range []string{
+		"http://" + host + "/a?b=c#frag",
+		"http://user:pass@" + host + "/a?b=c",
+	} {
+		if resp, _ := proxyTestRequest(t, p, "GET", target, "", ""); resp.StatusCode != 200 {
+			t.Fatalf("unexpected status %d of %s", resp.StatusCode, target)
+		}
+	}
+
+	// the origin gets neither fragment nor userinfo
+	if len(received) != 2 || received[0] != host+" /a?b=c" || received[1] != host+" /a?b=c" {
+		t.Fatalf("unexpected targets received %q", received)
+	}
+	// the hijacker observes the original ones
+	if len(h.targets) != 2 || h.targets[0] != "http://"+host+"/a?b=c#frag" ||
+		h.targets[1] != "http://user:pass@"+host+"/a?b=c" {
+		t.Fatalf("unexpected targets observed %q", h.targets)
+	}
+	if len(h.paths) != 2 || h.paths[0] != "/a?b=c#frag" || h.paths[1] != "/a?b=c" {
+		t.Fatalf("unexpected paths observed %q", h.paths)
+	}
+
+	// userinfo rejected
+	p.RejectUserInfo = true
+	if resp, _ := proxyTestRequest(t, p, "GET", "http://user:pass@"+host+"/", "", ""); resp.StatusCode != 400 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	err := serveRawRequest(p, "GET http://user:pass@"+host+"/ HTTP/1.1\r\n\r\n")
+	if !errors.Is(err, ErrClientMalformedRequest) || len(received) != 2 {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
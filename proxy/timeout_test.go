@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+// routeTimeoutHijacker routes the requests with its response timeouts
+type routeTimeoutHijacker struct {
+	tlsTestHijacker
+	route Route
+}
+
+func (h *routeTimeoutHijacker) Route() Route { return h.route }
+
+type routeTimeoutHijackerPool struct{ h *routeTimeoutHijacker }
+
+func (p routeTimeoutHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p routeTimeoutHijackerPool) Put(Hijacker) {}
+
+func TestResponseTimeouts(t *testing.T) {
+	ln := listenLocal(t, func(c net.Conn) {
+		defer c.Close()
+		req, err := nethttp.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		switch req.URL.Path {
+		case "/stalled-header":
+			time.Sleep(5 * time.Second)
+		case "/slow-body":
+			c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\n"))
+			for _, b := range []byte("abc") {
+				time.Sleep(time.Second)
+				c.Write([]byte{b})
+			}
+		case "/stalled-body":
+			c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\na"))
+			time.Sleep(5 * time.Second)
+		}
+	})
+	defer ln.Close()
+	url := "http://" + ln.Addr().String()
+	newProxy := func() *Proxy {
+		p := newTestProxy(t)
+		p.client.ResponseHeaderTimeout = 200 * time.Millisecond
+		p.client.BodyInactivityTimeout = 1500 * time.Millisecond
+		return p
+	}
+	expect := func(name string, err, kind error) {
+		if !errors.Is(err, kind) || !errors.Is(err, ErrUpstreamTimeout) {
+			t.Fatalf("%s: expected %v, got %v", name, kind, err)
+		}
+	}
+
+	// the header never comes
+	resp, body := proxyTestRequest(t, newProxy(), "GET", url+"/stalled-header", "", "")
+	if resp.StatusCode != nethttp.StatusGatewayTimeout || body != "Upstream response header timeout.\n" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	expect("header", serveRawRequest(newProxy(), "GET "+url+"/stalled-header HTTP/1.1\r\n\r\n"),
+		ErrUpstreamHeaderTimeout)
+
+	// a byte every second keeps the body alive
+	resp, body = proxyTestRequest(t, newProxy(), "GET", url+"/slow-body", "", "")
+	if resp.StatusCode != nethttp.StatusOK || body != "abc" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+
+	// the body stalls
+	start := time.Now()
+	expect("body", serveRawRequest(newProxy(), "GET "+url+"/stalled-body HTTP/1.1\r\n\r\n"),
+		ErrUpstreamBodyTimeout)
+	if d := time.Since(start); d < 1500*time.Millisecond || d > 3*time.Second {
+		t.Fatalf("body timed out after %s", d)
+	}
+
+	// the route shortens the inactivity timeout
+	p := newProxy()
+	p.HijackerPool = routeTimeoutHijackerPool{&routeTimeoutHijacker{
+		route: Route{BodyInactivityTimeout: 100 * time.Millisecond}}}
+	expect("route", serveRawRequest(p, "GET "+url+"/slow-body HTTP/1.1\r\n\r\n"),
+		ErrUpstreamBodyTimeout)
+}
+
+func TestSuperProxyHandshakeTimeout(t *testing.T) {
+	// a super proxy accepting the connections but never answering
+	sp := listenLocal(t, func(c net.Conn) {
+		io.Copy(ioutil.Discard, c)
+		c.Close()
+	})
+	defer sp.Close()
+	port := uint16(sp.Addr().(*net.TCPAddr).Port)
+	newProxy := func(proxyType superproxy.ProxyType) *Proxy {
+		p := newTestProxy(t, func(p *Proxy) {
+			p.SuperProxyHandshakeTimeout = 200 * time.Millisecond
+		})
+		p.client.SuperProxyHandshakeTimeout = p.SuperProxyHandshakeTimeout
+		p.SuperProxy, _ = superproxy.NewSuperProxy("127.0.0.1", port, proxyType, "", "", "")
+		return p
+	}
+	expect := func(name string, p *Proxy, raw string) {
+		client, server := net.Pipe()
+		defer client.Close()
+		errChan := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			errChan <- p.serveConn(server)
+			server.Close()
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		go client.Write([]byte(raw))
+		resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil || resp.StatusCode != nethttp.StatusGatewayTimeout {
+			t.Fatalf("%s: unexpected response %v %v", name, resp, err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Fatalf("%s: timed out after %s", name, d)
+		}
+		go io.Copy(ioutil.Discard, client)
+		if err := <-errChan; !superProxyTimedOut(err) {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+	}
+
+	expect("tunnel", newProxy(superproxy.ProxyTypeHTTP), "CONNECT www.example.com:443 HTTP/1.1\r\n\r\n")
+	expect("socks5", newProxy(superproxy.ProxyTypeSOCKS5),
+		"GET http://www.example.com/ HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+)
+
+// TLSInfo summary of a negotiated TLS connection
+type TLSInfo struct {
+	// Version TLS version, e.g. tls.VersionTLS12
+	Version uint16
+	// CipherSuite cipher suite, e.g. tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	CipherSuite uint16
+	// NegotiatedProtocol protocol negotiated with ALPN
+	NegotiatedProtocol string
+	// ServerName server name indication sent by the client
+	ServerName string
+	// LeafCertSHA256 SHA256 fingerprint of the peer's leaf certificate,
+	// zero if the peer presents none, e.g. most clients
+	LeafCertSHA256 [sha256.Size]byte
+	// CertChainSHA256 SHA256 fingerprints of the peer's certificate chain, leaf first
+	CertChainSHA256 [][sha256.Size]byte
+	// Profile name of the TLS profile the origin-facing handshake is made
+	// with, see Proxy.TLSProfileForHost, empty if none
+	Profile string
+}
+
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:            state.Version,
+		CipherSuite:        state.CipherSuite,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		ServerName:         state.ServerName,
+	}
+	if len(state.PeerCertificates) > 0 {
+		info.CertChainSHA256 = make([][sha256.Size]byte, len(state.PeerCertificates))
+		for i, cert := range state.PeerCertificates {
+			info.CertChainSHA256[i] = sha256.Sum256(cert.Raw)
+		}
+		info.LeafCertSHA256 = info.CertChainSHA256[0]
+	}
+	return info
+}
+
+// TLSHijacker optional interface of Hijacker asking for the TLS details of
+// the decrypted sessions, which are collected only for the hijackers
+// implementing it
+type TLSHijacker interface {
+	// OnTLS called before AfterResponse of every decrypted request with the
+	// client-facing and origin-facing TLS details, originTLS is nil if the
+	// request doesn't reach the origin, e.g. blocked or hijacked responses,
+	// or the connection made by DialTLS is not a *tls.Conn.
+	//
+	// It's not called for the tunnels which are not decrypted.
+	OnTLS(clientTLS, originTLS *TLSInfo)
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+// tlsTestHijacker decrypts every tunnel and records the TLS details
+type tlsTestHijacker struct {
+	host, port           string
+	clientTLS, originTLS *TLSInfo
+}
+
+func (h *tlsTestHijacker) RewriteHost() (string, string)                        { return h.host, h.port }
+func (h *tlsTestHijacker) OnConnect(http.Header, []byte) bool                   { return true }
+func (h *tlsTestHijacker) SSLBump() bool                                        { return true }
+func (h *tlsTestHijacker) RewriteTLSServerName(serverName string) string        { return serverName }
+func (h *tlsTestHijacker) Resolve() net.IP                                      { return nil }
+func (h *tlsTestHijacker) SuperProxy() *superproxy.SuperProxy                   { return nil }
+func (h *tlsTestHijacker) Block() bool                                          { return false }
+func (h *tlsTestHijacker) HijackResponse() io.ReadCloser                        { return nil }
+func (h *tlsTestHijacker) Dial() func(addr string) (net.Conn, error)            { return nil }
+func (h *tlsTestHijacker) OnRequest([]byte, http.Header, []byte) io.WriteCloser { return nil }
+func (h *tlsTestHijacker) AfterResponse(error)                                  {}
+func (h *tlsTestHijacker) BeforeRequest(method, path []byte, header http.Header,
+	rawHeader []byte) ([]byte, []byte) {
+	return path, rawHeader
+}
+func (h *tlsTestHijacker) DialTLS() func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	return func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+		return tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	}
+}
+func (h *tlsTestHijacker) OnResponse(http.ResponseLine, http.Header, []byte) io.WriteCloser {
+	return nil
+}
+func (h *tlsTestHijacker) OnTLS(clientTLS, originTLS *TLSInfo) {
+	h.clientTLS, h.originTLS = clientTLS, originTLS
+}
+
+type tlsTestHijackerPool struct{ h *tlsTestHijacker }
+
+func (p *tlsTestHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p *tlsTestHijackerPool) Put(Hijacker) {}
+
+func TestTLSHijackerInfo(t *testing.T) {
+	origin := httptest.NewTLSServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	hijacker := &tlsTestHijacker{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = &tlsTestHijackerPool{hijacker}
+	})
+	if body := decryptedGet(t, p, origin.Listener.Addr().String(), "example.com"); body != "ok" {
+		t.Fatalf("unexpected body %s", body)
+	}
+
+	if c := hijacker.clientTLS; c == nil || c.Version != tls.VersionTLS12 ||
+		c.ServerName != "example.com" || len(c.CertChainSHA256) != 0 {
+		t.Fatalf("unexpected client TLS info %+v", c)
+	}
+	leaf := sha256.Sum256(origin.Certificate().Raw)
+	if o := hijacker.originTLS; o == nil || o.Version == 0 || o.CipherSuite == 0 ||
+		o.LeafCertSHA256 != leaf {
+		t.Fatalf("unexpected origin TLS info %+v", o)
+	}
+}
+
+// decryptedGet makes a GET request decrypted by p through the tunnel to
+// connectHost, sending serverName in the TLS handshake, returns the body
+func decryptedGet(t *testing.T, p *Proxy, connectHost, serverName string) string {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+
+	go client.Write([]byte("CONNECT " + connectHost + " HTTP/1.1\r\n\r\n"))
+	br := bufio.NewReader(client)
+	resp, err := nethttp.ReadResponse(br, &nethttp.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("unexpected tunnel response %v %v", resp, err)
+	}
+	tlsClient := tls.Client(&bufferedConn{client, br}, &tls.Config{
+		InsecureSkipVerify: true, ServerName: serverName, MaxVersion: tls.VersionTLS12})
+	go tlsClient.Write([]byte("GET / HTTP/1.1\r\nHost: " + serverName + "\r\nConnection: close\r\n\r\n"))
+	resp, err = nethttp.ReadResponse(bufio.NewReader(tlsClient), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body)
+}
+
+// bufferedConn reads from the buffered reader of the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
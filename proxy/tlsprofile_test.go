@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/haxii/fastproxy/client"
+)
+
+// profileTestHijacker dials the origin with the TLS config given
+type profileTestHijacker struct{ tlsTestHijacker }
+
+func (h *profileTestHijacker) DialTLS() func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	return func(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+		config := tlsConfig.Clone()
+		config.InsecureSkipVerify = true
+		return tls.Dial("tcp", addr, config)
+	}
+}
+
+type profileTestHijackerPool struct{ h *profileTestHijacker }
+
+func (p profileTestHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p profileTestHijackerPool) Put(Hijacker) {}
+
+func TestTLSProfileForHost(t *testing.T) {
+	hellos := make(chan *tls.ClientHelloInfo, 4)
+	origin := httptest.NewUnstartedServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	origin.TLS = &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hellos <- hello
+			return nil, nil
+		},
+	}
+	origin.StartTLS()
+	defer origin.Close()
+
+	profile := &client.TLSProfile{
+		Name:             "legacy",
+		CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		CurvePreferences: []tls.CurveID{tls.CurveP256},
+		NextProtos:       []string{"http/1.1"},
+		MaxVersion:       tls.VersionTLS12,
+	}
+	var calls int
+	hijacker := &profileTestHijacker{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = profileTestHijackerPool{hijacker}
+	})
+	p.client.TLSProfileForHost = func(host string) *client.TLSProfile {
+		calls++
+		if host == "profiled.example.com" {
+			return profile
+		}
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if body := decryptedGet(t, p, origin.Listener.Addr().String(), "profiled.example.com"); body != "ok" {
+			t.Fatalf("unexpected body %s", body)
+		}
+		hello := <-hellos
+		// crypto/tls orders the cipher suites offered itself
+		suites := append([]uint16(nil), hello.CipherSuites...)
+		sort.Slice(suites, func(i, j int) bool { return suites[i] < suites[j] })
+		if !reflect.DeepEqual(suites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}) ||
+			!reflect.DeepEqual(hello.SupportedCurves, profile.CurvePreferences) ||
+			!reflect.DeepEqual(hello.SupportedProtos, profile.NextProtos) ||
+			!reflect.DeepEqual(hello.SupportedVersions, []uint16{tls.VersionTLS12}) {
+			t.Fatalf("unexpected client hello %v %v %v %v", hello.CipherSuites,
+				hello.SupportedCurves, hello.SupportedProtos, hello.SupportedVersions)
+		}
+		if o := hijacker.originTLS; o == nil || o.Profile != "legacy" || o.NegotiatedProtocol != "http/1.1" ||
+			o.Version != tls.VersionTLS12 || (o.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 &&
+			o.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384) {
+			t.Fatalf("unexpected origin TLS info %+v", o)
+		}
+	}
+
+	// the other hosts get the default ClientHello
+	if body := decryptedGet(t, p, origin.Listener.Addr().String(), "other.example.com"); body != "ok" {
+		t.Fatalf("unexpected body %s", body)
+	}
+	if hello := <-hellos; len(hello.SupportedProtos) != 0 || hijacker.originTLS.Profile != "" {
+		t.Fatalf("unexpected client hello %v, origin TLS info %+v", hello.SupportedProtos, hijacker.originTLS)
+	}
+	// the profile is made once for each host
+	if calls != 2 {
+		t.Fatalf("unexpected %d profile calls", calls)
+	}
+}
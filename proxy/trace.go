@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/servertime"
+)
+
+// TracePolicy how the TRACE requests are handled, which echo the requests
+// back and are abused for cross-site tracing
+type TracePolicy int
+
+const (
+	// TraceReject rejects the TRACE requests with 405
+	TraceReject TracePolicy = iota
+	// TracePassThrough forwards the TRACE requests with their Max-Forwards
+	// decremented, the ones with Max-Forwards of 0 are answered locally
+	// like TraceEcho, as required by RFC 7231 5.1.2
+	TracePassThrough
+	// TraceEcho answers the TRACE requests locally with the requests
+	// received, the credentials stripped
+	TraceEcho
+)
+
+var (
+	methodTrace = []byte("TRACE")
+	// traceSensitiveFields the header fields never echoed
+	traceSensitiveFields = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+	traceRejectedBody    = "TRACE is not allowed by the proxy.\n"
+)
+
+// handle the TRACE req in policy, answer the raw response of the ones
+// answered locally, nil if forwarded
+func (policy TracePolicy) handle(req *Request) (answer []byte) {
+	if !bytes.Equal(req.Method(), methodTrace) {
+		return nil
+	}
+	switch policy {
+	case TracePassThrough:
+		maxForwards := req.header.Peek("Max-Forwards")
+		n, err := strconv.Atoi(string(maxForwards))
+		if err != nil || n < 0 {
+			// forwarded as is if missing or invalid
+			return nil
+		}
+		if n > 0 {
+			if err := req.header.Set("Max-Forwards", strconv.Itoa(n-1)); err != nil {
+				return traceRejected()
+			}
+			req.rawHeader = req.header.Raw()
+			return nil
+		}
+		return traceEcho(req)
+	case TraceEcho:
+		return traceEcho(req)
+	}
+	return traceRejected()
+}
+
+// traceRejected the raw response rejecting the TRACE request
+func traceRejected() []byte {
+	return []byte(fmt.Sprintf("%sDate: %s\r\n"+
+		"Allow: GET, HEAD, POST, PUT, DELETE, OPTIONS, PATCH\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: %d\r\n"+
+		"\r\n%s",
+		http.StatusLine(http.StatusMethodNotAllowed), servertime.ServerDate(),
+		len(traceRejectedBody), traceRejectedBody))
+}
+
+// traceEcho the raw response echoing req, the sensitive fields stripped
+func traceEcho(req *Request) []byte {
+	var echo bytes.Buffer
+	echo.Write(req.reqLine.GetRequestLine())
+	var header http.Header
+	if _, err := header.Parse(append([]byte(nil), req.rawHeader...)); err != nil {
+		return traceRejected()
+	}
+	for _, key := range traceSensitiveFields {
+		if header.Peek(key) != nil {
+			// never echo the fields failed to strip
+			if err := header.Del(key); err != nil {
+				return traceRejected()
+			}
+		}
+	}
+	echo.Write(header.Raw())
+
+	var b bytes.Buffer
+	b.Write(http.StatusLine(http.StatusOK))
+	fmt.Fprintf(&b, "Date: %s\r\n", servertime.ServerDate())
+	b.WriteString("Content-Type: message/http\r\n")
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", echo.Len())
+	echo.WriteTo(&b)
+	return b.Bytes()
+}
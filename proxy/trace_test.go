@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTracePolicy(t *testing.T) {
+	var hits int32
+	var maxForwards atomic.Value
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		atomic.AddInt32(&hits, 1)
+		maxForwards.Store(r.Header.Get("Max-Forwards"))
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	p := newTestProxy(t)
+	header := "Cookie: session=secret\r\nAuthorization: Basic c2VjcmV0\r\nX-Echo: 1\r\n"
+
+	// rejected by default
+	resp, body := proxyTestRequest(t, p, "TRACE", origin.URL+"/", header, "")
+	if resp.StatusCode != 405 || len(resp.Header.Get("Allow")) == 0 || hits != 0 {
+		t.Fatalf("unexpected response %d %q after %d upstream requests", resp.StatusCode, body, hits)
+	}
+	if resp, _ = proxyTestRequest(t, p, "GET", origin.URL+"/", header, ""); resp.StatusCode != 200 || hits != 1 {
+		t.Fatalf("unexpected response %d after %d upstream requests", resp.StatusCode, hits)
+	}
+
+	// echoed locally without the credentials
+	p.Trace = TraceEcho
+	resp, body = proxyTestRequest(t, p, "TRACE", origin.URL+"/echo", header, "")
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "message/http" || hits != 1 {
+		t.Fatalf("unexpected response %d after %d upstream requests", resp.StatusCode, hits)
+	}
+	if !strings.HasPrefix(body, "TRACE "+origin.URL+"/echo HTTP/1.1\r\n") ||
+		!strings.Contains(body, "X-Echo: 1\r\n") || strings.Contains(body, "secret") ||
+		strings.Contains(body, "c2VjcmV0") {
+		t.Fatalf("unexpected echo %q", body)
+	}
+
+	// forwarded with Max-Forwards decremented, answered locally at 0
+	p.Trace = TracePassThrough
+	if resp, body = proxyTestRequest(t, p, "TRACE", origin.URL+"/", "Max-Forwards: 2\r\n", ""); resp.StatusCode != 200 ||
+		body != "origin" || hits != 2 || maxForwards.Load() != "1" {
+		t.Fatalf("unexpected response %d %q with Max-Forwards %v", resp.StatusCode, body, maxForwards.Load())
+	}
+	if resp, body = proxyTestRequest(t, p, "TRACE", origin.URL+"/", "Max-Forwards: 0\r\n", ""); resp.StatusCode != 200 ||
+		!strings.HasPrefix(body, "TRACE ") || hits != 2 {
+		t.Fatalf("unexpected response %d %q after %d upstream requests", resp.StatusCode, body, hits)
+	}
+	if resp, body = proxyTestRequest(t, p, "TRACE", origin.URL+"/", "", ""); body != "origin" ||
+		hits != 3 || maxForwards.Load() != "" {
+		t.Fatalf("unexpected response %d %q with Max-Forwards %v", resp.StatusCode, body, maxForwards.Load())
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// TrailerReceiver optional interface of the request body writer returned by
+// Hijacker.OnRequest, receiving the trailer fields of the chunked body
+type TrailerReceiver interface {
+	// OnTrailer called once the chunked body ends, before the writer is
+	// closed, with the trailer fields forwarded, which may be none
+	OnTrailer(trailer http.Header)
+}
+
+// forbiddenTrailers the fields never forwarded in the trailers, which
+// frame, route or control the request, RFC 7230 4.1.2
+var forbiddenTrailers = map[string]bool{"content-length": true, "transfer-encoding": true,
+	"trailer": true, "host": true, "connection": true, "keep-alive": true, "te": true,
+	"proxy-connection": true, "content-type": true, "content-encoding": true,
+	"authorization": true, "proxy-authorization": true, "expect": true}
+
+// trailerFilter keeps the trailer fields of the request body announced in
+// its Trailer header, or all of them if permissive, except the forbidden
+// ones. The fields kept are appended to kept.
+func (r *Request) trailerFilter(permissive bool, kept *[]byte) http.TrailerFilter {
+	var announced []string
+	for _, name := range bytes.Split(r.header.Peek("Trailer"), []byte(",")) {
+		if name = bytes.TrimSpace(name); len(name) > 0 {
+			announced = append(announced, strings.ToLower(string(name)))
+		}
+	}
+	return func(field []byte) bool {
+		i := bytes.IndexByte(field, ':')
+		if i <= 0 {
+			return false
+		}
+		name := strings.ToLower(string(bytes.TrimSpace(field[:i])))
+		if forbiddenTrailers[name] || !permissive && !containsString(announced, name) {
+			return false
+		}
+		*kept = append(*kept, field...)
+		return true
+	}
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
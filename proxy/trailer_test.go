@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// trailerHijacker taps the request trailers
+type trailerHijacker struct {
+	tlsTestHijacker
+	trailer string
+}
+
+func (h *trailerHijacker) OnRequest([]byte, http.Header, []byte) io.WriteCloser {
+	h.trailer = ""
+	return &trailerTap{h: h}
+}
+
+type trailerTap struct{ h *trailerHijacker }
+
+func (t *trailerTap) Write(b []byte) (int, error)   { return len(b), nil }
+func (t *trailerTap) Close() error                  { return nil }
+func (t *trailerTap) OnTrailer(trailer http.Header) { t.h.trailer = string(trailer.Raw()) }
+
+type trailerHijackerPool struct{ h *trailerHijacker }
+
+func (p trailerHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p trailerHijackerPool) Put(Hijacker) {}
+
+func TestRequestTrailers(t *testing.T) {
+	// the origin rejects the uploads without the checksum trailer
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if r.Trailer.Get("X-Checksum") != hex.EncodeToString(sum[:]) {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "ok extra=%s", r.Trailer.Get("X-Extra"))
+	}))
+	defer origin.Close()
+
+	h := &trailerHijacker{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = trailerHijackerPool{h}
+	})
+	sum := sha256.Sum256([]byte("hello world"))
+	checksum := "X-Checksum: " + hex.EncodeToString(sum[:]) + "\r\n"
+	upload := func(trailer string) (int, string) {
+		resp, body := proxyTestRequest(t, p, "POST", origin.URL+"/upload",
+			"Transfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n",
+			"5\r\nhello\r\n6\r\n world\r\n0\r\n"+trailer+"\r\n")
+		return resp.StatusCode, body
+	}
+
+	if status, _ := upload(""); status != 400 {
+		t.Fatalf("expected the upload without checksum rejected, got %d", status)
+	}
+	// the fields not announced are dropped, unless permissive
+	if status, body := upload(checksum + "X-Extra: 1\r\n"); status != 200 || body != "ok extra=" {
+		t.Fatalf("unexpected response %d %q", status, body)
+	}
+	if h.trailer != checksum+"\r\n" {
+		t.Fatalf("unexpected trailer tapped %q", h.trailer)
+	}
+	p.PermissiveTrailers = true
+	if status, body := upload("X-Extra: 1\r\nHost: evil.com\r\n" + checksum); status != 200 || body != "ok extra=1" {
+		t.Fatalf("unexpected response %d %q", status, body)
+	}
+	if h.trailer != "X-Extra: 1\r\n"+checksum+"\r\n" {
+		t.Fatalf("unexpected trailer tapped %q", h.trailer)
+	}
+
+	// tapped by all the chained hijackers through the memory guard
+	h2 := &trailerHijacker{}
+	p.HijackerPool = HijackerChainPool{trailerHijackerPool{h}, trailerHijackerPool{h2}}
+	p.MemoryGuard = &MemoryGuard{Limit: 1 << 30}
+	if status, _ := upload(checksum); status != 200 {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if h.trailer != checksum+"\r\n" || h2.trailer != checksum+"\r\n" {
+		t.Fatalf("unexpected trailers tapped %q %q", h.trailer, h2.trailer)
+	}
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/util"
+)
+
+// BodyTransform streaming transform of a response body relayed to the client
+type BodyTransform struct {
+	// Transform called with each piece of the body in order, then once with
+	// nil after the last one, returns the bytes relayed instead, which may
+	// be the piece itself. The pieces are split anywhere, so the patterns
+	// spanning them must be held back till the next call. The piece is only
+	// valid during the call.
+	Transform func(chunk []byte) []byte
+	// Decode transforms the body decoded from its gzip or deflate
+	// Content-Encoding, which is encoded back afterwards, the bodies of the
+	// other encodings are relayed as is then. The encoded bytes are
+	// transformed if not set.
+	Decode bool
+	// DropEncoding relays the body decoded without its Content-Encoding
+	// instead of encoding it back, implies Decode
+	DropEncoding bool
+}
+
+// ResponseTransformHijacker optional interface of Hijacker transforming the
+// response bodies relayed to the client, e.g. injecting a script into HTML.
+//
+// The body transformed is sent chunked to the HTTP/1.1 clients kept alive,
+// and delimited by closing the connection otherwise, its Content-Length
+// dropped. OnResponse still sees the original body, and the responses
+// transformed are never cached.
+type ResponseTransformHijacker interface {
+	// TransformResponse called once the response header is read, before
+	// OnResponse, returns the transform of the body, nil to relay it as is.
+	// It's not called for the responses without a body.
+	TransformResponse(statusLine http.ResponseLine, header http.Header) *BodyTransform
+}
+
+// bodyTransform the transform of the response body asked by the hijacker
+// with the encoding decoded, nil if the body is relayed as is
+func (r *Response) bodyTransform() (t *BodyTransform, encoding string) {
+	th, ok := r.hijacker.(ResponseTransformHijacker)
+	if !ok {
+		return nil, ""
+	}
+	switch code := r.respLine.GetStatusCode(); {
+	case code < 200, code == http.StatusNoContent, code == http.StatusNotModified:
+		return nil, ""
+	}
+	if t = th.TransformResponse(r.respLine, r.header); t == nil || t.Transform == nil {
+		return nil, ""
+	}
+	encoding = strings.ToLower(strings.TrimSpace(string(r.header.Peek("Content-Encoding"))))
+	switch {
+	case !t.Decode && !t.DropEncoding, len(encoding) == 0, encoding == "identity":
+		return t, ""
+	case encoding == "gzip", encoding == "x-gzip", encoding == "deflate":
+		return t, encoding
+	}
+	return nil, ""
+}
+
+var connectionCloseHeader = []byte("Connection: close\r\n")
+
+// isPerHopOrPayloadLength is the header line a per hop, Transfer-Encoding or
+// Content-Length one, which are replaced for the body transformed
+func isPerHopOrPayloadLength(line []byte) bool {
+	return isPerHopOrTransferEncoding(line) || http.IsContentLengthHeader(line)
+}
+
+// isPerHopOrPayloadFraming same as isPerHopOrPayloadLength, the
+// Content-Encoding one included, which is dropped for the body decoded
+func isPerHopOrPayloadFraming(line []byte) bool {
+	return isPerHopOrPayloadLength(line) || http.IsContentEncodingHeader(line)
+}
+
+// transformWriter transforms the body written into w, the body is decoded
+// from encoding before and encoded back after if any
+type transformWriter struct {
+	w         io.Writer
+	transform func([]byte) []byte
+
+	// pw pipes the encoded body to the goroutine transforming it,
+	// which ends with done
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newTransformWriter(t *BodyTransform, encoding string, w io.Writer) *transformWriter {
+	tw := &transformWriter{w: w, transform: t.Transform}
+	if len(encoding) == 0 {
+		return tw
+	}
+	pr, pw := io.Pipe()
+	tw.pw, tw.done = pw, make(chan error, 1)
+	go func() {
+		// the panic of the transform is passed to close
+		defer func() {
+			if v := recover(); v != nil {
+				pe := recovered(v)
+				pr.CloseWithError(pe)
+				tw.done <- pe
+			}
+		}()
+		err := transformEncoded(encoding, pr, w, t.Transform, t.DropEncoding)
+		if err == nil {
+			// discard the bytes left after the encoded body
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		tw.done <- err
+	}()
+	return tw
+}
+
+// transformEncoded transforms the body read from r in encoding into w,
+// encoded back unless decoded
+func transformEncoded(encoding string, r io.Reader, w io.Writer,
+	transform func([]byte) []byte, decoded bool) error {
+	var (
+		decoder io.ReadCloser
+		encoder io.WriteCloser
+		err     error
+	)
+	if encoding == "deflate" {
+		if decoder, err = zlib.NewReader(r); err != nil {
+			return util.ErrWrapper(err, "fail to decode response body")
+		}
+		encoder = zlib.NewWriter(w)
+	} else {
+		if decoder, err = gzip.NewReader(r); err != nil {
+			return util.ErrWrapper(err, "fail to decode response body")
+		}
+		encoder = gzip.NewWriter(w)
+	}
+	defer decoder.Close()
+	if decoded {
+		encoder = identityEncoder{w}
+	}
+	tw := &transformWriter{w: encoder, transform: transform}
+	if _, err = io.Copy(tw, decoder); err != nil {
+		return util.ErrWrapper(err, "fail to transform response body")
+	}
+	if err = tw.close(nil); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// identityEncoder writes the body decoded as is
+type identityEncoder struct{ io.Writer }
+
+func (identityEncoder) Close() error { return nil }
+
+func (tw *transformWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if tw.pw != nil {
+		return tw.pw.Write(b)
+	}
+	if out := tw.transform(b); len(out) > 0 {
+		if _, err := util.WriteWithValidation(tw.w, out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// close ends the body with err, the rest held back by the transform is
+// written if the body is complete
+func (tw *transformWriter) close(err error) error {
+	if tw.pw != nil {
+		tw.pw.CloseWithError(err)
+		e := <-tw.done
+		if pe, ok := e.(*panicError); ok {
+			panic(pe)
+		}
+		if err == nil {
+			err = e
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if out := tw.transform(nil); len(out) > 0 {
+		_, err = util.WriteWithValidation(tw.w, out)
+	}
+	return err
+}
+
+// chunkPayload strips the framing of the chunked body pieces
+type chunkPayload struct {
+	// left the payload bytes left in the current chunk
+	left int64
+}
+
+// strip the payload in the body piece data
+func (c *chunkPayload) strip(isChunkHeader bool, data []byte) []byte {
+	if isChunkHeader {
+		c.left, _ = strconv.ParseInt(string(bytes.TrimSpace(data)), 16, 64)
+		return nil
+	}
+	if int64(len(data)) > c.left {
+		data = data[:c.left]
+	}
+	c.left -= int64(len(data))
+	return data
+}
+
+// copyTransformedBody copies the body of the response from src into tw,
+// and the original one into dst2
+func (r *Response) copyTransformedBody(bodyType http.BodyType, src *bufio.Reader,
+	tw *transformWriter, dst2 additionalDst) (int, error) {
+	var chunks chunkPayload
+	n, err := r.body.Parse(src, bodyType, r.header.ContentLength(),
+		func(isChunkHeader bool, data []byte) (int, error) {
+			dst2(data)
+			payload := data
+			if bodyType == http.BodyTypeChunked {
+				payload = chunks.strip(isChunkHeader, data)
+			}
+			if _, err := tw.Write(payload); err != nil {
+				return 0, util.ErrWrapper(err, "error occurred when write to dst")
+			}
+			return len(data), nil
+		})
+	return n, tw.close(err)
+}
+
+// InjectBefore transform injecting content before the first marker found,
+// ignoring the ASCII case, e.g. a script before "</body>" of HTML. Only the
+// bytes which may start a marker spanning the pieces are held back, so the
+// body is streamed, and relayed as is once injected or if never found.
+func InjectBefore(marker, content string) func(chunk []byte) []byte {
+	var pending []byte
+	injected := false
+	return func(chunk []byte) []byte {
+		if injected {
+			return chunk
+		}
+		if chunk == nil {
+			out := pending
+			pending = nil
+			return out
+		}
+		pending = append(pending, chunk...)
+		if i := indexFold(pending, []byte(marker)); i >= 0 {
+			injected = true
+			out := make([]byte, 0, len(pending)+len(content))
+			out = append(append(append(out, pending[:i]...), content...), pending[i:]...)
+			pending = nil
+			return out
+		}
+		keep := len(marker) - 1
+		if keep > len(pending) {
+			keep = len(pending)
+		}
+		out := append([]byte(nil), pending[:len(pending)-keep]...)
+		pending = append(pending[:0], pending[len(pending)-keep:]...)
+		return out
+	}
+}
+
+// indexFold index of the first sep in s ignoring the case, -1 if not found
+func indexFold(s, sep []byte) int {
+	for i := 0; i+len(sep) <= len(s); i++ {
+		if bytes.EqualFold(s[i:i+len(sep)], sep) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// transformHijacker injects a script into the HTML bodies
+type transformHijacker struct {
+	tlsTestHijacker
+	decode, dropEncoding bool
+	sniffed              bytes.Buffer
+}
+
+func (h *transformHijacker) TransformResponse(line http.ResponseLine, header http.Header) *BodyTransform {
+	if !strings.HasPrefix(header.ContentType(), "text/html") {
+		return nil
+	}
+	if h.dropEncoding {
+		return &BodyTransform{Transform: InjectBefore("</BODY>", "<script></script>"), DropEncoding: true}
+	}
+	return &BodyTransform{Transform: replaceTransform("</body>", "<script></script></body>"), Decode: h.decode}
+}
+
+func (h *transformHijacker) OnResponse(http.ResponseLine, http.Header, []byte) io.WriteCloser {
+	h.sniffed.Reset()
+	return nopWriteCloser{&h.sniffed}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+type transformHijackerPool struct{ h *transformHijacker }
+
+func (p transformHijackerPool) Get(clientAddr net.Addr, isHTTPS bool, host, port string) Hijacker {
+	p.h.host, p.h.port = host, port
+	return p.h
+}
+func (p transformHijackerPool) Put(Hijacker) {}
+
+// replaceTransform replaces old with new, holding back the bytes which may
+// start an old spanning the pieces
+func replaceTransform(old, new string) func([]byte) []byte {
+	var pending []byte
+	return func(chunk []byte) []byte {
+		if chunk == nil {
+			return pending
+		}
+		pending = append(pending, chunk...)
+		replaced := bytes.Replace(pending, []byte(old), []byte(new), -1)
+		keep := len(old) - 1
+		if keep > len(replaced) {
+			keep = len(replaced)
+		}
+		out := append([]byte(nil), replaced[:len(replaced)-keep]...)
+		pending = append(pending[:0], replaced[len(replaced)-keep:]...)
+		return out
+	}
+}
+
+func TestResponseTransform(t *testing.T) {
+	page := "<html><body>" + strings.Repeat("fastproxy ", 20000) + "</body></html>"
+	injected := strings.Replace(page, "</body>", "<script></script></body>", 1)
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		switch r.URL.Path {
+		case "/text":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+			w.Write([]byte(page))
+		case "/chunked":
+			w.Header().Set("Content-Type", "text/html")
+			for i := 0; i < len(page); i += 3000 {
+				end := i + 3000
+				if end > len(page) {
+					end = len(page)
+				}
+				w.Write([]byte(page[i:end]))
+				w.(nethttp.Flusher).Flush()
+			}
+		case "/gzip-chunked":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			for i := 0; i < len(page); i += 3000 {
+				end := i + 3000
+				if end > len(page) {
+					end = len(page)
+				}
+				zw.Write([]byte(page[i:end]))
+				zw.Flush()
+				w.(nethttp.Flusher).Flush()
+			}
+			zw.Close()
+		case "/gzip", "/br":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", strings.TrimPrefix(r.URL.Path, "/"))
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte(page))
+			zw.Close()
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+			w.Write([]byte(page))
+		}
+	}))
+	defer origin.Close()
+
+	h := &transformHijacker{}
+	p := newTestProxy(t, func(p *Proxy) {
+		p.HijackerPool = transformHijackerPool{h}
+	})
+
+	// the body is transformed and delimited by closing the connection,
+	// the hijacker sniffs the original one
+	for path, expected := range map[string]string{"/html": injected, "/chunked": injected, "/text": page} {
+		resp, body := proxyTestRequest(t, p, "GET", origin.URL+path, "", "")
+		if body != expected || path != "/chunked" && h.sniffed.String() != page {
+			t.Fatalf("unexpected body of %s, %d bytes, %d sniffed", path, len(body), h.sniffed.Len())
+		}
+		if path != "/text" && (resp.ContentLength != -1 || !resp.Close) {
+			t.Fatalf("unexpected response of %s %d %v", path, resp.ContentLength, resp.Close)
+		}
+	}
+
+	// the body is chunked for the client kept alive
+	client, server := net.Pipe()
+	defer client.Close()
+	go p.serveConn(server)
+	reader := bufio.NewReader(client)
+	for _, path := range []string{"/html", "/chunked", "/text"} {
+		go client.Write([]byte("GET " + origin.URL + path + " HTTP/1.1\r\nHost: " +
+			strings.TrimPrefix(origin.URL, "http://") + "\r\n\r\n"))
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if path == "/text" {
+			if string(body) != page || resp.ContentLength != int64(len(page)) {
+				t.Fatalf("unexpected text relayed %d", resp.ContentLength)
+			}
+			continue
+		}
+		if string(body) != injected || len(resp.TransferEncoding) != 1 || resp.Close {
+			t.Fatalf("unexpected response of %s %v %v, %d bytes", path, resp.TransferEncoding, resp.Close, len(body))
+		}
+	}
+
+	// the body encoded is transformed decoded if asked
+	for _, c := range []struct {
+		path     string
+		decode   bool
+		expected string
+	}{
+		{"/gzip", true, injected},
+		{"/gzip", false, page},
+		{"/br", true, page},
+	} {
+		h.decode = c.decode
+		resp, body := proxyTestRequest(t, p, "GET", origin.URL+c.path, "Accept-Encoding: gzip\r\n", "")
+		zr, err := gzip.NewReader(strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error of %s: %s", c.path, err)
+		}
+		decoded, err := ioutil.ReadAll(zr)
+		if err != nil || string(decoded) != c.expected ||
+			resp.Header.Get("Content-Encoding") != strings.TrimPrefix(c.path, "/") {
+			t.Fatalf("unexpected body of %s %v, %d bytes, error: %v", c.path, c.decode, len(decoded), err)
+		}
+	}
+
+	// the gzip'd chunked body is relayed decoded if asked
+	h.dropEncoding = true
+	resp, body := proxyTestRequest(t, p, "GET", origin.URL+"/gzip-chunked", "Accept-Encoding: gzip\r\n", "")
+	if body != injected || resp.Header.Get("Content-Encoding") != "" || resp.ContentLength != -1 {
+		t.Fatalf("unexpected decoded response %v %d, %d bytes", resp.Header, resp.ContentLength, len(body))
+	}
+}
+
+func TestInjectBefore(t *testing.T) {
+	for _, c := range []struct{ body, expected string }{
+		{"<html><body>hi</body></html>", "<html><body>hi<script></script></body></html>"},
+		{"<HTML><BODY>hi</Body></HTML>", "<HTML><BODY>hi<script></script></Body></HTML>"},
+		{"</body></body>", "<script></script></body></body>"},
+		{"<html>no end", "<html>no end"},
+		{"", ""},
+	} {
+		// split the body at every position
+		for split := 0; split <= len(c.body); split++ {
+			inject := InjectBefore("</body>", "<script></script>")
+			out := append(inject([]byte(c.body[:split])), inject([]byte(c.body[split:]))...)
+			out = append(out, inject(nil)...)
+			if string(out) != c.expected {
+				t.Fatalf("unexpected body %q split at %d, expected %q", out, split, c.expected)
+			}
+		}
+	}
+}
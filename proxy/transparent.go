@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/haxii/fastproxy/client"
+	"github.com/haxii/fastproxy/transport"
+)
+
+// TransparentMode how the proxy finds the destination of the connections
+// intercepted transparently, i.e. requests without a CONNECT or absolute URI
+type TransparentMode int
+
+const (
+	// TransparentOff serves the proxy requests only
+	TransparentOff TransparentMode = iota
+	// TransparentRedirect serves the connections redirected by iptables
+	// REDIRECT or DNAT, whose destination is read by SO_ORIGINAL_DST
+	TransparentRedirect
+	// TransparentTProxy serves the connections intercepted by TPROXY, whose
+	// destination is the local address, Serve listens with IP_TRANSPARENT
+	TransparentTProxy
+)
+
+var errTransparentOff = errors.New("transparent mode is off")
+
+// tlsRecordTypeHandshake first byte of a TLS client hello
+const tlsRecordTypeHandshake = 0x16
+
+// originalDst the original destination of the intercepted connection c
+func (p *Proxy) originalDst(c net.Conn) (*net.TCPAddr, error) {
+	if p.lookupOriginalDst != nil {
+		return p.lookupOriginalDst(c)
+	}
+	switch p.Transparent {
+	case TransparentRedirect:
+		return transport.OriginalDst(c)
+	case TransparentTProxy:
+		if addr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+			return addr, nil
+		}
+		return nil, transport.ErrNotTCPConn
+	}
+	return nil, errTransparentOff
+}
+
+// isTLSHandshake if the connection starts with a TLS handshake
+func isTLSHandshake(reader *bufio.Reader) bool {
+	b, err := reader.Peek(1)
+	return err == nil && b[0] == tlsRecordTypeHandshake
+}
+
+// tunnelTransparent relays the intercepted connection to its original
+// destination as is, including the data buffered in reader
+func (p *Proxy) tunnelTransparent(c net.Conn, reader *bufio.Reader, req *Request, dst *net.TCPAddr) error {
+	if p.DisallowDirect && p.SuperProxy == nil {
+		p.logger.Warn(dst.String(), "intercepted tunnel rejected: %s", ErrNoUpstream)
+		return ErrNoUpstream
+	}
+	if sp := p.SuperProxy; sp != nil {
+		sp.AcquireToken()
+		defer sp.PushBackToken()
+	}
+	targetWithPort := dst.String()
+	req.connInfo.setUpstream(targetWithPort, p.SuperProxy)
+	req.connInfo.setState(ConnStateTunnel)
+	p.setDialers(req)
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{reader, c}
+	bytesUp, bytesDown, err := p.client.DoRaw(rw, p.SuperProxy, targetWithPort,
+		func(fail error) error { return fail }, &client.RawOptions{Dialers: &req.dialers})
+	err = upstreamError(err)
+	p.HostStats.RecordTunnel(targetWithPort, bytesUp, bytesDown, err)
+	p.HostStats.RecordEgress(targetWithPort, egressOf(p.SuperProxy))
+	p.logger.Debug(targetWithPort,
+		"intercepted tunnel closed, %d bytes up, %d bytes down, error: %v", bytesUp, bytesDown, err)
+	return err
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	nethttp "net/http"
+	"testing"
+)
+
+func TestTransparentHTTP(t *testing.T) {
+	origin := newRecordingOrigin(t)
+	defer origin.ln.Close()
+
+	p := newTestProxy(t, func(p *Proxy) {
+		p.Transparent = TransparentRedirect
+	})
+	p.lookupOriginalDst = func(c net.Conn) (*net.TCPAddr, error) {
+		return origin.ln.Addr().(*net.TCPAddr), nil
+	}
+
+	// origin-form requests are sent to the original destination with the Host kept
+	testRequestLineForm(t, p, origin,
+		"GET /path?q=1 HTTP/1.1\r\nHost: www.example.com\r\nConnection: close\r\n\r\n",
+		"GET /path?q=1 HTTP/1.1", "www.example.com")
+
+	// connections not intercepted are served as usual
+	p.lookupOriginalDst = func(c net.Conn) (*net.TCPAddr, error) {
+		return nil, errors.New("not intercepted")
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	go client.Write([]byte("GET /path HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != 400 {
+		t.Fatalf("unexpected status code %d", resp.StatusCode)
+	}
+}
+
+func TestTransparentTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	p := newTestProxy(t, func(p *Proxy) {
+		p.Transparent = TransparentRedirect
+	})
+	p.lookupOriginalDst = func(c net.Conn) (*net.TCPAddr, error) {
+		return ln.Addr().(*net.TCPAddr), nil
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+
+	// the TLS records are relayed as is
+	hello := []byte("\x16\x03\x01\x00\x05hello")
+	go client.Write(hello)
+	echo := make([]byte, len(hello))
+	if _, err := io.ReadFull(client, echo); err != nil || string(echo) != string(hello) {
+		t.Fatalf("unexpected relayed data %q %v", echo, err)
+	}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// TunnelProtocol the protocol the client speaks inside a CONNECT tunnel,
+// classified by its first bytes
+type TunnelProtocol int32
+
+const (
+	// TunnelProtocolUnknown the tunnel is not classified, e.g. the client
+	// sent nothing or ClassifyTunnels is not set
+	TunnelProtocolUnknown TunnelProtocol = iota
+	// TunnelProtocolTLS the client starts with a TLS handshake record
+	TunnelProtocolTLS
+	// TunnelProtocolHTTP the client speaks plaintext HTTP, e.g. the broken
+	// SDKs tunneling to port 443 without TLS
+	TunnelProtocolHTTP
+	// TunnelProtocolOther the client speaks neither TLS nor HTTP
+	TunnelProtocolOther
+)
+
+func (p TunnelProtocol) String() string {
+	switch p {
+	case TunnelProtocolTLS:
+		return "tls"
+	case TunnelProtocolHTTP:
+		return "http"
+	case TunnelProtocolOther:
+		return "other"
+	}
+	return "unknown"
+}
+
+// maxMethodLength the longest method token expected in plaintext requests
+const maxMethodLength = 16
+
+// classifyTunnel classifies the tunnel by the first bytes the client sent
+func classifyTunnel(first []byte) TunnelProtocol {
+	if len(first) == 0 {
+		return TunnelProtocolUnknown
+	}
+	if first[0] == tlsRecordTypeHandshake {
+		return TunnelProtocolTLS
+	}
+	// a method token followed by a space, or a part of it
+	for i, b := range first {
+		switch {
+		case i > maxMethodLength:
+			return TunnelProtocolOther
+		case 'A' <= b && b <= 'Z':
+		case b == ' ' && i > 0:
+			return TunnelProtocolHTTP
+		default:
+			return TunnelProtocolOther
+		}
+	}
+	return TunnelProtocolHTTP
+}
+
+// errPlainHTTPTunnel ends the relay of the tunnel whose plaintext requests
+// are served as the proxy requests
+var errPlainHTTPTunnel = errors.New("plaintext HTTP inside the tunnel")
+
+// classifyingConn classifies the tunnel by the first bytes read from the
+// client, which are kept for replaying when the tunnel is served as HTTP
+type classifyingConn struct {
+	net.Conn
+	protocol int32
+	// serveHTTP ends the relay of the plaintext HTTP ones
+	serveHTTP bool
+	peeked    []byte
+}
+
+func (c *classifyingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n == 0 || atomic.LoadInt32(&c.protocol) != int32(TunnelProtocolUnknown) {
+		return n, err
+	}
+	protocol := classifyTunnel(b[:n])
+	atomic.StoreInt32(&c.protocol, int32(protocol))
+	if protocol == TunnelProtocolHTTP && c.serveHTTP {
+		c.peeked = append([]byte(nil), b[:n]...)
+		return 0, errPlainHTTPTunnel
+	}
+	return n, err
+}
+
+// classified the protocol classified, unknown before the client sends
+func (c *classifyingConn) classified() TunnelProtocol {
+	return TunnelProtocol(atomic.LoadInt32(&c.protocol))
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyTunnel(t *testing.T) {
+	for first, expected := range map[string]TunnelProtocol{
+		"":                     TunnelProtocolUnknown,
+		"\x16\x03\x01\x02\x00": TunnelProtocolTLS,
+		"GET / HTTP/1.1\r\n":   TunnelProtocolHTTP,
+		"OPTIONS * HTTP/1.1":   TunnelProtocolHTTP,
+		"PO":                   TunnelProtocolHTTP,
+		" GET /":               TunnelProtocolOther,
+		"SSH-2.0-OpenSSH\r\n":  TunnelProtocolOther,
+		"get / HTTP/1.1\r\n":   TunnelProtocolOther,
+		"\x00\x01\x02":         TunnelProtocolOther,
+	} {
+		if protocol := classifyTunnel([]byte(first)); protocol != expected {
+			t.Fatalf("unexpected protocol %s of %q, expected %s", protocol, first, expected)
+		}
+	}
+}
+
+func TestTunnelClassification(t *testing.T) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	addr := origin.Listener.Addr().String()
+
+	// tunnel sends the first bytes through a tunnel to the origin and
+	// returns the response the client receives after the tunnel made
+	tunnel := func(p *Proxy, first string) (int, string) {
+		client, server := net.Pipe()
+		served := make(chan struct{})
+		go func() {
+			p.serveConn(server)
+			server.Close()
+			close(served)
+		}()
+		client.SetDeadline(time.Now().Add(10 * time.Second))
+		fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+		reader := bufio.NewReader(client)
+		made, err := reader.ReadString('\n')
+		if err != nil || !strings.HasPrefix(made, "HTTP/1.1 200") {
+			t.Fatalf("unexpected tunnel response %q, error: %v", made, err)
+		}
+		reader.ReadString('\n')
+		go client.Write([]byte(first))
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// the client closes the tunnel after the bodies delimited
+		var body []byte
+		if resp.ContentLength >= 0 {
+			body, _ = ioutil.ReadAll(resp.Body)
+		}
+		client.Close()
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel not closed")
+		}
+		return resp.StatusCode, string(body)
+	}
+	newProxy := func() *Proxy {
+		return newTestProxy(t, func(p *Proxy) {
+			p.HostStats = &HostStats{}
+		})
+	}
+	plainRequest := "GET / HTTP/1.1\r\nHost: " + addr + "\r\nConnection: close\r\n\r\n"
+	stat := func(p *Proxy) HostStat {
+		top := p.HostStats.TopHosts(1, MetricRequests)
+		if len(top) != 1 {
+			t.Fatalf("unexpected host stats %+v", top)
+		}
+		return top[0]
+	}
+
+	// relayed as is by default
+	p := newProxy()
+	p.ClassifyTunnels = true
+	if status, body := tunnel(p, plainRequest); status != 200 || body != "ok" {
+		t.Fatalf("unexpected response relayed %d %s", status, body)
+	}
+	if s := stat(p); s.Tunnels != 1 || s.Requests != 1 || s.PlainHTTPTunnels != 1 || s.OtherProtocolTunnels != 0 {
+		t.Fatalf("unexpected stats of the relayed tunnel %+v", s)
+	}
+	if status, _ := tunnel(p, "SSH-2.0-OpenSSH\r\n\r\n"); status != 400 {
+		t.Fatalf("unexpected status relayed %d", status)
+	}
+	if s := stat(p); s.Tunnels != 2 || s.PlainHTTPTunnels != 1 || s.OtherProtocolTunnels != 1 {
+		t.Fatalf("unexpected stats of the relayed tunnels %+v", s)
+	}
+
+	// served as the proxy requests, recorded as well
+	p = newProxy()
+	p.ServePlainHTTPTunnels = true
+	if status, body := tunnel(p, plainRequest); status != 200 || body != "ok" {
+		t.Fatalf("unexpected response served %d %s", status, body)
+	}
+	if s := stat(p); s.Tunnels != 1 || s.Requests != 2 || s.PlainHTTPTunnels != 1 {
+		t.Fatalf("unexpected stats of the served tunnel %+v", s)
+	}
+}
+
+func TestTunnelPinnedIP(t *testing.T) {
+	hosts := make(chan string, 1)
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		hosts <- r.Host
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+	target := "pinned.test:" + port
+
+	// the tunnel target resolves to the origin once only
+	var dialed []string
+	p := newTestProxy(t, func(p *Proxy) {
+		p.ServePlainHTTPTunnels = true
+		p.Dial = func(addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			if addr != target {
+				return net.Dial("tcp", addr)
+			} else if len(dialed) > 1 {
+				return nil, fmt.Errorf("%s rebound", addr)
+			}
+			return net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+		}
+	})
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	go fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\n\r\n", target)
+	reader := bufio.NewReader(client)
+	if resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: "CONNECT"}); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("unexpected tunnel response %v, error: %v", resp, err)
+	}
+	go fmt.Fprintf(client, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target)
+	resp, err := nethttp.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != 200 || string(body) != "ok" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, body)
+	}
+
+	// the request inside dials the IP pinned, for the host of the tunnel
+	if d := fmt.Sprint(dialed); d != "["+target+" 127.0.0.1:"+port+"]" {
+		t.Fatalf("unexpected addresses dialed %s", d)
+	}
+	if host := <-hosts; host != target {
+		t.Fatalf("unexpected host %s", host)
+	}
+}
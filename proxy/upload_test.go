@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// readCountingConn counts the reads of the conn
+type readCountingConn struct {
+	net.Conn
+	reads *int64
+}
+
+func (c readCountingConn) Read(b []byte) (int, error) {
+	atomic.AddInt64(c.reads, 1)
+	return c.Conn.Read(b)
+}
+
+// BenchmarkUploadLargeBody uploads 8MB bodies through the proxy, reporting
+// the reads of the client connection made per upload
+func BenchmarkUploadLargeBody(b *testing.B) {
+	origin := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer origin.Close()
+	body := bytes.Repeat([]byte("x"), 8<<20)
+	head := []byte(fmt.Sprintf("POST %s/ HTTP/1.1\r\nContent-Length: %d\r\nConnection: close\r\n\r\n",
+		origin.URL, len(body)))
+
+	for _, size := range []int{0, 256 * 1024} {
+		b.Run(fmt.Sprintf("RequestBodyBufSize=%d", size), func(b *testing.B) {
+			p := newTestProxy(b, func(p *Proxy) {
+				p.RequestBodyBufSize = size
+			})
+			var reads int64
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client, server := net.Pipe()
+				go func() {
+					p.serveConn(readCountingConn{server, &reads})
+					server.Close()
+				}()
+				go func() {
+					client.Write(head)
+					client.Write(body)
+				}()
+				resp, err := nethttp.ReadResponse(bufio.NewReader(client), nil)
+				if err != nil || resp.StatusCode != nethttp.StatusOK {
+					b.Fatalf("unexpected response %v, error: %v", resp, err)
+				}
+				resp.Body.Close()
+				client.Close()
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&reads))/float64(b.N), "reads/op")
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfigError the problems of the proxy configuration found by Validate,
+// each of them starts with the name of the field
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid proxy configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks the configuration of the proxy, a *ConfigError listing
+// all the problems is returned if any. A no-op Logger is set if missing,
+// and the settings ignored or falling back to notable defaults are warned.
+//
+// It's called by Serve and ServeConn once before serving.
+func (p *Proxy) Validate() error {
+	if p.Logger == nil {
+		p.Logger = nopLogger{}
+	}
+	var problems []string
+	problem := func(field, format string, v ...interface{}) {
+		problems = append(problems, field+": "+fmt.Sprintf(format, v...))
+	}
+	logger := &LeveledLogger{Logger: p.Logger, Level: p.LogLevel}
+	warn := func(field, format string, v ...interface{}) {
+		logger.Warn("ProxyMNG", field+": "+format, v...)
+	}
+
+	for _, size := range []struct {
+		field string
+		value int
+	}{
+		{"ReadBufferSize", p.ReadBufferSize},
+		{"WriteBufferSize", p.WriteBufferSize},
+		{"RequestBodyBufSize", p.RequestBodyBufSize},
+		{"ServerConcurrency", p.ServerConcurrency},
+		{"ForwardConcurrencyPerHost", p.ForwardConcurrencyPerHost},
+		{"MaxConcurrentRequestsPerHost", p.MaxConcurrentRequestsPerHost},
+	} {
+		if size.value < 0 {
+			problem(size.field, "negative value %d", size.value)
+		}
+	}
+	if p.SuperProxy != nil && len(p.SuperProxy.HostWithPort()) == 0 {
+		problem("SuperProxy", "no host, make it with superproxy.NewSuperProxy")
+	}
+	if p.Transparent < TransparentOff || p.Transparent > TransparentTProxy {
+		problem("Transparent", "unknown mode %d", p.Transparent)
+	}
+	if p.PathEncoding < PathEncodingAsIs || p.PathEncoding > PathEncodingStrict {
+		problem("PathEncoding", "unknown mode %d", p.PathEncoding)
+	}
+	if p.HostMismatch < HostMismatchPreferURI || p.HostMismatch > HostMismatchReject {
+		problem("HostMismatch", "unknown mode %d", p.HostMismatch)
+	}
+	if p.MaxConnLifetime < 0 {
+		problem("MaxConnLifetime", "negative lifetime %s", p.MaxConnLifetime)
+	}
+	if p.Trace < TraceReject || p.Trace > TraceEcho {
+		problem("Trace", "unknown policy %d", p.Trace)
+	}
+	if ca := p.MITMCertAuthority; ca != nil && (len(ca.Certificate) == 0 || ca.PrivateKey == nil) {
+		problem("MITMCertAuthority", "no certificate or private key")
+	}
+	if r := p.AccessRecordSampleRate; r < 0 || r > 1 {
+		problem("AccessRecordSampleRate", "%v out of [0, 1]", r)
+	}
+	if l := p.ErrorLogLimit; l != nil && (l.Rate < 0 || l.Burst < 0 || l.SummaryInterval < 0) {
+		problem("ErrorLogLimit", "negative rate, burst or summary interval")
+	}
+	if g := p.MemoryGuard; g != nil && g.Limit < 0 {
+		problem("MemoryGuard", "negative limit %d", g.Limit)
+	}
+	if g := p.FDGuard; g != nil && (g.Budget < 0 || g.HighWater < 0 || g.Critical < 0) {
+		problem("FDGuard", "negative budget or marks")
+	} else if g != nil && g.HighWater > 0 && g.Critical > 0 && g.HighWater > g.Critical {
+		problem("FDGuard", "high-water mark %d over the critical one %d", g.HighWater, g.Critical)
+	}
+	if t := p.RequestTracing; t != nil && t.RingSize < 0 {
+		problem("RequestTracing", "negative ring size %d", t.RingSize)
+	}
+	if c := p.TLSConfig; c != nil && len(c.Certificates) == 0 &&
+		c.GetCertificate == nil && c.GetConfigForClient == nil {
+		problem("TLSConfig", "no certificate to serve the proxy over TLS")
+	}
+
+	if p.HijackerPool != nil && p.MITMCertAuthority == nil {
+		warn("MITMCertAuthority", "not set, the tunnels decrypted by the hijackers "+
+			"are signed by the built-in authority untrusted by the clients")
+	}
+	if p.TLSConfig == nil && (p.SniffTimeout != 0 || p.SniffFallbackTLS) {
+		warn("SniffTimeout", "ignored without TLSConfig, the clients are served as plain ones")
+	}
+	if p.ResponseBodyLimit > 0 && p.OnBodySizeExceeded == nil {
+		warn("ResponseBodyLimit", "ignored without OnBodySizeExceeded, the bodies are streamed without limit")
+	}
+	if g := p.MemoryGuard; g != nil && g.Limit == 0 {
+		warn("MemoryGuard", "no limit, nothing is shed")
+	}
+	if p.ResponseBodyLimit <= 0 && p.OnBodySizeExceeded != nil {
+		warn("OnBodySizeExceeded", "never called without ResponseBodyLimit")
+	}
+	if !p.DisallowDirect && p.NoUpstreamHandler != nil {
+		warn("NoUpstreamHandler", "never called without DisallowDirect")
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// validate validates the configuration once for serving
+func (p *Proxy) validate() error {
+	p.validateOnce.Do(func() { p.validateErr = p.Validate() })
+	return p.validateErr
+}
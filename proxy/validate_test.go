@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+func TestValidate(t *testing.T) {
+	p := &Proxy{}
+	if err := p.Validate(); err != nil || p.Logger == nil {
+		t.Fatalf("unexpected error of the default config %v, logger %v", err, p.Logger)
+	}
+
+	logger := &recordingLogger{}
+	p = &Proxy{
+		Logger:            logger,
+		ReadBufferSize:    -1,
+		ServerConcurrency: -2,
+		SuperProxy:        &superproxy.SuperProxy{},
+		Transparent:       TransparentMode(7),
+		PathEncoding:      PathEncoding(-1),
+		MITMCertAuthority: &tls.Certificate{},
+		TLSConfig:         &tls.Config{},
+		HijackerPool:      &tlsTestHijackerPool{&tlsTestHijacker{}},
+		SniffFallbackTLS:  true,
+		ResponseBodyLimit: 1 << 20,
+	}
+	err := p.Validate()
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []string{
+		"ReadBufferSize: negative value -1",
+		"ServerConcurrency: negative value -2",
+		"SuperProxy: no host, make it with superproxy.NewSuperProxy",
+		"Transparent: unknown mode 7",
+		"PathEncoding: unknown mode -1",
+		"MITMCertAuthority: no certificate or private key",
+		"TLSConfig: no certificate to serve the proxy over TLS",
+	}
+	if problems := strings.Join(configErr.Problems, "\n"); problems != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected problems:\n%s", problems)
+	}
+
+	if warnings := fmt.Sprint(logger.logged()); !strings.Contains(warnings,
+		"[WARN] ResponseBodyLimit: ignored without OnBodySizeExceeded") {
+		t.Fatalf("missing warning in %s", warnings)
+	}
+
+	logger.reset()
+	p = &Proxy{Logger: logger, TLSConfig: &tls.Config{}, SniffTimeout: 1,
+		HijackerPool:       &tlsTestHijackerPool{&tlsTestHijacker{}},
+		OnBodySizeExceeded: func(string, int64) BodyLimitAction { return BodyLimitContinue }}
+	err = p.Validate()
+	if err == nil || err.Error() != "invalid proxy configuration: TLSConfig: no certificate to serve the proxy over TLS" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	warnings := fmt.Sprint(logger.logged())
+	for _, w := range []string{
+		"MITMCertAuthority: not set, the tunnels decrypted by the hijackers are signed by the built-in authority",
+		"OnBodySizeExceeded: never called without ResponseBodyLimit",
+	} {
+		if !strings.Contains(warnings, "[WARN] "+w) {
+			t.Fatalf("missing warning %q in %s", w, warnings)
+		}
+	}
+	if strings.Contains(warnings, "SniffTimeout") {
+		t.Fatalf("unexpected sniff warning in %s", warnings)
+	}
+
+	// no serving with an invalid configuration
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err = p.ServeConn(server); err == nil || !errors.As(err, &configErr) {
+		t.Fatalf("unexpected error serving %v", err)
+	}
+}
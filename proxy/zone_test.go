@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	nethttp "net/http"
+	"strconv"
+	"testing"
+)
+
+func TestConnectZonedIPv6Literal(t *testing.T) {
+	var loopback string
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+			break
+		}
+	}
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if len(loopback) == 0 || err != nil {
+		t.Skip("IPv6 loopback not available")
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	p := newTestProxy(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.serveConn(server)
+		server.Close()
+	}()
+
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	go client.Write([]byte("CONNECT [::1%25" + loopback + "]:" + port + " HTTP/1.1\r\n\r\n"))
+	br := bufio.NewReader(client)
+	resp, err := nethttp.ReadResponse(br, &nethttp.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected status code %d", resp.StatusCode)
+	}
+	go client.Write([]byte("ping"))
+	pong := make([]byte, 4)
+	if _, err := io.ReadFull(br, pong); err != nil || string(pong) != "ping" {
+		t.Fatalf("unexpected tunnel data %s %v", pong, err)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/haxii/log"
+)
+
+// flakyListener fails accepting with the errors given before accepting
+// the connections given, then returns the closed listener error
+type flakyListener struct {
+	errs  []error
+	conns []net.Conn
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	if len(l.conns) > 0 {
+		c := l.conns[0]
+		l.conns = l.conns[1:]
+		return c, nil
+	}
+	return nil, errors.New("use of closed network connection")
+}
+
+func (l *flakyListener) Close() error   { return nil }
+func (l *flakyListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestServerAcceptErrorBackoff(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp",
+		Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	client, conn := net.Pipe()
+	defer client.Close()
+	var served int32
+	var hooked []error
+	s := &Server{
+		Listener:      &flakyListener{errs: []error{emfile, emfile, emfile}, conns: []net.Conn{conn}},
+		Logger:        &log.DefaultLogger{},
+		OnAcceptError: func(err error) { hooked = append(hooked, err) },
+		ConnHandler: func(c net.Conn) error {
+			atomic.AddInt32(&served, 1)
+			return nil
+		},
+	}
+	start := time.Now()
+	if err := s.ListenAndServe(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// backed off 5ms, 10ms and 20ms
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("unexpected backoff %s", elapsed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&served) != 1 || len(hooked) != 3 || hooked[0] != emfile || s.AcceptErrors() != 3 {
+		t.Fatalf("unexpected %d connections served, errors hooked %v, %d counted",
+			served, hooked, s.AcceptErrors())
+	}
+
+	// the permanent errors still return
+	permanent := errors.New("permanent")
+	s.Listener = &flakyListener{errs: []error{permanent}}
+	if err := s.ListenAndServe(); err != permanent {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if s.AcceptErrors() != 4 {
+		t.Fatalf("unexpected %d errors counted", s.AcceptErrors())
+	}
+}
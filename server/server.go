@@ -6,6 +6,8 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/haxii/fastproxy/servertime"
@@ -25,6 +27,11 @@ type Server struct {
 	// connections handler
 	ConnHandler ConnHandler
 
+	// OnAcceptError optional hook called with the errors accepting the
+	// connections, e.g. alerting on file descriptor exhaustion, the
+	// temporary ones are retried with backoff afterwards
+	OnAcceptError func(err error)
+
 	// Logger server's logger
 	Logger log.Logger
 	// ServiceName, server's service name, used for logging
@@ -33,11 +40,26 @@ type Server struct {
 	// active connections
 	activeConn map[net.Conn]struct{}
 	mu         sync.Mutex
+
+	// acceptErrors number of the errors accepting the connections
+	acceptErrors uint64
 }
 
 // DefaultConcurrency is the maximum number of concurrent connections
 const DefaultConcurrency = 256 * 1024
 
+const (
+	// minAcceptBackoff and maxAcceptBackoff the backoff retrying the
+	// temporary accept errors, doubled after each error in a row
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// AcceptErrors number of the errors accepting the connections so far
+func (s *Server) AcceptErrors() uint64 {
+	return atomic.LoadUint64(&s.acceptErrors)
+}
+
 // ListenAndServe serves incoming connections from the given listener.
 //
 // Serve blocks until the given listener returns permanent error.
@@ -95,22 +117,32 @@ func (s *Server) ListenAndServe() error {
 }
 
 func (s *Server) acceptConn(ln net.Listener, lastPerIPErrorTime *time.Time) (net.Conn, error) {
+	var backoff time.Duration
 	for {
 		c, err := ln.Accept()
 		if err != nil {
 			if c != nil {
 				panic("BUG: net.Listener returned non-nil conn and non-nil error")
 			}
-			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-				s.Logger.Error(s.ServiceName, netErr, "Temporary error when accepting new connections")
-				time.Sleep(time.Second)
-				continue
+			if err == io.EOF || strings.Contains(err.Error(), "use of closed network connection") {
+				return nil, io.EOF
+			}
+			atomic.AddUint64(&s.acceptErrors, 1)
+			if s.OnAcceptError != nil {
+				s.OnAcceptError(err)
 			}
-			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
-				s.Logger.Error(s.ServiceName, err, "Permanent error when accepting new connections")
-				return nil, err
+			if isTemporaryAcceptError(err) {
+				if backoff == 0 {
+					backoff = minAcceptBackoff
+				} else if backoff *= 2; backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				s.warn("Temporary error when accepting new connections, retrying in %s: %s", backoff, err)
+				time.Sleep(backoff)
+				continue
 			}
-			return nil, io.EOF
+			s.Logger.Error(s.ServiceName, err, "Permanent error when accepting new connections")
+			return nil, err
 		}
 		if c == nil {
 			panic("BUG: net.Listener returned (nil, nil)")
@@ -119,6 +151,30 @@ func (s *Server) acceptConn(ln net.Listener, lastPerIPErrorTime *time.Time) (net
 	}
 }
 
+// isTemporaryAcceptError if the accept error is worth retrying, e.g. the
+// file descriptors exhausted or the connection aborted before accepted
+func isTemporaryAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE,
+		syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	netErr, ok := err.(net.Error)
+	return ok && (netErr.Timeout() || netErr.Temporary())
+}
+
+// warn logs the warning if the logger is leveled, otherwise as an error
+func (s *Server) warn(format string, v ...interface{}) {
+	if l, ok := s.Logger.(interface {
+		Warn(who, format string, v ...interface{})
+	}); ok {
+		l.Warn(s.ServiceName, format, v...)
+		return
+	}
+	s.Logger.Error(s.ServiceName, nil, format, v...)
+}
+
 // Close close the server and close all the active connections
 func (s *Server) Close() {
 	s.mu.Lock()
@@ -0,0 +1,110 @@
+package superproxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSuperProxyConnReuse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			defer conn.Close()
+		}
+	}()
+
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	superProxy, err := NewSuperProxy("127.0.0.1", port, ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cc, err := superProxy.AcquireConn(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn := cc.Get()
+	superProxy.ReleaseConn(cc)
+	time.Sleep(50 * time.Millisecond)
+
+	cc, err = superProxy.AcquireConn(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cc.Get() != conn {
+		t.Fatal("expected the released connection to be reused")
+	}
+	superProxy.ReleaseConn(cc)
+	time.Sleep(50 * time.Millisecond)
+
+	// concurrent users never share a connection
+	var (
+		wg    sync.WaitGroup
+		lock  sync.Mutex
+		inUse = make(map[net.Conn]bool)
+	)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				cc, err := superProxy.AcquireConn(nil, nil)
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+				lock.Lock()
+				if inUse[cc.Get()] {
+					t.Errorf("connection %s acquired twice", cc.Get().LocalAddr())
+				}
+				inUse[cc.Get()] = true
+				lock.Unlock()
+				time.Sleep(time.Millisecond)
+				lock.Lock()
+				delete(inUse, cc.Get())
+				lock.Unlock()
+				superProxy.ReleaseConn(cc)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&accepted); n >= 16*10 {
+		t.Fatalf("expected connections to be reused, got %d dials", n)
+	}
+
+	socks5Proxy, _ := NewSuperProxy("127.0.0.1", port, ProxyTypeSOCKS5, "", "", "")
+	if _, err := socks5Proxy.AcquireConn(nil, nil); err == nil {
+		t.Fatal("expected error acquiring a SOCKS5 connection")
+	}
+}
+
+func TestParseHTTPProxyRespStatus(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		ok   bool
+	}{
+		{"HTTP/1.1 200 Connection established\r\n", true},
+		// any 2xx makes the tunnel
+		{"HTTP/1.1 201 Created\r\n", true},
+		{"HTTP/1.0 299 Whatever\r\n", true},
+		{"HTTP/1.1 100 Continue\r\n", false},
+		{"HTTP/1.1 407 Proxy Authentication Required\r\n", false},
+	} {
+		if err := parseHTTPProxyRespStatus([]byte(c.line)); (err == nil) != c.ok {
+			t.Fatalf("unexpected error %v of %q", err, c.line)
+		}
+	}
+}
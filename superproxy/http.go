@@ -13,6 +13,18 @@ import (
 	"github.com/haxii/fastproxy/util"
 )
 
+// StatusError the super proxy responded the CONNECT request with
+// a status other than 2xx, e.g. 407 if the proxy auth is required
+type StatusError struct {
+	StatusCode int
+	// StatusLine the start line of the response, CRLF trimmed
+	StatusLine string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("super proxy responded CONNECT with status %d: %q", e.StatusCode, e.StatusLine)
+}
+
 var (
 	superProxyReqMethod     = []byte("CONNECT")
 	superProxyReqProtocol   = []byte("HTTP/1.1")
@@ -80,7 +92,9 @@ func (p *SuperProxy) writeHTTPProxyReq(c net.Conn, targetHostWithPort []byte) (i
 }
 
 // readProxyReq reads proxy connection request result (i.e. response)
-// only 200 OK is accepted.
+// only 2xx is accepted, a *StatusError is returned otherwise. The 2xx
+// response makes the tunnel, so it has no body whatever its header tells,
+// RFC 7231 4.3.6.
 func (p *SuperProxy) readHTTPProxyResp(c net.Conn, pool *bufiopool.Pool) error {
 	r := pool.AcquireReader(c)
 	defer pool.ReleaseReader(r)
@@ -108,8 +122,8 @@ func (p *SuperProxy) readHTTPProxyResp(c net.Conn, pool *bufiopool.Pool) error {
 			m += lineLen
 			if isStartLine {
 				isStartLine = false
-				if !bytes.Contains(b[:lineLen], []byte(" 200 ")) {
-					return fmt.Errorf("connected to proxy failed with start line %s", b[:lineLen])
+				if err := parseHTTPProxyRespStatus(b[:lineLen]); err != nil {
+					return err
 				}
 			} else {
 				if (lineLen == 2 && b[0] == '\r') || lineLen == 1 {
@@ -122,10 +136,34 @@ func (p *SuperProxy) readHTTPProxyResp(c net.Conn, pool *bufiopool.Pool) error {
 			}
 		}
 		if headerParsed {
-			// TODO: discard http body also? Does the proxy connect response contains body?
 			return nil
 		}
 		// require one more byte
 		n = r.Buffered() + 1
 	}
 }
+
+// parseHTTPProxyRespStatus parses the start line of the proxy connect response,
+// a *StatusError is returned if the status isn't 2xx
+func parseHTTPProxyRespStatus(line []byte) error {
+	line = bytes.TrimRight(line, "\r\n")
+	// HTTP/1.x 200 Connection established
+	if !bytes.HasPrefix(line, []byte("HTTP/")) {
+		return fmt.Errorf("malformed proxy connect response start line %q", line)
+	}
+	sp := bytes.IndexByte(line, ' ')
+	if sp < 0 || len(line) < sp+4 || (len(line) > sp+4 && line[sp+4] != ' ') {
+		return fmt.Errorf("malformed proxy connect response start line %q", line)
+	}
+	statusCode := 0
+	for _, c := range line[sp+1 : sp+4] {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("malformed proxy connect response start line %q", line)
+		}
+		statusCode = statusCode*10 + int(c-'0')
+	}
+	if statusCode < 200 || statusCode > 299 {
+		return &StatusError{StatusCode: statusCode, StatusLine: string(line)}
+	}
+	return nil
+}
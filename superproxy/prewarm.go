@@ -0,0 +1,257 @@
+package superproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+// PrewarmCheckInterval interval of the liveness checks of the warm
+// connections, the dead ones are replaced
+var PrewarmCheckInterval = 5 * time.Second
+
+// prewarmProbeTimeout how long a warm connection is read during the
+// liveness check, it's alive if nothing is read
+const prewarmProbeTimeout = time.Millisecond
+
+// PrewarmStats statistics of the warm connections
+type PrewarmStats struct {
+	// Idle number of the warm connections ready
+	Idle int
+	// Hits number of tunnels made with a warm connection
+	Hits uint64
+	// Misses number of tunnels made with a new connection while prewarming,
+	// the ones made by custom dial functions included
+	Misses uint64
+}
+
+// HitRate ratio of the tunnels made with a warm connection
+func (s PrewarmStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// warmPool idle connections to the proxy ready for tunnel requests
+type warmPool struct {
+	lock  sync.Mutex
+	size  int
+	conns []net.Conn
+	// checking closed once the connection taken out for its check is back
+	checking chan struct{}
+	// refill wakes the maintainer up, stop stops it
+	refill chan struct{}
+	stop   chan struct{}
+
+	hits   uint64
+	misses uint64
+}
+
+// Prewarm keeps n idle connections to the proxy ready for the tunnels made
+// by MakeTunnel, with the TLS handshake done for HTTPS proxies and the
+// greetings done for SOCKS5 ones. The connections are checked every
+// PrewarmCheckInterval and replaced when dead, or once used.
+//
+// Warm connections are made with the default dialer, so they are used
+// only by MakeTunnel calls without custom dial functions, the ones with
+// are counted as misses, e.g. the tunnels of a proxy counting its dials.
+// Pass a non-positive n to stop prewarming and close the idle connections.
+func (p *SuperProxy) Prewarm(n int) {
+	w := &p.warm
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if n <= 0 {
+		w.size = 0
+		for _, c := range w.conns {
+			c.Close()
+		}
+		w.conns = nil
+		if w.stop != nil {
+			close(w.stop)
+			w.stop = nil
+		}
+		return
+	}
+	w.size = n
+	if w.stop == nil {
+		w.stop = make(chan struct{})
+		w.refill = make(chan struct{}, 1)
+		go p.maintainWarmConns(w.stop, w.refill)
+	}
+	w.notifyRefill()
+}
+
+// PrewarmStats statistics of the warm connections
+func (p *SuperProxy) PrewarmStats() PrewarmStats {
+	p.warm.lock.Lock()
+	idle := len(p.warm.conns)
+	p.warm.lock.Unlock()
+	return PrewarmStats{
+		Idle:   idle,
+		Hits:   atomic.LoadUint64(&p.warm.hits),
+		Misses: atomic.LoadUint64(&p.warm.misses),
+	}
+}
+
+// takeWarmConn takes a warm connection if prewarming, nil if none available
+func (p *SuperProxy) takeWarmConn() net.Conn {
+	w := &p.warm
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	// the one being checked is waited for rather than dialing a new one
+	for w.size > 0 && len(w.conns) == 0 && w.checking != nil {
+		checking := w.checking
+		w.lock.Unlock()
+		<-checking
+		w.lock.Lock()
+	}
+	if w.size == 0 {
+		return nil
+	}
+	w.notifyRefill()
+	if len(w.conns) == 0 {
+		atomic.AddUint64(&w.misses, 1)
+		return nil
+	}
+	c := w.conns[len(w.conns)-1]
+	w.conns = w.conns[:len(w.conns)-1]
+	atomic.AddUint64(&w.hits, 1)
+	return c
+}
+
+// skipWarmConns counts a tunnel made without the warm connections as a miss
+// if prewarming
+func (p *SuperProxy) skipWarmConns() {
+	w := &p.warm
+	w.lock.Lock()
+	if w.size > 0 {
+		atomic.AddUint64(&w.misses, 1)
+	}
+	w.lock.Unlock()
+}
+
+// notifyRefill wakes the maintainer up without blocking, w.lock must be held
+func (w *warmPool) notifyRefill() {
+	select {
+	case w.refill <- struct{}{}:
+	default:
+	}
+}
+
+// maintainWarmConns checks and refills the warm connections until stopped
+func (p *SuperProxy) maintainWarmConns(stop, refill chan struct{}) {
+	ticker := time.NewTicker(PrewarmCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.checkWarmConns(stop)
+		case <-refill:
+		}
+		p.refillWarmConns(stop)
+	}
+}
+
+// checkWarmConns closes the dead warm connections, the oldest first. Each
+// is taken out of the pool while checked, so the others are taken by the
+// tunnels meanwhile, and put back at the end once alive unless no longer
+// needed, e.g. stopped while checking.
+func (p *SuperProxy) checkWarmConns(stop chan struct{}) {
+	w := &p.warm
+	w.lock.Lock()
+	n := len(w.conns)
+	w.lock.Unlock()
+	for i := 0; i < n; i++ {
+		w.lock.Lock()
+		if w.stop != stop || len(w.conns) == 0 {
+			w.lock.Unlock()
+			return
+		}
+		c := w.conns[0]
+		w.conns = w.conns[1:]
+		w.checking = make(chan struct{})
+		w.lock.Unlock()
+
+		alive := isConnAlive(c)
+		w.lock.Lock()
+		close(w.checking)
+		w.checking = nil
+		if alive && w.stop == stop && len(w.conns) < w.size {
+			w.conns = append(w.conns, c)
+		} else {
+			c.Close()
+		}
+		w.lock.Unlock()
+	}
+}
+
+// refillWarmConns makes new warm connections until there are enough
+func (p *SuperProxy) refillWarmConns(stop chan struct{}) {
+	w := &p.warm
+	for {
+		w.lock.Lock()
+		short := w.stop == stop && len(w.conns) < w.size
+		w.lock.Unlock()
+		if !short {
+			return
+		}
+		c, err := p.dialWarmConn()
+		if err != nil {
+			// retry on the next check
+			return
+		}
+		w.lock.Lock()
+		if w.stop != stop || len(w.conns) >= w.size {
+			w.lock.Unlock()
+			c.Close()
+			return
+		}
+		w.conns = append(w.conns, c)
+		w.lock.Unlock()
+	}
+}
+
+// dialWarmConn makes a connection to the proxy ready for the tunnel request
+func (p *SuperProxy) dialWarmConn() (net.Conn, error) {
+	c, err := p.dial(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		if err = transport.TLSHandshake(tlsConn, 0); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if p.proxyType == ProxyTypeSOCKS5 {
+		if err = p.greetSOCKS5Proxy(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// isConnAlive if the idle connection is neither closed by the peer nor
+// receiving unexpected data
+func isConnAlive(c net.Conn) bool {
+	if err := c.SetReadDeadline(time.Now().Add(prewarmProbeTimeout)); err != nil {
+		return false
+	}
+	var b [1]byte
+	n, err := c.Read(b[:])
+	if n > 0 {
+		return false
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		return false
+	}
+	return c.SetReadDeadline(time.Time{}) == nil
+}
@@ -0,0 +1,133 @@
+package superproxy
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/bufiopool"
+)
+
+// slowProxy a HTTP proxy taking 100ms before serving new connections
+type slowProxy struct {
+	ln    net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func newSlowProxy(t *testing.T) *slowProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &slowProxy{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.conns = append(s.conns, conn)
+			s.lock.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *slowProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	r := textproto.NewReader(bufio.NewReader(conn))
+	if _, err := r.ReadLine(); err != nil {
+		return
+	}
+	if _, err := r.ReadMIMEHeader(); err != nil {
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	conn.Read(make([]byte, 1))
+}
+
+func (s *slowProxy) accepted() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.conns)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the condition")
+}
+
+func TestSuperProxyPrewarm(t *testing.T) {
+	defaultInterval := PrewarmCheckInterval
+	PrewarmCheckInterval = 20 * time.Millisecond
+	defer func() { PrewarmCheckInterval = defaultInterval }()
+
+	s := newSlowProxy(t)
+	defer s.ln.Close()
+	port := uint16(s.ln.Addr().(*net.TCPAddr).Port)
+	superProxy, err := NewSuperProxy("127.0.0.1", port, ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	pool := bufiopool.New(0, 0)
+	makeTunnel := func() time.Duration {
+		start := time.Now()
+		c, err := superProxy.MakeTunnel(nil, nil, pool, "www.example.com:443")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		c.Close()
+		return time.Since(start)
+	}
+
+	if d := makeTunnel(); d < 100*time.Millisecond {
+		t.Fatalf("unexpected cold tunnel latency %s", d)
+	}
+
+	superProxy.Prewarm(1)
+	defer superProxy.Prewarm(0)
+	waitFor(t, func() bool { return superProxy.PrewarmStats().Idle == 1 })
+	time.Sleep(150 * time.Millisecond)
+	if d := makeTunnel(); d >= 100*time.Millisecond {
+		t.Fatalf("unexpected warm tunnel latency %s", d)
+	}
+	if stats := superProxy.PrewarmStats(); stats.Hits != 1 || stats.Misses != 0 || stats.HitRate() != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// used and dead connections are replaced
+	waitFor(t, func() bool { return s.accepted() == 3 && superProxy.PrewarmStats().Idle == 1 })
+	s.lock.Lock()
+	s.conns[2].Close()
+	s.lock.Unlock()
+	waitFor(t, func() bool { return s.accepted() == 4 && superProxy.PrewarmStats().Idle == 1 })
+
+	// the tunnels dialed by custom functions never use them
+	c, err := superProxy.MakeTunnel(func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}, nil, pool, "www.example.com:443")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.Close()
+	if stats := superProxy.PrewarmStats(); stats.Idle != 1 || stats.Misses != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	superProxy.Prewarm(0)
+	if stats := superProxy.PrewarmStats(); stats.Idle != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
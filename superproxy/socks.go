@@ -2,9 +2,11 @@ package superproxy
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"syscall"
 
 	"github.com/haxii/fastproxy/bytebufferpool"
 )
@@ -24,6 +26,18 @@ const (
 	socks5IP6    = 4
 )
 
+// SOCKS5 reply codes of the failed commands, RFC 1928 6
+const (
+	SOCKS5GeneralFailure byte = 1 + iota
+	SOCKS5NotAllowed
+	SOCKS5NetworkUnreachable
+	SOCKS5HostUnreachable
+	SOCKS5ConnectionRefused
+	SOCKS5TTLExpired
+	SOCKS5CommandNotSupported
+	SOCKS5AddressNotSupported
+)
+
 var socks5Errors = []string{
 	"",
 	"general failure",
@@ -36,6 +50,48 @@ var socks5Errors = []string{
 	"address type not supported",
 }
 
+// socks5Errnos the errnos of the dials failing the same way as the target
+// side failures, so that errors.Is finds them alike
+var socks5Errnos = map[byte]syscall.Errno{
+	SOCKS5NetworkUnreachable: syscall.ENETUNREACH,
+	SOCKS5HostUnreachable:    syscall.EHOSTUNREACH,
+	SOCKS5ConnectionRefused:  syscall.ECONNREFUSED,
+	SOCKS5TTLExpired:         syscall.EHOSTUNREACH,
+}
+
+// SOCKS5Error the SOCKS5 proxy replied the command with a failure,
+// e.g. SOCKS5ConnectionRefused if the target refused the connection
+type SOCKS5Error struct {
+	Code byte
+	// BoundAddr the address in the reply, empty if not sent
+	BoundAddr string
+
+	proxy   string
+	command string
+}
+
+func (e *SOCKS5Error) Error() string {
+	failure := "unknown error " + strconv.Itoa(int(e.Code))
+	if int(e.Code) < len(socks5Errors) {
+		failure = socks5Errors[e.Code]
+	}
+	return "proxy: SOCKS5 proxy at " + e.proxy + " failed to " + e.command + ": " + failure
+}
+
+// TargetFailure if the target is unreachable from the proxy, e.g. refused
+// the connection, rather than the proxy failed or disallowed the command
+func (e *SOCKS5Error) TargetFailure() bool {
+	_, ok := socks5Errnos[e.Code]
+	return ok
+}
+
+// Is if target is the errno of the dials failing alike,
+// e.g. syscall.ECONNREFUSED for SOCKS5ConnectionRefused
+func (e *SOCKS5Error) Is(target error) bool {
+	errno, ok := socks5Errnos[e.Code]
+	return ok && target == errno
+}
+
 func (p *SuperProxy) initSOCKS5GreetingsAndAuth(user string, pass string) {
 	p.socks5Greetings = make([]byte, 0, 4)
 	p.socks5Greetings = append(p.socks5Greetings, socks5Version)
@@ -58,10 +114,19 @@ func (p *SuperProxy) initSOCKS5GreetingsAndAuth(user string, pass string) {
 // connect takes an existing connection to a socks5 proxy server,
 // and commands the server to extend that connection to target,
 // which must be a canonical address with a host and port.
-func (p *SuperProxy) connectSOCKS5Proxy(conn net.Conn, targetHost string, targetPort int) error {
+func (p *SuperProxy) connectSOCKS5Proxy(conn net.Conn, targetHost string, targetPort int) (*socks5Addr, error) {
+	if err := p.greetSOCKS5Proxy(conn); err != nil {
+		return nil, err
+	}
+	return p.commandSOCKS5Connect(conn, targetHost, targetPort)
+}
+
+// greetSOCKS5Proxy sends the greetings and authenticates with the
+// socks5 proxy server, the connection is ready for the connect command
+func (p *SuperProxy) greetSOCKS5Proxy(conn net.Conn) error {
 	if _, err := conn.Write(p.socks5Greetings); err != nil {
-		return errors.New("proxy: failed to write greeting to SOCKS5 proxy at " +
-			p.hostWithPort + ": " + err.Error())
+		return fmt.Errorf("proxy: failed to write greeting to SOCKS5 proxy at %s: %w",
+			p.hostWithPort, err)
 	}
 	buf := bytebufferpool.Get()
 	defer bytebufferpool.Put(buf)
@@ -69,8 +134,8 @@ func (p *SuperProxy) connectSOCKS5Proxy(conn net.Conn, targetHost string, target
 
 	//TODO: use bufio instead?
 	if _, err := io.ReadFull(conn, buf.B[:2]); err != nil {
-		return errors.New("proxy: failed to read greeting from SOCKS5 proxy at " +
-			p.hostWithPort + ": " + err.Error())
+		return fmt.Errorf("proxy: failed to read greeting from SOCKS5 proxy at %s: %w",
+			p.hostWithPort, err)
 	}
 	if buf.B[0] != 5 {
 		return errors.New("proxy: SOCKS5 proxy at " +
@@ -84,13 +149,13 @@ func (p *SuperProxy) connectSOCKS5Proxy(conn net.Conn, targetHost string, target
 	// See RFC 1929
 	if buf.B[1] == socks5AuthPassword {
 		if _, err := conn.Write(p.socks5Auth); err != nil {
-			return errors.New("proxy: failed to write authentication request to SOCKS5 proxy at " +
-				p.hostWithPort + ": " + err.Error())
+			return fmt.Errorf("proxy: failed to write authentication request to SOCKS5 proxy at %s: %w",
+				p.hostWithPort, err)
 		}
 
 		if _, err := io.ReadFull(conn, buf.B[:2]); err != nil {
-			return errors.New("proxy: failed to read authentication reply from SOCKS5 proxy at " +
-				p.hostWithPort + ": " + err.Error())
+			return fmt.Errorf("proxy: failed to read authentication reply from SOCKS5 proxy at %s: %w",
+				p.hostWithPort, err)
 		}
 
 		if buf.B[1] != 0 {
@@ -98,84 +163,138 @@ func (p *SuperProxy) connectSOCKS5Proxy(conn net.Conn, targetHost string, target
 				p.hostWithPort + " rejected username/password")
 		}
 	}
+	return nil
+}
 
-	buf.Reset()
+// commandSOCKS5Connect commands the greeted socks5 proxy server to
+// extend the connection to target, returns the address bound for it
+func (p *SuperProxy) commandSOCKS5Connect(conn net.Conn, targetHost string, targetPort int) (*socks5Addr, error) {
+	return p.commandSOCKS5(conn, socks5Connect, "connect", targetHost, targetPort)
+}
+
+// commandSOCKS5 sends the command cmd named name with the address to the
+// greeted socks5 proxy server, returns the address bound by the server,
+// a failure replied is returned as a *SOCKS5Error
+func (p *SuperProxy) commandSOCKS5(conn net.Conn, cmd byte, name string,
+	targetHost string, targetPort int) (*socks5Addr, error) {
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
 	buf.WriteByte(socks5Version)
-	buf.WriteByte(socks5Connect)
+	buf.WriteByte(cmd)
 	buf.WriteByte(0) /* reserved */
 
-	if ip := net.ParseIP(targetHost); ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
-			buf.WriteByte(socks5IP4)
-			ip = ip4
-		} else {
-			buf.WriteByte(socks5IP6)
-		}
-		buf.Write(ip)
-	} else {
-		if len(targetHost) > 255 {
-			return errors.New("proxy: destination host name too long: " + targetHost)
-		}
-		buf.WriteByte(socks5Domain)
-		buf.WriteByte(byte(len(targetHost)))
-		buf.WriteString(targetHost)
+	var err error
+	if buf.B, err = appendSOCKS5Addr(buf.B, targetHost, targetPort); err != nil {
+		return nil, err
 	}
-	buf.WriteByte(byte(targetPort >> 8))
-	buf.WriteByte(byte(targetPort))
 
 	if _, err := conn.Write(buf.B); err != nil {
-		return errors.New("proxy: failed to write connect request to SOCKS5 proxy at " +
-			p.hostWithPort + ": " + err.Error())
+		return nil, fmt.Errorf("proxy: failed to write %s request to SOCKS5 proxy at %s: %w",
+			name, p.hostWithPort, err)
 	}
 
-	if _, err := io.ReadFull(conn, buf.B[:4]); err != nil {
-		return errors.New("proxy: failed to read connect reply from SOCKS5 proxy at " +
-			p.hostWithPort + ": " + err.Error())
+	if _, err := io.ReadFull(conn, buf.B[:3]); err != nil {
+		return nil, fmt.Errorf("proxy: failed to read %s reply from SOCKS5 proxy at %s: %w",
+			name, p.hostWithPort, err)
 	}
 
-	failure := "unknown error"
-	if int(buf.B[1]) < len(socks5Errors) {
-		failure = socks5Errors[buf.B[1]]
+	if buf.B[0] != socks5Version {
+		return nil, errors.New("proxy: SOCKS5 proxy at " +
+			p.hostWithPort + " has unexpected version " + strconv.Itoa(int(buf.B[0])))
 	}
 
-	if len(failure) > 0 {
-		return errors.New("proxy: SOCKS5 proxy at " +
-			p.hostWithPort + " failed to connect: " + failure)
+	// the address is read whatever the reply, a failure is still reported
+	// if the proxy closes the connection without sending it
+	addr, err := readSOCKS5Addr(conn)
+	if code := buf.B[1]; code != 0 {
+		replyErr := &SOCKS5Error{Code: code, proxy: p.hostWithPort, command: name}
+		if err == nil {
+			replyErr.BoundAddr = addr.String()
+		}
+		return nil, replyErr
 	}
+	if err != nil {
+		return nil, fmt.Errorf("proxy: failed to read bound address from SOCKS5 proxy at %s: %w",
+			p.hostWithPort, err)
+	}
+	return addr, nil
+}
 
-	bytesToDiscard := 0
-	switch buf.B[3] {
-	case socks5IP4:
-		bytesToDiscard = net.IPv4len
-	case socks5IP6:
-		bytesToDiscard = net.IPv6len
-	case socks5Domain:
-		_, err := io.ReadFull(conn, buf.B[:1])
-		if err != nil {
-			return errors.New("proxy: failed to read domain length from SOCKS5 proxy at " +
-				p.hostWithPort + ": " + err.Error())
+// socks5Addr the address of the socks5 requests, replies and datagrams,
+// host is either the IP or the domain
+type socks5Addr struct {
+	host string
+	port int
+}
+
+func (a *socks5Addr) String() string {
+	return net.JoinHostPort(a.host, strconv.Itoa(a.port))
+}
+
+// SOCKS5Conn the tunnel made through a SOCKS5 proxy by MakeTunnel
+type SOCKS5Conn struct {
+	net.Conn
+	bound string
+}
+
+// BoundAddr the address the proxy bound for the tunnel, i.e. the host and
+// port the target sees the tunnel from, which is a domain or IPv4 or IPv6
+func (c *SOCKS5Conn) BoundAddr() string {
+	return c.bound
+}
+
+// appendSOCKS5Addr appends the address type, address and port of the host
+func appendSOCKS5Addr(b []byte, host string, port int) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5IP4)
+			ip = ip4
+		} else {
+			b = append(b, socks5IP6)
 		}
-		bytesToDiscard = int(buf.B[0])
-	default:
-		return errors.New("proxy: got unknown address type " +
-			strconv.Itoa(int(buf.B[3])) + " from SOCKS5 proxy at " + p.hostWithPort)
+		b = append(b, ip...)
+	} else {
+		if len(host) > 255 {
+			return b, errors.New("proxy: destination host name too long: " + host)
+		}
+		b = append(b, socks5Domain, byte(len(host)))
+		b = append(b, host...)
 	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
 
-	if cap(buf.B) < bytesToDiscard {
-		buf.B = make([]byte, bytesToDiscard)
-	} else {
-		buf.B = buf.B[:bytesToDiscard]
+// readSOCKS5Addr reads the address type, address and port from r
+func readSOCKS5Addr(r io.Reader) (*socks5Addr, error) {
+	var b [255]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return nil, err
 	}
-	if _, err := io.ReadFull(conn, buf.B); err != nil {
-		return errors.New("proxy: failed to read address from SOCKS5 proxy at " +
-			p.hostWithPort + ": " + err.Error())
+	addr := &socks5Addr{}
+	switch b[0] {
+	case socks5IP4, socks5IP6:
+		n := net.IPv4len
+		if b[0] == socks5IP6 {
+			n = net.IPv6len
+		}
+		if _, err := io.ReadFull(r, b[:n]); err != nil {
+			return nil, err
+		}
+		addr.host = net.IP(b[:n]).String()
+	case socks5Domain:
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return nil, err
+		}
+		n := int(b[0])
+		if _, err := io.ReadFull(r, b[:n]); err != nil {
+			return nil, err
+		}
+		addr.host = string(b[:n])
+	default:
+		return nil, errors.New("unknown address type " + strconv.Itoa(int(b[0])))
 	}
-
-	// Also need to discard the port number
-	if _, err := io.ReadFull(conn, buf.B[:2]); err != nil {
-		return errors.New("proxy: failed to read port from SOCKS5 proxy at " +
-			p.hostWithPort + ": " + err.Error())
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return nil, err
 	}
-
-	return nil
+	addr.port = int(b[0])<<8 | int(b[1])
+	return addr, nil
 }
@@ -0,0 +1,119 @@
+package superproxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scriptedSOCKS5Proxy a SOCKS5 proxy answering the greetings with no auth,
+// then the connect request with reply, followed by the rest bytes, it closes
+// the connection once replied if the reply carries no address
+func scriptedSOCKS5Proxy(t *testing.T, reply []byte, rest string) (*SuperProxy, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 3)
+		if _, err = io.ReadFull(conn, b[:3]); err != nil {
+			return
+		}
+		conn.Write([]byte{socks5Version, socks5AuthNone})
+		if _, err = io.ReadFull(conn, b[:3]); err != nil {
+			return
+		}
+		if _, err = readSOCKS5Addr(conn); err != nil {
+			return
+		}
+		conn.Write(append(reply, rest...))
+		if len(reply) > 3 {
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	p, err := NewSuperProxy("127.0.0.1", uint16(ln.Addr().(*net.TCPAddr).Port), ProxyTypeSOCKS5, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return p, func() { ln.Close() }
+}
+
+func TestSOCKS5Replies(t *testing.T) {
+	ip4Bound := []byte{socks5IP4, 10, 0, 0, 1, 0x1f, 0x90}
+	ip6Bound := append(append([]byte{socks5IP6}, net.ParseIP("2001:db8::1")...), 0, 80)
+	domainBound := append(append([]byte{socks5Domain, 11}, "example.com"...), 1, 187)
+
+	for _, c := range []struct {
+		code      byte
+		bound     []byte
+		boundAddr string
+		target    bool
+		errno     error
+	}{
+		{SOCKS5GeneralFailure, ip4Bound, "10.0.0.1:8080", false, nil},
+		{SOCKS5NotAllowed, ip6Bound, "[2001:db8::1]:80", false, nil},
+		{SOCKS5NetworkUnreachable, domainBound, "example.com:443", true, syscall.ENETUNREACH},
+		{SOCKS5HostUnreachable, ip4Bound, "10.0.0.1:8080", true, syscall.EHOSTUNREACH},
+		{SOCKS5ConnectionRefused, ip6Bound, "[2001:db8::1]:80", true, syscall.ECONNREFUSED},
+		{SOCKS5TTLExpired, domainBound, "example.com:443", true, syscall.EHOSTUNREACH},
+		{SOCKS5CommandNotSupported, ip4Bound, "10.0.0.1:8080", false, nil},
+		{SOCKS5AddressNotSupported, ip4Bound, "10.0.0.1:8080", false, nil},
+		{0x42, ip4Bound, "10.0.0.1:8080", false, nil},
+		// the address is left out by the proxy closing the connection
+		{SOCKS5ConnectionRefused, nil, "", true, syscall.ECONNREFUSED},
+	} {
+		p, stop := scriptedSOCKS5Proxy(t, append([]byte{socks5Version, c.code, 0}, c.bound...), "")
+		conn, err := p.MakeTunnelBefore(nil, nil, nil, "www.example.com:443", time.Now().Add(5*time.Second))
+		stop()
+		if conn != nil {
+			t.Fatalf("code %d: unexpected tunnel made", c.code)
+		}
+		var replyErr *SOCKS5Error
+		if !errors.As(err, &replyErr) || replyErr.Code != c.code || replyErr.BoundAddr != c.boundAddr {
+			t.Fatalf("code %d: unexpected error %#v", c.code, err)
+		}
+		if replyErr.TargetFailure() != c.target || errors.Is(err, ErrHandshake) == c.target {
+			t.Fatalf("code %d: unexpected target failure %v of %s", c.code, replyErr.TargetFailure(), err)
+		}
+		if c.errno != nil && !errors.Is(err, c.errno) {
+			t.Fatalf("code %d: expected %s to be %s", c.code, err, c.errno)
+		}
+	}
+}
+
+func TestSOCKS5BoundAddr(t *testing.T) {
+	for _, c := range []struct {
+		bound     []byte
+		boundAddr string
+	}{
+		{[]byte{socks5IP4, 10, 0, 0, 1, 0x1f, 0x90}, "10.0.0.1:8080"},
+		{append(append([]byte{socks5IP6}, net.ParseIP("2001:db8::1")...), 0, 80), "[2001:db8::1]:80"},
+		{append(append([]byte{socks5Domain, 11}, "example.com"...), 1, 187), "example.com:443"},
+	} {
+		// the bytes after the reply are the target's, none is lost
+		p, stop := scriptedSOCKS5Proxy(t, append([]byte{socks5Version, 0, 0}, c.bound...), "hello")
+		conn, err := p.MakeTunnel(nil, nil, nil, "www.example.com:443")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", c.boundAddr, err)
+		}
+		socksConn, ok := conn.(*SOCKS5Conn)
+		if !ok || socksConn.BoundAddr() != c.boundAddr {
+			t.Fatalf("%s: unexpected tunnel %#v", c.boundAddr, conn)
+		}
+		b := make([]byte, 5)
+		if _, err = io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+			t.Fatalf("%s: unexpected bytes %q read, error: %v", c.boundAddr, b, err)
+		}
+		conn.Close()
+		stop()
+	}
+}
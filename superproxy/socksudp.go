@@ -0,0 +1,181 @@
+package superproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/haxii/fastproxy/util"
+)
+
+const socks5UDPAssociate = 3
+
+// maxUDPDatagramSize max size of the datagrams relayed, header included
+const maxUDPDatagramSize = 64 * 1024
+
+// errUDPNotSOCKS5 the UDP association is asked from a proxy other than SOCKS5
+var errUDPNotSOCKS5 = errors.New("proxy: UDP associate needs a SOCKS5 proxy")
+
+// UDPAssociation a UDP association made with the SOCKS5 proxy, RFC 1928 7,
+// relaying the datagrams to and from any target through the proxy, e.g. for
+// DNS or QUIC. It ends once closed or the proxy closes its control
+// connection.
+//
+// The limitations:
+//   - the fragmented datagrams are not supported, the ones received are
+//     dropped and the ones sent are never fragmented, so the payload must
+//     fit into a single datagram to the relay
+//   - the client address is announced as unknown, i.e. 0.0.0.0:0, the
+//     proxies accepting only the datagrams from the address announced
+//     reject the association
+//   - the relay of the proxy behind a NAT may bind an address unreachable
+//     from here, the unspecified one is replaced by the address of the proxy,
+//     while the other private ones are dialed as is
+//   - the datagrams are relayed as is, there's no retransmission or order
+type UDPAssociation struct {
+	ctrl  net.Conn
+	relay *net.UDPConn
+}
+
+// AssociateUDP makes a UDP association with the SOCKS5 proxy, the control
+// connection is dialed by dial if not nil, the handshake fails with a
+// timeout error once the deadline is exceeded, no deadline if zero
+func (p *SuperProxy) AssociateUDP(dial func(addr string) (net.Conn, error),
+	deadline time.Time) (*UDPAssociation, error) {
+	if p.proxyType != ProxyTypeSOCKS5 {
+		return nil, errUDPNotSOCKS5
+	}
+	ctrl, err := p.dial(dial, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !deadline.IsZero() {
+		if err = ctrl.SetDeadline(deadline); err != nil {
+			ctrl.Close()
+			return nil, err
+		}
+	}
+	bound, err := p.associateSOCKS5UDP(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, util.ErrKind(ErrHandshake, err)
+	}
+	if err = ctrl.SetDeadline(time.Time{}); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	// the unspecified relay address is the one of the proxy
+	relayAddr, err := net.ResolveUDPAddr("udp", bound.String())
+	if err == nil && relayAddr.IP.IsUnspecified() {
+		if tcpAddr, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relayAddr.IP = tcpAddr.IP
+		}
+	}
+	var relay *net.UDPConn
+	if err == nil {
+		relay, err = net.DialUDP("udp", nil, relayAddr)
+	}
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	a := &UDPAssociation{ctrl: ctrl, relay: relay}
+	go a.watch()
+	return a, nil
+}
+
+// associateSOCKS5UDP greets the socks5 proxy server and commands the UDP
+// associate, returns the address of the relay
+func (p *SuperProxy) associateSOCKS5UDP(conn net.Conn) (*socks5Addr, error) {
+	if err := p.greetSOCKS5Proxy(conn); err != nil {
+		return nil, err
+	}
+	return p.commandSOCKS5(conn, socks5UDPAssociate, "associate UDP", "0.0.0.0", 0)
+}
+
+// watch closes the association once the proxy closes the control connection
+func (a *UDPAssociation) watch() {
+	io.Copy(ioutil.Discard, a.ctrl)
+	a.Close()
+}
+
+// RelayAddr address of the relay of the proxy the datagrams are sent to
+func (a *UDPAssociation) RelayAddr() net.Addr {
+	return a.relay.RemoteAddr()
+}
+
+// WriteTo sends b in a datagram to the target through the relay
+func (a *UDPAssociation) WriteTo(b []byte, targetHostWithPort string) (int, error) {
+	host, portStr, err := net.SplitHostPort(targetHostWithPort)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return 0, errors.New("proxy: invalid target port number: " + portStr)
+	}
+	datagram := make([]byte, 0, 3+1+255+2+len(b))
+	datagram = append(datagram, 0, 0, 0 /* reserved and fragment */)
+	if datagram, err = appendSOCKS5Addr(datagram, host, port); err != nil {
+		return 0, err
+	}
+	if len(datagram)+len(b) > maxUDPDatagramSize {
+		return 0, errors.New("proxy: UDP payload too large: " + strconv.Itoa(len(b)))
+	}
+	if _, err = a.relay.Write(append(datagram, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads the payload of the next datagram relayed back into b,
+// returns its size and the target it's from. The payload is truncated to
+// the size of b, and the fragmented datagrams are dropped.
+func (a *UDPAssociation) ReadFrom(b []byte) (n int, targetHostWithPort string, err error) {
+	bufPtr := acquireDatagramBuf()
+	defer datagramBufPool.Put(bufPtr)
+	datagram := *bufPtr
+	for {
+		dn, err := a.relay.Read(datagram)
+		if err != nil {
+			return 0, "", err
+		}
+		if dn < 4 || datagram[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(datagram[3:dn])
+		addr, err := readSOCKS5Addr(r)
+		if err != nil {
+			continue
+		}
+		return copy(b, datagram[dn-r.Len():dn]), addr.String(), nil
+	}
+}
+
+// datagramBufPool pool of the buffers the datagrams are read into
+var datagramBufPool sync.Pool
+
+func acquireDatagramBuf() *[]byte {
+	if v := datagramBufPool.Get(); v != nil {
+		return v.(*[]byte)
+	}
+	b := make([]byte, maxUDPDatagramSize)
+	return &b
+}
+
+// SetReadDeadline sets the deadline of ReadFrom
+func (a *UDPAssociation) SetReadDeadline(t time.Time) error {
+	return a.relay.SetReadDeadline(t)
+}
+
+// Close ends the association
+func (a *UDPAssociation) Close() error {
+	a.ctrl.Close()
+	return a.relay.Close()
+}
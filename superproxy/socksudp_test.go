@@ -0,0 +1,126 @@
+package superproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpSOCKS5Proxy a SOCKS5 proxy relaying the datagrams back with their
+// payload in upper case as if sent by their targets, a datagram of fragment 1 is sent first
+type udpSOCKS5Proxy struct {
+	ln    net.Listener
+	relay *net.UDPConn
+	ctrl  chan net.Conn
+}
+
+func newUDPSOCKS5Proxy(t *testing.T) *udpSOCKS5Proxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &udpSOCKS5Proxy{ln: ln, relay: relay, ctrl: make(chan net.Conn, 1)}
+	go s.serveCtrl()
+	go s.serveRelay()
+	return s
+}
+
+func (s *udpSOCKS5Proxy) serveCtrl() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	b := make([]byte, 10)
+	// greetings with no auth, then the associate request of 0.0.0.0:0
+	if _, err = io.ReadFull(conn, b[:3]); err != nil {
+		return
+	}
+	conn.Write([]byte{socks5Version, socks5AuthNone})
+	if _, err = io.ReadFull(conn, b[:10]); err != nil || b[1] != socks5UDPAssociate {
+		conn.Close()
+		return
+	}
+	// bound to the unspecified address
+	port := s.relay.LocalAddr().(*net.UDPAddr).Port
+	conn.Write([]byte{socks5Version, 0, 0, socks5IP4, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+	s.ctrl <- conn
+}
+
+func (s *udpSOCKS5Proxy) serveRelay() {
+	b := make([]byte, 2048)
+	for {
+		n, addr, err := s.relay.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(b[3:n])
+		if _, err := readSOCKS5Addr(r); err != nil {
+			continue
+		}
+		header := n - r.Len()
+		reply := append(append([]byte(nil), b[:header]...), bytes.ToUpper(b[header:n])...)
+		fragment := append([]byte(nil), reply...)
+		fragment[2] = 1
+		s.relay.WriteToUDP(fragment, addr)
+		s.relay.WriteToUDP(reply, addr)
+	}
+}
+
+func (s *udpSOCKS5Proxy) close() {
+	s.ln.Close()
+	s.relay.Close()
+}
+
+func TestAssociateUDP(t *testing.T) {
+	s := newUDPSOCKS5Proxy(t)
+	defer s.close()
+	p, err := NewSuperProxy("127.0.0.1", uint16(s.ln.Addr().(*net.TCPAddr).Port),
+		ProxyTypeSOCKS5, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	a, err := p.AssociateUDP(nil, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer a.Close()
+	if relay := a.RelayAddr().(*net.UDPAddr); !relay.IP.IsLoopback() {
+		t.Fatalf("unexpected relay address %s", relay)
+	}
+
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, target := range []string{"8.8.8.8:53", "dns.example.com:53", "[2001:db8::1]:443"} {
+		if _, err = a.WriteTo([]byte("query"), target); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// the fragment is dropped
+		b := make([]byte, 16)
+		n, from, err := a.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(b[:n]) != "QUERY" || from != target {
+			t.Fatalf("unexpected datagram %q from %s", b[:n], from)
+		}
+	}
+
+	// the proxy ends the association
+	(<-s.ctrl).Close()
+	time.Sleep(50 * time.Millisecond)
+	if _, err = a.WriteTo([]byte("query"), "8.8.8.8:53"); err == nil {
+		t.Fatal("expected the association closed")
+	}
+
+	// only SOCKS5 proxies associate
+	p, _ = NewSuperProxy("127.0.0.1", 8080, ProxyTypeHTTP, "", "", "")
+	if _, err = p.AssociateUDP(nil, time.Time{}); !errors.Is(err, errUDPNotSOCKS5) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/haxii/fastproxy/bufiopool"
 	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/util"
 )
 
 // ProxyType type of super proxy
@@ -27,6 +28,12 @@ const (
 	DefaultMaxConcurrency = 128
 )
 
+// ErrHandshake the tunnel request made to the super proxy failed,
+// e.g. the CONNECT request is rejected. The *SOCKS5Error telling the
+// target is unreachable, see SOCKS5Error.TargetFailure, is not the
+// failure of the proxy, so it's returned by MakeTunnel as is.
+var ErrHandshake = errors.New("super proxy handshake failed")
+
 //SuperProxy chaining proxy
 type SuperProxy struct {
 	hostWithPort      string
@@ -53,6 +60,9 @@ type SuperProxy struct {
 
 	//concurrency chan
 	concurrencyChan chan struct{}
+
+	// warm connections kept by Prewarm
+	warm warmPool
 }
 
 // NewSuperProxy new a super proxy
@@ -123,33 +133,107 @@ func (p *SuperProxy) HTTPProxyAuthHeaderWithCRLF() []byte {
 	return p.authHeaderWithCRLF
 }
 
-// MakeTunnel makes a TCP tunnel by making a connect request to proxy
-func (p *SuperProxy) MakeTunnel(dial func(addr string) (net.Conn, error),
-	dialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error),
-	pool *bufiopool.Pool, targetHostWithPort string) (net.Conn, error) {
-	var (
-		c   net.Conn
-		err error
-	)
+// dial makes a new connection to the proxy
+func (p *SuperProxy) dial(dial func(addr string) (net.Conn, error),
+	dialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error)) (net.Conn, error) {
 	switch p.proxyType {
 	case ProxyTypeHTTP:
 		fallthrough
 	case ProxyTypeSOCKS5:
 		if dial != nil {
-			c, err = dial(p.hostWithPort)
-		} else {
-			c, err = transport.Dial(p.hostWithPort)
+			return dial(p.hostWithPort)
 		}
+		return transport.Dial(p.hostWithPort)
 	case ProxyTypeHTTPS:
 		if dialTLS != nil {
-			c, err = dialTLS(p.hostWithPort, p.tlsConfig)
-		} else {
-			c, err = transport.DialTLS(p.hostWithPort, p.tlsConfig)
+			return dialTLS(p.hostWithPort, p.tlsConfig)
 		}
+		return transport.DialTLS(p.hostWithPort, p.tlsConfig)
 	}
+	return nil, errors.New("proxy: unknown proxy type " + strconv.Itoa(int(p.proxyType)))
+}
 
-	if err != nil {
-		return nil, err
+// AcquireConn acquires an idle keep-alive connection to the proxy or makes
+// a new one if none available, which is only used by non-tunneled HTTP proxy
+// requests, CONNECT tunnels are made by MakeTunnel and never reused.
+//
+// It is safe calling AcquireConn from concurrently running go routines.
+// The connection must be passed to ReleaseConn or CloseConn after usage.
+func (p *SuperProxy) AcquireConn(dial func(addr string) (net.Conn, error),
+	dialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error)) (*transport.Conn, error) {
+	if p.proxyType == ProxyTypeSOCKS5 {
+		return nil, errors.New("proxy: SOCKS5 proxy does not support non-tunneled requests")
+	}
+	return p.connManager.AcquireConn(func() (net.Conn, error) {
+		return p.dial(dial, dialTLS)
+	})
+}
+
+// ReleaseConn puts the connection acquired by AcquireConn back for reusing
+func (p *SuperProxy) ReleaseConn(cc *transport.Conn) {
+	p.connManager.ReleaseConn(cc)
+}
+
+// CloseConn closes the connection acquired by AcquireConn
+func (p *SuperProxy) CloseConn(cc *transport.Conn) {
+	p.connManager.CloseConn(cc)
+}
+
+// CloseIdleConns closes the idle connections acquired by AcquireConn and
+// put back, returns the number closed
+func (p *SuperProxy) CloseIdleConns() int {
+	return p.connManager.CloseIdleConns()
+}
+
+// MakeTunnel makes a TCP tunnel by making a connect request to proxy,
+// the tunnels made through SOCKS5 proxies are *SOCKS5Conn
+func (p *SuperProxy) MakeTunnel(dial func(addr string) (net.Conn, error),
+	dialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error),
+	pool *bufiopool.Pool, targetHostWithPort string) (net.Conn, error) {
+	return p.MakeTunnelBefore(dial, dialTLS, pool, targetHostWithPort, time.Time{})
+}
+
+// MakeTunnelBefore same as MakeTunnel, the handshake with the proxy fails
+// with a timeout error once the deadline is exceeded, no deadline if zero
+func (p *SuperProxy) MakeTunnelBefore(dial func(addr string) (net.Conn, error),
+	dialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error),
+	pool *bufiopool.Pool, targetHostWithPort string, deadline time.Time) (net.Conn, error) {
+	return p.MakeTunnelWithin(dial, dialTLS, pool, targetHostWithPort, deadline, 0)
+}
+
+// MakeTunnelWithin same as MakeTunnelBefore, the handshake with the proxy
+// also fails with a timeout error if it takes longer than timeout counted
+// from the connection made, i.e. regardless of the dial timeout, no limit
+// but the deadline if not set
+func (p *SuperProxy) MakeTunnelWithin(dial func(addr string) (net.Conn, error),
+	dialTLS func(addr string, tlsConfig *tls.Config) (net.Conn, error),
+	pool *bufiopool.Pool, targetHostWithPort string, deadline time.Time,
+	timeout time.Duration) (net.Conn, error) {
+	// prefer a warm connection made with the default dialer
+	var c net.Conn
+	var err error
+	warm := false
+	if dial == nil && dialTLS == nil {
+		c = p.takeWarmConn()
+		warm = c != nil
+	} else {
+		p.skipWarmConns()
+	}
+	if c == nil {
+		if c, err = p.dial(dial, dialTLS); err != nil {
+			return nil, err
+		}
+	}
+	if timeout > 0 {
+		if d := time.Now().Add(timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if !deadline.IsZero() {
+		if err = c.SetDeadline(deadline); err != nil {
+			c.Close()
+			return nil, err
+		}
 	}
 
 	if p.proxyType != ProxyTypeSOCKS5 {
@@ -157,11 +241,11 @@ func (p *SuperProxy) MakeTunnel(dial func(addr string) (net.Conn, error),
 		_, err := p.writeHTTPProxyReq(c, []byte(targetHostWithPort))
 		if err != nil {
 			c.Close()
-			return nil, err
+			return nil, util.ErrKind(ErrHandshake, err)
 		}
 		if err = p.readHTTPProxyResp(c, pool); err != nil {
 			c.Close()
-			return nil, err
+			return nil, util.ErrKind(ErrHandshake, err)
 		}
 	} else {
 		// SOCKS5 tunnel establishing
@@ -176,13 +260,60 @@ func (p *SuperProxy) MakeTunnel(dial func(addr string) (net.Conn, error),
 		if targetPort < 1 || targetPort > 0xffff {
 			return nil, errors.New("proxy: target port number out of range: " + targetPortStr)
 		}
-		if err = p.connectSOCKS5Proxy(c, targetHost, targetPort); err != nil {
+		var bound *socks5Addr
+		if warm {
+			bound, err = p.commandSOCKS5Connect(c, targetHost, targetPort)
+		} else {
+			bound, err = p.connectSOCKS5Proxy(c, targetHost, targetPort)
+		}
+		var replyErr *SOCKS5Error
+		if errors.As(err, &replyErr) && replyErr.TargetFailure() {
+			// the proxy works, it's the target that's unreachable
+			c.Close()
+			return nil, err
+		} else if err != nil {
+			c.Close()
+			return nil, util.ErrKind(ErrHandshake, err)
+		}
+		c = &SOCKS5Conn{Conn: c, bound: bound.String()}
+	}
+	if !deadline.IsZero() {
+		if err = c.SetDeadline(time.Time{}); err != nil {
+			c.Close()
 			return nil, err
 		}
 	}
 	return c, nil
 }
 
+// errTLSConfigNotHTTPS the TLS config is set to a proxy other than HTTPS
+var errTLSConfigNotHTTPS = errors.New("TLS config set to a super proxy other than HTTPS")
+
+// SetTLSConfig sets the TLS config of the connections to the HTTPS proxy,
+// e.g. trusting a custom CA, which is independent of the TLS config of the
+// targets. The one made by NewSuperProxy is kept if tlsConfig is nil.
+//
+// serverName overrides the SNI sent and the name verified if not empty,
+// e.g. when the certificate of the proxy doesn't match the host dialed.
+// Only the connections made afterwards use the new config.
+func (p *SuperProxy) SetTLSConfig(tlsConfig *tls.Config, serverName string) error {
+	if p.proxyType != ProxyTypeHTTPS {
+		return errTLSConfigNotHTTPS
+	}
+	if tlsConfig == nil {
+		tlsConfig = p.tlsConfig
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	if len(serverName) > 0 {
+		tlsConfig.ServerName = serverName
+	}
+	p.tlsConfig = tlsConfig
+	return nil
+}
+
 // SetMaxConcurrency sets max concurrency,
 // n should > 0
 func (p *SuperProxy) SetMaxConcurrency(n int) {
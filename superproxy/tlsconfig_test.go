@@ -0,0 +1,62 @@
+package superproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSuperProxySetTLSConfig(t *testing.T) {
+	serverNames := make(chan string, 4)
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverNames <- hello.ServerName
+		return nil, nil
+	}}
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	// the certificate is issued to example.com by a CA not trusted by default
+	superProxy, err := NewSuperProxy("localhost", uint16(addr.Port), ProxyTypeHTTPS, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	handshake := func() error {
+		c, err := superProxy.dial(nil, nil)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return c.(*tls.Conn).Handshake()
+	}
+	if err := handshake(); err == nil {
+		t.Fatal("expected the certificate of the proxy rejected")
+	}
+	if name := <-serverNames; name != "localhost" {
+		t.Fatalf("unexpected SNI %q", name)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	if err := superProxy.SetTLSConfig(&tls.Config{RootCAs: roots}, "example.com"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := handshake(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if name := <-serverNames; name != "example.com" {
+		t.Fatalf("unexpected SNI %q", name)
+	}
+
+	plain, _ := NewSuperProxy("localhost", 8080, ProxyTypeHTTP, "", "", "")
+	if err := plain.SetTLSConfig(nil, "example.com"); err != errTLSConfigNotHTTPS {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
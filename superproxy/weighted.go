@@ -0,0 +1,113 @@
+package superproxy
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// WeightedChooser chooses super proxies randomly in proportion to their
+// weights, e.g. to pick the exit proxy of every request in the hijacker's
+// SuperProxy. It's safe for concurrent use, weights can be updated at
+// any time, and Choose makes no allocations.
+//
+// To shift the load off the heavily used proxies, drive the weights from
+// per-proxy byte counters: e.g. start the weight of each proxy at the bytes
+// left in its quota, and lower it by the bytes relayed through it as the
+// hijacker's OnResponse or the proxy's OnConnClose reports them. A proxy
+// whose quota runs out is no longer chosen.
+type WeightedChooser struct {
+	lock    sync.Mutex
+	weights map[*SuperProxy]float64
+	// order keeps the proxies in the order they're added
+	order []*SuperProxy
+
+	// dirty 1 if the weights are changed since the sampler built
+	dirty   int32
+	sampler atomic.Value
+}
+
+// weightedSampler prefix-sum sampler of the proxies with positive weights
+type weightedSampler struct {
+	proxies []*SuperProxy
+	// cumulative weights of the proxies
+	cumulative []float64
+}
+
+// SetWeight sets the weight of p, a non-positive weight removes p
+func (c *WeightedChooser) SetWeight(p *SuperProxy, w float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.weights == nil {
+		c.weights = make(map[*SuperProxy]float64)
+	}
+	if _, ok := c.weights[p]; !ok {
+		if w <= 0 {
+			return
+		}
+		c.order = append(c.order, p)
+	}
+	if w <= 0 {
+		delete(c.weights, p)
+		for i, o := range c.order {
+			if o == p {
+				c.order = append(c.order[:i], c.order[i+1:]...)
+				break
+			}
+		}
+	} else {
+		c.weights[p] = w
+	}
+	atomic.StoreInt32(&c.dirty, 1)
+}
+
+// Weight the weight of p, 0 if not set
+func (c *WeightedChooser) Weight(p *SuperProxy) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.weights[p]
+}
+
+// Choose chooses a proxy randomly by weight, nil if no proxies weighted
+func (c *WeightedChooser) Choose() *SuperProxy {
+	if atomic.LoadInt32(&c.dirty) == 1 {
+		c.rebuild()
+	}
+	s, _ := c.sampler.Load().(*weightedSampler)
+	if s == nil || len(s.proxies) == 0 {
+		return nil
+	}
+	x := rand.Float64() * s.cumulative[len(s.cumulative)-1]
+	// the first proxy whose cumulative weight is above x
+	lo, hi := 0, len(s.cumulative)-1
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if s.cumulative[mid] > x {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return s.proxies[lo]
+}
+
+// rebuild builds the sampler from the current weights
+func (c *WeightedChooser) rebuild() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if atomic.LoadInt32(&c.dirty) == 0 {
+		return
+	}
+	s := &weightedSampler{
+		proxies:    make([]*SuperProxy, len(c.order)),
+		cumulative: make([]float64, len(c.order)),
+	}
+	copy(s.proxies, c.order)
+	total := 0.0
+	for i, p := range s.proxies {
+		total += c.weights[p]
+		s.cumulative[i] = total
+	}
+	c.sampler.Store(s)
+	atomic.StoreInt32(&c.dirty, 0)
+}
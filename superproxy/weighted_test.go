@@ -0,0 +1,46 @@
+package superproxy
+
+import (
+	"testing"
+)
+
+func TestWeightedChooser(t *testing.T) {
+	c := &WeightedChooser{}
+	if c.Choose() != nil {
+		t.Fatal("expected nil chosen without weights")
+	}
+	a, _ := NewSuperProxy("127.0.0.1", 1080, ProxyTypeHTTP, "", "", "")
+	b, _ := NewSuperProxy("127.0.0.1", 1081, ProxyTypeHTTP, "", "", "")
+	d, _ := NewSuperProxy("127.0.0.1", 1082, ProxyTypeHTTP, "", "", "")
+	c.SetWeight(a, 1)
+	c.SetWeight(b, 3)
+	c.SetWeight(d, 0)
+
+	const n = 40000
+	count := func() map[*SuperProxy]int {
+		counts := make(map[*SuperProxy]int)
+		for i := 0; i < n; i++ {
+			counts[c.Choose()]++
+		}
+		return counts
+	}
+	counts := count()
+	if counts[d] != 0 || counts[a] < n/4-n/20 || counts[a] > n/4+n/20 {
+		t.Fatalf("unexpected distribution %d %d %d", counts[a], counts[b], counts[d])
+	}
+
+	// weights updated take effect
+	c.SetWeight(b, 0)
+	c.SetWeight(d, 1)
+	counts = count()
+	if counts[b] != 0 || counts[a] < n/2-n/20 || counts[a] > n/2+n/20 {
+		t.Fatalf("unexpected distribution %d %d %d", counts[a], counts[b], counts[d])
+	}
+	if c.Weight(a) != 1 || c.Weight(b) != 0 {
+		t.Fatalf("unexpected weights %f %f", c.Weight(a), c.Weight(b))
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { c.Choose() }); allocs != 0 {
+		t.Fatalf("unexpected allocs %f", allocs)
+	}
+}
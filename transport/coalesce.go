@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+)
+
+// coalesceBufSize size of the buffer holding the writes coalesced
+const coalesceBufSize = 4 * 1024
+
+var errCoalescingWriterClosed = errors.New("coalescing writer closed")
+
+// ForwardWithCoalescing same as ForwardWithBufSize, the chunks read from src
+// within window are coalesced into a single write into dst, which is made
+// once the window expires or the buffer of 4KB fills up. It saves the write
+// syscalls of chatty relays, e.g. interactive tunnels of tiny packets, at the
+// cost of delaying every chunk for at most window.
+//
+// It's the same as ForwardWithBufSize if window not set.
+func ForwardWithCoalescing(dst io.Writer, src io.Reader, idle time.Duration,
+	bufSize int, window time.Duration) (int64, error) {
+	if window <= 0 {
+		return ForwardWithBufSize(dst, src, idle, bufSize)
+	}
+	w := newCoalescingWriter(dst, window)
+	n, err := ForwardWithBufSize(w, src, idle, bufSize)
+	if e := w.Close(); err == nil {
+		err = e
+	}
+	return n, err
+}
+
+// coalescingWriter buffers the writes into dst for at most window
+type coalescingWriter struct {
+	lock   sync.Mutex
+	dst    io.Writer
+	window time.Duration
+	buffer *bytebufferpool.ByteBuffer
+	timer  *time.Timer
+	// armed if the timer is going to flush the buffer
+	armed bool
+	// err the error of the last write into dst
+	err error
+}
+
+func newCoalescingWriter(dst io.Writer, window time.Duration) *coalescingWriter {
+	w := &coalescingWriter{dst: dst, window: window, buffer: bytebufferpool.Get()}
+	w.timer = time.AfterFunc(time.Hour, w.flushOnTimer)
+	w.timer.Stop()
+	return w
+}
+
+// Write buffers p, the number of bytes buffered is returned
+// along with the error of the previous writes into dst if any
+func (w *coalescingWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if len(w.buffer.B)+len(p) > coalesceBufSize {
+		if w.flush(); w.err != nil {
+			return 0, w.err
+		}
+	}
+	if len(p) >= coalesceBufSize {
+		_, w.err = w.dst.Write(p)
+		if w.err != nil {
+			return 0, w.err
+		}
+		return len(p), nil
+	}
+	w.buffer.B = append(w.buffer.B, p...)
+	if len(w.buffer.B) == coalesceBufSize {
+		w.flush()
+	} else if !w.armed {
+		w.armed = true
+		w.timer.Reset(w.window)
+	}
+	return len(p), nil
+}
+
+// flush writes the buffer into dst, w.lock must be held
+func (w *coalescingWriter) flush() {
+	if w.armed {
+		w.timer.Stop()
+		w.armed = false
+	}
+	if len(w.buffer.B) == 0 || w.err != nil {
+		return
+	}
+	_, w.err = w.dst.Write(w.buffer.B)
+	w.buffer.Reset()
+}
+
+func (w *coalescingWriter) flushOnTimer() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.armed {
+		w.armed = false
+		w.flush()
+	}
+}
+
+// Close flushes the buffer and releases it
+func (w *coalescingWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.flush()
+	bytebufferpool.Put(w.buffer)
+	w.buffer = nil
+	if w.err == nil {
+		w.err = errCoalescingWriterClosed
+		return nil
+	}
+	return w.err
+}
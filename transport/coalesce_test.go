@@ -0,0 +1,120 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chunkReader returns the chunks sent in one read each
+type chunkReader chan []byte
+
+func (r chunkReader) Read(p []byte) (int, error) {
+	chunk, ok := <-r
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, chunk), nil
+}
+
+// recordingWriter records the writes and the time they're made
+type recordingWriter struct {
+	lock   sync.Mutex
+	writes [][]byte
+	times  []time.Time
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.writes = append(w.writes, append([]byte(nil), p...))
+	w.times = append(w.times, time.Now())
+	return len(p), nil
+}
+
+func (w *recordingWriter) count() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.writes)
+}
+
+func TestForwardWithCoalescing(t *testing.T) {
+	const window = 20 * time.Millisecond
+	src := make(chunkReader)
+	dst := &recordingWriter{}
+	done := make(chan struct{})
+	go func() {
+		if n, err := ForwardWithCoalescing(dst, src, 0, 0, window); n != 4*1024+15 || err != nil {
+			t.Errorf("unexpected result %d %v", n, err)
+		}
+		close(done)
+	}()
+
+	// tiny chunks within the window are written at once, delayed by the window at most
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		src <- []byte("a")
+	}
+	for dst.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if d := dst.times[0].Sub(start); d > window+10*time.Millisecond {
+		t.Fatalf("unexpected delay %s", d)
+	}
+	if dst.count() != 1 || string(dst.writes[0]) != "aaaaaaaaaa" {
+		t.Fatalf("unexpected writes %q", dst.writes)
+	}
+
+	// written once the buffer fills up, large chunks are written as is
+	src <- []byte("bbbb")
+	src <- bytes.Repeat([]byte("c"), 4*1024)
+	src <- []byte("d")
+	close(src)
+	<-done
+	if dst.count() != 4 || string(dst.writes[1]) != "bbbb" || len(dst.writes[2]) != 4*1024 ||
+		string(dst.writes[3]) != "d" {
+		t.Fatalf("unexpected writes %d", dst.count())
+	}
+}
+
+// countingDiscard counts the writes
+type countingDiscard struct{ writes *int64 }
+
+func (w countingDiscard) Write(p []byte) (int, error) {
+	atomic.AddInt64(w.writes, 1)
+	return len(p), nil
+}
+
+// BenchmarkForwardChattyTunnels relays 1k tunnels of tiny packets,
+// reporting the writes made per packet
+func BenchmarkForwardChattyTunnels(b *testing.B) {
+	for _, window := range []time.Duration{0, 500 * time.Microsecond} {
+		b.Run("window="+window.String(), func(b *testing.B) {
+			const tunnels = 1000
+			var writes int64
+			packet := []byte("ping")
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for t := 0; t < tunnels; t++ {
+				src := make(chunkReader, 16)
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					ForwardWithCoalescing(countingDiscard{&writes}, src, 0, 0, window)
+				}()
+				go func() {
+					defer wg.Done()
+					for i := 0; i < b.N; i++ {
+						src <- packet
+					}
+					close(src)
+				}()
+			}
+			wg.Wait()
+			b.ReportMetric(float64(writes)/float64(b.N*tunnels), "writes/packet")
+		})
+	}
+}
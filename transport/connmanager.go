@@ -114,14 +114,14 @@ func (c *ConnManager) AcquireConn(dialer NewConn) (*Conn, error) {
 }
 
 func (c *ConnManager) connsCleaner() {
-	if c.MaxIdleConnDuration <= 0 {
-		c.MaxIdleConnDuration = DefaultMaxIdleConnDuration
-	}
-
+	// the default is kept off the field, which is read by the tunnels
 	var (
 		scratch             []*Conn
 		maxIdleConnDuration = c.MaxIdleConnDuration
 	)
+	if maxIdleConnDuration <= 0 {
+		maxIdleConnDuration = DefaultMaxIdleConnDuration
+	}
 	for {
 		currentTime := time.Now()
 
@@ -164,6 +164,18 @@ func (c *ConnManager) connsCleaner() {
 	}
 }
 
+// CloseIdleConns closes the idle connections pooled, returns the number closed
+func (c *ConnManager) CloseIdleConns() int {
+	c.connsLock.Lock()
+	idle := c.conns
+	c.conns = nil
+	c.connsLock.Unlock()
+	for _, cc := range idle {
+		c.CloseConn(cc)
+	}
+	return len(idle)
+}
+
 // CloseConn close the connection
 func (c *ConnManager) CloseConn(cc *Conn) {
 	c.decConnsCount()
@@ -184,6 +196,8 @@ func (c *ConnManager) ReleaseConn(cc *Conn) {
 			c.CloseConn(cc)
 			return
 		}
+		// the read deadline is cleared by isConnClosedByRemote
+		cc.LastReadDeadlineTime = time.Time{}
 		cc.lastUseTime = servertime.CoarseTimeNow()
 		c.connsLock.Lock()
 		c.conns = append(c.conns, cc)
@@ -212,6 +226,7 @@ func acquireClientConn(conn net.Conn) *Conn {
 	cc := v.(*Conn)
 	cc.c = conn
 	cc.createdTime = servertime.CoarseTimeNow()
+	cc.headerCache.Reset()
 	return cc
 }
 
@@ -230,6 +245,14 @@ type Conn struct {
 	// last read and write deadline time
 	LastReadDeadlineTime  time.Time
 	LastWriteDeadlineTime time.Time
+
+	// headerCache the request header last written to c
+	headerCache HeaderCache
+}
+
+// HeaderCache the cache of the request header last written to the net conn
+func (cc *Conn) HeaderCache() *HeaderCache {
+	return &cc.headerCache
 }
 
 // Get get the net conn in cc
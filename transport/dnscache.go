@@ -0,0 +1,320 @@
+package transport
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/haxii/fastproxy/util/singleflight"
+)
+
+// DefaultDNSCache shared by Dial, DialTLS and the Resolvers referring to it
+var DefaultDNSCache = &DNSCache{}
+
+// dnsCacheSweepSize the number of entries sweeping the expired ones
+const dnsCacheSweepSize = 1024
+
+// DNSCache the resolved addresses of host names shared by reference between
+// the Dialers and Resolvers, a host resolved by any of them is not resolved
+// again by the others until the entry expires. The zero value is ready to use.
+type DNSCache struct {
+	// MaxEntries max hosts cached, the least recently used one is evicted
+	// for caching another, e.g. bounding the memory of the proxies resolving
+	// millions of hosts. No limit if not set.
+	MaxEntries int
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// lru the entries from the most recently used
+	lru list.List
+	// sweepSize the number of entries when the expired ones are swept
+	sweepSize int
+	// evicted number of entries evicted by MaxEntries
+	evicted uint64
+}
+
+type dnsCacheEntry struct {
+	host     string
+	addrs    []net.IPAddr
+	resolved time.Time
+	expire   time.Time
+}
+
+// Get the cached addresses of host, false if not cached or expired
+func (c *DNSCache) Get(host string) ([]net.IPAddr, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.entries[host]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*dnsCacheEntry)
+	if time.Now().After(e.expire) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.addrs, true
+}
+
+// Put caches the addresses of host for ttl, the addrs must not be modified
+// after, nothing is cached if addrs is empty or ttl is not positive
+func (c *DNSCache) Put(host string, addrs []net.IPAddr, ttl time.Duration) {
+	if len(addrs) == 0 || ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	c.lock.Lock()
+	c.put(&dnsCacheEntry{host: host, addrs: addrs, resolved: now, expire: now.Add(ttl)}, now)
+	c.lock.Unlock()
+}
+
+// put the entry, sweeping the expired entries if there are too many, and
+// evicting the least recently used ones beyond MaxEntries
+func (c *DNSCache) put(e *dnsCacheEntry, now time.Time) {
+	if el, ok := c.entries[e.host]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if len(c.entries) >= c.sweepSize {
+		for el := c.lru.Front(); el != nil; {
+			next := el.Next()
+			if now.After(el.Value.(*dnsCacheEntry).expire) {
+				c.remove(el)
+			}
+			el = next
+		}
+		c.sweepSize = 2 * len(c.entries)
+		if c.sweepSize < dnsCacheSweepSize {
+			c.sweepSize = dnsCacheSweepSize
+		}
+	}
+	for c.MaxEntries > 0 && c.lru.Len() >= c.MaxEntries {
+		c.remove(c.lru.Back())
+		c.evicted++
+	}
+	c.entries[e.host] = c.lru.PushFront(e)
+}
+
+// remove the entry of el, lock required
+func (c *DNSCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*dnsCacheEntry).host)
+}
+
+// DNSCacheEntry the addresses of a host cached, e.g. exported by Entries
+// and restored after a restart
+type DNSCacheEntry struct {
+	Host     string
+	Addrs    []net.IPAddr
+	Resolved time.Time
+	Expire   time.Time
+}
+
+// Entries the entries not expired from the least recently used, so that
+// the recency is kept once restored
+func (c *DNSCache) Entries() []DNSCacheEntry {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries := make([]DNSCacheEntry, 0, len(c.entries))
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		if e := el.Value.(*dnsCacheEntry); now.Before(e.expire) {
+			entries = append(entries, DNSCacheEntry{Host: e.host, Addrs: e.addrs, Resolved: e.resolved, Expire: e.expire})
+		}
+	}
+	return entries
+}
+
+// Restore caches the entries until they expire, the expired and empty ones
+// are skipped, the addrs must not be modified after
+func (c *DNSCache) Restore(entries []DNSCacheEntry) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, e := range entries {
+		if len(e.Addrs) > 0 && now.Before(e.Expire) {
+			c.put(&dnsCacheEntry{host: e.Host, addrs: e.Addrs, resolved: e.Resolved, expire: e.Expire}, now)
+		}
+	}
+}
+
+// peek the cached addresses of host and when they're resolved, the expired
+// entry is left as is for the next Get or Put, the recency is left as well
+func (c *DNSCache) peek(host string) ([]net.IPAddr, time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.entries[host]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	e := el.Value.(*dnsCacheEntry)
+	if time.Now().After(e.expire) {
+		return nil, time.Time{}, false
+	}
+	return e.addrs, e.resolved, true
+}
+
+// Flush removes all the entries
+func (c *DNSCache) Flush() {
+	c.lock.Lock()
+	c.entries = nil
+	c.lru.Init()
+	c.lock.Unlock()
+}
+
+// Len the number of entries, expired ones included, e.g. for monitoring
+// the memory of the cache
+func (c *DNSCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// Evicted the number of entries evicted by MaxEntries so far
+func (c *DNSCache) Evicted() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.evicted
+}
+
+// Resolver resolves host names through the shared Cache, e.g. for the
+// hijackers pinning the IP of the requests, so the Dialers sharing the
+// cache never resolve the same host again
+type Resolver struct {
+	// Cache shared DNS cache, the addresses resolved are not cached if not set
+	Cache *DNSCache
+	// LookupIPAddr resolver hook, net.DefaultResolver is used if not set
+	LookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+	// Timeout max duration for resolving a host name, DefaultDNSTimeout is used if not set
+	Timeout time.Duration
+	// TTL duration of the addresses cached, DefaultDNSCacheDuration is used if not set
+	TTL time.Duration
+	// MaxConcurrentLookups max lookups running at once, e.g. protecting the
+	// resolver from the bursts of the host names not cached, the others wait
+	// for their turn within Timeout. No limit if not set.
+	MaxConcurrentLookups int
+
+	// lookups dedupes the concurrent lookups of the same host
+	lookups singleflight.Group
+	// lookupSlots limits the concurrent lookups by MaxConcurrentLookups
+	lookupSlots     chan struct{}
+	lookupSlotsOnce sync.Once
+}
+
+// Resolve the addresses of host from the cache, or looks them up within
+// Timeout and caches them, ErrDNSTimeout is returned if timed out, and
+// ErrDNSQueueTimeout if the lookup can't start in time
+func (r *Resolver) Resolve(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := r.resolve(ctx, host)
+	return addrs, err
+}
+
+// ResolveIP the first address of host, nil if it can't be resolved,
+// e.g. for the Resolve of the hijackers
+func (r *Resolver) ResolveIP(host string) net.IP {
+	addrs, err := r.Resolve(context.Background(), host)
+	if err != nil {
+		return nil
+	}
+	return addrs[0].IP
+}
+
+// resolve the addresses of host and if they're from the cache
+func (r *Resolver) resolve(ctx context.Context, host string) ([]net.IPAddr, bool, error) {
+	if r.Cache != nil {
+		if addrs, ok := r.Cache.Get(host); ok {
+			return addrs, true, nil
+		}
+	}
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	lookupIPAddr := r.LookupIPAddr
+	if lookupIPAddr == nil {
+		lookupIPAddr = net.DefaultResolver.LookupIPAddr
+	}
+	// the addresses are cached within the lookup, so the host is never
+	// looked up again once it's resolved
+	v, _, err := r.lookups.Do(ctx, host, func() (interface{}, error) {
+		if r.Cache != nil {
+			if addrs, ok := r.Cache.Get(host); ok {
+				return addrs, nil
+			}
+		}
+		if !r.acquireLookupSlot(ctx) {
+			return nil, ErrDNSQueueTimeout
+		}
+		defer r.releaseLookupSlot()
+		addrs, err := lookupIPAddr(ctx, host)
+		if err != nil || len(addrs) == 0 || r.Cache == nil {
+			return addrs, err
+		}
+		ttl := r.TTL
+		if ttl <= 0 {
+			ttl = DefaultDNSCacheDuration
+		}
+		r.Cache.Put(host, addrs, ttl)
+		return addrs, nil
+	})
+	if err != nil {
+		if err == ErrDNSQueueTimeout {
+			return nil, false, err
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, false, ErrDNSTimeout
+		}
+		return nil, false, err
+	}
+	addrs := v.([]net.IPAddr)
+	if len(addrs) == 0 {
+		return nil, false, errNoDNSEntries
+	}
+	return addrs, false, nil
+}
+
+// LookupStats the lookups made and waited for by the concurrent resolves
+// of the same host
+func (r *Resolver) LookupStats() singleflight.Stats {
+	return r.lookups.Stats()
+}
+
+// acquireLookupSlot waits for a slot of the lookups until ctx is done,
+// false if none is acquired
+func (r *Resolver) acquireLookupSlot(ctx context.Context) bool {
+	r.lookupSlotsOnce.Do(func() {
+		if r.MaxConcurrentLookups > 0 {
+			r.lookupSlots = make(chan struct{}, r.MaxConcurrentLookups)
+		}
+	})
+	if r.lookupSlots == nil {
+		return true
+	}
+	select {
+	case r.lookupSlots <- struct{}{}:
+		return true
+	default:
+	}
+	select {
+	case r.lookupSlots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (r *Resolver) releaseLookupSlot() {
+	if r.lookupSlots != nil {
+		<-r.lookupSlots
+	}
+}
@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	c := &DNSCache{}
+	if _, ok := c.Get("example.com"); ok {
+		t.Fatal("unexpected entry in empty cache")
+	}
+	addrs := []net.IPAddr{{IP: net.IPv4(1, 2, 3, 4)}}
+	c.Put("example.com", addrs, time.Minute)
+	c.Put("short.com", addrs, time.Millisecond)
+	c.Put("empty.com", nil, time.Minute)
+	if got, ok := c.Get("example.com"); !ok || !got[0].IP.Equal(addrs[0].IP) {
+		t.Fatalf("unexpected entry %v %v", got, ok)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("short.com"); ok {
+		t.Fatal("expected expired entry missed")
+	}
+	if _, ok := c.Get("empty.com"); ok {
+		t.Fatal("expected empty addresses never cached")
+	}
+	c.Flush()
+	if _, ok := c.Get("example.com"); ok || c.Len() != 0 {
+		t.Fatal("expected cache flushed")
+	}
+}
+
+func TestDNSCacheMaxEntries(t *testing.T) {
+	c := &DNSCache{MaxEntries: 2}
+	addrs := []net.IPAddr{{IP: net.IPv4(1, 2, 3, 4)}}
+	c.Put("a.com", addrs, time.Minute)
+	c.Put("b.com", addrs, time.Minute)
+	// the least recently used one is evicted, b.com
+	c.Get("a.com")
+	c.Put("c.com", addrs, time.Minute)
+	if _, ok := c.Get("b.com"); ok || c.Len() != 2 || c.Evicted() != 1 {
+		t.Fatalf("unexpected %d entries with %d evicted", c.Len(), c.Evicted())
+	}
+	// the one cached again is not evicted
+	c.Put("a.com", addrs, time.Hour)
+	if c.Len() != 2 || c.Evicted() != 1 {
+		t.Fatalf("unexpected %d entries with %d evicted", c.Len(), c.Evicted())
+	}
+
+	// the recency is kept once restored
+	restored := &DNSCache{MaxEntries: 2}
+	restored.Restore(c.Entries())
+	restored.Put("d.com", addrs, time.Minute)
+	if _, ok := restored.Get("c.com"); ok {
+		t.Fatal("expected c.com evicted")
+	}
+	if _, ok := restored.Get("a.com"); !ok {
+		t.Fatal("expected a.com kept")
+	}
+}
+
+func TestResolverSharesCacheWithDialer(t *testing.T) {
+	var lookups int32
+	lookupIPAddr := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		atomic.AddInt32(&lookups, 1)
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+	}
+	cache := &DNSCache{}
+	r := &Resolver{Cache: cache, LookupIPAddr: lookupIPAddr}
+	var dialed string
+	d := &Dialer{DNSCache: cache, LookupIPAddr: lookupIPAddr,
+		DialTCP: func(addr *net.TCPAddr) (net.Conn, error) {
+			dialed = addr.String()
+			c, _ := net.Pipe()
+			return c, nil
+		},
+	}
+
+	if ip := r.ResolveIP("example.com"); !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("unexpected ip %s", ip)
+	}
+	conn, err := d.Dial("example.com:80", time.Second, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.Close()
+	if n := atomic.LoadInt32(&lookups); n != 1 || dialed != "127.0.0.1:80" {
+		t.Fatalf("expected a single lookup dialing 127.0.0.1:80, got %d lookups dialing %s", n, dialed)
+	}
+
+	cache.Flush()
+	if _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadInt32(&lookups); n != 2 {
+		t.Fatalf("expected flushed host resolved again, got %d lookups", n)
+	}
+}
@@ -0,0 +1,7 @@
+package transport
+
+import "errors"
+
+// ErrFDLimitUnsupported is returned when the file descriptor limit of the
+// process can't be read on the platform
+var ErrFDLimitUnsupported = errors.New("file descriptor limit not supported on this platform")
@@ -0,0 +1,19 @@
+package transport
+
+import (
+	"math"
+	"syscall"
+)
+
+// FDLimit returns the soft limit of the file descriptors of the process,
+// a.k.a. RLIMIT_NOFILE
+func FDLimit() (int64, error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, err
+	}
+	if limit.Cur > math.MaxInt64 {
+		return math.MaxInt64, nil
+	}
+	return int64(limit.Cur), nil
+}
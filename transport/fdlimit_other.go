@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+// FDLimit returns the soft limit of the file descriptors of the process,
+// which is supported on linux only
+func FDLimit() (int64, error) {
+	return 0, ErrFDLimitUnsupported
+}
@@ -0,0 +1,40 @@
+package transport
+
+import "bytes"
+
+// HeaderCache the request header last serialized for a keep-alive
+// connection with the header fields it's built from, so the next request
+// of the identical fields writes it again instead of serializing them,
+// see Conn.HeaderCache. The fields are compared byte by byte, any change
+// of them, e.g. by the hooks rewriting the header, rebuilds it.
+type HeaderCache struct {
+	raw    []byte
+	extra  []byte
+	header []byte
+	built  bool
+}
+
+// Header the header cached if it's built from the raw header fields and
+// the extra ones appended, nil otherwise
+func (c *HeaderCache) Header(raw, extra []byte) []byte {
+	if c == nil || !c.built || !bytes.Equal(c.raw, raw) || !bytes.Equal(c.extra, extra) {
+		return nil
+	}
+	return c.header
+}
+
+// Build caches the header of the raw and the extra header fields built by
+// build, which appends it to the buffer given, returns the header built
+func (c *HeaderCache) Build(raw, extra []byte, build func(b []byte) []byte) []byte {
+	c.raw = append(c.raw[:0], raw...)
+	c.extra = append(c.extra[:0], extra...)
+	c.header = build(c.header[:0])
+	c.built = true
+	return c.header
+}
+
+// Reset drops the header cached, the buffers are kept for reusing
+func (c *HeaderCache) Reset() {
+	c.raw, c.extra, c.header = c.raw[:0], c.extra[:0], c.header[:0]
+	c.built = false
+}
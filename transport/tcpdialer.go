@@ -1,15 +1,19 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/haxii/fastproxy/servertime"
+	"github.com/haxii/fastproxy/util"
+	"github.com/haxii/fastproxy/util/singleflight"
 )
 
 // DialFunc must establish connection to addr.
@@ -29,11 +33,70 @@ const DefaultDialTimeout = 5 * time.Second
 // DefaultMaxDialConcurrency max dial concurrency
 const DefaultMaxDialConcurrency = 1000
 
+// DefaultDNSTimeout is timeout used by Dial for resolving the host names.
+const DefaultDNSTimeout = 2 * time.Second
+
+// DefaultDialRetryBackoff is the pause used by Dial between the attempts
+// dialing the same address.
+const DefaultDialRetryBackoff = 100 * time.Millisecond
+
 type Dialer struct {
 	MaxDialConcurrency int
 
-	DialTCP  func(addr *net.TCPAddr) (net.Conn, error)
+	// DialTCP custom dialer of the TCP addresses resolved, a dial outliving
+	// the timeout keeps running in its goroutine, holding a slot of
+	// MaxDialConcurrency, until it returns. The connection made too late is
+	// closed. The default dialer gives up at the timeout.
+	DialTCP func(addr *net.TCPAddr) (net.Conn, error)
+	// Control called after creating the network connection but before
+	// actually dialing, used for setting socket options like SO_MARK,
+	// see net.Dialer.Control for details. Ignored if DialTCP is set.
+	Control func(network, address string, c syscall.RawConn) error
+	// LookupIP legacy resolver hook, LookupIPAddr takes precedence if both set
 	LookupIP func(host string) ([]net.IP, error)
+	// LookupIPAddr resolver hook, net.DefaultResolver is used if both
+	// LookupIP and LookupIPAddr are not set
+	LookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	// DNSTimeout max duration for resolving a host name, which is
+	// also bounded by the dial timeout.
+	//
+	// DefaultDNSTimeout is used if not set.
+	DNSTimeout time.Duration
+	// MaxDNSConcurrency max host names resolved at once, the others wait
+	// for their turn within DNSTimeout, ErrDNSQueueTimeout is returned if
+	// they can't start in time. No limit if not set.
+	MaxDNSConcurrency int
+	// DNSCache optional cache of the host names resolved, shared with the
+	// Resolvers referring to it, a private one is used if not set
+	DNSCache *DNSCache
+	// DisableDNSCache resolves the host names on every dial, e.g. for the
+	// service discoveries of short TTLs, DNSCache is ignored if set. The
+	// concurrent dials to the same host still resolve it once.
+	DisableDNSCache bool
+
+	// TLSHandshakeTimeout max duration for the TLS handshake of TLS dials
+	//
+	// DefaultTLSHandshakeTimeout is used if not set.
+	TLSHandshakeTimeout time.Duration
+
+	// MaxDialAttempts max attempts dialing each of the resolved addresses,
+	// e.g. retrying the only address of a flapping host, the attempts are
+	// bounded by the dial timeout as well. Each address is dialed once if not set.
+	MaxDialAttempts int
+	// DialRetryBackoff pause before retrying the same address, doubled
+	// after every retry.
+	//
+	// DefaultDialRetryBackoff is used if not set.
+	DialRetryBackoff time.Duration
+
+	// OnDialTrace called after every dial with its timing details if set
+	OnDialTrace func(addr string, trace *DialTrace)
+	// OnResolve called with the addresses host is resolved to, cached or
+	// not, before dialing any of them, e.g. for rejecting the private ones
+	// against the DNS rebinding. A non-nil error fails the dial with it.
+	// The IP literals dialed are not resolved, so never seen by it.
+	OnResolve func(host string, addrs []net.TCPAddr) error
 
 	dialer      *tcpDialer
 	dialMap     map[int]DialFunc
@@ -66,14 +129,7 @@ type Dialer struct {
 //     * foo.bar:80
 //     * aaa.com:8080
 func (d *Dialer) Dial(addr string, timeout time.Duration, isTLS bool, tlsConfig *tls.Config) (net.Conn, error) {
-	d.once.Do(func() {
-		d.dialer = &tcpDialer{
-			maxDialConcurrency: d.MaxDialConcurrency,
-			dialTCP:            d.DialTCP,
-			lookupIP:           d.LookupIP,
-		}
-		d.dialMap = make(map[int]DialFunc)
-	})
+	d.once.Do(d.init)
 	conn, err := d.getDialer(timeout)(addr)
 	if err != nil {
 		return nil, err
@@ -82,11 +138,78 @@ func (d *Dialer) Dial(addr string, timeout time.Duration, isTLS bool, tlsConfig
 		return nil, errors.New("BUG: DialFunc returned (nil, nil)")
 	}
 	if isTLS {
-		conn = tls.Client(conn, tlsConfig)
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := TLSHandshake(tlsConn, d.TLSHandshakeTimeout); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
 	}
 	return conn, nil
 }
 
+func (d *Dialer) init() {
+	d.dialer = &tcpDialer{
+		maxDialConcurrency: d.MaxDialConcurrency,
+		dialTCP:            d.DialTCP,
+		control:            d.Control,
+		resolver: Resolver{
+			Cache:        d.DNSCache,
+			LookupIPAddr: d.LookupIPAddr,
+			Timeout:      d.DNSTimeout,
+
+			MaxConcurrentLookups: d.MaxDNSConcurrency,
+		},
+		onDialTrace:      d.OnDialTrace,
+		onResolve:        d.OnResolve,
+		maxDialAttempts:  d.MaxDialAttempts,
+		dialRetryBackoff: d.DialRetryBackoff,
+	}
+	if d.DisableDNSCache {
+		d.dialer.resolver.Cache = nil
+	} else if d.dialer.resolver.Cache == nil {
+		d.dialer.resolver.Cache = &DNSCache{}
+	}
+	if d.dialer.resolver.LookupIPAddr == nil && d.LookupIP != nil {
+		d.dialer.resolver.LookupIPAddr = lookupIPAddrWithContext(d.LookupIP)
+	}
+	d.dialMap = make(map[int]DialFunc)
+}
+
+// LookupStats the host names looked up by the dialer and the concurrent
+// dials waiting for them, see Resolver.LookupStats
+func (d *Dialer) LookupStats() singleflight.Stats {
+	d.once.Do(d.init)
+	return d.dialer.resolver.LookupStats()
+}
+
+// ResolvedAddrs the TCP addresses of addr cached by the dialer, e.g. for
+// diagnosing the DNS behaviour, with the time they're resolved and if they
+// are cached at all. Nothing is resolved and IP literals are never cached.
+func (d *Dialer) ResolvedAddrs(addr string) ([]net.TCPAddr, time.Time, bool) {
+	d.once.Do(d.init)
+	host, portS, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	port, err := strconv.Atoi(portS)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	if d.dialer.resolver.Cache == nil {
+		return nil, time.Time{}, false
+	}
+	ips, resolved, ok := d.dialer.resolver.Cache.peek(host)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	addrs := make([]net.TCPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.TCPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+	}
+	return addrs, resolved, true
+}
+
 func (d *Dialer) getDialer(timeout time.Duration) DialFunc {
 	if timeout <= 0 {
 		timeout = DefaultDialTimeout
@@ -104,14 +227,30 @@ func (d *Dialer) getDialer(timeout time.Duration) DialFunc {
 	return dialer
 }
 
+// DialTrace timing details of a single dial
+type DialTrace struct {
+	// ResolveDuration time spent on DNS resolution, zero on cache hits
+	ResolveDuration time.Duration
+	// ConnectDuration time spent on TCP connecting
+	ConnectDuration time.Duration
+	// DNSCacheHit whether the resolved addresses come from cache
+	DNSCacheHit bool
+}
+
 type tcpDialer struct {
-	dialTCP  func(addr *net.TCPAddr) (net.Conn, error)
-	lookupIP func(host string) ([]net.IP, error)
+	dialTCP     func(addr *net.TCPAddr) (net.Conn, error)
+	control     func(network, address string, c syscall.RawConn) error
+	dial        func(addr *net.TCPAddr, deadline time.Time) (net.Conn, error)
+	resolver    Resolver
+	onDialTrace func(addr string, trace *DialTrace)
+	onResolve   func(host string, addrs []net.TCPAddr) error
 
 	maxDialConcurrency int
+	maxDialAttempts    int
+	dialRetryBackoff   time.Duration
 
-	tcpAddrsLock sync.Mutex
-	tcpAddrsMap  map[string]*tcpAddrEntry
+	// addrsIdx round-robin index of the resolved addresses
+	addrsIdx uint32
 
 	concurrencyCh chan struct{}
 
@@ -121,35 +260,69 @@ type tcpDialer struct {
 // ErrDialTimeout is returned when TCP dialing is timed out.
 var ErrDialTimeout = errors.New("dialing to the given TCP address timed out")
 
+// ErrDNSTimeout is returned when resolving the host name is timed out.
+var ErrDNSTimeout = errors.New("resolving the given host name timed out")
+
+// ErrDNSQueueTimeout is returned when resolving the host name can't start
+// in time because of the lookups running at the concurrency limit.
+var ErrDNSQueueTimeout = errors.New("waiting to resolve the given host name timed out")
+
 func (d *tcpDialer) newDial(timeout time.Duration) DialFunc {
 	d.once.Do(func() {
-		if d.dialTCP == nil {
-			d.dialTCP = func(addr *net.TCPAddr) (net.Conn, error) {
-				return net.DialTCP("tcp", nil, addr)
+		if d.dialTCP != nil {
+			d.dial = func(addr *net.TCPAddr, deadline time.Time) (net.Conn, error) {
+				return d.dialTCP(addr)
+			}
+		} else {
+			// the default dial ends by the deadline, never outliving the
+			// timeout of tryDial for long
+			d.dial = func(addr *net.TCPAddr, deadline time.Time) (net.Conn, error) {
+				dialer := net.Dialer{Control: d.control, Deadline: deadline}
+				return dialer.Dial("tcp", addr.String())
 			}
-		}
-		if d.lookupIP == nil {
-			d.lookupIP = net.LookupIP
 		}
 		if d.maxDialConcurrency <= 0 {
 			d.maxDialConcurrency = DefaultMaxDialConcurrency
 		}
+		if d.maxDialAttempts <= 0 {
+			d.maxDialAttempts = 1
+		}
+		if d.dialRetryBackoff <= 0 {
+			d.dialRetryBackoff = DefaultDialRetryBackoff
+		}
 		d.concurrencyCh = make(chan struct{}, d.maxDialConcurrency)
-		d.tcpAddrsMap = make(map[string]*tcpAddrEntry)
-		go d.tcpAddrsClean()
 	})
 
-	return func(addr string) (net.Conn, error) {
-		addrs, idx, err := d.getTCPAddrs(addr)
+	return func(addr string) (conn net.Conn, err error) {
+		var trace DialTrace
+		start := time.Now()
+		deadline := start.Add(timeout)
+		if d.onDialTrace != nil {
+			defer func() {
+				trace.ConnectDuration = time.Since(start) - trace.ResolveDuration
+				d.onDialTrace(addr, &trace)
+			}()
+		}
+
+		// IP literals, e.g. the pinned IPs of the requests, bypass both
+		// the resolver and the DNS cache
+		if tcpAddr := parseLiteralTCPAddr(addr); tcpAddr != nil {
+			return d.dialWithRetries(tcpAddr, deadline)
+		}
+
+		addrs, idx, cached, err := d.getTCPAddrs(addr, deadline)
+		trace.DNSCacheHit = cached
+		if !cached {
+			trace.ResolveDuration = time.Since(start)
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		var conn net.Conn
+		// only the remaining time budget is used for connecting
 		n := uint32(len(addrs))
-		deadline := time.Now().Add(timeout)
 		for n > 0 {
-			conn, err = d.tryDial(&addrs[idx%n], deadline, d.concurrencyCh)
+			conn, err = d.dialWithRetries(&addrs[idx%n], deadline)
 			if err == nil {
 				return conn, nil
 			}
@@ -163,6 +336,24 @@ func (d *tcpDialer) newDial(timeout time.Duration) DialFunc {
 	}
 }
 
+// dialWithRetries dials addr up to maxDialAttempts times with the backoff
+// in between, the last error is returned if the deadline leaves no time
+// for another attempt
+func (d *tcpDialer) dialWithRetries(addr *net.TCPAddr, deadline time.Time) (net.Conn, error) {
+	backoff := d.dialRetryBackoff
+	for attempt := 1; ; attempt++ {
+		conn, err := d.tryDial(addr, deadline, d.concurrencyCh)
+		if err == nil || err == ErrDialTimeout || attempt >= d.maxDialAttempts {
+			return conn, err
+		}
+		if time.Until(deadline) <= backoff {
+			return nil, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
 func (d *tcpDialer) tryDial(addr *net.TCPAddr, deadline time.Time, concurrencyCh chan struct{}) (net.Conn, error) {
 	timeout := -time.Since(deadline)
 	if timeout <= 0 {
@@ -198,7 +389,7 @@ func (d *tcpDialer) tryDial(addr *net.TCPAddr, deadline time.Time, concurrencyCh
 	ch := chv.(chan dialResult)
 	go func() {
 		var dr dialResult
-		dr.conn, dr.err = d.dialTCP(addr)
+		dr.conn, dr.err = d.dial(addr, deadline)
 		ch <- dr
 		<-concurrencyCh
 	}()
@@ -216,6 +407,14 @@ func (d *tcpDialer) tryDial(addr *net.TCPAddr, deadline time.Time, concurrencyCh
 		dialResultChanPool.Put(ch)
 	case <-tc.C:
 		err = ErrDialTimeout
+		// close the connection made too late once the dial returns, the
+		// channel is reusable then
+		go func() {
+			if dr := <-ch; dr.err == nil {
+				dr.conn.Close()
+			}
+			dialResultChanPool.Put(ch)
+		}()
 	}
 	servertime.ReleaseTimer(tc)
 
@@ -229,97 +428,88 @@ type dialResult struct {
 	err  error
 }
 
-type tcpAddrEntry struct {
-	addrs    []net.TCPAddr
-	addrsIdx uint32
-
-	resolveTime time.Time
-	pending     bool
-}
-
 // DefaultDNSCacheDuration is the duration for caching resolved TCP addresses
 // by Dial* functions.
 const DefaultDNSCacheDuration = time.Minute
 
-func (d *tcpDialer) tcpAddrsClean() {
-	expireDuration := 2 * DefaultDNSCacheDuration
-	for {
-		time.Sleep(time.Second)
-		t := time.Now()
-
-		d.tcpAddrsLock.Lock()
-		for k, e := range d.tcpAddrsMap {
-			if t.Sub(e.resolveTime) > expireDuration {
-				delete(d.tcpAddrsMap, k)
-			}
-		}
-		d.tcpAddrsLock.Unlock()
+// getTCPAddrs resolves addr through the DNS cache, returns its TCP
+// addresses, the round-robin index and if they're from the cache
+func (d *tcpDialer) getTCPAddrs(addr string, deadline time.Time) ([]net.TCPAddr, uint32, bool, error) {
+	host, portS, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, false, err
 	}
-}
-
-func (d *tcpDialer) getTCPAddrs(addr string) ([]net.TCPAddr, uint32, error) {
-	d.tcpAddrsLock.Lock()
-	e := d.tcpAddrsMap[addr]
-	if e != nil && !e.pending && time.Since(e.resolveTime) > DefaultDNSCacheDuration {
-		e.pending = true
-		e = nil
+	port, err := strconv.Atoi(portS)
+	if err != nil {
+		return nil, 0, false, err
 	}
-	d.tcpAddrsLock.Unlock()
 
-	if e == nil {
-		addrs, err := d.resolveTCPAddrs(addr)
-		if err != nil {
-			d.tcpAddrsLock.Lock()
-			e = d.tcpAddrsMap[addr]
-			if e != nil && e.pending {
-				e.pending = false
-			}
-			d.tcpAddrsLock.Unlock()
-			return nil, 0, err
-		}
+	// resolve with its own timeout, bounded by the dial deadline
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	ips, cached, err := d.resolver.resolve(ctx, host)
+	if err != nil {
+		return nil, 0, false, err
+	}
 
-		e = &tcpAddrEntry{
-			addrs:       addrs,
-			resolveTime: time.Now(),
+	addrs := make([]net.TCPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.TCPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+	}
+	if d.onResolve != nil {
+		if err := d.onResolve(host, addrs); err != nil {
+			return nil, 0, cached, err
 		}
-
-		d.tcpAddrsLock.Lock()
-		d.tcpAddrsMap[addr] = e
-		d.tcpAddrsLock.Unlock()
 	}
-
-	idx := atomic.AddUint32(&e.addrsIdx, 1)
-	return e.addrs, idx, nil
+	return addrs, atomic.AddUint32(&d.addrsIdx, 1), cached, nil
 }
 
-func (d *tcpDialer) resolveTCPAddrs(addr string) ([]net.TCPAddr, error) {
+var errNoDNSEntries = errors.New("couldn't find DNS entries for the given domain")
+
+// parseLiteralTCPAddr parses addr whose host is an IP literal, v4 or v6 with
+// an optional zone, bracketed or not, nil returned for other addresses
+func parseLiteralTCPAddr(addr string) *net.TCPAddr {
 	host, portS, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, err
+		return nil
 	}
-	port, err := strconv.Atoi(portS)
-	if err != nil {
-		return nil, err
+	ip, zone := util.ParseIPZone(host)
+	if ip == nil {
+		return nil
 	}
-
-	ips, err := d.lookupIP(host)
+	port, err := strconv.Atoi(portS)
 	if err != nil {
-		return nil, err
+		return nil
 	}
+	return &net.TCPAddr{IP: ip, Port: port, Zone: zone}
+}
 
-	n := len(ips)
-	addrs := make([]net.TCPAddr, 0, n)
-	for i := 0; i < n; i++ {
-		ip := ips[i]
-		addrs = append(addrs, net.TCPAddr{
-			IP:   ip,
-			Port: port,
-		})
+// lookupIPAddrWithContext wraps a context unaware lookup function,
+// the lookup keeps running in background after the context is done
+func lookupIPAddrWithContext(lookupIP func(host string) ([]net.IP, error)) func(
+	ctx context.Context, host string) ([]net.IPAddr, error) {
+	type lookupResult struct {
+		ips []net.IP
+		err error
 	}
-	if len(addrs) == 0 {
-		return nil, errNoDNSEntries
+	return func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		ch := make(chan lookupResult, 1)
+		go func() {
+			ips, err := lookupIP(host)
+			ch <- lookupResult{ips, err}
+		}()
+		select {
+		case r := <-ch:
+			if r.err != nil {
+				return nil, r.err
+			}
+			addrs := make([]net.IPAddr, len(r.ips))
+			for i, ip := range r.ips {
+				addrs[i].IP = ip
+			}
+			return addrs, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
-	return addrs, nil
 }
-
-var errNoDNSEntries = errors.New("couldn't find DNS entries for the given domain")
@@ -0,0 +1,480 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialerDNSTimeout(t *testing.T) {
+	var trace DialTrace
+	d := &Dialer{
+		DNSTimeout: 50 * time.Millisecond,
+		LookupIPAddr: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			select {
+			case <-time.After(10 * time.Second):
+				return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+		OnDialTrace: func(addr string, t *DialTrace) { trace = *t },
+	}
+	start := time.Now()
+	_, err := d.Dial("slow.resolver.test:80", 5*time.Second, false, nil)
+	if err != ErrDNSTimeout {
+		t.Fatalf("expected ErrDNSTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dns timeout took too long: %s", elapsed)
+	}
+	if trace.ResolveDuration < 50*time.Millisecond || trace.DNSCacheHit {
+		t.Fatalf("unexpected dial trace %+v", trace)
+	}
+}
+
+func TestDialerLegacyLookupIPTimeout(t *testing.T) {
+	d := &Dialer{
+		DNSTimeout: 50 * time.Millisecond,
+		LookupIP: func(host string) ([]net.IP, error) {
+			time.Sleep(time.Second)
+			return nil, nil
+		},
+	}
+	if _, err := d.Dial("slow.resolver.test:80", 5*time.Second, false, nil); err != ErrDNSTimeout {
+		t.Fatalf("expected ErrDNSTimeout, got %v", err)
+	}
+}
+
+func TestDialerTLSHandshakeTimeout(t *testing.T) {
+	// a peer accepts the connection but never completes the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		time.Sleep(time.Second)
+		conn.Close()
+	}()
+
+	d := &Dialer{TLSHandshakeTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err = d.Dial(ln.Addr().String(), time.Second, true, &tls.Config{InsecureSkipVerify: true})
+	if err != ErrTLSHandshakeTimeout {
+		t.Fatalf("expected error %s, got %v", ErrTLSHandshakeTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("handshake timeout took too long: %s", elapsed)
+	}
+}
+
+func newLiteralTestDialer(lookups *int32) *Dialer {
+	return &Dialer{
+		DialTCP: func(addr *net.TCPAddr) (net.Conn, error) {
+			c, _ := net.Pipe()
+			return c, nil
+		},
+		LookupIPAddr: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			atomic.AddInt32(lookups, 1)
+			return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+		},
+	}
+}
+
+func TestDialerIPLiteral(t *testing.T) {
+	var lookups int32
+	d := newLiteralTestDialer(&lookups)
+	for _, addr := range []string{"1.2.3.4:443", "[::1]:443", "[fe80::1%lo]:80", "[fe80::1%25lo]:80"} {
+		conn, err := d.Dial(addr, time.Second, false, nil)
+		if err != nil {
+			t.Fatalf("unexpected error dialing %s: %s", addr, err)
+		}
+		conn.Close()
+	}
+	if n := atomic.LoadInt32(&lookups); n != 0 {
+		t.Fatalf("expected no lookups for IP literals, got %d", n)
+	}
+	cached := d.dialer.resolver.Cache.Len()
+	if cached != 0 {
+		t.Fatalf("expected IP literals never cached, got %d entries", cached)
+	}
+	if _, err := d.Dial("localhost:80", time.Second, false, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Fatalf("expected host names resolved, got %d lookups", n)
+	}
+}
+
+func BenchmarkDialIPLiteral(b *testing.B) {
+	var lookups int32
+	d := newLiteralTestDialer(&lookups)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		conn, err := d.Dial("1.2.3.4:443", time.Second, false, nil)
+		if err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+		conn.Close()
+	}
+	b.StopTimer()
+	cached := d.dialer.resolver.Cache.Len()
+	if n := atomic.LoadInt32(&lookups); n != 0 || cached != 0 {
+		b.Fatalf("expected no lookups and no cache entries, got %d lookups %d entries", n, cached)
+	}
+}
+
+func TestDialerControl(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+
+	var controlled []string
+	d := &Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			controlled = append(controlled, network+" "+address)
+			return nil
+		},
+	}
+	conn, err := d.Dial(ln.Addr().String(), time.Second, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.Close()
+	if len(controlled) != 1 || controlled[0] != "tcp4 "+ln.Addr().String() {
+		t.Fatalf("unexpected control calls %v", controlled)
+	}
+
+	// dialing fails if control fails
+	errControl := errors.New("control error")
+	d = &Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return errControl
+		},
+	}
+	if _, err := d.Dial(ln.Addr().String(), time.Second, false, nil); err == nil {
+		t.Fatal("expected error when control fails")
+	}
+}
+
+func TestDialerMaxDialAttempts(t *testing.T) {
+	// the only address refuses the first dials
+	var dials int32
+	newDialer := func(refused int32, attempts int, backoff time.Duration) *Dialer {
+		atomic.StoreInt32(&dials, 0)
+		return &Dialer{
+			MaxDialAttempts:  attempts,
+			DialRetryBackoff: backoff,
+			DialTCP: func(addr *net.TCPAddr) (net.Conn, error) {
+				if atomic.AddInt32(&dials, 1) <= refused {
+					return nil, syscall.ECONNREFUSED
+				}
+				c, _ := net.Pipe()
+				return c, nil
+			},
+			LookupIPAddr: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+				return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+			},
+		}
+	}
+
+	for _, addr := range []string{"1.2.3.4:80", "flapping.test:80"} {
+		conn, err := newDialer(2, 3, time.Millisecond).Dial(addr, time.Second, false, nil)
+		if err != nil {
+			t.Fatalf("unexpected error dialing %s: %s", addr, err)
+		}
+		conn.Close()
+		if n := atomic.LoadInt32(&dials); n != 3 {
+			t.Fatalf("expected 3 dials to %s, got %d", addr, n)
+		}
+	}
+
+	// dialed once by default
+	if _, err := newDialer(1, 0, 0).Dial("1.2.3.4:80", time.Second, false, nil); err != syscall.ECONNREFUSED {
+		t.Fatalf("expected refused, got %v", err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("expected a single dial, got %d", n)
+	}
+
+	// the retries are bounded by the dial timeout
+	start := time.Now()
+	if _, err := newDialer(100, 100, 50*time.Millisecond).Dial("1.2.3.4:80",
+		200*time.Millisecond, false, nil); err != syscall.ECONNREFUSED {
+		t.Fatalf("expected refused, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("retries took too long: %s", elapsed)
+	}
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Fatalf("expected 3 dials within the timeout, got %d", n)
+	}
+}
+
+func TestDialerResolvedAddrs(t *testing.T) {
+	var lookups int32
+	d := newLiteralTestDialer(&lookups)
+	if addrs, _, ok := d.ResolvedAddrs("localhost:80"); ok || addrs != nil {
+		t.Fatalf("unexpected addresses resolved before dialing %v", addrs)
+	}
+	start := time.Now()
+	conn, err := d.Dial("localhost:80", time.Second, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.Close()
+	addrs, resolved, ok := d.ResolvedAddrs("localhost:8080")
+	if !ok || len(addrs) != 1 || addrs[0].String() != "127.0.0.1:8080" {
+		t.Fatalf("unexpected addresses resolved %v", addrs)
+	}
+	if resolved.Before(start) || resolved.After(time.Now()) {
+		t.Fatalf("unexpected resolve time %s", resolved)
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Fatalf("expected no lookups by ResolvedAddrs, got %d", n)
+	}
+	for _, addr := range []string{"1.2.3.4:80", "localhost", "localhost:http"} {
+		if _, _, ok := d.ResolvedAddrs(addr); ok {
+			t.Fatalf("unexpected addresses resolved for %s", addr)
+		}
+	}
+}
+
+func TestDialerDisableDNSCache(t *testing.T) {
+	var lookups int32
+	release := make(chan struct{})
+	d := &Dialer{
+		DisableDNSCache: true,
+		DNSCache:        &DNSCache{},
+		DialTCP: func(addr *net.TCPAddr) (net.Conn, error) {
+			c, _ := net.Pipe()
+			return c, nil
+		},
+		LookupIPAddr: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			atomic.AddInt32(&lookups, 1)
+			<-release
+			return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+		},
+	}
+
+	// the concurrent dials resolve once
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			conn, err := d.Dial("fresh.test:80", time.Second, false, nil)
+			if err == nil {
+				conn.Close()
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Fatalf("expected the concurrent dials resolved once, got %d lookups", n)
+	}
+
+	// every dial resolves afresh
+	conn, err := d.Dial("fresh.test:80", time.Second, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.Close()
+	if n := atomic.LoadInt32(&lookups); n != 2 {
+		t.Fatalf("expected the dial resolved afresh, got %d lookups", n)
+	}
+	if _, _, ok := d.ResolvedAddrs("fresh.test:80"); ok || d.DNSCache.Len() != 0 {
+		t.Fatal("expected nothing cached")
+	}
+}
+
+func TestDialerMaxDNSConcurrency(t *testing.T) {
+	var running, maxRunning int32
+	release := make(chan struct{})
+	d := &Dialer{
+		MaxDNSConcurrency: 2,
+		DialTCP: func(addr *net.TCPAddr) (net.Conn, error) {
+			c, _ := net.Pipe()
+			return c, nil
+		},
+		LookupIPAddr: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			<-release
+			return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+		},
+	}
+
+	// the distinct hosts wait for their turn
+	errs := make(chan error, 6)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			conn, err := d.Dial(fmt.Sprintf("host%d.test:80", i), time.Second, false, nil)
+			if err == nil {
+				conn.Close()
+			}
+			errs <- err
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if maxRunning != 2 {
+		t.Fatalf("unexpected %d lookups running at once", maxRunning)
+	}
+
+	// the ones not started in time fail
+	release = make(chan struct{})
+	defer close(release)
+	d = &Dialer{MaxDNSConcurrency: 2, DNSTimeout: 50 * time.Millisecond,
+		DialTCP: d.DialTCP, LookupIPAddr: d.LookupIPAddr}
+	for i := 0; i < 2; i++ {
+		go d.Dial(fmt.Sprintf("blocked%d.test:80", i), 5*time.Second, false, nil)
+	}
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	if _, err := d.Dial("queued.test:80", 5*time.Second, false, nil); err != ErrDNSQueueTimeout {
+		t.Fatalf("expected ErrDNSQueueTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("queue timeout took too long: %s", elapsed)
+	}
+}
+
+func TestDialerOnResolve(t *testing.T) {
+	errRebinding := errors.New("rebinding")
+	var resolved []string
+	ip := net.IPv4(93, 184, 216, 34)
+	d := &Dialer{
+		DNSCache: &DNSCache{},
+		DialTCP: func(addr *net.TCPAddr) (net.Conn, error) {
+			c, _ := net.Pipe()
+			return c, nil
+		},
+		LookupIPAddr: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return []net.IPAddr{{IP: ip}}, nil
+		},
+		OnResolve: func(host string, addrs []net.TCPAddr) error {
+			resolved = append(resolved, host+" "+addrs[0].String())
+			if addrs[0].IP.IsLoopback() {
+				return errRebinding
+			}
+			return nil
+		},
+	}
+	conn, err := d.Dial("rebind.test:80", time.Second, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.Close()
+
+	// the cached addresses are seen as well
+	conn, err = d.Dial("rebind.test:80", time.Second, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.Close()
+
+	// rebound to a private address once the cache is gone
+	ip = net.IPv4(127, 0, 0, 1)
+	d.DNSCache.Flush()
+	if _, err := d.Dial("rebind.test:80", time.Second, false, nil); err != errRebinding {
+		t.Fatalf("expected the rebinding rejected, got %v", err)
+	}
+	// while the IP literals are never resolved
+	conn, err = d.Dial("127.0.0.1:80", time.Second, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.Close()
+
+	expected := []string{"rebind.test 93.184.216.34:80", "rebind.test 93.184.216.34:80", "rebind.test 127.0.0.1:80"}
+	if fmt.Sprint(resolved) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected resolutions %q", resolved)
+	}
+}
+
+type closeRecordingConn struct {
+	net.Conn
+	closed int32
+}
+
+func (c *closeRecordingConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.Conn.Close()
+}
+
+func TestDialerTimeoutLateConn(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var late []*closeRecordingConn
+	d := &Dialer{
+		DialTCP: func(addr *net.TCPAddr) (net.Conn, error) {
+			<-release
+			c, _ := net.Pipe()
+			conn := &closeRecordingConn{Conn: c}
+			lock.Lock()
+			late = append(late, conn)
+			lock.Unlock()
+			return conn, nil
+		},
+	}
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		if _, err := d.Dial("127.0.0.1:80", 20*time.Millisecond, false, nil); err != ErrDialTimeout {
+			t.Fatalf("expected ErrDialTimeout, got %v", err)
+		}
+	}
+	if n := runtime.NumGoroutine(); n < baseline+10 {
+		t.Fatalf("expected the dials running, %d goroutines from %d", n, baseline)
+	}
+
+	// the dials outliving the timeout end with their connections closed
+	close(release)
+	for i := 0; runtime.NumGoroutine() > baseline; i++ {
+		if i == 100 {
+			t.Fatalf("goroutines leaked, %d from %d", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(late) != 10 {
+		t.Fatalf("unexpected dials %d", len(late))
+	}
+	for _, conn := range late {
+		if atomic.LoadInt32(&conn.closed) != 1 {
+			t.Fatal("the connection made too late is not closed")
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package transport
+
+import "errors"
+
+var (
+	// ErrTransparentUnsupported is returned when the transparent proxy
+	// socket options are not supported by the platform
+	ErrTransparentUnsupported = errors.New("transparent proxy not supported on this platform")
+	// ErrNotTCPConn is returned when the original destination is asked
+	// on a connection which is not a TCP one
+	ErrNotTCPConn = errors.New("not a tcp connection")
+)
@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// soOriginalDst SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST of netfilter
+	soOriginalDst = 80
+	// ipv6Transparent IPV6_TRANSPARENT missing in syscall
+	ipv6Transparent = 75
+)
+
+// OriginalDst returns the original destination of a connection redirected
+// by netfilter, e.g. iptables REDIRECT or DNAT, a.k.a. SO_ORIGINAL_DST
+func OriginalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, ErrNotTCPConn
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	isIPv4 := tc.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var addr *net.TCPAddr
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if isIPv4 {
+			// the sockaddr_in fits in the IPv6Mreq buffer
+			var mreq *syscall.IPv6Mreq
+			if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst); sockErr != nil {
+				return
+			}
+			b := mreq.Multiaddr
+			addr = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(b[2])<<8 | int(b[3])}
+			return
+		}
+		// the sockaddr_in6 fits in the IPv6MTUInfo buffer
+		var info *syscall.IPv6MTUInfo
+		if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst); sockErr != nil {
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		addr = &net.TCPAddr{IP: append(net.IP(nil), info.Addr.Addr[:]...), Port: int(port[0])<<8 | int(port[1])}
+		if info.Addr.Scope_id != 0 {
+			addr.Zone = zoneName(int(info.Addr.Scope_id))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+func zoneName(index int) string {
+	if iface, err := net.InterfaceByIndex(index); err == nil {
+		return iface.Name
+	}
+	return strconv.Itoa(index)
+}
+
+// SetTransparent sets IP_TRANSPARENT on the socket, used as the Control of
+// net.ListenConfig to accept the connections intercepted by TPROXY, whose
+// local address is the original destination. It requires CAP_NET_ADMIN.
+func SetTransparent(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Transparent, 1)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TRANSPARENT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
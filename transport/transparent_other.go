@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import (
+	"net"
+	"syscall"
+)
+
+// OriginalDst returns the original destination of a connection redirected
+// by netfilter, which is supported on linux only
+func OriginalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentUnsupported
+}
+
+// SetTransparent sets IP_TRANSPARENT on the socket, which is supported on linux only
+func SetTransparent(network, address string, c syscall.RawConn) error {
+	return ErrTransparentUnsupported
+}
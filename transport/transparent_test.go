@@ -0,0 +1,14 @@
+package transport
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOriginalDstNotTCPConn(t *testing.T) {
+	c, _ := net.Pipe()
+	defer c.Close()
+	if _, err := OriginalDst(c); err != ErrNotTCPConn && err != ErrTransparentUnsupported {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
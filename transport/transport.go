@@ -2,15 +2,44 @@ package transport
 
 import (
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"strings"
 	"time"
 
 	"github.com/haxii/fastproxy/bytebufferpool"
+	"github.com/haxii/fastproxy/util/singleflight"
 )
 
-var defaultDialer Dialer
+var defaultDialer = Dialer{DNSCache: DefaultDNSCache}
+
+// DefaultTLSHandshakeTimeout is timeout used for TLS handshakes by default.
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
+// ErrTLSHandshakeTimeout is returned when the TLS handshake is not
+// completed in time, e.g. the peer never responds.
+var ErrTLSHandshakeTimeout = errors.New("tls handshake timeout")
+
+// TLSHandshake runs the handshake of conn within timeout and clears the
+// connection deadline after the handshake completes.
+//
+// DefaultTLSHandshakeTimeout is used if timeout not set.
+func TLSHandshake(conn *tls.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultTLSHandshakeTimeout
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if err := conn.Handshake(); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return ErrTLSHandshakeTimeout
+		}
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
 
 //DialTLS dial tls without pool
 func DialTLS(addr string, tlsConfig *tls.Config) (net.Conn, error) {
@@ -22,15 +51,37 @@ func Dial(addr string) (net.Conn, error) {
 	return defaultDialer.Dial(addr, -1, false, nil)
 }
 
+// ResolvedAddrs the TCP addresses of addr cached by Dial and DialTLS,
+// see Dialer.ResolvedAddrs
+func ResolvedAddrs(addr string) ([]net.TCPAddr, time.Time, bool) {
+	return defaultDialer.ResolvedAddrs(addr)
+}
+
+// LookupStats the host names looked up by Dial and DialTLS, see
+// Dialer.LookupStats
+func LookupStats() singleflight.Stats {
+	return defaultDialer.LookupStats()
+}
+
 // Forward forward remote and local connection
 // It returns the number of bytes write to dst
 // and the first error encountered while writing, if any.
 func Forward(dst io.Writer, src io.Reader, idle time.Duration) (int64, error) {
+	return ForwardWithBufSize(dst, src, idle, 0)
+}
+
+// ForwardWithBufSize same as Forward using a copy buffer of bufSize,
+// bytebufferpool.DefaultCopyBufSize is used if bufSize not set.
+//
+// There is no internal queueing, src is not read until the previous chunk
+// is written into dst, so a stalled dst halts the reads of src within
+// bufSize, which leaves the TCP flow control to slow down the peer of src.
+func ForwardWithBufSize(dst io.Writer, src io.Reader, idle time.Duration, bufSize int) (int64, error) {
 	buffer := bytebufferpool.Get()
 	defer bytebufferpool.Put(buffer)
 	var err, e error
 	var wn int64
-	if wn, e = buffer.CopyWithIdleDuration(dst, src, idle); e != nil {
+	if wn, e = buffer.CopyWithIdleDurationAndBufSize(dst, src, idle, bufSize); e != nil {
 		errStr := e.Error()
 		if !(strings.Contains(errStr, "broken pipe") ||
 			strings.Contains(errStr, "reset by peer") ||
@@ -0,0 +1,171 @@
+package uri
+
+import (
+	"bytes"
+	"sort"
+)
+
+// CacheKey the canonical form of the URI, equivalent URIs share the same
+// key which is suitable as a map key, see AppendCacheKey
+func (uri *URI) CacheKey() string {
+	return string(uri.AppendCacheKey(nil))
+}
+
+// AppendCacheKey appends the canonical form of the URI to dst, which is
+// `scheme://host/path?query` normalized as follows:
+// - the scheme is lower-cased, http if the URI has a host but no scheme
+// - the host is lower-cased, the port is omitted if it's the default one
+// of the scheme, i.e. 80 of http and 443 of https, the userinfo is dropped
+// - the `.` and `..` segments of the path are removed following
+// RFC 3986 5.2.4, an empty path becomes `/`
+// - the query parameters are sorted, the empty ones are dropped
+// - the hex digits of the percent-encodings in the path and query
+// are upper-cased, nothing is decoded
+// - the fragment is dropped as it's never sent to the servers
+//
+// The scheme and host are omitted if the URI has no host, e.g. the
+// origin-form ones, and the URI of CONNECT is the host with port only.
+func (uri *URI) AppendCacheKey(dst []byte) []byte {
+	if uri.isConnect {
+		return appendLower(dst, uri.host)
+	}
+	if len(uri.host) > 0 {
+		start := len(dst)
+		if len(uri.scheme) > 0 {
+			dst = appendLower(dst, uri.scheme)
+		} else {
+			dst = append(dst, "http"...)
+		}
+		scheme := dst[start:]
+		dst = append(dst, schemeSeparator...)
+		host, port := splitHostPort(uri.host)
+		dst = appendLower(dst, host)
+		if len(port) > 0 && !(string(scheme) == "http" && string(port) == "80") &&
+			!(string(scheme) == "https" && string(port) == "443") {
+			dst = append(dst, ':')
+			dst = append(dst, port...)
+		}
+	}
+
+	start := len(dst)
+	if len(uri.path) == 0 {
+		dst = append(dst, '/')
+	} else {
+		dst = appendRemovingDotSegments(dst, uri.path)
+	}
+	dst = appendSortedQuery(dst, uri.queries)
+	upperPercentEncodings(dst[start:])
+	return dst
+}
+
+// splitHostPort splits the port of the host if any
+func splitHostPort(host []byte) ([]byte, []byte) {
+	i := bytes.LastIndexByte(host, ':')
+	if i < 0 || i < bytes.LastIndexByte(host, ']') {
+		return host, nil
+	}
+	return host[:i], host[i+1:]
+}
+
+// appendLower appends the lower-cased ASCII b to dst
+func appendLower(dst, b []byte) []byte {
+	for _, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// appendRemovingDotSegments appends path to dst with the dot segments
+// removed, following the remove_dot_segments of RFC 3986 5.2.4
+func appendRemovingDotSegments(dst, path []byte) []byte {
+	start := len(dst)
+	// removeLastSegment removes the last segment and its preceding `/`
+	removeLastSegment := func() {
+		if i := bytes.LastIndexByte(dst[start:], '/'); i >= 0 {
+			dst = dst[:start+i]
+		} else {
+			dst = dst[:start]
+		}
+	}
+	for len(path) > 0 {
+		switch {
+		case bytes.HasPrefix(path, []byte("../")):
+			path = path[3:]
+		case bytes.HasPrefix(path, []byte("./")):
+			path = path[2:]
+		case bytes.HasPrefix(path, []byte("/./")):
+			path = path[2:]
+		case bytes.Equal(path, []byte("/.")):
+			path = []byte("/")
+		case bytes.HasPrefix(path, []byte("/../")):
+			path = path[3:]
+			removeLastSegment()
+		case bytes.Equal(path, []byte("/..")):
+			path = []byte("/")
+			removeLastSegment()
+		case bytes.Equal(path, []byte(".")), bytes.Equal(path, []byte("..")):
+			path = nil
+		default:
+			// move the first segment with its preceding `/` if any
+			i := bytes.IndexByte(path[1:], '/') + 1
+			if i == 0 {
+				i = len(path)
+			}
+			dst = append(dst, path[:i]...)
+			path = path[i:]
+		}
+	}
+	if len(dst) == start {
+		dst = append(dst, '/')
+	}
+	return dst
+}
+
+// appendSortedQuery appends the query, i.e. `?a=1&b=2`, with its
+// parameters sorted and the empty ones dropped, nothing if it's empty
+func appendSortedQuery(dst, query []byte) []byte {
+	if len(query) > 0 && query[0] == '?' {
+		query = query[1:]
+	}
+	var params [][]byte
+	for _, param := range bytes.Split(query, []byte("&")) {
+		if len(param) > 0 {
+			params = append(params, param)
+		}
+	}
+	if len(params) == 0 {
+		return dst
+	}
+	sort.Slice(params, func(i, j int) bool { return bytes.Compare(params[i], params[j]) < 0 })
+	for i, param := range params {
+		if i == 0 {
+			dst = append(dst, '?')
+		} else {
+			dst = append(dst, '&')
+		}
+		dst = append(dst, param...)
+	}
+	return dst
+}
+
+// upperPercentEncodings upper-cases the hex digits of the percent-encodings in b
+func upperPercentEncodings(b []byte) {
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != '%' || !isHex(b[i+1]) || !isHex(b[i+2]) {
+			continue
+		}
+		for j := i + 1; j <= i+2; j++ {
+			if 'a' <= b[j] && b[j] <= 'f' {
+				b[j] -= 'a' - 'A'
+			}
+		}
+		i += 2
+	}
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
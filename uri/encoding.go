@@ -0,0 +1,84 @@
+package uri
+
+import (
+	"errors"
+)
+
+// ErrInvalidPercentEncoding a `%` not followed by two hex digits
+var ErrInvalidPercentEncoding = errors.New("invalid percent-encoding")
+
+// pathChars and queryChars the bytes allowed as is in the path and query
+// by RFC 3986, i.e. the pchar with `/`, as well as `?` in the query
+var pathChars, queryChars [256]bool
+
+func init() {
+	const pchar = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789" +
+		"-._~" + "!$&'()*+,;=" + ":@"
+	for i := 0; i < len(pchar); i++ {
+		pathChars[pchar[i]] = true
+		queryChars[pchar[i]] = true
+	}
+	pathChars['/'], queryChars['/'], queryChars['?'] = true, true, true
+}
+
+// IsPercentEncoded if the path and query of pathWithQuery are already
+// encoded as AppendPercentEncoded does, i.e. nothing to change
+func IsPercentEncoded(pathWithQuery []byte) bool {
+	allowed := &pathChars
+	for i := 0; i < len(pathWithQuery); i++ {
+		switch c := pathWithQuery[i]; {
+		case c == '#':
+			return true
+		case c == '?':
+			allowed = &queryChars
+		case c == '%':
+			if !isPercentEncoding(pathWithQuery, i) {
+				return false
+			}
+			i += 2
+		case !allowed[c]:
+			return false
+		}
+	}
+	return true
+}
+
+// AppendPercentEncoded appends pathWithQuery to dst with the bytes not
+// allowed by RFC 3986 in the path and query percent-encoded, e.g. spaces
+// and non-ASCII bytes, the valid percent-encodings are kept as is so nothing
+// is encoded twice. A `%` not starting a valid one is encoded as `%25` if
+// fixPercent, otherwise ErrInvalidPercentEncoding is returned. The fragment,
+// if any, is appended as is.
+func AppendPercentEncoded(dst, pathWithQuery []byte, fixPercent bool) ([]byte, error) {
+	const upperHex = "0123456789ABCDEF"
+	allowed := &pathChars
+	for i := 0; i < len(pathWithQuery); i++ {
+		c := pathWithQuery[i]
+		switch {
+		case c == '#':
+			return append(dst, pathWithQuery[i:]...), nil
+		case c == '?':
+			allowed = &queryChars
+		case c == '%':
+			if isPercentEncoding(pathWithQuery, i) {
+				dst = append(dst, pathWithQuery[i:i+3]...)
+				i += 2
+			} else if fixPercent {
+				dst = append(dst, "%25"...)
+			} else {
+				return dst, ErrInvalidPercentEncoding
+			}
+			continue
+		case !allowed[c]:
+			dst = append(dst, '%', upperHex[c>>4], upperHex[c&0xf])
+			continue
+		}
+		dst = append(dst, c)
+	}
+	return dst, nil
+}
+
+// isPercentEncoding if b[i:] starts with a valid percent-encoding
+func isPercentEncoding(b []byte, i int) bool {
+	return i+2 < len(b) && isHex(b[i+1]) && isHex(b[i+2])
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"net"
+	"strings"
+)
+
+// ParseIPZone parses host as an IP literal with an optional IPv6 zone,
+// host can be enclosed in square brackets and the zone separator can be
+// either the raw `%` or the percent-encoded `%25` used in URIs.
+//
+// A nil ip is returned if host is not an IP literal.
+func ParseIPZone(host string) (ip net.IP, zone string) {
+	if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+		host = host[1 : len(host)-1]
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		zone = host[i+1:]
+		if strings.HasPrefix(zone, "25") && len(zone) > 2 {
+			zone = zone[2:]
+		}
+		host = host[:i]
+		if len(zone) == 0 || strings.IndexByte(host, ':') < 0 {
+			// zone is only allowed in IPv6 addresses
+			return nil, ""
+		}
+	}
+	return net.ParseIP(host), zone
+}
@@ -0,0 +1,98 @@
+// Package singleflight makes the concurrent calls of the same key once, the
+// callers arriving while it's in flight wait for its result instead, e.g.
+// the burst of the tunnels to a new host signing the same certificate.
+package singleflight
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrPanicked returned to the callers waiting for a call panicked, the
+// panic is left to the caller making it
+var ErrPanicked = errors.New("the call in flight panicked")
+
+// Group of the calls in flight by their keys, the zero Group is ready for use
+type Group struct {
+	lock  sync.Mutex
+	calls map[string]*call
+
+	executed uint64
+	waited   uint64
+	waiting  int64
+	timedOut uint64
+}
+
+type call struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// Stats the calls of a Group
+type Stats struct {
+	// Executed calls made
+	Executed uint64
+	// Waited callers given the result of a call in flight instead of
+	// making their own, the ones timed out included
+	Waited uint64
+	// Waiting callers waiting for the calls in flight currently
+	Waiting int64
+	// TimedOut callers given up waiting as their context is done
+	TimedOut uint64
+}
+
+// Do calls fn for key unless it's in flight, whose result is waited for
+// until ctx is done then, ctx.Err() is returned if it's done first, the
+// call is left to finish for the others. shared if the result is of a call
+// made by another caller.
+func (g *Group) Do(ctx context.Context, key string,
+	fn func() (interface{}, error)) (v interface{}, shared bool, err error) {
+	g.lock.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		atomic.AddUint64(&g.waited, 1)
+		atomic.AddInt64(&g.waiting, 1)
+		defer atomic.AddInt64(&g.waiting, -1)
+		select {
+		case <-c.done:
+			return c.val, true, c.err
+		case <-ctx.Done():
+			atomic.AddUint64(&g.timedOut, 1)
+			return nil, true, ctx.Err()
+		}
+	}
+	c := &call{done: make(chan struct{})}
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	g.calls[key] = c
+	g.lock.Unlock()
+	atomic.AddUint64(&g.executed, 1)
+
+	returned := false
+	defer func() {
+		if !returned {
+			c.err = ErrPanicked
+		}
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn()
+	returned = true
+	return c.val, false, c.err
+}
+
+// Stats the calls made so far
+func (g *Group) Stats() Stats {
+	return Stats{
+		Executed: atomic.LoadUint64(&g.executed),
+		Waited:   atomic.LoadUint64(&g.waited),
+		Waiting:  atomic.LoadInt64(&g.waiting),
+		TimedOut: atomic.LoadUint64(&g.timedOut),
+	}
+}
@@ -0,0 +1,90 @@
+package singleflight
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	calls := 0
+	fn := func() (interface{}, error) {
+		calls++
+		<-release
+		return "v", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan interface{}, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, _, err := g.Do(context.Background(), "k", fn)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			results <- v
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); g.Stats().Waiting < 9; {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats %+v", g.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the ones giving up waiting leave the call in flight
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, shared, err := g.Do(ctx, "k", fn); !shared || err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v, shared %v", err, shared)
+	}
+	close(release)
+	wg.Wait()
+	close(results)
+	for v := range results {
+		if v != "v" {
+			t.Fatalf("unexpected result %v", v)
+		}
+	}
+	if s := g.Stats(); calls != 1 || s != (Stats{Executed: 1, Waited: 10, TimedOut: 1}) {
+		t.Fatalf("unexpected %d calls, stats %+v", calls, s)
+	}
+
+	// the call is made again once it's finished
+	if v, shared, err := g.Do(context.Background(), "k", func() (interface{}, error) {
+		return "w", nil
+	}); v != "w" || shared || err != nil {
+		t.Fatalf("unexpected result %v, shared %v, error: %v", v, shared, err)
+	}
+}
+
+func TestDoPanic(t *testing.T) {
+	var g Group
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		g.Do(context.Background(), "k", func() (interface{}, error) {
+			close(entered)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-entered
+	go func() {
+		for g.Stats().Waiting < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := g.Do(ctx, "k", nil); err != ErrPanicked {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
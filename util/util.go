@@ -2,6 +2,7 @@ package util
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -22,12 +23,46 @@ func WriteWithValidation(w io.Writer, p []byte) (int, error) {
 	return wn, nil
 }
 
-// ErrWrapper wrap the error message except io.EOF
+// ErrWrapper wrap the error message except io.EOF,
+// err is kept for errors.Is and errors.As
 func ErrWrapper(err error, msg string, args ...interface{}) error {
 	if err == nil {
 		return fmt.Errorf(msg, args...)
 	}
-	return fmt.Errorf(msg+" [error "+err.Error()+"]", args...)
+	return fmt.Errorf(msg+" [error %w]", append(args, err)...)
+}
+
+// KindError an error of Kind caused by Err, errors.Is and errors.As
+// match both the kind and the cause
+type KindError struct {
+	Kind error
+	Err  error
+}
+
+// ErrKind marks err as an error of kind, err is returned as is if
+// it's already of kind, and kind is returned if err is nil
+func ErrKind(kind, err error) error {
+	if err == nil {
+		return kind
+	}
+	if errors.Is(err, kind) {
+		return err
+	}
+	return &KindError{Kind: kind, Err: err}
+}
+
+func (e *KindError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the cause
+func (e *KindError) Unwrap() error {
+	return e.Err
+}
+
+// Is if target is the kind
+func (e *KindError) Is(target error) bool {
+	return target == e.Kind
 }
 
 // PeekBuffered peek buffered bytes for buffer reader
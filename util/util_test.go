@@ -1,7 +1,9 @@
 package util
 
 import (
+	"errors"
 	"io"
+	"net"
 	"testing"
 
 	"github.com/haxii/fastproxy/bytebufferpool"
@@ -25,3 +27,40 @@ func testWriteWithValidation(t *testing.T, w io.Writer, testString string, expEr
 		t.Fatalf("expected write length is %d, but it is %d ", expWriteLength, n)
 	}
 }
+
+func TestParseIPZone(t *testing.T) {
+	for _, c := range []struct{ host, ip, zone string }{
+		{"127.0.0.1", "127.0.0.1", ""},
+		{"::1", "::1", ""},
+		{"[::1]", "::1", ""},
+		{"fe80::1%eth0", "fe80::1", "eth0"},
+		{"[fe80::1%25eth0]", "fe80::1", "eth0"},
+		{"127.0.0.1%eth0", "", ""},
+		{"fe80::1%", "", ""},
+		{"www.example.com", "", ""},
+	} {
+		ip, zone := ParseIPZone(c.host)
+		if (ip == nil && len(c.ip) > 0) || (ip != nil && ip.String() != c.ip) || zone != c.zone {
+			t.Fatalf("unexpected ip %s zone %s of %s", ip, zone, c.host)
+		}
+	}
+}
+
+func TestErrKind(t *testing.T) {
+	kind := errors.New("kind")
+	cause := &net.OpError{Op: "dial", Err: errors.New("refused")}
+	err := ErrWrapper(ErrKind(kind, cause), "fail to %s", "dial")
+	if !errors.Is(err, kind) || !errors.Is(err, cause) {
+		t.Fatalf("unexpected error %s", err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr != cause {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err.Error() != "fail to dial [error kind: dial: refused]" {
+		t.Fatalf("unexpected message %s", err)
+	}
+	if ErrKind(kind, nil) != kind || ErrKind(kind, err) != err {
+		t.Fatalf("unexpected kind error")
+	}
+}